@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/gox/frm/log"
 	"github.com/gox/frm/nw"
@@ -33,10 +35,17 @@ func (this_ *echoHandler) OnData(c *nw.ConnContext, data []byte) error {
 	return c.Write(data)
 }
 
+func (this_ *echoHandler) OnIdle(c *nw.ConnContext, state nw.IdleState) bool {
+	log.Debug("[%d:%s] %v idle timeout", c.Fd(), c.RemoteAddr(), state)
+	return false
+}
+
 func main() {
 	server := nw.NewService(&nw.Config{
 		TcpHost:   ":9090",
 		WsHost:    ":9091",
+		UdpHost:   ":9092",
+		KcpHost:   ":9093",
 		MaxConn:   10000,
 		HeadBlend: 0x01020304,
 		Timeout:   60,
@@ -48,7 +57,12 @@ func main() {
 	go func() {
 		sig := <-sigCh
 		log.Debug("收到信号: %v", sig)
-		server.Stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		res, err := server.Shutdown(ctx, nil)
+		log.Debug("drained: %d, killed: %d, err: %v", res.Drained, res.Killed, err)
 	}()
 
 	server.Run()
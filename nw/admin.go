@@ -0,0 +1,297 @@
+package nw
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ADMIN_READ_TIMEOUT     = 10 * time.Second // 管理接口读取请求头的超时
+	ADMIN_SHUTDOWN_TIMEOUT = 5 * time.Second  // 服务停止时等待管理接口请求完成的时间
+	ADMIN_LIST_LIMIT       = 1000             // 连接列表默认返回的数量
+	ADMIN_USER_DATA_SIZE   = 256              // 连接列表中用户数据摘要的最大长度
+)
+
+// ConnInfo 连接信息, 用于管理接口
+type ConnInfo struct {
+	ID           uint64 `json:"id"`                  // 连接ID
+	Protocol     string `json:"protocol"`            // 协议
+	RemoteAddr   string `json:"remote_addr"`         // 客户端地址
+	TLS          bool   `json:"tls"`                 // 是否为 tls 连接
+	ConnectTime  int64  `json:"connect_time"`        // 连接建立时间, unix 秒
+	LastUpdate   int64  `json:"last_update"`         // 最后接收消息时间, unix 秒
+	BytesIn      uint64 `json:"bytes_in"`            // 收到的字节数
+	BytesOut     uint64 `json:"bytes_out"`           // 提交写入的字节数
+	Queued       int64  `json:"queued"`              // 已投递但尚未处理完成的消息数
+	PendingBytes int64  `json:"pending_bytes"`       // 尚未写入套接字的字节数
+	RTT          int64  `json:"rtt_us"`              // 最近一次心跳的往返时间, 微秒
+	UserData     string `json:"user_data,omitempty"` // 用户数据摘要, 超过 ADMIN_USER_DATA_SIZE 时截断
+}
+
+// Info 连接信息
+func (this_ *ConnContext) Info() ConnInfo {
+	info := ConnInfo{
+		ID:           this_.ID(),
+		Protocol:     this_.Protocol().String(),
+		RemoteAddr:   this_.RemoteAddr(),
+		TLS:          this_.TLS(),
+		ConnectTime:  this_.ConnectTime().Unix(),
+		LastUpdate:   this_.LastUpdate().Unix(),
+		BytesIn:      this_.BytesIn(),
+		BytesOut:     this_.BytesOut(),
+		Queued:       this_.Queued(),
+		PendingBytes: this_.PendingBytes(),
+		RTT:          this_.RTT().Microseconds(),
+	}
+
+	if ud := this_.UserData(); ud != nil {
+		info.UserData = fmt.Sprintf("%v", ud)
+		if len(info.UserData) > ADMIN_USER_DATA_SIZE {
+			info.UserData = info.UserData[:ADMIN_USER_DATA_SIZE] + "..."
+		}
+	}
+
+	return info
+}
+
+// AdminHandler 管理接口的 http 处理器, 可以挂载到 web.Server 的路由上
+//   - token: 访问令牌, 请求需要带 Authorization: Bearer <token> 或 X-Admin-Token 头. 为空时拒绝所有请求
+//
+// 接口路径相对于挂载点:
+//   - GET  /info: 服务配置和队列、限流统计
+//   - GET  /conns: 连接列表, 按连接ID排序. 参数 protocol 按协议过滤, offset 和 limit 分页, limit 默认为 ADMIN_LIST_LIMIT
+//   - GET  /conns/{id}: 单个连接的信息
+//   - POST /conns/{id}/kick: 关闭连接. 参数 code 和 reason 不为空时 websocket 发送对应的关闭帧
+//   - POST /conns/{id}/send: 将请求体作为一条消息发送给连接. 参数 text=1 时 websocket 发送文本消息
+func (this_ *Service) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /info", this_.adminInfo)
+	mux.HandleFunc("GET /conns", this_.adminConns)
+	mux.HandleFunc("GET /conns/{id}", this_.adminConn)
+	mux.HandleFunc("POST /conns/{id}/kick", this_.adminKick)
+	mux.HandleFunc("POST /conns/{id}/send", this_.adminSend)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(r, token) {
+			adminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminAuthorized 检查请求的访问令牌
+func adminAuthorized(r *http.Request, token string) bool {
+	if len(token) == 0 {
+		return false
+	}
+
+	got := r.Header.Get("X-Admin-Token")
+	if len(got) == 0 {
+		got, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// adminInfo 服务配置和统计
+func (this_ *Service) adminInfo(w http.ResponseWriter, r *http.Request) {
+	adminJSON(w, http.StatusOK, map[string]any{
+		"service": json.RawMessage(this_.String()),
+		"queue":   this_.QueueStats(),
+		"limit":   this_.LimitStats(),
+	})
+}
+
+// adminConns 连接列表
+func (this_ *Service) adminConns(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	proto := query.Get("protocol")
+
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = ADMIN_LIST_LIMIT
+	}
+
+	var ids []uint64
+	this_.conns.Range(func(id uint64, cctx *ConnContext) bool {
+		if len(proto) == 0 || cctx.Protocol().String() == proto {
+			ids = append(ids, id)
+		}
+		return true
+	})
+
+	slices.Sort(ids)
+
+	total := len(ids)
+	offset = min(max(offset, 0), total)
+	ids = ids[offset:min(offset+limit, total)]
+
+	// 期间关闭的连接不返回
+	conns := make([]ConnInfo, 0, len(ids))
+	for _, id := range ids {
+		if info, err := this_.ConnInfo(id); err == nil {
+			conns = append(conns, info)
+		}
+	}
+
+	adminJSON(w, http.StatusOK, map[string]any{
+		"total": total,
+		"conns": conns,
+	})
+}
+
+// adminConn 单个连接的信息
+func (this_ *Service) adminConn(w http.ResponseWriter, r *http.Request) {
+	id, ok := adminID(w, r)
+	if !ok {
+		return
+	}
+
+	info, err := this_.ConnInfo(id)
+	if err != nil {
+		adminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	adminJSON(w, http.StatusOK, info)
+}
+
+// adminKick 关闭连接
+func (this_ *Service) adminKick(w http.ResponseWriter, r *http.Request) {
+	id, ok := adminID(w, r)
+	if !ok {
+		return
+	}
+
+	var err error
+	if code := r.URL.Query().Get("code"); len(code) > 0 {
+		status, perr := strconv.ParseUint(code, 10, 16)
+		if perr != nil {
+			adminError(w, http.StatusBadRequest, "invalid code")
+			return
+		}
+		err = this_.CloseWithStatus(id, uint16(status), r.URL.Query().Get("reason"))
+	} else {
+		err = this_.Close(id)
+	}
+
+	if err != nil {
+		adminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	adminJSON(w, http.StatusOK, map[string]any{"id": id})
+}
+
+// adminSend 发送一条消息
+func (this_ *Service) adminSend(w http.ResponseWriter, r *http.Request) {
+	id, ok := adminID(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(MESSAGE_MAX_SIZE)))
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if r.URL.Query().Get("text") == "1" {
+		err = this_.WriteText(id, data)
+	} else {
+		err = this_.Write(id, data)
+	}
+
+	var stale *StaleConnError
+	if errors.As(err, &stale) {
+		adminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	adminJSON(w, http.StatusOK, map[string]any{"id": id, "bytes": len(data)})
+}
+
+// adminID 解析路径中的连接ID, 格式错误时写入错误响应并返回 false
+//
+// 处理函数只保存连接ID, 通过 Service 的方法按ID操作连接, 避免操作已被复用的连接上下文
+func adminID(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "invalid id")
+		return 0, false
+	}
+
+	return id, true
+}
+
+// adminJSON 输出 json 响应
+func adminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// adminError 输出错误响应
+func adminError(w http.ResponseWriter, status int, msg string) {
+	adminJSON(w, status, map[string]string{"error": msg})
+}
+
+// adminServer 管理接口的 http 服务, 随 Service 启动和停止
+type adminServer struct {
+	srv *http.Server
+}
+
+// newAdminServer 创建管理接口
+//   - owner: 所属服务
+//   - host: 监听地址
+//   - token: 管理 API 的访问令牌, 为空时只提供 /metrics
+func newAdminServer(owner *Service, host, token string) *adminServer {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", owner.MetricsHandler())
+	if len(token) > 0 {
+		mux.Handle("/admin/", http.StripPrefix("/admin", owner.AdminHandler(token)))
+	}
+
+	return &adminServer{
+		srv: &http.Server{
+			Addr:              host,
+			Handler:           mux,
+			ReadHeaderTimeout: ADMIN_READ_TIMEOUT,
+		},
+	}
+}
+
+// run 监听并处理请求, 直到 stop 被调用
+func (this_ *adminServer) run() error {
+	err := this_.srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// stop 停止监听, 等待处理中的请求完成
+func (this_ *adminServer) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), ADMIN_SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	this_.srv.Shutdown(ctx)
+}
@@ -0,0 +1,274 @@
+package nw
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gox/frm/log"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// OverflowPolicy 队列超过上限时的处理策略
+type OverflowPolicy int
+
+const (
+	OverflowPolicy_Block      OverflowPolicy = 0 // 阻塞等待, 入站消息会阻塞事件循环, 出站数据会阻塞写入方. 事件循环中的写入不等待, 按丢弃处理
+	OverflowPolicy_DropNewest OverflowPolicy = 1 // 丢弃最新的消息
+	OverflowPolicy_Disconnect OverflowPolicy = 2 // 断开超过上限的连接
+)
+
+func (this_ OverflowPolicy) String() string {
+	switch this_ {
+	case OverflowPolicy_Block:
+		return "block"
+	case OverflowPolicy_DropNewest:
+		return "drop_newest"
+	case OverflowPolicy_Disconnect:
+		return "disconnect"
+	}
+
+	return "unknown"
+}
+
+const (
+	DEFAULT_QUEUE_SIZE        = 65536                 // 默认的待处理消息总数上限
+	OUTBOUND_BLOCK_TIMEOUT    = 5 * time.Second       // 出站数据阻塞等待的最长时间, 超时后断开连接
+	OUTBOUND_REFRESH_INTERVAL = 10 * time.Millisecond // 超过上限时刷新写出缓冲区大小的周期
+)
+
+var ErrOutboundOverflow = errors.New("outbound pending bytes over limit")
+
+// QueueStats 队列统计
+type QueueStats struct {
+	Queued               int    `json:"queued"`                // 当前待处理的消息数
+	InboundDropped       uint64 `json:"inbound_dropped"`       // 因待处理消息超过上限而丢弃的消息数
+	InboundDisconnected  uint64 `json:"inbound_disconnected"`  // 因待处理消息超过上限而断开的连接数
+	OutboundBlocked      uint64 `json:"outbound_blocked"`      // 因待发送数据超过上限而阻塞的写入次数
+	OutboundDropped      uint64 `json:"outbound_dropped"`      // 因待发送数据超过上限而丢弃的写入次数
+	OutboundDisconnected uint64 `json:"outbound_disconnected"` // 因待发送数据超过上限而断开的连接数
+}
+
+// backpressure 入站队列和出站数据的上限控制
+type backpressure struct {
+	queue       chan struct{}  // 待处理消息信号量
+	connQueue   int            // 单个连接待处理消息数上限
+	queuePolicy OverflowPolicy // 入站策略
+	maxPending  int64          // 单个连接待发送字节数上限
+	outPolicy   OverflowPolicy // 出站策略
+	inDropped   atomic.Uint64
+	inClosed    atomic.Uint64
+	outBlocked  atomic.Uint64
+	outDropped  atomic.Uint64
+	outClosed   atomic.Uint64
+	loops       sync.Map // 正在调用用户回调的事件循环 gnet.EventLoop => *atomic.Int32
+}
+
+func newBackpressure(c *Config) *backpressure {
+	size := c.QueueSize
+	if size <= 0 {
+		size = DEFAULT_QUEUE_SIZE
+	}
+
+	return &backpressure{
+		queue:       make(chan struct{}, size),
+		connQueue:   c.ConnQueueSize,
+		queuePolicy: c.QueuePolicy,
+		maxPending:  int64(c.MaxPending),
+		outPolicy:   c.PendingPolicy,
+	}
+}
+
+// initConn 初始化连接的入站和出站状态
+func (this_ *backpressure) initConn(cctx *ConnContext) {
+	if this_.connQueue > 0 && cap(cctx.queue) != this_.connQueue {
+		cctx.queue = make(chan struct{}, this_.connQueue)
+	}
+
+	if cctx.out.writable == nil {
+		cctx.out.writable = make(chan struct{}, 1)
+	}
+}
+
+// acquire 消息入队前占用队列, 返回 false 表示超过上限
+func (this_ *backpressure) acquire(cctx *ConnContext) bool {
+	if this_.queuePolicy == OverflowPolicy_Block {
+		if cctx.queue != nil {
+			cctx.queue <- struct{}{}
+		}
+		this_.queue <- struct{}{}
+		return true
+	}
+
+	if cctx.queue != nil {
+		select {
+		case cctx.queue <- struct{}{}:
+		default:
+			return false
+		}
+	}
+
+	select {
+	case this_.queue <- struct{}{}:
+		return true
+	default:
+		if cctx.queue != nil {
+			<-cctx.queue
+		}
+		return false
+	}
+}
+
+// release 消息处理完成后释放队列
+func (this_ *backpressure) release(cctx *ConnContext) {
+	<-this_.queue
+	if cctx.queue != nil {
+		<-cctx.queue
+	}
+}
+
+// reserve 写入前检查连接的待发送字节数
+//
+// 待发送数据为空时总是允许写入, 避免超过上限的单条消息永远无法发送.
+// 待发送数据只在事件循环的写入回调中减少, 在事件循环中调用时不等待, 阻塞策略按丢弃处理
+func (this_ *backpressure) reserve(cctx *ConnContext, n int) error {
+	if this_.maxPending <= 0 || !this_.overflow(cctx, n) {
+		return nil
+	}
+
+	if !this_.onLoop(cctx) {
+		// 写出缓冲区的大小只在写入回调中更新, 可能已经过时, 刷新后再确认
+		timeout := OUTBOUND_REFRESH_INTERVAL
+		if this_.outPolicy == OverflowPolicy_Block {
+			this_.outBlocked.Add(1)
+			timeout = OUTBOUND_BLOCK_TIMEOUT
+		}
+
+		if this_.wait(cctx, n, timeout) {
+			return nil
+		}
+	}
+
+	if this_.outPolicy != OverflowPolicy_Disconnect {
+		this_.outDropped.Add(1)
+		return ErrOutboundOverflow
+	}
+
+	this_.outClosed.Add(1)
+	log.Warn("[%d:%v] outbound pending %d bytes over limit, disconnect", cctx.Fd(), cctx.RemoteAddr(), cctx.PendingBytes())
+	cctx.Close()
+	return ErrOutboundOverflow
+}
+
+// full 待发送数据是否已超过上限, 不等待. 超过时计入丢弃次数, 广播时用于跳过慢连接
+func (this_ *backpressure) full(cctx *ConnContext, n int) bool {
+	if this_.maxPending <= 0 || !this_.overflow(cctx, n) {
+		return false
+	}
+
+	this_.outDropped.Add(1)
+	return true
+}
+
+func (this_ *backpressure) overflow(cctx *ConnContext, n int) bool {
+	pending := cctx.PendingBytes()
+	return pending > 0 && pending+int64(n) > this_.maxPending
+}
+
+// wait 等待待发送数据降到上限以下, 超时返回 false. 不能在事件循环中调用
+func (this_ *backpressure) wait(cctx *ConnContext, n int, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	ticker := time.NewTicker(OUTBOUND_REFRESH_INTERVAL)
+	defer ticker.Stop()
+
+	cctx.out.refresh(cctx.c)
+	for this_.overflow(cctx, n) {
+		select {
+		case <-cctx.out.writable:
+		case <-ticker.C:
+			cctx.out.refresh(cctx.c)
+		case <-timer.C:
+			return false
+		}
+	}
+
+	return true
+}
+
+// enterLoop 事件循环开始调用用户回调, 返回的函数在回调结束后调用. 回调中对该事件循环上连接的写入不等待
+func (this_ *backpressure) enterLoop(c gnet.Conn) func() {
+	if this_.maxPending <= 0 || c == nil {
+		return func() {}
+	}
+
+	v, _ := this_.loops.LoadOrStore(c.EventLoop(), new(atomic.Int32))
+	depth := v.(*atomic.Int32)
+	depth.Add(1)
+	return func() { depth.Add(-1) }
+}
+
+// onLoop 连接所属的事件循环是否正在调用用户回调
+//
+// 其他协程在此期间写入同一事件循环上的连接时也不等待
+func (this_ *backpressure) onLoop(cctx *ConnContext) bool {
+	v, ok := this_.loops.Load(cctx.c.EventLoop())
+	return ok && v.(*atomic.Int32).Load() > 0
+}
+
+func (this_ *backpressure) stats() QueueStats {
+	return QueueStats{
+		Queued:               len(this_.queue),
+		InboundDropped:       this_.inDropped.Load(),
+		InboundDisconnected:  this_.inClosed.Load(),
+		OutboundBlocked:      this_.outBlocked.Load(),
+		OutboundDropped:      this_.outDropped.Load(),
+		OutboundDisconnected: this_.outClosed.Load(),
+	}
+}
+
+// outbound 连接的待发送数据
+//
+// 待发送数据由两部分组成: 已提交给事件循环但尚未处理的数据, 以及事件循环写入套接字失败后暂存在写出缓冲区中的数据
+type outbound struct {
+	bytes    int64         // 已提交给事件循环但尚未处理的字节数
+	buffered int64         // 写出缓冲区中的字节数, 在事件循环的写入回调中更新
+	writable chan struct{} // 待发送数据减少时通知阻塞的写入方
+}
+
+// add 增加待发送字节数, 返回写入回调
+func (this_ *outbound) add(n int, callback gnet.AsyncCallback) gnet.AsyncCallback {
+	atomic.AddInt64(&this_.bytes, int64(n))
+	return func(c gnet.Conn, err error) error {
+		atomic.StoreInt64(&this_.buffered, int64(c.OutboundBuffered()))
+		this_.done(n)
+		if callback != nil {
+			return callback(c, err)
+		}
+		return nil
+	}
+}
+
+// done 数据已交给事件循环处理或提交失败
+func (this_ *outbound) done(n int) {
+	atomic.AddInt64(&this_.bytes, -int64(n))
+	select {
+	case this_.writable <- struct{}{}:
+	default:
+	}
+}
+
+// refresh 提交一次空写入, 在事件循环中刷新写出缓冲区大小
+func (this_ *outbound) refresh(c gnet.Conn) {
+	err := c.AsyncWrite(nil, this_.add(0, nil))
+	if err != nil {
+		this_.done(0)
+	}
+}
+
+// pending 待发送的字节数
+func (this_ *outbound) pending() int64 {
+	return atomic.LoadInt64(&this_.bytes) + atomic.LoadInt64(&this_.buffered)
+}
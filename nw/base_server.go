@@ -2,7 +2,10 @@ package nw
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gox/frm/log"
@@ -10,7 +13,10 @@ import (
 	"github.com/panjf2000/gnet/v2/pkg/logging"
 )
 
-const HEART_BEAT_INTERVAL = 15 * time.Second // 心跳检查周期
+const (
+	HEART_BEAT_INTERVAL = 15 * time.Second // 默认心跳周期
+	HANDSHAKE_TIMEOUT   = 10 * time.Second // 连接建立后协议握手的超时
+)
 
 // IServer 服务接口
 type IServer interface {
@@ -19,12 +25,17 @@ type IServer interface {
 	Proto() Protocol                  // 协议
 	Host() string                     // 监听地址
 	Write(*ConnContext, []byte) error // 写数据
+	Close(*ConnContext)               // 关闭连接
 }
 
 // baseServer 基类
 type baseServer struct {
 	gnet.BuiltinEventEngine
-	eng gnet.Engine
+
+	mtx     sync.Mutex  // 保护 eng, booted 和 stopped
+	eng     gnet.Engine // 引擎, OnBoot 后有效
+	booted  bool        // 是否已启动
+	stopped bool        // 是否已调用 Stop, 启动前调用时在 OnBoot 中直接停止
 
 	owner    *Service        // 所属服务
 	server   IServer         // 实际的服务
@@ -32,6 +43,9 @@ type baseServer struct {
 	cctxPool connContextPool // ConnContext 对象池
 	wbufPool BufferPool      // 写对象池
 	msgPool  messagePool     // 消息对象池
+	tlsConf  *tls.Config     // tls 配置, 为 nil 时不启用 tls
+	wheel    *timingWheel    // 空闲检测时间轮, 只包含本服务的连接
+	pending  bool            // 连接建立后还需要协议握手, 握手完成后由具体服务调用 connected
 }
 
 // newBaseServer 构造函数
@@ -41,8 +55,10 @@ func newBaseServer(owner *Service, server IServer, host string) *baseServer {
 		wbufPool: NewBufferPool(),
 		msgPool:  newMessagePool(),
 		server:   server,
-		host:     fmt.Sprintf("tcp://%v", host),
+		host:     fmt.Sprintf("%v://%v", network(server.Proto()), host),
 		cctxPool: newConnContextPool(),
+		wheel:    newTimingWheel(TIMING_WHEEL_TICK),
+		pending:  owner.resume.enabled(server.Proto()),
 	}
 }
 
@@ -58,60 +74,230 @@ func (this_ *baseServer) Host() string {
 
 // OnBoot 启动事件
 func (this_ *baseServer) OnBoot(eng gnet.Engine) gnet.Action {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	if this_.stopped {
+		return gnet.Shutdown
+	}
+
 	this_.eng = eng
+	this_.booted = true
 	return gnet.None
 }
 
 // OnOpen 客户端连接事件
 func (this_ *baseServer) OnOpen(c gnet.Conn) ([]byte, gnet.Action) {
+	// 服务停止中, 不再接受新连接
+	if atomic.LoadInt32(&this_.owner.info.State) != ServiceState_Running {
+		return nil, gnet.Close
+	}
+
 	if this_.owner.info.MaxConn > 0 && this_.owner.conns.Count() >= this_.owner.info.MaxConn {
 		return nil, gnet.Close
 	}
 
-	cctx := this_.cctxPool.get()
-	cctx.Init(c, this_)
+	cctx := this_.newConnContext(c)
+
+	// 发送 PROXY 头的连接在收到头后根据客户端地址检查, 来自可信代理的 websocket 连接在升级后根据转发的客户端地址检查
+	cctx.proxied = this_.owner.limiter.expectProxy(cctx)
+	if !cctx.proxied && (cctx.upgraded.Load() || !this_.owner.limiter.trusted(cctx)) {
+		if !this_.owner.limiter.admit(cctx) {
+			log.Warn("[%d:%v] connection rejected", c.Fd(), cctx.remoteAddr)
+			this_.freeConn(cctx)
+			return nil, gnet.Close
+		}
+	}
+
+	// 被拒绝的连接没有上下文, 关闭时不触发任何事件
+	c.SetContext(cctx)
+
+	// 需要协议握手或等待 PROXY 头的连接在完成后才触发 OnConnected, 超时未完成时关闭
+	if this_.pending || cctx.proxied {
+		cctx.pending.Store(true)
+		this_.watchHandshake(cctx)
+	}
+
+	// tls 连接在握手完成后才触发 OnConnected
+	if this_.tlsConf != nil {
+		cctx.tls = newTlsConn(c, this_.tlsConf, &cctx.out)
+		go this_.handshake(cctx)
+		return nil, gnet.None
+	}
+
+	if this_.pending || cctx.proxied {
+		return nil, gnet.None
+	}
 
-	if err := this_.owner.event.OnConnected(cctx); err != nil {
-		log.Error("[%d:%v] connected failed: %v", err)
-		this_.cctxPool.put(cctx)
+	if err := this_.connected(cctx); err != nil {
+		log.Error("[%d:%v] connected failed: %v", c.Fd(), cctx.remoteAddr, err)
+		c.SetContext(nil)
+		this_.owner.limiter.release(cctx)
+		this_.freeConn(cctx)
 		return nil, gnet.Close
 	}
 
-	// 将连接上下文放入 conns 集中
-	this_.owner.conns.Set(cctx.Fd(), cctx)
 	return nil, gnet.None
 }
 
-// OnClose 客户端连接断开事件
-func (this_ *baseServer) OnClose(c gnet.Conn, err error) gnet.Action {
-	cctx := c.Context().(*ConnContext)
+// connected 连接就绪, 触发 OnConnected 并将连接上下文放入 conns 集中
+func (this_ *baseServer) connected(cctx *ConnContext) error {
+	leave := this_.owner.bp.enterLoop(cctx.c)
+	err := this_.owner.event.OnConnected(cctx)
+	leave()
+	if err != nil {
+		return err
+	}
+
+	cctx.pending.Store(false)
+	this_.addConn(cctx)
+	return nil
+}
 
-	this_.owner.conns.Remove(cctx.Fd())
+// addConn 将连接放入 conns 集中并开始空闲检测
+func (this_ *baseServer) addConn(cctx *ConnContext) {
+	this_.owner.conns.Set(cctx.id, cctx)
+	this_.watchIdle(cctx)
+}
+
+// disconnected 在事件循环中触发 OnDisconnected
+func (this_ *baseServer) disconnected(cctx *ConnContext) {
+	defer this_.owner.bp.enterLoop(cctx.c)()
 	this_.owner.event.OnDisconnected(cctx)
-	this_.cctxPool.put(cctx)
-	return gnet.None
 }
 
-// OnTick 定时任务, 主要作用是心跳检查
-func (this_ *baseServer) OnTick() (time.Duration, gnet.Action) {
-	var (
-		tnow    = time.Now().Unix()
-		timeout = this_.owner.info.Timeout
-	)
+// removeConn 将连接从 conns 集和所有分组中移除, 并停止空闲检测
+func (this_ *baseServer) removeConn(cctx *ConnContext) {
+	this_.wheel.cancel(&cctx.idle)
+	this_.owner.conns.Remove(cctx.id)
+	this_.owner.groups.leaveAll(cctx)
+}
+
+// newConnContext 从对象池中获取并初始化连接上下文
+func (this_ *baseServer) newConnContext(c gnet.Conn) *ConnContext {
+	cctx := this_.cctxPool.get()
+	cctx.Init(c, this_.server)
+	cctx.id = this_.owner.newConnID()
+	cctx.owner = this_.owner
+	cctx.pool = &this_.cctxPool
+	this_.owner.bp.initConn(cctx)
+	this_.owner.metrics.OnAccept(this_.server.Proto())
+	return cctx
+}
 
-	this_.owner.conns.Range(func(fd int, cctx *ConnContext) bool {
-		if tnow-cctx.lastUpdate > timeout {
-			cctx.Close()
+// freeConn 连接已关闭, 释放连接本身的引用
+//
+// 连接上下文在待处理的消息全部处理完成后才放回对象池, 之前收到的消息因连接ID不一致而被丢弃
+func (this_ *baseServer) freeConn(cctx *ConnContext) {
+	atomic.StoreUint64(&cctx.id, 0)
+	cctx.release()
+}
+
+// handshake tls 握手, 完成后触发 OnConnected
+func (this_ *baseServer) handshake(cctx *ConnContext) {
+	c := cctx.c
+
+	err := cctx.tls.handshake(func() error {
+		// 还需要协议握手时在协议握手完成后触发
+		if this_.pending {
+			return nil
 		}
-		return true
+
+		return this_.connected(cctx)
 	})
 
-	return HEART_BEAT_INTERVAL, gnet.None
+	if err != nil {
+		log.Error("[%d:%v] tls handshake failed: %v", c.Fd(), cctx.remoteAddr, err)
+		c.Close()
+		return
+	}
+
+	// 握手期间可能已经收到了应用数据, 唤醒事件循环处理
+	c.Wake(nil)
+}
+
+// readTLS 读取并解密 tls 数据, 返回 false 表示握手尚未完成或连接出错
+func (this_ *baseServer) readTLS(cctx *ConnContext) (bool, gnet.Action) {
+	ok, err := cctx.tls.feed(cctx.c)
+	if err != nil {
+		if !IsClosedErr(err) {
+			log.Error("[%d:%v] tls read failed: %v", cctx.Fd(), cctx.remoteAddr, err)
+		}
+		return false, gnet.Close
+	}
+
+	return ok, gnet.None
+}
+
+// OnClose 客户端连接断开事件
+func (this_ *baseServer) OnClose(c gnet.Conn, err error) gnet.Action {
+	// OnOpen 中被拒绝的连接没有上下文
+	cctx, ok := c.Context().(*ConnContext)
+	if !ok {
+		return gnet.None
+	}
+
+	this_.owner.limiter.release(cctx)
+
+	// tls 连接可能仍被握手协程引用, 不放回对象池; 握手未完成的连接没有触发过 OnConnected
+	if cctx.tls != nil {
+		if cctx.tls.close() && !cctx.pending.Load() {
+			// 保留的会话在恢复或到期前保持连接ID
+			if this_.detach(cctx) {
+				return gnet.None
+			}
+
+			this_.removeConn(cctx)
+			this_.disconnected(cctx)
+		}
+		this_.wheel.cancel(&cctx.idle)
+		atomic.StoreUint64(&cctx.id, 0)
+		return gnet.None
+	}
+
+	// 保留的会话不放回对象池, 到期后由 expire 触发 OnDisconnected
+	if !cctx.pending.Load() && this_.detach(cctx) {
+		return gnet.None
+	}
+
+	this_.removeConn(cctx)
+	if !cctx.pending.Load() {
+		this_.disconnected(cctx)
+	}
+	this_.freeConn(cctx)
+	return gnet.None
 }
 
-// Stop 停止服务
+// OnTick 定时任务, 推进空闲检测时间轮
+func (this_ *baseServer) OnTick() (time.Duration, gnet.Action) {
+	this_.wheel.advance(time.Now())
+	return TIMING_WHEEL_TICK, gnet.None
+}
+
+// Stop 停止服务, 可以在启动完成之前调用
 func (this_ *baseServer) Stop() {
-	this_.eng.Stop(context.TODO())
+	this_.mtx.Lock()
+	this_.stopped = true
+	eng, booted := this_.eng, this_.booted
+	this_.mtx.Unlock()
+
+	if booted {
+		eng.Stop(context.TODO())
+	}
+}
+
+// Close 关闭客户端连接
+func (this_ *baseServer) Close(cctx *ConnContext) {
+	err := cctx.c.Close()
+	if err != nil {
+		log.Error("[%d:%v] Close error: %v", cctx.Fd(), cctx.remoteAddr, err)
+	}
+}
+
+// writeFailed 异步写入回调中的错误, 记录日志和指标
+func (this_ *baseServer) writeFailed(err error) {
+	log.Error("AsyncWrite failed: %v", err)
+	this_.owner.metrics.OnWriteError(this_.server.Proto(), err)
 }
 
 // Write 向客户端发送数据
@@ -119,6 +305,15 @@ func (this_ *baseServer) Write(cctx *ConnContext, data []byte) error {
 	return this_.server.Write(cctx, data)
 }
 
+// network 协议对应的 gnet 网络类型
+func network(proto Protocol) string {
+	if proto == Protocol_UDP || proto == Protocol_KCP {
+		return "udp"
+	}
+
+	return "tcp"
+}
+
 // Run 启动服务
 func Run(server IServer) error {
 	return gnet.Run(server, server.Host(),
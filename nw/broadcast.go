@@ -0,0 +1,216 @@
+package nw
+
+import (
+	"sync"
+
+	"github.com/gox/frm/log"
+)
+
+// frameWriter 支持预先编码的服务
+//
+// 广播时每种协议只编码一次, 然后将同一帧写给该协议下的所有连接
+type frameWriter interface {
+	encode(data []byte) ([]byte, error)               // 编码, 返回的帧在写出后不能被修改
+	writeFrame(cctx *ConnContext, frame []byte) error // 写入已编码的帧
+}
+
+// encodedFrame 广播时某种协议的编码结果
+type encodedFrame struct {
+	data []byte
+	err  error
+}
+
+// groupManager 分组管理
+//
+// 成员按连接ID记录, 连接上下文放回对象池后会被复用, 发送前需按ID重新查找并确认ID未变
+type groupManager struct {
+	mtx    sync.RWMutex
+	groups map[string]map[uint64]struct{} // 分组名 => 成员连接ID
+}
+
+func newGroupManager() *groupManager {
+	return &groupManager{
+		groups: make(map[string]map[uint64]struct{}),
+	}
+}
+
+// join 将连接加入分组, 已关闭或已退出所有分组的连接被忽略
+func (this_ *groupManager) join(name string, cctx *ConnContext) bool {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	id := cctx.ID()
+	if id == 0 || cctx.groupsClosed {
+		return false
+	}
+
+	members, ok := this_.groups[name]
+	if !ok {
+		members = make(map[uint64]struct{})
+		this_.groups[name] = members
+	}
+
+	members[id] = struct{}{}
+	if cctx.groups == nil {
+		cctx.groups = make(map[string]struct{})
+	}
+	cctx.groups[name] = struct{}{}
+	return true
+}
+
+func (this_ *groupManager) leave(name string, cctx *ConnContext) {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	if _, ok := cctx.groups[name]; !ok {
+		return
+	}
+
+	this_.remove(name, cctx.ID())
+	delete(cctx.groups, name)
+}
+
+// leaveAll 将连接从所有分组中移除, 之后不能再加入分组. 连接关闭时在清除连接ID之前调用
+func (this_ *groupManager) leaveAll(cctx *ConnContext) {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	id := cctx.ID()
+	for name := range cctx.groups {
+		this_.remove(name, id)
+	}
+	cctx.groups = nil
+	cctx.groupsClosed = true
+}
+
+// replace 将 old 所在的分组转移给 cctx, 会话恢复时调用. cctx 沿用 old 的连接ID, 分组成员不变
+func (this_ *groupManager) replace(old, cctx *ConnContext) {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	cctx.groups = old.groups
+	old.groups = nil
+	old.groupsClosed = true
+}
+
+// remove 从分组中移除成员, 分组为空时删除分组. 调用方需持有写锁
+func (this_ *groupManager) remove(name string, id uint64) {
+	members, ok := this_.groups[name]
+	if !ok {
+		return
+	}
+
+	delete(members, id)
+	if len(members) == 0 {
+		delete(this_.groups, name)
+	}
+}
+
+// members 分组中的所有连接ID
+func (this_ *groupManager) members(name string) []uint64 {
+	this_.mtx.RLock()
+	defer this_.mtx.RUnlock()
+
+	members := this_.groups[name]
+	res := make([]uint64, 0, len(members))
+	for id := range members {
+		res = append(res, id)
+	}
+
+	return res
+}
+
+// Broadcast 向所有连接发送数据, 返回发送成功的连接数
+func (this_ *Service) Broadcast(data []byte) int {
+	ids := make([]uint64, 0, this_.conns.Count())
+	this_.conns.Range(func(id uint64, cctx *ConnContext) bool {
+		ids = append(ids, id)
+		return true
+	})
+
+	return this_.multicast(ids, data)
+}
+
+// SendTo 向指定ID的连接发送数据, 不存在的连接会被忽略, 返回发送成功的连接数
+func (this_ *Service) SendTo(ids []uint64, data []byte) int {
+	return this_.multicast(ids, data)
+}
+
+// Join 将连接加入分组, 连接关闭时会自动退出所有分组. 已关闭的连接不能加入, 返回 false
+func (this_ *Service) Join(group string, cctx *ConnContext) bool {
+	return this_.groups.join(group, cctx)
+}
+
+// Leave 将连接移出分组
+func (this_ *Service) Leave(group string, cctx *ConnContext) {
+	this_.groups.leave(group, cctx)
+}
+
+// Members 分组中仍然有效的连接
+func (this_ *Service) Members(group string) []*ConnContext {
+	ids := this_.groups.members(group)
+	res := make([]*ConnContext, 0, len(ids))
+	for _, id := range ids {
+		if cctx := this_.conns.Get(id); cctx != nil && cctx.ID() == id {
+			res = append(res, cctx)
+		}
+	}
+
+	return res
+}
+
+// SendGroup 向分组中的所有连接发送数据, 返回发送成功的连接数
+func (this_ *Service) SendGroup(group string, data []byte) int {
+	return this_.multicast(this_.groups.members(group), data)
+}
+
+// multicast 向多个连接发送数据, 每种协议只编码一次. 与 Write 相同, 连接不存在或ID已变化时跳过
+func (this_ *Service) multicast(ids []uint64, data []byte) int {
+	var (
+		frames = make(map[IServer]encodedFrame, 4)
+		n      = 0
+		err    error
+	)
+
+	for _, id := range ids {
+		cctx := this_.conns.Get(id)
+		if cctx == nil || cctx.ID() != id {
+			continue
+		}
+
+		// websocket 连接未完成升级
+		if !cctx.upgraded.Load() {
+			continue
+		}
+
+		// 待发送数据超过上限的慢连接直接跳过, 不等待
+		if this_.bp.full(cctx, len(data)) {
+			continue
+		}
+
+		// 会话恢复的消息带有各自的序号, 不能共用同一帧
+		if fw, ok := cctx.server.(frameWriter); ok && cctx.resume == nil {
+			frame, ok := frames[cctx.server]
+			if !ok {
+				frame.data, frame.err = fw.encode(data)
+				frames[cctx.server] = frame
+			}
+
+			err = frame.err
+			if err == nil {
+				err = fw.writeFrame(cctx, frame.data)
+			}
+		} else {
+			err = cctx.Write(data)
+		}
+
+		if err != nil {
+			log.Error("[%d:%v] multicast failed: %v", cctx.Fd(), cctx.RemoteAddr(), err)
+			continue
+		}
+
+		n++
+	}
+
+	return n
+}
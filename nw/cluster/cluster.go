@@ -0,0 +1,582 @@
+package cluster
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gox/frm/log"
+	"github.com/gox/frm/nw"
+)
+
+const (
+	CLUSTER_PREFIX     = "nw:cluster"    // 默认的键和频道前缀
+	CLUSTER_TTL        = 10              // 默认的节点过期时间, 单位秒
+	CLUSTER_REPLICAS   = 100             // 默认的一致性哈希虚拟节点数
+	CLUSTER_OP_TIMEOUT = 5 * time.Second // 单次存储操作的超时
+)
+
+var (
+	ErrInvalidNode = errors.New("node id and type are required") // 节点缺少ID或类型
+	ErrNodeExists  = errors.New("node already registered")       // 节点ID已在本进程注册
+	ErrUnknownNode = errors.New("node not registered")           // 节点未在本进程注册
+	ErrStarted     = errors.New("cluster already started")       // 重复启动
+)
+
+// Node 节点信息
+type Node struct {
+	ID       string            `json:"id"`                 // 节点ID, 在集群内唯一
+	Type     string            `json:"type"`               // 节点类型, 如 gate, game
+	TcpHost  string            `json:"tcp_host,omitempty"` // tcp 监听地址
+	WsHost   string            `json:"ws_host,omitempty"`  // websocket 监听地址
+	Load     int               `json:"load"`               // 负载, 注册的服务为当前连接数
+	Meta     map[string]string `json:"meta,omitempty"`     // 自定义信息
+	UpdateAt int64             `json:"update_at"`          // 最后心跳时间, unix 毫秒
+}
+
+// EventKind 节点事件类型
+type EventKind int
+
+const (
+	EventKind_Join  EventKind = 1 // 节点加入
+	EventKind_Leave EventKind = 2 // 节点离开, 包括注销和心跳超时
+)
+
+func (this_ EventKind) String() string {
+	switch this_ {
+	case EventKind_Join:
+		return "join"
+	case EventKind_Leave:
+		return "leave"
+	}
+
+	return "unknown"
+}
+
+// Event 节点事件, 也是事件频道中的消息格式
+type Event struct {
+	Kind EventKind `json:"kind"`
+	Node Node      `json:"node"`
+}
+
+// Config 集群配置
+type Config struct {
+	Prefix    string `json:"prefix,omitempty"`    // 键和频道的前缀, 默认为 CLUSTER_PREFIX. 不同集群使用不同前缀
+	TTL       int64  `json:"ttl,omitempty"`       // 节点过期时间, 单位秒, 超过后没有心跳视为离开. 默认为 CLUSTER_TTL
+	Heartbeat int64  `json:"heartbeat,omitempty"` // 心跳周期, 单位秒, 默认为 TTL/3, 最小为 1
+	Sync      int64  `json:"sync,omitempty"`      // 完整同步周期, 单位秒, 用于发现过期的节点和丢失的事件. 默认与心跳周期相同
+	Replicas  int    `json:"replicas,omitempty"`  // 一致性哈希每个节点的虚拟节点数, 默认为 CLUSTER_REPLICAS
+}
+
+// registration 本进程注册的节点
+type registration struct {
+	node Node
+	svc  *nw.Service // 为 nil 时负载不更新
+}
+
+// Cluster 基于 Redis 的服务发现
+//
+// 注册的节点以带过期时间的键保存, 定期心跳续期并更新负载; 加入和离开通过频道通知其它节点,
+// 异常退出的节点在过期后由定期的完整同步发现. 本进程注册的节点同样出现在节点列表中
+//
+//	c := cluster.New(cluster.NewRedisStore(rc), &cluster.Config{})
+//	c.OnEvent(func(e cluster.Event) { ... })
+//	c.Register(svc, cluster.Node{ID: "game-1", Type: "game"})
+//	c.Start()
+//	defer c.Close()
+type Cluster struct {
+	store     Store
+	prefix    string
+	ttl       time.Duration
+	heartbeat time.Duration
+	period    time.Duration // 完整同步周期
+	replicas  int
+
+	mtx      sync.RWMutex
+	nodes    map[string]Node          // 节点ID => 节点
+	rings    map[string]*HashRing     // 节点类型 => 哈希环
+	left     map[string]int64         // 离开的节点ID => 离开时的本地时间, unix 毫秒. 防止过期的同步结果重新加入节点
+	handlers []func(Event)            // 事件处理函数
+	events   []Event                  // 待分发的事件
+	signal   chan struct{}            // 有新的待分发事件
+	started  bool                     // 是否已启动
+	hbMtx    sync.Mutex               // 保证注销后不再续期
+	locals   map[string]*registration // 本进程注册的节点
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New 创建服务发现, 调用 Start 后开始心跳和同步
+//   - store: 存储, 通常为 NewRedisStore
+//   - c: 配置
+func New(store Store, c *Config) *Cluster {
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = CLUSTER_TTL
+	}
+
+	heartbeat := c.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = max(ttl/3, 1)
+	}
+
+	period := c.Sync
+	if period <= 0 {
+		period = heartbeat
+	}
+
+	this_ := &Cluster{
+		store:     store,
+		prefix:    c.Prefix,
+		ttl:       time.Duration(ttl) * time.Second,
+		heartbeat: time.Duration(heartbeat) * time.Second,
+		period:    time.Duration(period) * time.Second,
+		replicas:  c.Replicas,
+		nodes:     make(map[string]Node),
+		rings:     make(map[string]*HashRing),
+		left:      make(map[string]int64),
+		signal:    make(chan struct{}, 1),
+		locals:    make(map[string]*registration),
+	}
+
+	if len(this_.prefix) == 0 {
+		this_.prefix = CLUSTER_PREFIX
+	}
+
+	if this_.replicas <= 0 {
+		this_.replicas = CLUSTER_REPLICAS
+	}
+
+	this_.ctx, this_.cancel = context.WithCancel(context.Background())
+	return this_
+}
+
+// nodeKey 节点的键
+func (this_ *Cluster) nodeKey(id string) string {
+	return this_.prefix + ":node:" + id
+}
+
+// channel 事件频道
+func (this_ *Cluster) channel() string {
+	return this_.prefix + ":events"
+}
+
+// OnEvent 添加事件处理函数, 在分发协程中按发生顺序调用. Start 时已存在的节点以加入事件通知
+func (this_ *Cluster) OnEvent(handler func(Event)) {
+	this_.mtx.Lock()
+	this_.handlers = append(this_.handlers, handler)
+	this_.mtx.Unlock()
+}
+
+// Register 注册节点并立即写入存储, 之后按心跳周期续期
+//   - svc: 节点对应的服务, 用于填充监听地址和负载. 为 nil 时使用 node 中的值.
+//     监听地址没有指定 IP (如 :9000) 时需要在 node 中设置其它节点可以访问的地址
+//   - node: 节点信息, 需要设置 ID 和 Type
+func (this_ *Cluster) Register(svc *nw.Service, node Node) error {
+	if len(node.ID) == 0 || len(node.Type) == 0 {
+		return ErrInvalidNode
+	}
+
+	if svc != nil {
+		if len(node.TcpHost) == 0 {
+			node.TcpHost = listenAddr(svc.TcpHost())
+		}
+		if len(node.WsHost) == 0 {
+			node.WsHost = listenAddr(svc.WsHost())
+		}
+	}
+
+	reg := &registration{node: node, svc: svc}
+
+	this_.hbMtx.Lock()
+	defer this_.hbMtx.Unlock()
+
+	if _, ok := this_.locals[node.ID]; ok {
+		return ErrNodeExists
+	}
+
+	n, err := this_.refresh(reg)
+	if err != nil {
+		return err
+	}
+	this_.locals[node.ID] = reg
+
+	this_.publish(Event{Kind: EventKind_Join, Node: n})
+	this_.join(n, 0)
+	return nil
+}
+
+// listenAddr 去掉服务监听地址的协议前缀, 如 tcp://127.0.0.1:9000 => 127.0.0.1:9000
+func listenAddr(host string) string {
+	if _, addr, ok := strings.Cut(host, "://"); ok {
+		return addr
+	}
+
+	return host
+}
+
+// Deregister 注销本进程注册的节点, 删除存储中的键并通知其它节点
+func (this_ *Cluster) Deregister(id string) error {
+	this_.hbMtx.Lock()
+	defer this_.hbMtx.Unlock()
+
+	reg, ok := this_.locals[id]
+	if !ok {
+		return ErrUnknownNode
+	}
+	delete(this_.locals, id)
+
+	ctx, cancel := context.WithTimeout(context.Background(), CLUSTER_OP_TIMEOUT)
+	defer cancel()
+
+	err := this_.store.Del(ctx, this_.nodeKey(id))
+	this_.publish(Event{Kind: EventKind_Leave, Node: reg.node})
+	this_.leave(id)
+	return err
+}
+
+// refresh 更新负载和心跳时间并写入存储, 调用方需要持有 hbMtx
+func (this_ *Cluster) refresh(reg *registration) (Node, error) {
+	if reg.svc != nil {
+		reg.node.Load = reg.svc.CurrConn()
+	}
+	reg.node.UpdateAt = time.Now().UnixMilli()
+
+	data, err := json.Marshal(&reg.node)
+	if err != nil {
+		return reg.node, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CLUSTER_OP_TIMEOUT)
+	defer cancel()
+
+	return reg.node, this_.store.Set(ctx, this_.nodeKey(reg.node.ID), string(data), this_.ttl)
+}
+
+// publish 发布事件, 失败时其它节点通过完整同步发现变化
+func (this_ *Cluster) publish(e Event) {
+	data, _ := json.Marshal(&e)
+
+	ctx, cancel := context.WithTimeout(context.Background(), CLUSTER_OP_TIMEOUT)
+	defer cancel()
+
+	if err := this_.store.Publish(ctx, this_.channel(), string(data)); err != nil {
+		log.Warn("cluster publish %v %s failed: %v", e.Kind, e.Node.ID, err)
+	}
+}
+
+// Start 订阅事件频道并完成第一次同步, 然后开始心跳和定期同步
+func (this_ *Cluster) Start() error {
+	this_.mtx.Lock()
+	if this_.started {
+		this_.mtx.Unlock()
+		return ErrStarted
+	}
+	this_.started = true
+	this_.mtx.Unlock()
+
+	// 先订阅再同步, 不会遗漏同步期间的事件
+	ctx, cancel := context.WithCancel(this_.ctx)
+	events, err := this_.store.Subscribe(ctx, this_.channel())
+	if err == nil {
+		err = this_.syncNodes()
+	}
+
+	if err != nil {
+		cancel()
+		this_.mtx.Lock()
+		this_.started = false
+		this_.mtx.Unlock()
+		return err
+	}
+
+	this_.wg.Add(3)
+	go this_.watchLoop(events, cancel)
+	go this_.heartbeatLoop()
+	go this_.dispatchLoop()
+	return nil
+}
+
+// Close 注销本进程的所有节点并停止心跳和同步
+func (this_ *Cluster) Close() error {
+	this_.hbMtx.Lock()
+	ids := make([]string, 0, len(this_.locals))
+	for id := range this_.locals {
+		ids = append(ids, id)
+	}
+	this_.hbMtx.Unlock()
+
+	for _, id := range ids {
+		this_.Deregister(id)
+	}
+
+	this_.cancel()
+	this_.wg.Wait()
+	return nil
+}
+
+// watchLoop 处理事件频道的消息, 退出时取消订阅
+func (this_ *Cluster) watchLoop(events <-chan string, cancel context.CancelFunc) {
+	defer this_.wg.Done()
+	defer cancel()
+
+	for msg := range events {
+		var e Event
+		if err := json.Unmarshal([]byte(msg), &e); err != nil {
+			log.Error("cluster decode event failed: %v", err)
+			continue
+		}
+
+		switch e.Kind {
+		case EventKind_Join:
+			this_.join(e.Node, 0)
+		case EventKind_Leave:
+			this_.leave(e.Node.ID)
+		}
+	}
+}
+
+// heartbeatLoop 定期续期本进程的节点并同步所有节点
+func (this_ *Cluster) heartbeatLoop() {
+	defer this_.wg.Done()
+
+	heartbeat := time.NewTicker(this_.heartbeat)
+	defer heartbeat.Stop()
+
+	period := time.NewTicker(this_.period)
+	defer period.Stop()
+
+	for {
+		select {
+		case <-heartbeat.C:
+			this_.hbMtx.Lock()
+			for _, reg := range this_.locals {
+				n, err := this_.refresh(reg)
+				if err != nil {
+					log.Warn("cluster heartbeat %s failed: %v", reg.node.ID, err)
+					continue
+				}
+				this_.join(n, 0)
+			}
+			this_.hbMtx.Unlock()
+
+		case <-period.C:
+			if err := this_.syncNodes(); err != nil {
+				log.Warn("cluster sync failed: %v", err)
+			}
+
+		case <-this_.ctx.Done():
+			return
+		}
+	}
+}
+
+// syncNodes 从存储读取所有节点, 加入新节点, 移除已过期的节点
+func (this_ *Cluster) syncNodes() error {
+	ctx, cancel := context.WithTimeout(this_.ctx, CLUSTER_OP_TIMEOUT)
+	defer cancel()
+
+	// 离开时间和读取时间都使用本地时钟, 节点的 UpdateAt 来自各自的时钟, 不能与之比较
+	scanAt := time.Now().UnixMilli()
+	prefix := this_.nodeKey("")
+	kvs, err := this_.store.Scan(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	alive := make(map[string]bool, len(kvs))
+	for key, value := range kvs {
+		var n Node
+		if err := json.Unmarshal([]byte(value), &n); err != nil || n.ID != strings.TrimPrefix(key, prefix) {
+			log.Warn("cluster invalid node %s: %v", key, value)
+			continue
+		}
+
+		alive[n.ID] = true
+		this_.join(n, scanAt)
+	}
+
+	this_.mtx.RLock()
+	var gone []string
+	for id := range this_.nodes {
+		if !alive[id] {
+			gone = append(gone, id)
+		}
+	}
+	this_.mtx.RUnlock()
+
+	for _, id := range gone {
+		this_.leave(id)
+	}
+
+	// 超过过期时间后同步结果中不会再出现离开的节点
+	expire := time.Now().Add(-2 * this_.ttl).UnixMilli()
+	this_.mtx.Lock()
+	for id, at := range this_.left {
+		if at < expire {
+			delete(this_.left, id)
+		}
+	}
+	this_.mtx.Unlock()
+
+	return nil
+}
+
+// join 加入或更新节点
+//   - scanAt: 来自完整同步时为开始读取存储的本地时间, unix 毫秒, 否则为 0. 读取开始后才离开的节点不会被该次同步重新加入
+func (this_ *Cluster) join(n Node, scanAt int64) {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	if at, ok := this_.left[n.ID]; ok {
+		if scanAt > 0 && scanAt <= at {
+			return
+		}
+		delete(this_.left, n.ID)
+	}
+
+	old, ok := this_.nodes[n.ID]
+	if ok && old.UpdateAt > n.UpdateAt {
+		return
+	}
+	this_.nodes[n.ID] = n
+
+	if !ok || old.Type != n.Type {
+		if ok {
+			this_.rebuild(old.Type)
+		}
+		this_.rebuild(n.Type)
+		this_.emit(Event{Kind: EventKind_Join, Node: n})
+	}
+}
+
+// leave 移除节点
+func (this_ *Cluster) leave(id string) {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	n, ok := this_.nodes[id]
+	if !ok {
+		return
+	}
+
+	delete(this_.nodes, id)
+	this_.left[id] = time.Now().UnixMilli()
+	this_.rebuild(n.Type)
+	this_.emit(Event{Kind: EventKind_Leave, Node: n})
+}
+
+// rebuild 重建节点类型的哈希环, 调用方需要持有 mtx
+func (this_ *Cluster) rebuild(nodeType string) {
+	var ids []string
+	for id, n := range this_.nodes {
+		if n.Type == nodeType {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		delete(this_.rings, nodeType)
+		return
+	}
+
+	this_.rings[nodeType] = NewHashRing(ids, this_.replicas)
+}
+
+// emit 加入待分发的事件, 调用方需要持有 mtx
+func (this_ *Cluster) emit(e Event) {
+	if len(this_.handlers) == 0 {
+		return
+	}
+
+	this_.events = append(this_.events, e)
+	select {
+	case this_.signal <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchLoop 按顺序分发事件, 处理函数中可以调用 Cluster 的方法
+func (this_ *Cluster) dispatchLoop() {
+	defer this_.wg.Done()
+
+	for {
+		select {
+		case <-this_.signal:
+		case <-this_.ctx.Done():
+			return
+		}
+
+		this_.mtx.Lock()
+		events, handlers := this_.events, this_.handlers
+		this_.events = nil
+		this_.mtx.Unlock()
+
+		for _, e := range events {
+			for _, handler := range handlers {
+				handler(e)
+			}
+		}
+	}
+}
+
+// Node 根据ID获取节点
+func (this_ *Cluster) Node(id string) (Node, bool) {
+	this_.mtx.RLock()
+	defer this_.mtx.RUnlock()
+
+	n, ok := this_.nodes[id]
+	return n, ok
+}
+
+// Nodes 节点类型对应的所有节点, 按ID排序. nodeType 为空时返回所有节点
+func (this_ *Cluster) Nodes(nodeType string) []Node {
+	this_.mtx.RLock()
+	nodes := make([]Node, 0, len(this_.nodes))
+	for _, n := range this_.nodes {
+		if len(nodeType) == 0 || n.Type == nodeType {
+			nodes = append(nodes, n)
+		}
+	}
+	this_.mtx.RUnlock()
+
+	slices.SortFunc(nodes, func(a, b Node) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return nodes
+}
+
+// Pick 按一致性哈希选择节点类型对应的节点, key 通常为用户ID.
+// 同一 key 在节点不变时总是选中同一节点, 节点增减时只有少部分 key 的选择改变. 没有节点时返回 false
+func (this_ *Cluster) Pick(nodeType, key string) (Node, bool) {
+	this_.mtx.RLock()
+	defer this_.mtx.RUnlock()
+
+	ring := this_.rings[nodeType]
+	if ring == nil {
+		return Node{}, false
+	}
+
+	n, ok := this_.nodes[ring.Get(key)]
+	return n, ok
+}
+
+// PickLeast 选择节点类型对应的负载最低的节点, 负载相同时选择ID较小的节点. 没有节点时返回 false
+func (this_ *Cluster) PickLeast(nodeType string) (Node, bool) {
+	nodes := this_.Nodes(nodeType)
+	if len(nodes) == 0 {
+		return Node{}, false
+	}
+
+	return slices.MinFunc(nodes, func(a, b Node) int {
+		return cmp.Or(cmp.Compare(a.Load, b.Load), cmp.Compare(a.ID, b.ID))
+	}), true
+}
@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"slices"
+	"strconv"
+)
+
+// HashRing 一致性哈希环, 每个节点在环上有 replicas 个虚拟节点. 创建后只读, 可以在多个协程中使用
+//
+// 节点增减时只有相邻区间的键改变归属, 用于会话等需要粘滞的场景
+type HashRing struct {
+	hashes []uint32          // 虚拟节点的哈希, 升序
+	owners map[uint32]string // 虚拟节点的哈希 => 节点ID
+}
+
+// NewHashRing 创建哈希环
+//   - ids: 节点ID
+//   - replicas: 每个节点的虚拟节点数, 通常为 CLUSTER_REPLICAS
+func NewHashRing(ids []string, replicas int) *HashRing {
+	ring := &HashRing{
+		hashes: make([]uint32, 0, len(ids)*replicas),
+		owners: make(map[uint32]string, len(ids)*replicas),
+	}
+
+	for _, id := range ids {
+		for i := 0; i < replicas; i++ {
+			h := ringHash(id + "#" + strconv.Itoa(i))
+			// 哈希冲突时保留 ID 较小的节点, 保证与节点的加入顺序无关
+			if owner, ok := ring.owners[h]; ok {
+				if id < owner {
+					ring.owners[h] = id
+				}
+				continue
+			}
+
+			ring.owners[h] = id
+			ring.hashes = append(ring.hashes, h)
+		}
+	}
+
+	slices.Sort(ring.hashes)
+	return ring
+}
+
+// Get key 顺时针方向的第一个节点, 环为空时返回空字符串
+func (this_ *HashRing) Get(key string) string {
+	if len(this_.hashes) == 0 {
+		return ""
+	}
+
+	h := ringHash(key)
+	i, _ := slices.BinarySearch(this_.hashes, h)
+	if i == len(this_.hashes) {
+		i = 0
+	}
+
+	return this_.owners[this_.hashes[i]]
+}
+
+// ringHash 哈希环使用的哈希. 虚拟节点的名称只有序号不同, 需要分布均匀的哈希, 与 ketama 相同取 md5 的前 4 字节
+func ringHash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,208 @@
+package cluster
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// CLUSTER_SCAN_COUNT 遍历节点键时每次 SCAN 的数量
+const CLUSTER_SCAN_COUNT = 100
+
+// Store 节点注册使用的存储, 是 Redis 命令的最小子集. 生产环境使用 NewRedisStore, 测试使用 NewMemoryStore
+type Store interface {
+	Set(ctx context.Context, key, value string, ttl time.Duration) error // 设置键值和过期时间
+	Del(ctx context.Context, key string) error                           // 删除键
+	Scan(ctx context.Context, prefix string) (map[string]string, error)  // 前缀匹配的所有键值
+	Publish(ctx context.Context, channel, message string) error          // 发布消息
+
+	// Subscribe 订阅频道, 返回后保证订阅已生效. 返回的通道在 ctx 取消后关闭
+	Subscribe(ctx context.Context, channel string) (<-chan string, error)
+}
+
+// redisStore 基于 go-redis 的存储
+type redisStore struct {
+	rc *redis.Client
+}
+
+// NewRedisStore 使用 Redis 作为存储, rc 可以由 com.NewRedis 创建
+func NewRedisStore(rc *redis.Client) Store {
+	return &redisStore{rc: rc}
+}
+
+func (this_ *redisStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return this_.rc.Set(ctx, key, value, ttl).Err()
+}
+
+func (this_ *redisStore) Del(ctx context.Context, key string) error {
+	return this_.rc.Del(ctx, key).Err()
+}
+
+func (this_ *redisStore) Scan(ctx context.Context, prefix string) (map[string]string, error) {
+	var keys []string
+	iter := this_.rc.Scan(ctx, 0, prefix+"*", CLUSTER_SCAN_COUNT).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	kvs := make(map[string]string, len(keys))
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), CLUSTER_SCAN_COUNT)]
+		keys = keys[len(batch):]
+
+		values, err := this_.rc.MGet(ctx, batch...).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		// 遍历之后过期的键为 nil
+		for i, v := range values {
+			if s, ok := v.(string); ok {
+				kvs[batch[i]] = s
+			}
+		}
+	}
+
+	return kvs, nil
+}
+
+func (this_ *redisStore) Publish(ctx context.Context, channel, message string) error {
+	return this_.rc.Publish(ctx, channel, message).Err()
+}
+
+func (this_ *redisStore) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	ps := this_.rc.Subscribe(ctx, channel)
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return nil, err
+	}
+
+	ch := make(chan string, 64)
+	go func() {
+		defer close(ch)
+		defer ps.Close()
+
+		// 连接断开时 go-redis 自动重连并重新订阅
+		msgs := ps.Channel()
+		for {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+				select {
+				case ch <- msg.Payload:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// memoryEntry 内存存储的值
+type memoryEntry struct {
+	value    string
+	expireAt time.Time // 为零值时不过期
+}
+
+// memoryStore 进程内的存储, 语义与 Redis 相同, 用于测试和单机部署
+type memoryStore struct {
+	mtx  sync.Mutex
+	kvs  map[string]memoryEntry
+	subs map[string]map[chan string]struct{} // 频道 => 订阅者
+}
+
+// NewMemoryStore 创建进程内的存储, 同一个 Store 上的多个 Cluster 可以互相发现
+func NewMemoryStore() Store {
+	return &memoryStore{
+		kvs:  make(map[string]memoryEntry),
+		subs: make(map[string]map[chan string]struct{}),
+	}
+}
+
+func (this_ *memoryStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	e := memoryEntry{value: value}
+	if ttl > 0 {
+		e.expireAt = time.Now().Add(ttl)
+	}
+
+	this_.mtx.Lock()
+	this_.kvs[key] = e
+	this_.mtx.Unlock()
+	return nil
+}
+
+func (this_ *memoryStore) Del(ctx context.Context, key string) error {
+	this_.mtx.Lock()
+	delete(this_.kvs, key)
+	this_.mtx.Unlock()
+	return nil
+}
+
+func (this_ *memoryStore) Scan(ctx context.Context, prefix string) (map[string]string, error) {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	now := time.Now()
+	kvs := make(map[string]string)
+	for k, e := range this_.kvs {
+		if !e.expireAt.IsZero() && !now.Before(e.expireAt) {
+			delete(this_.kvs, k)
+			continue
+		}
+
+		if strings.HasPrefix(k, prefix) {
+			kvs[k] = e.value
+		}
+	}
+
+	return kvs, nil
+}
+
+func (this_ *memoryStore) Publish(ctx context.Context, channel, message string) error {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	// 与 Redis 相同, 订阅者处理不及时时丢弃消息
+	for ch := range this_.subs[channel] {
+		select {
+		case ch <- message:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (this_ *memoryStore) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	ch := make(chan string, 64)
+
+	this_.mtx.Lock()
+	if this_.subs[channel] == nil {
+		this_.subs[channel] = make(map[chan string]struct{})
+	}
+	this_.subs[channel][ch] = struct{}{}
+	this_.mtx.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		this_.mtx.Lock()
+		delete(this_.subs[channel], ch)
+		close(ch)
+		this_.mtx.Unlock()
+	}()
+
+	return ch, nil
+}
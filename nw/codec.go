@@ -0,0 +1,354 @@
+package nw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame too large")          // 帧长度超过上限
+	ErrFrameSize     = errors.New("invalid frame size")       // 消息长度不符合编解码器要求
+	ErrFrameDelim    = errors.New("frame contains delimiter") // 消息中包含分隔符
+	ErrLengthWidth   = errors.New("invalid length width")     // 长度头字节数不是 1, 2, 4, 8
+)
+
+// Codec 流式协议的帧编解码器, tcp 服务端和客户端共用
+//
+// 编解码器不保存连接状态, 同一个实例会被所有连接并发使用
+type Codec interface {
+	// Encode 将消息编码为一帧写入 buf
+	Encode(buf *Buffer, data []byte) error
+
+	// Decode 从 data 开头解析一帧, 返回消息体和整帧的长度. 数据不足一帧时 n 为 0, 返回错误时关闭连接
+	//
+	// 消息体可以引用 data, 调用方在丢弃数据之前拷贝
+	Decode(data []byte) (body []byte, n int, err error)
+}
+
+// DefaultCodec 默认的编解码器: 4 字节大端长度头, 与 blend 异或. 不使用心跳标志, 需要心跳帧时设置 Heartbeat
+func DefaultCodec(blend uint32) *LengthCodec {
+	return &LengthCodec{
+		Width:   TCP_HEADER_SIZE,
+		Order:   binary.BigEndian,
+		MaxSize: int(MESSAGE_MAX_SIZE),
+		Blend:   uint64(blend),
+	}
+}
+
+// LengthCodec 长度前缀: HEADER[Width] + DATA
+type LengthCodec struct {
+	Width     int              // 长度头字节数, 支持 1, 2, 4, 8
+	Order     binary.ByteOrder // 长度头字节序, 为 nil 时使用大端
+	MaxSize   int              // 消息体最大长度, 0 表示 MESSAGE_MAX_SIZE
+	Blend     uint64           // 长度头混合值, 只使用低 Width 字节
+	Heartbeat bool             // 长度头最高位是否为心跳标志, 开启后消息体长度不能使用该位
+}
+
+// NewLengthCodec 创建长度前缀编解码器
+//   - width: 长度头字节数, 支持 1, 2, 4, 8
+//   - order: 字节序
+//   - maxSize: 消息体最大长度, 0 表示 MESSAGE_MAX_SIZE
+//   - blend: 长度头混合值
+func NewLengthCodec(width int, order binary.ByteOrder, maxSize int, blend uint64) (*LengthCodec, error) {
+	this_ := &LengthCodec{Width: width, Order: order, MaxSize: maxSize, Blend: blend}
+	if err := this_.check(); err != nil {
+		return nil, err
+	}
+
+	return this_, nil
+}
+
+func (this_ *LengthCodec) Encode(buf *Buffer, data []byte) error {
+	if err := this_.check(); err != nil {
+		return err
+	}
+
+	if len(data) > this_.maxSize() {
+		return ErrFrameTooLarge
+	}
+
+	this_.writeHeader(buf, uint64(len(data)))
+	buf.Write(data)
+	return nil
+}
+
+func (this_ *LengthCodec) Decode(data []byte) ([]byte, int, error) {
+	if err := this_.check(); err != nil {
+		return nil, 0, err
+	}
+
+	if len(data) < this_.Width {
+		return nil, 0, nil
+	}
+
+	dlen := this_.readHeader(data)
+	if dlen > uint64(this_.maxSize()) {
+		return nil, 0, ErrFrameTooLarge
+	}
+
+	n := this_.Width + int(dlen)
+	if len(data) < n {
+		return nil, 0, nil
+	}
+
+	return data[this_.Width:n], n, nil
+}
+
+// check 检查长度头字节数. 字段可以直接赋值, 不一定经过 NewLengthCodec
+func (this_ *LengthCodec) check() error {
+	switch this_.Width {
+	case 1, 2, 4, 8:
+		return nil
+	}
+
+	return fmt.Errorf("%w: %d", ErrLengthWidth, this_.Width)
+}
+
+// maxSize 消息体最大长度, 不超过长度头可以表示的范围
+func (this_ *LengthCodec) maxSize() int {
+	size := this_.MaxSize
+	if size <= 0 {
+		size = int(MESSAGE_MAX_SIZE)
+	}
+
+	bits := uint(this_.Width * 8)
+	if this_.Heartbeat {
+		bits--
+	}
+
+	if bits < 63 && uint64(size) >= uint64(1)<<bits {
+		size = int(uint64(1)<<bits - 1)
+	}
+
+	return size
+}
+
+func (this_ *LengthCodec) order() binary.ByteOrder {
+	if this_.Order == nil {
+		return binary.BigEndian
+	}
+
+	return this_.Order
+}
+
+// heartbeatFlag 长度头中的心跳标志
+func (this_ *LengthCodec) heartbeatFlag() uint64 {
+	return uint64(1) << (this_.Width*8 - 1)
+}
+
+// writeHeader 写入与混合值异或后的长度头
+func (this_ *LengthCodec) writeHeader(buf *Buffer, v uint64) {
+	var header [8]byte
+
+	v ^= this_.Blend
+	switch this_.Width {
+	case 1:
+		header[0] = byte(v)
+	case 2:
+		this_.order().PutUint16(header[:], uint16(v))
+	case 4:
+		this_.order().PutUint32(header[:], uint32(v))
+	default:
+		this_.order().PutUint64(header[:], v)
+	}
+
+	buf.Write(header[:this_.Width])
+}
+
+// readHeader 读取长度头并还原混合值, data 至少包含 Width 字节
+func (this_ *LengthCodec) readHeader(data []byte) uint64 {
+	var v uint64
+
+	switch this_.Width {
+	case 1:
+		v = uint64(data[0] ^ byte(this_.Blend))
+	case 2:
+		v = uint64(this_.order().Uint16(data) ^ uint16(this_.Blend))
+	case 4:
+		v = uint64(this_.order().Uint32(data) ^ uint32(this_.Blend))
+	default:
+		v = this_.order().Uint64(data) ^ this_.Blend
+	}
+
+	return v
+}
+
+// VarintCodec 变长长度前缀: HEADER[uvarint] + DATA, 与 protobuf 的 delimited 格式相同
+type VarintCodec struct {
+	MaxSize int // 消息体最大长度, 0 表示 MESSAGE_MAX_SIZE
+}
+
+// NewVarintCodec 创建变长长度前缀编解码器
+//   - maxSize: 消息体最大长度, 0 表示 MESSAGE_MAX_SIZE
+func NewVarintCodec(maxSize int) *VarintCodec {
+	return &VarintCodec{MaxSize: maxSize}
+}
+
+func (this_ *VarintCodec) Encode(buf *Buffer, data []byte) error {
+	if len(data) > this_.maxSize() {
+		return ErrFrameTooLarge
+	}
+
+	var header [binary.MaxVarintLen64]byte
+	buf.Write(header[:binary.PutUvarint(header[:], uint64(len(data)))])
+	buf.Write(data)
+	return nil
+}
+
+func (this_ *VarintCodec) Decode(data []byte) ([]byte, int, error) {
+	dlen, hlen := binary.Uvarint(data)
+	if hlen == 0 {
+		return nil, 0, nil
+	}
+
+	if hlen < 0 || dlen > uint64(this_.maxSize()) {
+		return nil, 0, ErrFrameTooLarge
+	}
+
+	n := hlen + int(dlen)
+	if len(data) < n {
+		return nil, 0, nil
+	}
+
+	return data[hlen:n], n, nil
+}
+
+func (this_ *VarintCodec) maxSize() int {
+	if this_.MaxSize <= 0 {
+		return int(MESSAGE_MAX_SIZE)
+	}
+
+	return this_.MaxSize
+}
+
+// DelimiterCodec 分隔符: DATA + DELIM, 消息中不能包含分隔符
+type DelimiterCodec struct {
+	Delim   []byte // 分隔符
+	MaxSize int    // 消息体最大长度, 不包含分隔符, 0 表示 MESSAGE_MAX_SIZE
+	TrimCR  bool   // 解码时去掉消息末尾的 \r, 用于兼容 \r\n 换行
+}
+
+// NewDelimiterCodec 创建分隔符编解码器
+//   - delim: 分隔符, 不能为空
+//   - maxSize: 消息体最大长度, 0 表示 MESSAGE_MAX_SIZE
+func NewDelimiterCodec(delim []byte, maxSize int) (*DelimiterCodec, error) {
+	if len(delim) == 0 {
+		return nil, errors.New("empty delimiter")
+	}
+
+	return &DelimiterCodec{Delim: delim, MaxSize: maxSize}, nil
+}
+
+// NewLineCodec 创建按行分隔的编解码器, 编码时使用 \n, 解码时兼容 \r\n
+//   - maxSize: 单行最大长度, 0 表示 MESSAGE_MAX_SIZE
+func NewLineCodec(maxSize int) *DelimiterCodec {
+	return &DelimiterCodec{Delim: []byte{'\n'}, MaxSize: maxSize, TrimCR: true}
+}
+
+func (this_ *DelimiterCodec) Encode(buf *Buffer, data []byte) error {
+	if len(data) > this_.maxSize() {
+		return ErrFrameTooLarge
+	}
+
+	if bytes.Contains(data, this_.Delim) {
+		return ErrFrameDelim
+	}
+
+	buf.Write(data)
+	buf.Write(this_.Delim)
+	return nil
+}
+
+func (this_ *DelimiterCodec) Decode(data []byte) ([]byte, int, error) {
+	// 只在上限范围内查找, 避免缓冲大量数据后反复扫描
+	limit := min(len(data), this_.maxSize()+len(this_.Delim))
+	i := bytes.Index(data[:limit], this_.Delim)
+	if i < 0 {
+		if limit == this_.maxSize()+len(this_.Delim) {
+			return nil, 0, ErrFrameTooLarge
+		}
+		return nil, 0, nil
+	}
+
+	body := data[:i]
+	if this_.TrimCR && len(body) > 0 && body[len(body)-1] == '\r' {
+		body = body[:len(body)-1]
+	}
+
+	return body, i + len(this_.Delim), nil
+}
+
+func (this_ *DelimiterCodec) maxSize() int {
+	if this_.MaxSize <= 0 {
+		return int(MESSAGE_MAX_SIZE)
+	}
+
+	return this_.MaxSize
+}
+
+// FixedCodec 定长帧: DATA[Size], 每条消息的长度必须为 Size
+type FixedCodec struct {
+	Size int // 帧长度
+}
+
+// NewFixedCodec 创建定长编解码器
+//   - size: 帧长度, 必须大于 0
+func NewFixedCodec(size int) (*FixedCodec, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid frame size: %d", size)
+	}
+
+	return &FixedCodec{Size: size}, nil
+}
+
+func (this_ *FixedCodec) Encode(buf *Buffer, data []byte) error {
+	if len(data) != this_.Size {
+		return ErrFrameSize
+	}
+
+	buf.Write(data)
+	return nil
+}
+
+func (this_ *FixedCodec) Decode(data []byte) ([]byte, int, error) {
+	if len(data) < this_.Size {
+		return nil, 0, nil
+	}
+
+	return data[:this_.Size], this_.Size, nil
+}
+
+// encodeFrame 编码为独立的帧, 返回的数据可以在写出后继续持有
+//   - fc: 消息压缩, 为 nil 时不压缩
+func encodeFrame(codec Codec, fc *frameCompressor, data []byte) ([]byte, error) {
+	buf := &Buffer{}
+	if err := encodeMessage(buf, codec, fc, data); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// heartbeatOf 编解码器支持心跳帧时返回对应的长度前缀编解码器, 否则返回 nil. 长度头字节数无效时由 Decode 返回错误
+func heartbeatOf(codec Codec) *LengthCodec {
+	if lc, ok := codec.(*LengthCodec); ok && lc.Heartbeat && lc.check() == nil {
+		return lc
+	}
+
+	return nil
+}
+
+// decodeFrame 从 data 开头解析一帧, 先检查心跳帧. heartbeat 为 true 时 body 为心跳消息体
+//   - hb: heartbeatOf(codec) 的结果, 为 nil 时不检查心跳帧
+func decodeFrame(codec Codec, hb *LengthCodec, data []byte) (body []byte, n int, heartbeat bool, err error) {
+	if hb != nil {
+		if body, n, ok, err := hb.readHeartbeat(data); ok || err != nil {
+			return body, n, true, err
+		}
+	}
+
+	body, n, err = codec.Decode(data)
+	return body, n, false, err
+}
@@ -0,0 +1,199 @@
+package nw
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressType tcp 消息压缩算法
+type CompressType int
+
+const (
+	CompressType_None   CompressType = 0 // 不压缩, 帧中没有压缩标志
+	CompressType_Gzip   CompressType = 1 // gzip
+	CompressType_Snappy CompressType = 2 // snappy 块格式
+	CompressType_Zstd   CompressType = 3 // zstd
+)
+
+func (this_ CompressType) String() string {
+	switch this_ {
+	case CompressType_None:
+		return "none"
+	case CompressType_Gzip:
+		return "gzip"
+	case CompressType_Snappy:
+		return "snappy"
+	case CompressType_Zstd:
+		return "zstd"
+	}
+
+	return "unknown"
+}
+
+const TCP_COMPRESS_THRESHOLD = 1024 // 默认的压缩阈值, 小于该长度的消息不压缩
+
+var ErrUnknownCompress = errors.New("unknown compress type")
+
+var (
+	gzipWriterPool = sync.Pool{
+		New: func() any {
+			return gzip.NewWriter(nil)
+		},
+	}
+
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// zstdCodec 全局的 zstd 编解码器, EncodeAll 和 DecodeAll 可以并发调用
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(MESSAGE_MAX_SIZE)))
+	})
+
+	return zstdEncoder, zstdDecoder
+}
+
+// frameCompressor tcp 消息压缩
+//
+// 开启压缩后消息体格式为 FLAG[1] + DATA, FLAG 为 DATA 使用的 CompressType, 未压缩时为 0.
+// 两端需要同时开启, 解压时按 FLAG 处理, 不要求两端使用相同的算法
+type frameCompressor struct {
+	kind      CompressType // 发送时使用的压缩算法
+	threshold int          // 压缩阈值
+}
+
+// newFrameCompressor 创建消息压缩, 不压缩时返回 nil
+func newFrameCompressor(kind CompressType, threshold int) (*frameCompressor, error) {
+	switch kind {
+	case CompressType_None:
+		return nil, nil
+	case CompressType_Gzip, CompressType_Snappy, CompressType_Zstd:
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCompress, kind)
+	}
+
+	if threshold <= 0 {
+		threshold = TCP_COMPRESS_THRESHOLD
+	}
+
+	return &frameCompressor{kind: kind, threshold: threshold}, nil
+}
+
+// pack 将消息写入 buf, 超过阈值且压缩后更小时写入压缩数据
+func (this_ *frameCompressor) pack(buf *Buffer, data []byte) {
+	if len(data) >= this_.threshold {
+		if payload := this_.compress(data); len(payload) < len(data) {
+			buf.Write([]byte{byte(this_.kind)})
+			buf.Write(payload)
+			return
+		}
+	}
+
+	buf.Write([]byte{byte(CompressType_None)})
+	buf.Write(data)
+}
+
+// unpack 还原消息, 解压后超过 MESSAGE_MAX_SIZE 时返回错误. 未压缩时返回的数据引用 body
+func (this_ *frameCompressor) unpack(body []byte) ([]byte, error) {
+	if len(body) == 0 {
+		return nil, errors.New("missing compress flag")
+	}
+
+	data := body[1:]
+	switch CompressType(body[0]) {
+	case CompressType_None:
+		return data, nil
+
+	case CompressType_Gzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return readLimited(zr)
+
+	case CompressType_Snappy:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > int(MESSAGE_MAX_SIZE) {
+			return nil, ErrFrameTooLarge
+		}
+		return snappy.Decode(nil, data)
+
+	case CompressType_Zstd:
+		_, dec := zstdCodec()
+		return dec.DecodeAll(data, nil)
+	}
+
+	return nil, fmt.Errorf("%w: %d", ErrUnknownCompress, body[0])
+}
+
+// compress 使用配置的算法压缩
+func (this_ *frameCompressor) compress(data []byte) []byte {
+	switch this_.kind {
+	case CompressType_Gzip:
+		var buf bytes.Buffer
+		zw := gzipWriterPool.Get().(*gzip.Writer)
+		zw.Reset(&buf)
+		zw.Write(data)
+		zw.Close()
+		gzipWriterPool.Put(zw)
+		return buf.Bytes()
+
+	case CompressType_Snappy:
+		return snappy.Encode(nil, data)
+
+	case CompressType_Zstd:
+		enc, _ := zstdCodec()
+		return enc.EncodeAll(data, nil)
+	}
+
+	return data
+}
+
+// encodeMessage 按需压缩后编码为一帧写入 buf
+//   - fc: 消息压缩, 为 nil 时不压缩
+func encodeMessage(buf *Buffer, codec Codec, fc *frameCompressor, data []byte) error {
+	if fc == nil {
+		return codec.Encode(buf, data)
+	}
+
+	tmp := &Buffer{}
+	fc.pack(tmp, data)
+	return codec.Encode(buf, tmp.Bytes())
+}
+
+// decodeMessage 还原解码后的消息体
+//   - fc: 消息压缩, 为 nil 时原样返回
+func decodeMessage(fc *frameCompressor, body []byte) ([]byte, error) {
+	if fc == nil {
+		return body, nil
+	}
+
+	return fc.unpack(body)
+}
+
+// readLimited 读取全部解压数据, 超过 MESSAGE_MAX_SIZE 时返回 ErrFrameTooLarge
+func readLimited(r io.Reader) ([]byte, error) {
+	out, err := io.ReadAll(io.LimitReader(r, int64(MESSAGE_MAX_SIZE)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out) > int(MESSAGE_MAX_SIZE) {
+		return nil, ErrFrameTooLarge
+	}
+
+	return out, nil
+}
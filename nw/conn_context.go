@@ -1,46 +1,122 @@
 package nw
 
 import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gox/frm/log"
 	"github.com/panjf2000/gnet/v2"
 )
 
 // ConnContext 连接上下文
 type ConnContext struct {
-	c             gnet.Conn // 原始连接
-	fd            int       // 文件描述符
-	upgraded      bool      // websocket 使用
-	lastUpdate    int64     // 最后接收消息时间
-	server        IServer   // 所属服务
-	remoteAddr    string    // 远端地址
-	userData      any       // 用户数据
-	xRealIP       string    // ws 中 X-Real-IP
-	xForwardedFor string    // ws 中 X-Forwareded-For
-}
-
-// Init 初始化
+	id            uint64                        // 连接ID, 在所属服务内单调递增且不会复用
+	c             gnet.Conn                     // 原始连接
+	fd            int                           // 文件描述符
+	upgraded      atomic.Bool                   // websocket 是否已完成升级, 其它协议总是为 true
+	lastUpdate    int64                         // 最后接收消息时间
+	lastWrite     int64                         // 最后发送数据时间
+	lastPing      int64                         // 最后发送心跳时间
+	connectAt     int64                         // 连接建立时间, 恢复的会话为原连接的建立时间
+	bytesIn       uint64                        // 收到的字节数, 包括协议头和控制帧
+	bytesOut      uint64                        // 提交写入的字节数, 包括协议头和控制帧
+	idleAt        [3]int64                      // 各类空闲事件最后触发时间, 按 IdleState 排列
+	idle          wheelTimer                    // 空闲检测定时器
+	server        IServer                       // 所属服务
+	owner         *Service                      // 所属网络服务
+	remoteAddr    string                        // 远端地址, 收到 PROXY 头后为头中的客户端地址
+	proxyAddr     string                        // 发送 PROXY 头的负载均衡器地址, 没有时为空
+	proxied       bool                          // 等待 PROXY 头, 只在事件循环中访问
+	userData      any                           // 用户数据
+	xRealIP       string                        // ws 中 X-Real-IP
+	xForwardedFor string                        // ws 中 X-Forwareded-For
+	udpAddr       net.Addr                      // udp 对端地址
+	kcp           *kcp                          // kcp 会话
+	tls           *tlsConn                      // tls 连接
+	inflight      int64                         // 已投递但尚未处理完成的消息数
+	refs          int32                         // 引用计数, 连接本身和每条待处理消息各占一个, 归零后放回对象池
+	pool          *connContextPool              // 所属对象池
+	out           outbound                      // 待发送数据
+	queue         chan struct{}                 // 待处理消息信号量, 限制单个连接的待处理消息数
+	clientIP      string                        // 通过连接限制检查的客户端 IP, 为空表示尚未检查
+	msgBucket     tokenBucket                   // 消息速率令牌桶
+	byteBucket    tokenBucket                   // 字节速率令牌桶
+	rtt           int64                         // 最近一次心跳的往返时间, 纳秒
+	groups        map[string]struct{}           // 所在分组, 由 groupManager 维护
+	groupsClosed  bool                          // 已退出所有分组, 不能再加入, 由 groupManager 维护
+	mailbox       mailbox                       // 消息邮箱, 保序分发时使用
+	wsState       wsState                       // websocket 协议状态
+	pending       atomic.Bool                   // 等待协议握手, 尚未触发 OnConnected
+	sess          atomic.Pointer[cipherSession] // tcp 加密会话, 未加密或握手完成前为 nil
+	resume        *resumeState                  // 会话恢复状态, 未开启或握手完成前为 nil
+}
+
+// inbound 入站数据, 由 gnet.Conn 或 tls 明文缓冲区实现
+type inbound interface {
+	InboundBuffered() int
+	Peek(n int) ([]byte, error)
+	Discard(n int) (int, error)
+}
+
+// Init 初始化, 由调用方将连接上下文关联到 gnet.Conn. udp 的 gnet.Conn 只在当前数据报的回调中有效, 不关联
 func (this_ *ConnContext) Init(c gnet.Conn, server IServer) {
 	this_.c = c
-	this_.upgraded = server.Proto() == Protocol_TCP
+	this_.upgraded.Store(server.Proto() != Protocol_Websocket)
 	this_.server = server
 	this_.remoteAddr = c.RemoteAddr().String()
+	this_.proxyAddr = ""
+	this_.proxied = false
 	this_.xRealIP = ""
 	this_.xForwardedFor = ""
 	this_.userData = nil
+	this_.udpAddr = nil
+	this_.kcp = nil
+	this_.tls = nil
+	this_.inflight = 0
+	this_.refs = 1
+	this_.out.bytes = 0
+	this_.out.buffered = 0
+	this_.groups = nil
+	this_.groupsClosed = false
+	this_.clientIP = ""
+	this_.msgBucket = tokenBucket{}
+	this_.byteBucket = tokenBucket{}
+	this_.rtt = 0
+	this_.idleAt = [3]int64{}
+	this_.wsState.op = 0
+	this_.wsState.compressed = false
+	this_.wsState.buf = nil
+	this_.wsState.deflate = nil
+	this_.wsState.closing.Store(false)
+	this_.pending.Store(false)
+	this_.sess.Store(nil)
+	this_.resume = nil
 	this_.lastUpdate = time.Now().Unix()
-	c.SetContext(this_)
+	this_.lastWrite = this_.lastUpdate
+	this_.lastPing = this_.lastUpdate
+	this_.connectAt = this_.lastUpdate
+	this_.bytesIn = 0
+	this_.bytesOut = 0
 }
 
 // Reset 重置
 func (this_ *ConnContext) Reset() {
-	this_.c.SetContext(nil)
 	this_.fd = 0
+	atomic.StoreUint64(&this_.id, 0)
+}
+
+// ID 连接ID, 在所属服务内唯一且不会被复用, 连接关闭后返回 0
+func (this_ *ConnContext) ID() uint64 {
+	return atomic.LoadUint64(&this_.id)
 }
 
 // Fd 获取 socket 文件描述符
+//
+// 注意: udp 连接共用同一个监听套接字, 此时返回的是由 udpServer 分配的虚拟描述符
 func (this_ *ConnContext) Fd() int {
 	if this_.fd == 0 {
 		this_.fd = this_.c.Fd()
@@ -49,12 +125,28 @@ func (this_ *ConnContext) Fd() int {
 	return this_.fd
 }
 
-// Close 关闭连接
+// Close 关闭连接. 开启会话恢复时会话随之结束, 已断开的会话在下一个 tick 触发 OnDisconnected
 func (this_ *ConnContext) Close() {
-	err := this_.c.Close()
-	if err != nil {
-		log.Error("[%d:%v] Close error: %v", this_.Fd(), this_.remoteAddr, err)
+	if this_.resume != nil && this_.owner.resume.close(this_) {
+		return
+	}
+
+	this_.server.Close(this_)
+}
+
+// TLS 是否为 tls 连接
+func (this_ *ConnContext) TLS() bool {
+	return this_.tls != nil
+}
+
+// TLSConnectionState tls 连接状态, 可用于获取客户端证书. 非 tls 连接返回 nil
+func (this_ *ConnContext) TLSConnectionState() *tls.ConnectionState {
+	if this_.tls == nil {
+		return nil
 	}
+
+	state := this_.tls.conn.ConnectionState()
+	return &state
 }
 
 // Protocol 客户端的连接协议
@@ -75,6 +167,11 @@ func (this_ *ConnContext) RemoteAddr() string {
 	return this_.remoteAddr
 }
 
+// ProxyAddr 发送 PROXY 头的负载均衡器地址, 不是通过 PROXY protocol 建立的连接返回空字符串
+func (this_ *ConnContext) ProxyAddr() string {
+	return this_.proxyAddr
+}
+
 // XRealIP 只有在websocket协议中有效
 func (this_ *ConnContext) XRealIP() string {
 	return this_.xRealIP
@@ -94,11 +191,225 @@ func (this_ *ConnContext) SetUserData(ud any) {
 	this_.userData = ud
 }
 
-// Write 发送数据
+// Write 发送数据, 连接已关闭时返回 *StaleConnError
 func (this_ *ConnContext) Write(data []byte) error {
+	if this_.ID() == 0 {
+		return &StaleConnError{}
+	}
+
+	// 会话断开期间的消息被缓存, 恢复后发送
+	if this_.resume != nil {
+		return this_.resume.write(data)
+	}
+
+	return this_.server.Write(this_, data)
+}
+
+// WriteText 发送文本消息, 只有 websocket 区分文本和二进制消息, 其它协议与 Write 相同. 开启会话恢复时总是发送二进制消息
+func (this_ *ConnContext) WriteText(data []byte) error {
+	if this_.ID() == 0 {
+		return &StaleConnError{}
+	}
+
+	if this_.resume != nil {
+		return this_.resume.write(data)
+	}
+
+	if w, ok := this_.server.(textWriter); ok {
+		return w.writeText(this_, data)
+	}
+
 	return this_.server.Write(this_, data)
 }
 
+// CloseWithStatus 以指定的状态码关闭连接, websocket 会先发送带状态码和原因的关闭帧, 其它协议与 Close 相同
+func (this_ *ConnContext) CloseWithStatus(code uint16, reason string) {
+	if this_.resume != nil && this_.owner.resume.close(this_) {
+		return
+	}
+
+	if c, ok := this_.server.(statusCloser); ok {
+		c.closeWithStatus(this_, code, reason)
+		return
+	}
+
+	this_.Close()
+}
+
+// inbound 入站数据, tls 连接返回解密后的明文
+func (this_ *ConnContext) inbound() inbound {
+	if this_.tls != nil {
+		return this_.tls
+	}
+
+	return this_.c
+}
+
+// readWriter 用于协议升级的读写对象, tls 连接读写的是明文
+func (this_ *ConnContext) readWriter() io.ReadWriter {
+	if this_.tls != nil {
+		return this_.tls
+	}
+
+	return this_.c
+}
+
+// asyncWrite 异步写入已编码的数据, tls 连接会先加密. 待发送数据超过上限时按配置的策略处理
+func (this_ *ConnContext) asyncWrite(data []byte, callback gnet.AsyncCallback) error {
+	if err := this_.owner.bp.reserve(this_, len(data)); err != nil {
+		if callback != nil {
+			callback(this_.c, err)
+		}
+		return err
+	}
+
+	return this_.rawWrite(data, callback)
+}
+
+// rawWrite 异步写入已编码的数据, 不检查待发送数据上限. 用于心跳等控制帧, 可以在事件循环中调用
+func (this_ *ConnContext) rawWrite(data []byte, callback gnet.AsyncCallback) error {
+	this_.touchWrite()
+	this_.countWrite(len(data))
+	if this_.tls != nil {
+		_, err := this_.tls.Write(data)
+		if callback != nil {
+			callback(this_.c, err)
+		}
+		return err
+	}
+
+	// 提交失败时不会调用回调, 在这里记录
+	err := this_.c.AsyncWrite(data, this_.out.add(len(data), callback))
+	if err != nil {
+		this_.out.done(len(data))
+		this_.owner.metrics.OnWriteError(this_.Protocol(), err)
+	}
+
+	return err
+}
+
+// touch 收到数据, 更新最后接收消息时间
+func (this_ *ConnContext) touch() {
+	atomic.StoreInt64(&this_.lastUpdate, time.Now().Unix())
+}
+
+// touchWrite 发送数据, 更新最后发送数据时间
+func (this_ *ConnContext) touchWrite() {
+	atomic.StoreInt64(&this_.lastWrite, time.Now().Unix())
+}
+
+// countRead 收到一帧, 更新连接和服务的接收统计
+func (this_ *ConnContext) countRead(n int) {
+	atomic.AddUint64(&this_.bytesIn, uint64(n))
+	this_.owner.metrics.OnRead(this_.Protocol(), n)
+}
+
+// countWrite 提交写入一帧, 更新连接和服务的发送统计
+func (this_ *ConnContext) countWrite(n int) {
+	atomic.AddUint64(&this_.bytesOut, uint64(n))
+	this_.owner.metrics.OnWrite(this_.Protocol(), n)
+}
+
+// ConnectTime 连接建立时间
+func (this_ *ConnContext) ConnectTime() time.Time {
+	return time.Unix(atomic.LoadInt64(&this_.connectAt), 0)
+}
+
+// LastUpdate 最后接收消息时间
+func (this_ *ConnContext) LastUpdate() time.Time {
+	return time.Unix(atomic.LoadInt64(&this_.lastUpdate), 0)
+}
+
+// BytesIn 收到的字节数, 包括协议头和控制帧
+func (this_ *ConnContext) BytesIn() uint64 {
+	return atomic.LoadUint64(&this_.bytesIn)
+}
+
+// BytesOut 提交写入的字节数, 包括协议头和控制帧
+func (this_ *ConnContext) BytesOut() uint64 {
+	return atomic.LoadUint64(&this_.bytesOut)
+}
+
+// PendingBytes 尚未写入套接字的字节数
+func (this_ *ConnContext) PendingBytes() int64 {
+	return this_.out.pending()
+}
+
+// RTT 最近一次心跳的往返时间, 没有收到过心跳应答时为 0
+func (this_ *ConnContext) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this_.rtt))
+}
+
+// onPong 收到心跳应答, 更新往返时间
+func (this_ *ConnContext) onPong(ts int64) {
+	atomic.StoreInt64(&this_.rtt, rtt(ts))
+}
+
+// retain 增加引用, 投递消息前调用
+func (this_ *ConnContext) retain() {
+	atomic.AddInt32(&this_.refs, 1)
+}
+
+// release 释放引用, 归零时放回对象池. 连接关闭后仍有待处理的消息时, 由最后一条消息处理完成后放回
+func (this_ *ConnContext) release() {
+	if atomic.AddInt32(&this_.refs, -1) == 0 && this_.pool != nil {
+		this_.pool.put(this_)
+	}
+}
+
+// Queued 已投递但尚未处理完成的消息数
+func (this_ *ConnContext) Queued() int64 {
+	return atomic.LoadInt64(&this_.inflight)
+}
+
+// drained 消息是否已处理完成且发送数据已全部写出
+func (this_ *ConnContext) drained() bool {
+	if atomic.LoadInt64(&this_.inflight) > 0 || atomic.LoadInt64(&this_.out.bytes) > 0 {
+		return false
+	}
+
+	if k := this_.kcp; k != nil {
+		k.mtx.Lock()
+		defer k.mtx.Unlock()
+		return k.waitSnd() == 0
+	}
+
+	return true
+}
+
+// goAway 发送即将关闭的通知
+func (this_ *ConnContext) goAway(data []byte) error {
+	if w, ok := this_.server.(goAwayWriter); ok {
+		return w.writeGoAway(this_, data)
+	}
+
+	return this_.Write(data)
+}
+
+// goAwayWriter 需要以特殊方式发送关闭通知的服务
+type goAwayWriter interface {
+	writeGoAway(*ConnContext, []byte) error
+}
+
+// textWriter 区分文本消息的服务
+type textWriter interface {
+	writeText(*ConnContext, []byte) error
+}
+
+// statusCloser 关闭时可以携带状态码的服务
+type statusCloser interface {
+	closeWithStatus(*ConnContext, uint16, string)
+}
+
+// StaleConnError 连接已关闭
+type StaleConnError struct {
+	ID uint64 // 连接ID
+}
+
+func (this_ *StaleConnError) Error() string {
+	return fmt.Sprintf("connection %d is closed", this_.ID)
+}
+
 type connContextPool struct {
 	pool sync.Pool
 }
@@ -0,0 +1,255 @@
+package nw
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// DispatchMode 消息分发模式
+type DispatchMode int
+
+const (
+	DispatchMode_Ordered   DispatchMode = 0 // 按连接保序: 同一连接的消息依次处理, 不同连接的消息并行处理
+	DispatchMode_Unordered DispatchMode = 1 // 不保序: 由协程池并发处理, 同一连接的消息可能乱序
+	DispatchMode_Inline    DispatchMode = 2 // 内联: 在事件循环中直接处理, 仅适用于非常轻量且不会阻塞的处理函数
+)
+
+func (this_ DispatchMode) String() string {
+	switch this_ {
+	case DispatchMode_Ordered:
+		return "ordered"
+	case DispatchMode_Unordered:
+		return "unordered"
+	case DispatchMode_Inline:
+		return "inline"
+	}
+
+	return "unknown"
+}
+
+// DISPATCH_BATCH_SIZE 保序模式下一次调度中连续处理同一连接的最大消息数, 超过后重新排队, 避免单个连接占用工作协程
+const DISPATCH_BATCH_SIZE = 64
+
+// dispatcher 消息分发器
+type dispatcher interface {
+	start(wg *sync.WaitGroup) // 启动, 工作协程退出时调用 wg.Done
+	dispatch(msg *message)    // 分发消息, 在事件循环中调用
+	stop()                    // 停止, 已分发的消息会在工作协程退出前处理完
+}
+
+// newDispatcher 创建消息分发器
+//   - mode: 分发模式
+//   - workers: 工作协程数, 小于等于 0 时使用 CPU 核数, 内联模式忽略
+//   - queueSize: 待处理消息数上限, 由调用方保证不会超过
+//   - handle: 消息处理函数
+func newDispatcher(mode DispatchMode, workers int, queueSize int, handle func(*message)) dispatcher {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	switch mode {
+	case DispatchMode_Unordered:
+		return &unorderedDispatcher{
+			workers: newWorkerGroup(workers, queueSize, handle),
+		}
+
+	case DispatchMode_Inline:
+		return &inlineDispatcher{
+			handle: handle,
+		}
+	}
+
+	this_ := &orderedDispatcher{
+		handle: handle,
+	}
+	// 调度队列中的邮箱要么有待处理消息, 要么正在被工作协程处理
+	this_.workers = newWorkerGroup(workers, queueSize+workers, this_.run)
+	return this_
+}
+
+// workerGroup 共享同一队列的工作协程组
+type workerGroup[T any] struct {
+	n       int
+	size    int
+	handle  func(T)
+	q       chan T
+	stopC   chan struct{}
+	running int32
+}
+
+func newWorkerGroup[T any](n int, size int, handle func(T)) *workerGroup[T] {
+	return &workerGroup[T]{
+		n:      n,
+		size:   size,
+		handle: handle,
+	}
+}
+
+func (this_ *workerGroup[T]) start(wg *sync.WaitGroup) {
+	if !atomic.CompareAndSwapInt32(&this_.running, 0, 1) {
+		return
+	}
+
+	this_.q = make(chan T, this_.size)
+	this_.stopC = make(chan struct{})
+
+	wg.Add(this_.n)
+	for i := 0; i < this_.n; i++ {
+		go this_.run(wg)
+	}
+}
+
+func (this_ *workerGroup[T]) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		select {
+		case item := <-this_.q:
+			this_.handle(item)
+
+		case <-this_.stopC:
+			// 处理队列中剩余的任务, 处理过程中可能有新的任务入队
+			for {
+				select {
+				case item := <-this_.q:
+					this_.handle(item)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (this_ *workerGroup[T]) push(item T) {
+	this_.q <- item
+}
+
+func (this_ *workerGroup[T]) stop() {
+	if atomic.CompareAndSwapInt32(&this_.running, 1, 0) {
+		close(this_.stopC)
+	}
+}
+
+// mailbox 连接的消息邮箱
+//
+// 邮箱有消息时进入调度队列, 同一时刻最多被一个工作协程处理, 以此保证同一连接的消息顺序
+type mailbox struct {
+	mtx       sync.Mutex
+	msgs      []*message
+	head      int
+	scheduled bool // 是否已在调度队列中或正在处理
+}
+
+// push 放入消息, 返回是否需要调度
+func (this_ *mailbox) push(msg *message) bool {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	// 已处理的消息占用了队列头部, 扩容前先移动到头部
+	if this_.head > 0 && len(this_.msgs) == cap(this_.msgs) {
+		n := copy(this_.msgs, this_.msgs[this_.head:])
+		clear(this_.msgs[n:])
+		this_.msgs = this_.msgs[:n]
+		this_.head = 0
+	}
+
+	this_.msgs = append(this_.msgs, msg)
+	if this_.scheduled {
+		return false
+	}
+
+	this_.scheduled = true
+	return true
+}
+
+// pop 取出消息, 邮箱为空时清除调度标记并返回 nil
+func (this_ *mailbox) pop() *message {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	if this_.head == len(this_.msgs) {
+		this_.msgs = this_.msgs[:0]
+		this_.head = 0
+		this_.scheduled = false
+		return nil
+	}
+
+	msg := this_.msgs[this_.head]
+	this_.msgs[this_.head] = nil
+	this_.head++
+	return msg
+}
+
+// orderedDispatcher 按连接保序的分发器
+//
+// 邮箱在调度队列中或正在处理时持有连接上下文的引用, 连接关闭后邮箱清空前连接上下文不会被复用
+type orderedDispatcher struct {
+	workers *workerGroup[*ConnContext]
+	handle  func(*message)
+}
+
+func (this_ *orderedDispatcher) start(wg *sync.WaitGroup) {
+	this_.workers.start(wg)
+}
+
+func (this_ *orderedDispatcher) dispatch(msg *message) {
+	cctx := msg.cctx
+	if cctx.mailbox.push(msg) {
+		cctx.retain()
+		this_.workers.push(cctx)
+	}
+}
+
+func (this_ *orderedDispatcher) stop() {
+	this_.workers.stop()
+}
+
+// run 处理连接邮箱中的消息
+func (this_ *orderedDispatcher) run(cctx *ConnContext) {
+	mb := &cctx.mailbox
+	for i := 0; i < DISPATCH_BATCH_SIZE; i++ {
+		msg := mb.pop()
+		if msg == nil {
+			// 邮箱已退出调度, 之后不再访问
+			cctx.release()
+			return
+		}
+
+		this_.handle(msg)
+	}
+
+	// 还有未处理的消息, 重新排队让其他连接的消息得到处理
+	this_.workers.push(cctx)
+}
+
+// unorderedDispatcher 不保序的分发器
+type unorderedDispatcher struct {
+	workers *workerGroup[*message]
+}
+
+func (this_ *unorderedDispatcher) start(wg *sync.WaitGroup) {
+	this_.workers.start(wg)
+}
+
+func (this_ *unorderedDispatcher) dispatch(msg *message) {
+	this_.workers.push(msg)
+}
+
+func (this_ *unorderedDispatcher) stop() {
+	this_.workers.stop()
+}
+
+// inlineDispatcher 在事件循环中直接处理消息的分发器
+type inlineDispatcher struct {
+	handle func(*message)
+}
+
+func (this_ *inlineDispatcher) start(wg *sync.WaitGroup) {}
+
+func (this_ *inlineDispatcher) dispatch(msg *message) {
+	this_.handle(msg)
+}
+
+func (this_ *inlineDispatcher) stop() {}
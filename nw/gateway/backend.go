@@ -0,0 +1,224 @@
+package gateway
+
+import (
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/gox/frm/log"
+	"github.com/gox/frm/nw"
+	"github.com/gox/frm/nw/router"
+	"github.com/gox/frm/utils"
+)
+
+// IBackendEvent 后端的会话事件
+//
+// 同一条网关链路上的事件在链路的消息处理协程中调用, 按连接保序的分发模式下同一网关的会话依次处理
+type IBackendEvent interface {
+	OnOpen(*Session) error         // 会话打开, 返回错误时关闭会话
+	OnData(*Session, []byte) error // 收到客户端的一帧, 格式与 router 相同, 数据在返回后失效. 返回错误时关闭会话
+	OnClose(*Session)              // 会话关闭: 客户端断开、调用 Session.Close 或网关链路断开
+}
+
+// sessionKey 会话在后端的键, 不同网关的连接ID可能相同
+type sessionKey struct {
+	link uint64 // 网关链路的连接ID
+	id   uint64 // 客户端在网关上的连接ID
+}
+
+// Backend 后端节点, 作为 nw.Service 的事件处理网关链路上的会话
+//
+//	svc := nw.NewService(&nw.Config{TcpHost: ":9000"}, gateway.NewBackend(handler))
+//
+// 只应接受网关的连接, 可以通过 AllowIPs 或 TcpEncryptKey 限制
+type Backend struct {
+	event    IBackendEvent
+	svc      *nw.Service
+	sessions *utils.SafeMap[sessionKey, *Session]
+}
+
+// NewBackend 创建后端
+func NewBackend(event IBackendEvent) *Backend {
+	return &Backend{
+		event:    event,
+		sessions: utils.NewSafeMap[sessionKey, *Session](),
+	}
+}
+
+// Sessions 当前的会话数
+func (this_ *Backend) Sessions() int {
+	return this_.sessions.Count()
+}
+
+// OnInit 初始化事件
+func (this_ *Backend) OnInit(svc *nw.Service) error {
+	this_.svc = svc
+	return nil
+}
+
+// OnConnected 网关链路连接事件
+func (this_ *Backend) OnConnected(link *nw.ConnContext) error {
+	log.Info("[%d:%v] gateway connected", link.Fd(), link.RemoteAddr())
+	return nil
+}
+
+// OnDisconnected 网关链路断开事件, 关闭链路上的所有会话
+func (this_ *Backend) OnDisconnected(link *nw.ConnContext) {
+	id := link.ID()
+
+	var sessions []*Session
+	this_.sessions.Range(func(key sessionKey, s *Session) bool {
+		if key.link == id {
+			sessions = append(sessions, s)
+		}
+		return true
+	})
+
+	for _, s := range sessions {
+		s.shutdown()
+	}
+
+	log.Info("[%d:%v] gateway disconnected, %d sessions closed", link.Fd(), link.RemoteAddr(), len(sessions))
+}
+
+// OnStopped 服务停止事件
+func (this_ *Backend) OnStopped(svc *nw.Service) {
+}
+
+// OnIdle 网关链路空闲事件, 关闭空闲的链路
+func (this_ *Backend) OnIdle(link *nw.ConnContext, state nw.IdleState) bool {
+	return false
+}
+
+// OnData 网关链路的消息事件
+func (this_ *Backend) OnData(link *nw.ConnContext, data []byte) error {
+	kind, id, body, err := decodeLink(data)
+	if err != nil {
+		return err
+	}
+
+	key := sessionKey{link: link.ID(), id: id}
+	switch kind {
+	case LinkKind_Open:
+		// 链路恢复后网关可能重复打开会话
+		if this_.sessions.Has(key) {
+			return nil
+		}
+
+		s := &Session{owner: this_, key: key}
+		if err := json.Unmarshal(body, &s.info); err != nil {
+			return err
+		}
+
+		this_.sessions.Set(key, s)
+		if err := this_.event.OnOpen(s); err != nil {
+			log.Error("[%d:%v] open session %d failed: %v", link.Fd(), link.RemoteAddr(), id, err)
+			s.Close()
+		}
+
+	case LinkKind_Data:
+		// 交还被拒绝的帧, 由网关重新打开会话后重发
+		s := this_.sessions.Get(key)
+		if s == nil {
+			return link.Write(encodeLink(LinkKind_Reset, id, body))
+		}
+
+		if err := this_.event.OnData(s, body); err != nil {
+			log.Error("[%d:%v] handle session %d failed: %v", link.Fd(), link.RemoteAddr(), id, err)
+			s.Close()
+		}
+
+	case LinkKind_Close:
+		if s := this_.sessions.Get(key); s != nil {
+			s.shutdown()
+		}
+
+	default:
+		log.Error("[%d:%v] unexpected link frame %v", link.Fd(), link.RemoteAddr(), kind)
+	}
+
+	return nil
+}
+
+// Session 后端上的客户端会话
+type Session struct {
+	owner    *Backend
+	key      sessionKey
+	info     SessionInfo
+	userData any
+	closed   atomic.Bool
+}
+
+// ID 客户端在网关上的连接ID
+func (this_ *Session) ID() uint64 {
+	return this_.info.ID
+}
+
+// Identity 网关认证得到的身份
+func (this_ *Session) Identity() string {
+	return this_.info.Identity
+}
+
+// RemoteAddr 客户端地址
+func (this_ *Session) RemoteAddr() string {
+	return this_.info.RemoteAddr
+}
+
+// Info 会话信息
+func (this_ *Session) Info() SessionInfo {
+	return this_.info
+}
+
+func (this_ *Session) UserData() any {
+	return this_.userData
+}
+
+func (this_ *Session) SetUserData(ud any) {
+	this_.userData = ud
+}
+
+// Write 通过网关向客户端发送一帧, 会话或链路已关闭时返回错误
+func (this_ *Session) Write(data []byte) error {
+	if this_.closed.Load() {
+		return ErrNoSession
+	}
+
+	return this_.owner.svc.Write(this_.key.link, encodeLink(LinkKind_Data, this_.key.id, data))
+}
+
+// Reply 应答客户端的请求, 与 router.Router 的应答格式相同. 单向消息不应答
+func (this_ *Session) Reply(h router.Header, rsp []byte, err error) error {
+	if h.IsPush() {
+		return nil
+	}
+
+	flags := router.Flag_Response
+	if err != nil {
+		flags |= router.Flag_Error
+		rsp = []byte(err.Error())
+	}
+
+	return this_.Write(router.Header{Cmd: h.Cmd, Seq: h.Seq, Flags: flags}.Encode(rsp))
+}
+
+// Push 向客户端发送单向消息
+func (this_ *Session) Push(cmd uint32, body []byte) error {
+	return this_.Write(router.Header{Cmd: cmd, Flags: router.Flag_Push}.Encode(body))
+}
+
+// Close 关闭会话, 网关随后关闭客户端连接
+func (this_ *Session) Close() {
+	if this_.shutdown() {
+		this_.owner.svc.Write(this_.key.link, encodeLink(LinkKind_Close, this_.key.id, nil))
+	}
+}
+
+// shutdown 移除会话并触发 OnClose, 返回 false 表示会话已关闭
+func (this_ *Session) shutdown() bool {
+	if !this_.closed.CompareAndSwap(false, true) {
+		return false
+	}
+
+	this_.owner.sessions.Remove(this_.key)
+	this_.owner.event.OnClose(this_)
+	return true
+}
@@ -0,0 +1,639 @@
+package gateway
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gox/frm/log"
+	"github.com/gox/frm/nw"
+	"github.com/gox/frm/nw/cluster"
+	"github.com/gox/frm/nw/router"
+	"github.com/gox/frm/utils"
+)
+
+// Balance 同类型节点的选择策略. 会话选定节点后保持粘滞, 直到节点被移除或链路关闭
+type Balance int
+
+const (
+	Balance_LeastSessions Balance = 0 // 选择打开会话最少的节点
+	Balance_Hash          Balance = 1 // 按身份的一致性哈希选择, 未认证时按连接ID. 同一身份总是选中同一节点, 节点增减时只有少量身份改变节点
+)
+
+func (this_ Balance) String() string {
+	switch this_ {
+	case Balance_LeastSessions:
+		return "least_sessions"
+	case Balance_Hash:
+		return "hash"
+	}
+
+	return "unknown"
+}
+
+var (
+	ErrNoNode      = errors.New("no available node")   // 命令对应的节点类型没有可用的节点
+	ErrNodeExists  = errors.New("node already exists") // 节点ID重复
+	ErrUnknownNode = errors.New("unknown node")        // 节点不存在
+	ErrNoSession   = errors.New("session not found")   // 会话不存在或已断开
+)
+
+// Node 后端节点
+type Node struct {
+	ID   string `json:"id"`   // 节点ID
+	Type string `json:"type"` // 节点类型, 路由按类型选择节点
+	Host string `json:"host"` // 内部链路的监听地址, 即后端 nw.Service 的 TcpHost
+}
+
+// NodeInfo 节点状态
+type NodeInfo struct {
+	Node
+	Sessions  int  `json:"sessions"`  // 在该节点打开的会话数
+	Connected bool `json:"connected"` // 链路是否连通, 重连期间为 false
+}
+
+// AuthFunc 认证函数. 会话认证通过之前收到的每一帧都交给它处理, 不转发给后端
+//   - identity: 不为空时认证通过, 之后的帧按路由转发, 身份随会话信息发给后端
+//   - rsp: 不为 nil 时作为应答发给客户端, 单向消息忽略
+//   - err: 不为 nil 时应答错误并关闭连接
+type AuthFunc func(cctx *nw.ConnContext, h router.Header, body []byte) (identity string, rsp []byte, err error)
+
+// Config 网关配置
+type Config struct {
+	Link        nw.TCPClientConfig // 连接后端的客户端配置, OnMessage 由网关设置. Reconnect 为 nil 时使用默认的重连配置
+	Auth        AuthFunc           // 认证, 为 nil 时不认证
+	DefaultType string             // 没有路由的命令转发到的节点类型, 为空时应答错误
+	Balance     Balance            // 同类型节点的选择策略
+}
+
+// cmdRange 命令号区间的路由
+type cmdRange struct {
+	min, max uint32
+	nodeType string
+}
+
+// Gateway 网关
+//
+// 作为 nw.Service 的事件接受客户端连接, 按命令号将客户端的帧转发给后端节点, 并将后端的消息发回对应的连接.
+// 客户端使用 router 的帧格式; 每个后端节点一条内部链路, 承载该节点上的所有会话, 后端使用 Backend 处理.
+// 需要处理其它事件时可以嵌入 Gateway 并覆盖对应的方法, 覆盖的方法需要调用 Gateway 的实现
+type Gateway struct {
+	conf     Config
+	svc      *nw.Service
+	mtx      sync.RWMutex
+	nodes    map[string]*node                 // 节点ID => 节点
+	types    map[string][]*node               // 节点类型 => 节点, 按节点ID排序
+	rings    map[string]*cluster.HashRing     // 节点类型 => 哈希环, 只在 Balance_Hash 时使用
+	routes   map[uint32]string                // 命令号 => 节点类型
+	ranges   []cmdRange                       // 命令号区间 => 节点类型, 按注册顺序匹配
+	sessions *utils.SafeMap[uint64, *session] // 连接ID => 会话
+}
+
+// session 网关上的客户端会话
+type session struct {
+	cctx   *nw.ConnContext
+	info   SessionInfo
+	authed bool             // 是否已认证
+	closed bool             // 连接已断开
+	mtx    sync.Mutex       // 保证同一会话的帧按顺序转发
+	bound  map[string]*node // 节点类型 => 粘滞的节点
+}
+
+// New 创建网关
+func New(c *Config) *Gateway {
+	return &Gateway{
+		conf:     *c,
+		nodes:    make(map[string]*node),
+		types:    make(map[string][]*node),
+		rings:    make(map[string]*cluster.HashRing),
+		routes:   make(map[uint32]string),
+		sessions: utils.NewSafeMap[uint64, *session](),
+	}
+}
+
+// Route 将命令转发到指定类型的节点, 优先于 RouteRange
+func (this_ *Gateway) Route(cmd uint32, nodeType string) {
+	this_.mtx.Lock()
+	this_.routes[cmd] = nodeType
+	this_.mtx.Unlock()
+}
+
+// RouteRange 将 [min, max] 区间内的命令转发到指定类型的节点, 区间重叠时先注册的优先
+func (this_ *Gateway) RouteRange(min, max uint32, nodeType string) {
+	this_.mtx.Lock()
+	this_.ranges = append(this_.ranges, cmdRange{min: min, max: max, nodeType: nodeType})
+	this_.mtx.Unlock()
+}
+
+// route 命令对应的节点类型
+func (this_ *Gateway) route(cmd uint32) string {
+	this_.mtx.RLock()
+	defer this_.mtx.RUnlock()
+
+	if t, ok := this_.routes[cmd]; ok {
+		return t
+	}
+
+	for _, r := range this_.ranges {
+		if cmd >= r.min && cmd <= r.max {
+			return r.nodeType
+		}
+	}
+
+	return this_.conf.DefaultType
+}
+
+// AddNode 连接后端节点并加入路由, 连接失败时返回错误
+func (this_ *Gateway) AddNode(n Node) error {
+	this_.mtx.RLock()
+	_, ok := this_.nodes[n.ID]
+	this_.mtx.RUnlock()
+	if ok {
+		return ErrNodeExists
+	}
+
+	nd := &node{Node: n, owner: this_, opened: make(map[uint64]struct{})}
+
+	conf := this_.conf.Link
+	conf.OnMessage = nd.onMessage
+
+	var rc nw.ReconnectConfig
+	if conf.Reconnect != nil {
+		rc = *conf.Reconnect
+	}
+	onConnect := rc.OnConnect
+	rc.OnConnect = func(resumed bool) {
+		// 后端没有恢复链路时原有的会话已关闭, 之后的帧需要重新打开会话
+		if !resumed {
+			nd.reset()
+		}
+		if onConnect != nil {
+			onConnect(resumed)
+		}
+	}
+	conf.Reconnect = &rc
+
+	client, err := nw.NewAsyncTCPClientWithConfig(n.Host, &conf)
+	if err != nil {
+		return err
+	}
+	nd.client = client
+
+	this_.mtx.Lock()
+	if _, ok := this_.nodes[n.ID]; ok {
+		this_.mtx.Unlock()
+		client.Close()
+		return ErrNodeExists
+	}
+	this_.nodes[n.ID] = nd
+	nodes := append(this_.types[n.Type], nd)
+	slices.SortFunc(nodes, func(a, b *node) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	this_.types[n.Type] = nodes
+	this_.rebuild(n.Type)
+	this_.mtx.Unlock()
+
+	log.Info("gateway add node %s(%s) %s", n.ID, n.Type, n.Host)
+	return nil
+}
+
+// RemoveNode 移除节点并关闭链路, 后端关闭该链路上的所有会话. 粘滞在该节点的会话在下一帧时重新选择节点
+func (this_ *Gateway) RemoveNode(id string) error {
+	this_.mtx.Lock()
+	nd, ok := this_.nodes[id]
+	if !ok {
+		this_.mtx.Unlock()
+		return ErrUnknownNode
+	}
+	delete(this_.nodes, id)
+	this_.types[nd.Type] = slices.DeleteFunc(slices.Clone(this_.types[nd.Type]), func(n *node) bool {
+		return n == nd
+	})
+	if len(this_.types[nd.Type]) == 0 {
+		delete(this_.types, nd.Type)
+	}
+	this_.rebuild(nd.Type)
+	this_.mtx.Unlock()
+
+	nd.removed.Store(true)
+	nd.client.Close()
+
+	log.Info("gateway remove node %s(%s) %s", nd.ID, nd.Type, nd.Host)
+	return nil
+}
+
+// rebuild 重建节点类型的哈希环, 调用方需要持有 mtx
+func (this_ *Gateway) rebuild(nodeType string) {
+	if this_.conf.Balance != Balance_Hash {
+		return
+	}
+
+	nodes := this_.types[nodeType]
+	if len(nodes) == 0 {
+		delete(this_.rings, nodeType)
+		return
+	}
+
+	ids := make([]string, len(nodes))
+	for i, nd := range nodes {
+		ids[i] = nd.ID
+	}
+	this_.rings[nodeType] = cluster.NewHashRing(ids, cluster.CLUSTER_REPLICAS)
+}
+
+// Nodes 所有节点的状态, 按节点ID排序
+func (this_ *Gateway) Nodes() []NodeInfo {
+	this_.mtx.RLock()
+	infos := make([]NodeInfo, 0, len(this_.nodes))
+	for _, nd := range this_.nodes {
+		infos = append(infos, nd.info())
+	}
+	this_.mtx.RUnlock()
+
+	slices.SortFunc(infos, func(a, b NodeInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return infos
+}
+
+// Bind 将会话粘滞到指定节点, 之后该节点类型的命令都转发到这个节点. 用于按业务 (如房间) 指定节点
+func (this_ *Gateway) Bind(id uint64, nodeID string) error {
+	s := this_.sessions.Get(id)
+	if s == nil {
+		return ErrNoSession
+	}
+
+	this_.mtx.RLock()
+	nd := this_.nodes[nodeID]
+	this_.mtx.RUnlock()
+	if nd == nil {
+		return ErrUnknownNode
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.closed {
+		return ErrNoSession
+	}
+
+	s.bound[nd.Type] = nd
+	return nil
+}
+
+// Session 会话信息, 会话不存在时返回 false
+func (this_ *Gateway) Session(id uint64) (SessionInfo, bool) {
+	s := this_.sessions.Get(id)
+	if s == nil {
+		return SessionInfo{}, false
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.info, true
+}
+
+// pick 为会话选择节点类型对应的节点, 已粘滞的节点可用时总是选择它
+func (this_ *Gateway) pick(s *session, nodeType string) *node {
+	if nd := s.bound[nodeType]; nd != nil && nd.alive() {
+		return nd
+	}
+
+	this_.mtx.RLock()
+	ring := this_.rings[nodeType]
+	nodes := make([]*node, 0, len(this_.types[nodeType]))
+	for _, nd := range this_.types[nodeType] {
+		if nd.alive() {
+			nodes = append(nodes, nd)
+		}
+	}
+	this_.mtx.RUnlock()
+
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	var best *node
+	switch this_.conf.Balance {
+	case Balance_Hash:
+		key := s.info.Identity
+		if len(key) == 0 {
+			key = strconv.FormatUint(s.info.ID, 10)
+		}
+		best = hashPick(ring, nodes, key)
+
+	default:
+		score := 0
+		for _, nd := range nodes {
+			if n := nd.sessions(); best == nil || n < score {
+				best, score = nd, n
+			}
+		}
+	}
+
+	s.bound[nodeType] = best
+	return best
+}
+
+// hashPick 按一致性哈希选择节点. 环上选中的节点不可用 (如重连失败) 时在可用的节点中重新计算
+//   - ring: 节点类型的哈希环
+//   - nodes: 可用的节点, 不能为空
+func hashPick(ring *cluster.HashRing, nodes []*node, key string) *node {
+	find := func(id string) *node {
+		for _, nd := range nodes {
+			if nd.ID == id {
+				return nd
+			}
+		}
+		return nil
+	}
+
+	if ring != nil {
+		if nd := find(ring.Get(key)); nd != nil {
+			return nd
+		}
+	}
+
+	ids := make([]string, len(nodes))
+	for i, nd := range nodes {
+		ids[i] = nd.ID
+	}
+	return find(cluster.NewHashRing(ids, cluster.CLUSTER_REPLICAS).Get(key))
+}
+
+// OnInit 初始化事件
+func (this_ *Gateway) OnInit(svc *nw.Service) error {
+	this_.svc = svc
+	return nil
+}
+
+// OnConnected 客户端连接事件, 创建会话
+func (this_ *Gateway) OnConnected(cctx *nw.ConnContext) error {
+	this_.sessions.Set(cctx.ID(), &session{
+		cctx: cctx,
+		info: SessionInfo{
+			ID:         cctx.ID(),
+			RemoteAddr: cctx.RemoteAddr(),
+			Protocol:   cctx.Protocol().String(),
+		},
+		authed: this_.conf.Auth == nil,
+		bound:  make(map[string]*node),
+	})
+
+	return nil
+}
+
+// OnDisconnected 客户端断开事件, 通知打开过会话的节点
+func (this_ *Gateway) OnDisconnected(cctx *nw.ConnContext) {
+	id := cctx.ID()
+	s := this_.sessions.Get(id)
+	if s == nil {
+		return
+	}
+	this_.sessions.Remove(id)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.closed = true
+	for _, nd := range s.bound {
+		if nd.close(id) {
+			nd.client.Write(encodeLink(LinkKind_Close, id, nil))
+		}
+	}
+}
+
+// OnStopped 服务停止事件, 关闭所有节点的链路
+func (this_ *Gateway) OnStopped(svc *nw.Service) {
+	this_.mtx.RLock()
+	ids := make([]string, 0, len(this_.nodes))
+	for id := range this_.nodes {
+		ids = append(ids, id)
+	}
+	this_.mtx.RUnlock()
+
+	for _, id := range ids {
+		this_.RemoveNode(id)
+	}
+}
+
+// OnIdle 连接空闲事件, 关闭空闲的客户端
+func (this_ *Gateway) OnIdle(cctx *nw.ConnContext, state nw.IdleState) bool {
+	return false
+}
+
+// OnData 客户端消息事件, 认证或按路由转发
+func (this_ *Gateway) OnData(cctx *nw.ConnContext, data []byte) error {
+	h, body, err := router.Decode(data)
+	if err != nil {
+		return err
+	}
+
+	s := this_.sessions.Get(cctx.ID())
+	if s == nil {
+		return nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	if !s.authed {
+		return this_.authenticate(s, h, body)
+	}
+
+	nodeType := this_.route(h.Cmd)
+	if len(nodeType) == 0 {
+		return reply(cctx, h, nil, fmt.Errorf("unknown command %d", h.Cmd))
+	}
+
+	nd := this_.pick(s, nodeType)
+	if nd == nil {
+		return reply(cctx, h, nil, fmt.Errorf("%w: %s", ErrNoNode, nodeType))
+	}
+
+	if err := nd.forward(s, data); err != nil {
+		log.Error("[%d:%v] forward %d to node %s failed: %v", cctx.Fd(), cctx.RemoteAddr(), h.Cmd, nd.ID, err)
+		return reply(cctx, h, nil, err)
+	}
+
+	return nil
+}
+
+// authenticate 认证会话, 返回错误时关闭连接
+func (this_ *Gateway) authenticate(s *session, h router.Header, body []byte) error {
+	identity, rsp, err := this_.conf.Auth(s.cctx, h, body)
+	if err != nil {
+		reply(s.cctx, h, nil, err)
+		return err
+	}
+
+	if len(identity) > 0 {
+		s.authed = true
+		s.info.Identity = identity
+	}
+
+	if rsp != nil {
+		return reply(s.cctx, h, rsp, nil)
+	}
+
+	return nil
+}
+
+// reply 应答客户端的请求, 单向消息不应答
+func reply(cctx *nw.ConnContext, h router.Header, rsp []byte, err error) error {
+	if h.IsPush() {
+		return nil
+	}
+
+	flags := router.Flag_Response
+	if err != nil {
+		flags |= router.Flag_Error
+		rsp = []byte(err.Error())
+	}
+
+	return cctx.Write(router.Header{Cmd: h.Cmd, Seq: h.Seq, Flags: flags}.Encode(rsp))
+}
+
+// node 网关上的后端节点
+type node struct {
+	Node
+	owner   *Gateway
+	client  *nw.AsyncTCPClient
+	mtx     sync.Mutex
+	opened  map[uint64]struct{} // 已在节点上打开的会话
+	removed atomic.Bool         // 已从网关移除
+}
+
+// alive 节点未被移除且链路未关闭, 重连中的节点仍然可用
+func (this_ *node) alive() bool {
+	return !this_.removed.Load() && !this_.client.Closed()
+}
+
+// info 节点状态
+func (this_ *node) info() NodeInfo {
+	return NodeInfo{
+		Node:      this_.Node,
+		Sessions:  this_.sessions(),
+		Connected: this_.alive() && !this_.client.Reconnecting(),
+	}
+}
+
+// sessions 在节点上打开的会话数
+func (this_ *node) sessions() int {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	return len(this_.opened)
+}
+
+// open 标记会话在节点上打开, 返回 true 表示需要发送打开会话的帧
+func (this_ *node) open(id uint64) bool {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	if _, ok := this_.opened[id]; ok {
+		return false
+	}
+
+	this_.opened[id] = struct{}{}
+	return true
+}
+
+// close 移除会话, 返回 true 表示会话在节点上打开过
+func (this_ *node) close(id uint64) bool {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	if _, ok := this_.opened[id]; !ok {
+		return false
+	}
+
+	delete(this_.opened, id)
+	return true
+}
+
+// reset 链路重连后后端没有恢复, 所有会话需要重新打开
+func (this_ *node) reset() {
+	this_.mtx.Lock()
+	this_.opened = make(map[uint64]struct{})
+	this_.mtx.Unlock()
+}
+
+// forward 转发客户端的一帧, 会话未在节点上打开时先发送打开会话的帧
+func (this_ *node) forward(s *session, data []byte) error {
+	id := s.info.ID
+	if this_.open(id) {
+		if err := this_.client.Write(encodeOpen(&s.info)); err != nil {
+			this_.close(id)
+			return err
+		}
+	}
+
+	return this_.client.Write(encodeLink(LinkKind_Data, id, data))
+}
+
+// resend 重新打开会话并重发被后端拒绝的一帧, 失败时向客户端返回错误. 会话已断开时丢弃
+func (this_ *node) resend(s *session, data []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.closed || len(data) == 0 {
+		return
+	}
+
+	err := ErrNoNode
+	if this_.alive() {
+		err = this_.forward(s, data)
+	}
+
+	if err != nil {
+		log.Error("[%d:%v] resend to node %s failed: %v", s.cctx.Fd(), s.cctx.RemoteAddr(), this_.ID, err)
+		if h, _, err2 := router.Decode(data); err2 == nil {
+			reply(s.cctx, h, nil, err)
+		}
+	}
+}
+
+// onMessage 后端的消息, 在链路的读协程中调用
+func (this_ *node) onMessage(c *nw.AsyncTCPClient, msg []byte) {
+	kind, id, body, err := decodeLink(msg)
+	if err != nil {
+		log.Error("gateway node %s decode failed: %v", this_.ID, err)
+		return
+	}
+
+	svc := this_.owner.svc
+	switch kind {
+	case LinkKind_Data:
+		if err := svc.Write(id, body); err != nil {
+			log.Debug("gateway node %s push to %d failed: %v", this_.ID, id, err)
+		}
+
+	case LinkKind_Close:
+		this_.close(id)
+		if cctx := svc.GetConn(id); cctx != nil && cctx.ID() == id {
+			log.Debug("[%d:%v] closed by node %s: %s", cctx.Fd(), cctx.RemoteAddr(), this_.ID, body)
+			cctx.Close()
+		}
+
+	case LinkKind_Reset:
+		this_.close(id)
+		if s := this_.owner.sessions.Get(id); s != nil {
+			this_.resend(s, body)
+		}
+
+	default:
+		log.Error("gateway node %s unexpected frame %v", this_.ID, kind)
+	}
+}
@@ -0,0 +1,72 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// LinkKind 内部链路的帧类型
+type LinkKind uint8
+
+const (
+	LinkKind_Open  LinkKind = 1 // 网关 => 后端, 在节点上打开会话, 消息体为 SessionInfo 的 json
+	LinkKind_Data  LinkKind = 2 // 双向, 消息体为客户端的一帧
+	LinkKind_Close LinkKind = 3 // 双向, 网关发送表示客户端已断开, 后端发送表示关闭客户端连接. 消息体为原因, 可以为空
+	LinkKind_Reset LinkKind = 4 // 后端 => 网关, 后端没有该会话 (如链路重连后), 消息体为被拒绝的一帧. 网关重新打开会话后重发该帧
+)
+
+func (this_ LinkKind) String() string {
+	switch this_ {
+	case LinkKind_Open:
+		return "open"
+	case LinkKind_Data:
+		return "data"
+	case LinkKind_Close:
+		return "close"
+	case LinkKind_Reset:
+		return "reset"
+	}
+
+	return "unknown"
+}
+
+// LINK_HEADER_SIZE 内部链路的帧头长度
+//
+// 网关与后端之间的一条 tcp 连接承载多个客户端会话, 每条 nw 消息为一帧.
+// 帧格式(大端): KIND[uint8] + SESSION[uint64] + BODY, SESSION 为客户端在网关上的连接ID
+const LINK_HEADER_SIZE = 9
+
+var ErrInvalidLinkFrame = errors.New("invalid link frame")
+
+// SessionInfo 会话信息, 打开会话时由网关发给后端
+type SessionInfo struct {
+	ID         uint64 `json:"id"`                 // 客户端在网关上的连接ID
+	Identity   string `json:"identity,omitempty"` // 认证得到的身份, 未设置认证时为空
+	RemoteAddr string `json:"remote_addr"`        // 客户端地址
+	Protocol   string `json:"protocol"`           // 客户端使用的协议
+}
+
+// encodeLink 编码内部链路的帧
+func encodeLink(kind LinkKind, session uint64, body []byte) []byte {
+	data := make([]byte, LINK_HEADER_SIZE+len(body))
+	data[0] = byte(kind)
+	binary.BigEndian.PutUint64(data[1:], session)
+	copy(data[LINK_HEADER_SIZE:], body)
+	return data
+}
+
+// decodeLink 解码内部链路的帧, 返回的消息体引用 data
+func decodeLink(data []byte) (LinkKind, uint64, []byte, error) {
+	if len(data) < LINK_HEADER_SIZE {
+		return 0, 0, nil, ErrInvalidLinkFrame
+	}
+
+	return LinkKind(data[0]), binary.BigEndian.Uint64(data[1:]), data[LINK_HEADER_SIZE:], nil
+}
+
+// encodeOpen 编码打开会话的帧
+func encodeOpen(info *SessionInfo) []byte {
+	body, _ := json.Marshal(info)
+	return encodeLink(LinkKind_Open, info.ID, body)
+}
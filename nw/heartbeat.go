@@ -0,0 +1,93 @@
+package nw
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// tcp 心跳帧
+//
+// 只有开启心跳标志的长度前缀编解码器支持. 长度头的最高位为心跳标志, 消息体为 类型[1] + 时间戳[8](大端, 纳秒).
+// 应答帧原样带回请求帧的时间戳, 由发起方计算 RTT. 建立加密会话后消息体与数据帧一样加密
+const (
+	TCP_HEARTBEAT_FLAG    = uint32(1) << 31                   // 默认 4 字节消息头中的心跳标志
+	HEARTBEAT_PING        = byte(1)                           // 心跳请求
+	HEARTBEAT_PONG        = byte(2)                           // 心跳应答
+	HEARTBEAT_SIZE        = 9                                 // 心跳消息体长度
+	HEARTBEAT_SEALED_SIZE = HEARTBEAT_SIZE + SESSION_TAG_SIZE // 加密后的心跳消息体长度
+)
+
+// heartbeatBody 心跳消息体
+func heartbeatBody(kind byte, ts int64) []byte {
+	body := make([]byte, HEARTBEAT_SIZE)
+	body[0] = kind
+	binary.BigEndian.PutUint64(body[1:], uint64(ts))
+	return body
+}
+
+// encodeHeartbeat 编码 tcp 心跳帧
+//   - body: 心跳消息体, 建立加密会话后为密文
+func (this_ *LengthCodec) encodeHeartbeat(body []byte) []byte {
+	buf := &Buffer{}
+	this_.writeHeader(buf, this_.heartbeatFlag()|uint64(len(body)))
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// readHeartbeat 检查 data 开头是否为心跳帧, 是心跳帧时返回消息体和整帧长度, 数据不足一帧时 n 为 0
+func (this_ *LengthCodec) readHeartbeat(data []byte) (body []byte, n int, ok bool, err error) {
+	if len(data) < this_.Width {
+		return nil, 0, false, nil
+	}
+
+	header := this_.readHeader(data)
+	if header&this_.heartbeatFlag() == 0 {
+		return nil, 0, false, nil
+	}
+
+	size := int(header &^ this_.heartbeatFlag())
+	if size != HEARTBEAT_SIZE && size != HEARTBEAT_SEALED_SIZE {
+		return nil, 0, true, errors.New("invalid heartbeat frame")
+	}
+
+	n = this_.Width + size
+	if len(data) < n {
+		return nil, 0, true, nil
+	}
+
+	return data[this_.Width:n], n, true, nil
+}
+
+// decodeHeartbeat 解码心跳消息体
+func decodeHeartbeat(body []byte) (byte, int64, bool) {
+	if len(body) != HEARTBEAT_SIZE {
+		return 0, 0, false
+	}
+
+	return body[0], int64(binary.BigEndian.Uint64(body[1:])), true
+}
+
+// heartbeatInterval 客户端发送心跳的周期, 需要小于读超时
+func heartbeatInterval(timeout time.Duration) time.Duration {
+	if timeout > 0 && timeout/3 < HEART_BEAT_INTERVAL {
+		return timeout / 3
+	}
+
+	return HEART_BEAT_INTERVAL
+}
+
+// rtt 根据心跳应答中的时间戳计算往返时间
+func rtt(ts int64) int64 {
+	d := time.Now().UnixNano() - ts
+	if d < 0 {
+		return 0
+	}
+
+	return d
+}
+
+// pinger 支持心跳的服务
+type pinger interface {
+	ping(cctx *ConnContext) error // 发送心跳请求
+}
@@ -0,0 +1,171 @@
+package nw
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/gox/frm/log"
+)
+
+// IdleState 连接空闲类型
+type IdleState int
+
+const (
+	IdleState_Read  IdleState = 1 // 超过 ReadIdle 没有收到数据
+	IdleState_Write IdleState = 2 // 超过 WriteIdle 没有发送数据
+	IdleState_All   IdleState = 3 // 超过 AllIdle 既没有收到也没有发送数据
+)
+
+func (this_ IdleState) String() string {
+	switch this_ {
+	case IdleState_Read:
+		return "read"
+	case IdleState_Write:
+		return "write"
+	case IdleState_All:
+		return "all"
+	}
+
+	return "unknown"
+}
+
+// idleConfig 空闲检测配置, 单位秒, 0 表示不检测
+type idleConfig struct {
+	read  int64 // 读空闲超时
+	write int64 // 写空闲超时
+	all   int64 // 读写空闲超时
+	ping  int64 // 心跳周期, 0 表示不发送心跳
+}
+
+func newIdleConfig(c *Config) idleConfig {
+	conf := idleConfig{
+		read:  c.ReadIdle,
+		write: c.WriteIdle,
+		all:   c.AllIdle,
+	}
+
+	if conf.read <= 0 {
+		conf.read = c.Timeout
+	}
+
+	if c.Heartbeat {
+		conf.ping = c.HeartbeatInterval
+		if conf.ping <= 0 {
+			conf.ping = int64(HEART_BEAT_INTERVAL / time.Second)
+		}
+	}
+
+	return conf
+}
+
+// first 连接建立后第一次检查的间隔
+func (this_ *idleConfig) first() int64 {
+	next := int64(math.MaxInt64)
+	for _, d := range [...]int64{this_.read, this_.write, this_.all, this_.ping} {
+		if d > 0 && d < next {
+			next = d
+		}
+	}
+
+	return next
+}
+
+// watchIdle 开始检测连接空闲
+func (this_ *baseServer) watchIdle(cctx *ConnContext) {
+	next := this_.owner.idle.first()
+	if next == math.MaxInt64 {
+		return
+	}
+
+	if cctx.idle.task == nil {
+		cctx.idle.task = func() { this_.checkIdle(cctx) }
+	}
+
+	this_.wheel.schedule(&cctx.idle, time.Duration(next)*time.Second)
+}
+
+// watchHandshake 开始检测协议握手超时, 握手完成后由 watchIdle 重新设置同一个定时器
+func (this_ *baseServer) watchHandshake(cctx *ConnContext) {
+	if cctx.idle.task == nil {
+		cctx.idle.task = func() { this_.checkIdle(cctx) }
+	}
+
+	this_.wheel.schedule(&cctx.idle, HANDSHAKE_TIMEOUT)
+}
+
+// checkIdle 连接的定时器到期, 检查各项空闲超时并发送心跳, 然后按最近的截止时间重新设置定时器
+//
+// 活跃的连接只更新时间戳, 定时器到期时才计算实际的截止时间, 避免每次收发都调整时间轮
+func (this_ *baseServer) checkIdle(cctx *ConnContext) {
+	// 连接已关闭
+	if cctx.ID() == 0 {
+		return
+	}
+
+	if cctx.pending.Load() {
+		log.Warn("[%d:%v] handshake timeout, close", cctx.Fd(), cctx.RemoteAddr())
+		cctx.Close()
+		return
+	}
+
+	// 断开后保留的会话
+	if cctx.resume != nil && this_.expire(cctx) {
+		return
+	}
+
+	var (
+		conf  = &this_.owner.idle
+		now   = time.Now().Unix()
+		read  = atomic.LoadInt64(&cctx.lastUpdate)
+		write = atomic.LoadInt64(&cctx.lastWrite)
+		next  = int64(math.MaxInt64)
+	)
+
+	checks := [...]struct {
+		state   IdleState
+		timeout int64
+		last    int64
+	}{
+		{IdleState_Read, conf.read, read},
+		{IdleState_Write, conf.write, write},
+		{IdleState_All, conf.all, max(read, write)},
+	}
+
+	for _, check := range checks {
+		if check.timeout <= 0 {
+			continue
+		}
+
+		// 事件处理后保持的连接以上次触发的时间作为新的起点, 避免每个 tick 重复触发
+		last := max(check.last, cctx.idleAt[check.state-1])
+		if now-last < check.timeout {
+			next = min(next, last+check.timeout)
+			continue
+		}
+
+		if !this_.owner.event.OnIdle(cctx, check.state) {
+			log.Debug("[%d:%v] %v idle timeout, close", cctx.Fd(), cctx.RemoteAddr(), check.state)
+			cctx.Close()
+			return
+		}
+
+		cctx.idleAt[check.state-1] = now
+		next = min(next, now+check.timeout)
+	}
+
+	if p, ok := this_.server.(pinger); ok && conf.ping > 0 {
+		if cctx.upgraded.Load() && now-cctx.lastPing >= conf.ping {
+			if err := p.ping(cctx); err != nil {
+				log.Warn("[%d:%v] ping failed: %v", cctx.Fd(), cctx.RemoteAddr(), err)
+			}
+			cctx.lastPing = now
+		}
+
+		next = min(next, max(cctx.lastPing+conf.ping, now+1))
+	}
+
+	if next != math.MaxInt64 {
+		this_.wheel.schedule(&cctx.idle, time.Duration(next-now)*time.Second)
+	}
+}
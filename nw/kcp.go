@@ -0,0 +1,741 @@
+package nw
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// kcp 协议常量
+const (
+	KCP_RTO_NDL     = 30     // nodelay 模式下最小 rto
+	KCP_RTO_MIN     = 100    // 普通模式下最小 rto
+	KCP_RTO_DEF     = 200    // 默认 rto
+	KCP_RTO_MAX     = 60000  // 最大 rto
+	KCP_CMD_PUSH    = 81     // 数据
+	KCP_CMD_ACK     = 82     // 确认
+	KCP_CMD_WASK    = 83     // 询问窗口
+	KCP_CMD_WINS    = 84     // 告知窗口
+	KCP_ASK_SEND    = 1      // 需要发送 WASK
+	KCP_ASK_TELL    = 2      // 需要发送 WINS
+	KCP_WND_SND     = 128    // 默认发送窗口
+	KCP_WND_RCV     = 128    // 默认接收窗口
+	KCP_MTU_DEF     = 1400   // 默认 mtu
+	KCP_INTERVAL    = 10     // 默认刷新间隔(毫秒)
+	KCP_OVERHEAD    = 24     // 分片头长度
+	KCP_DEADLINK    = 20     // 重传多少次后视为断开
+	KCP_THRESH_INIT = 2      // 初始慢启动阈值
+	KCP_THRESH_MIN  = 2      // 最小慢启动阈值
+	KCP_PROBE_INIT  = 7000   // 初始窗口探测时间
+	KCP_PROBE_LIMIT = 120000 // 最大窗口探测时间
+	KCP_FASTRESEND  = 2      // 快速重传阈值
+	KCP_FRG_MAX     = 255    // 单条消息最大分片数
+)
+
+var (
+	ErrKcpInvalidPacket   = errors.New("kcp invalid packet")
+	ErrKcpConvMismatch    = errors.New("kcp conv mismatch")
+	ErrKcpMessageTooLarge = errors.New("kcp message too large")
+	ErrKcpClosed          = errors.New("kcp session closed")
+)
+
+// kcpClock kcp 使用的毫秒时钟
+func kcpClock() uint32 {
+	return uint32(time.Now().UnixMilli())
+}
+
+// kcpTimediff 计算回绕安全的时间差
+func kcpTimediff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+// kcpSegment kcp 分片
+//
+// 分片格式(小端): conv[4] + cmd[1] + frg[1] + wnd[2] + ts[4] + sn[4] + una[4] + len[4] + DATA
+type kcpSegment struct {
+	conv     uint32
+	cmd      uint8
+	frg      uint8
+	wnd      uint16
+	ts       uint32
+	sn       uint32
+	una      uint32
+	rto      uint32
+	xmit     uint32
+	resendts uint32
+	fastack  uint32
+	data     []byte
+}
+
+// encode 将分片头写入 buf, 返回写入后的偏移
+func (this_ *kcpSegment) encode(buf []byte, offset int) int {
+	binary.LittleEndian.PutUint32(buf[offset:], this_.conv)
+	buf[offset+4] = this_.cmd
+	buf[offset+5] = this_.frg
+	binary.LittleEndian.PutUint16(buf[offset+6:], this_.wnd)
+	binary.LittleEndian.PutUint32(buf[offset+8:], this_.ts)
+	binary.LittleEndian.PutUint32(buf[offset+12:], this_.sn)
+	binary.LittleEndian.PutUint32(buf[offset+16:], this_.una)
+	binary.LittleEndian.PutUint32(buf[offset+20:], uint32(len(this_.data)))
+	return offset + KCP_OVERHEAD
+}
+
+type kcpAck struct {
+	sn uint32
+	ts uint32
+}
+
+// kcp ARQ 会话
+//
+// 提供序列号, 确认, 超时重传, 快速重传和拥塞窗口, 在不可靠的数据报之上实现有序可靠的消息传输.
+// kcp 本身不是并发安全的, 调用方需持有 mtx
+type kcp struct {
+	mtx sync.Mutex
+
+	conv, mtu, mss, state      uint32
+	sndUna, sndNxt, rcvNxt     uint32
+	ssthresh                   uint32
+	rxRttvar, rxSrtt           int32
+	rxRto, rxMinrto            uint32
+	sndWnd, rcvWnd, rmtWnd     uint32
+	cwnd, probe                uint32
+	current, interval, tsFlush uint32
+	nodelay, updated           bool
+	tsProbe, probeWait         uint32
+	deadLink, incr             uint32
+	fastresend                 uint32
+	nocwnd                     bool
+
+	sndQueue []kcpSegment
+	rcvQueue []kcpSegment
+	sndBuf   []kcpSegment
+	rcvBuf   []kcpSegment
+	ackList  []kcpAck
+	buffer   []byte
+	output   func([]byte) // 数据报输出
+}
+
+// newKcp 创建 kcp 会话, 使用低延迟模式
+//   - conv: 会话编号, 通信双方必须一致
+//   - nc: 是否关闭拥塞控制, 关闭后发送只受收发窗口限制
+//   - output: 数据报输出函数, 调用返回后 buf 会被复用
+func newKcp(conv uint32, nc bool, output func([]byte)) *kcp {
+	this_ := &kcp{
+		conv:     conv,
+		mtu:      KCP_MTU_DEF,
+		mss:      KCP_MTU_DEF - KCP_OVERHEAD,
+		sndWnd:   KCP_WND_SND,
+		rcvWnd:   KCP_WND_RCV,
+		rmtWnd:   KCP_WND_RCV,
+		rxRto:    KCP_RTO_DEF,
+		rxMinrto: KCP_RTO_MIN,
+		interval: KCP_INTERVAL,
+		tsFlush:  KCP_INTERVAL,
+		ssthresh: KCP_THRESH_INIT,
+		deadLink: KCP_DEADLINK,
+		buffer:   make([]byte, (KCP_MTU_DEF+KCP_OVERHEAD)*3),
+		output:   output,
+	}
+
+	this_.setNoDelay(true, KCP_INTERVAL, KCP_FASTRESEND, nc)
+	return this_
+}
+
+// setNoDelay 设置工作模式
+//   - nodelay: 是否启用 nodelay, 启用后 rto 最小值更小且超时退避更慢
+//   - interval: 刷新间隔(毫秒)
+//   - resend: 快速重传阈值, 0 表示关闭
+//   - nc: 是否关闭拥塞控制
+func (this_ *kcp) setNoDelay(nodelay bool, interval, resend uint32, nc bool) {
+	this_.nodelay = nodelay
+	if nodelay {
+		this_.rxMinrto = KCP_RTO_NDL
+	} else {
+		this_.rxMinrto = KCP_RTO_MIN
+	}
+
+	if interval > 5000 {
+		interval = 5000
+	} else if interval < 10 {
+		interval = 10
+	}
+
+	this_.interval = interval
+	this_.fastresend = resend
+	this_.nocwnd = nc
+}
+
+// dead 连接是否因重传次数过多而失效
+func (this_ *kcp) dead() bool {
+	return this_.state != 0
+}
+
+// waitSnd 等待发送的分片数
+func (this_ *kcp) waitSnd() int {
+	return len(this_.sndBuf) + len(this_.sndQueue)
+}
+
+// peekSize 接收队列中下一条完整消息的长度, 不完整时返回 -1
+func (this_ *kcp) peekSize() int {
+	if len(this_.rcvQueue) == 0 {
+		return -1
+	}
+
+	seg := &this_.rcvQueue[0]
+	if seg.frg == 0 {
+		return len(seg.data)
+	}
+
+	if len(this_.rcvQueue) < int(seg.frg)+1 {
+		return -1
+	}
+
+	length := 0
+	for i := range this_.rcvQueue {
+		length += len(this_.rcvQueue[i].data)
+		if this_.rcvQueue[i].frg == 0 {
+			break
+		}
+	}
+
+	return length
+}
+
+// recv 取出一条完整消息, 没有时返回 nil
+func (this_ *kcp) recv() []byte {
+	size := this_.peekSize()
+	if size < 0 {
+		return nil
+	}
+
+	recover := len(this_.rcvQueue) >= int(this_.rcvWnd)
+
+	data := make([]byte, 0, size)
+	count := 0
+	for i := range this_.rcvQueue {
+		seg := &this_.rcvQueue[i]
+		data = append(data, seg.data...)
+		count++
+		if seg.frg == 0 {
+			break
+		}
+	}
+
+	this_.rcvQueue = this_.rcvQueue[count:]
+	this_.moveRcvBuf()
+
+	// 接收窗口由满变为有空闲时, 主动告知对端
+	if len(this_.rcvQueue) < int(this_.rcvWnd) && recover {
+		this_.probe |= KCP_ASK_TELL
+	}
+
+	return data
+}
+
+// send 将消息分片后放入发送队列
+func (this_ *kcp) send(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	count := (len(data) + int(this_.mss) - 1) / int(this_.mss)
+	if count > KCP_FRG_MAX {
+		return ErrKcpMessageTooLarge
+	}
+
+	for i := 0; i < count; i++ {
+		size := len(data)
+		if size > int(this_.mss) {
+			size = int(this_.mss)
+		}
+
+		seg := kcpSegment{
+			data: append([]byte(nil), data[:size]...),
+			frg:  uint8(count - i - 1),
+		}
+		this_.sndQueue = append(this_.sndQueue, seg)
+		data = data[size:]
+	}
+
+	return nil
+}
+
+// kcpCheck 检查数据报中的分片是否完整且属于同一会话, 不修改会话状态
+//
+// 返回会话编号, 以及是否包含序号为 0 的数据分片. 新会话的第一个数据分片序号总是 0
+func kcpCheck(data []byte) (conv uint32, first bool, err error) {
+	if len(data) < KCP_OVERHEAD {
+		return 0, false, ErrKcpInvalidPacket
+	}
+
+	conv = binary.LittleEndian.Uint32(data)
+	for len(data) > 0 {
+		if len(data) < KCP_OVERHEAD {
+			return 0, false, ErrKcpInvalidPacket
+		}
+
+		cmd := data[4]
+		sn := binary.LittleEndian.Uint32(data[12:])
+		length := binary.LittleEndian.Uint32(data[20:])
+		if binary.LittleEndian.Uint32(data) != conv {
+			return 0, false, ErrKcpConvMismatch
+		}
+
+		if cmd < KCP_CMD_PUSH || cmd > KCP_CMD_WINS || uint32(len(data)-KCP_OVERHEAD) < length {
+			return 0, false, ErrKcpInvalidPacket
+		}
+
+		if cmd == KCP_CMD_PUSH && sn == 0 {
+			first = true
+		}
+
+		data = data[KCP_OVERHEAD+int(length):]
+	}
+
+	return conv, first, nil
+}
+
+// input 处理收到的数据报
+func (this_ *kcp) input(data []byte) error {
+	if len(data) < KCP_OVERHEAD {
+		return ErrKcpInvalidPacket
+	}
+
+	var (
+		prevUna = this_.sndUna
+		maxack  uint32
+		latest  uint32
+		flag    bool
+	)
+
+	for len(data) >= KCP_OVERHEAD {
+		conv := binary.LittleEndian.Uint32(data)
+		cmd := data[4]
+		frg := data[5]
+		wnd := binary.LittleEndian.Uint16(data[6:])
+		ts := binary.LittleEndian.Uint32(data[8:])
+		sn := binary.LittleEndian.Uint32(data[12:])
+		una := binary.LittleEndian.Uint32(data[16:])
+		length := binary.LittleEndian.Uint32(data[20:])
+		data = data[KCP_OVERHEAD:]
+
+		if conv != this_.conv {
+			return ErrKcpConvMismatch
+		}
+
+		if uint32(len(data)) < length {
+			return ErrKcpInvalidPacket
+		}
+
+		if cmd < KCP_CMD_PUSH || cmd > KCP_CMD_WINS {
+			return ErrKcpInvalidPacket
+		}
+
+		this_.rmtWnd = uint32(wnd)
+		this_.parseUna(una)
+		this_.shrinkBuf()
+
+		switch cmd {
+		case KCP_CMD_ACK:
+			if rtt := kcpTimediff(this_.current, ts); rtt >= 0 {
+				this_.updateAck(rtt)
+			}
+
+			this_.parseAck(sn)
+			this_.shrinkBuf()
+
+			if !flag {
+				flag = true
+				maxack, latest = sn, ts
+			} else if kcpTimediff(sn, maxack) > 0 {
+				maxack, latest = sn, ts
+			}
+
+		case KCP_CMD_PUSH:
+			if kcpTimediff(sn, this_.rcvNxt+this_.rcvWnd) < 0 {
+				this_.ackList = append(this_.ackList, kcpAck{sn: sn, ts: ts})
+				if kcpTimediff(sn, this_.rcvNxt) >= 0 {
+					this_.parseData(kcpSegment{
+						conv: conv,
+						cmd:  cmd,
+						frg:  frg,
+						wnd:  wnd,
+						ts:   ts,
+						sn:   sn,
+						una:  una,
+						data: append([]byte(nil), data[:length]...),
+					})
+				}
+			}
+
+		case KCP_CMD_WASK:
+			this_.probe |= KCP_ASK_TELL
+
+		case KCP_CMD_WINS:
+			// 仅更新远端窗口, 已在上面处理
+		}
+
+		data = data[length:]
+	}
+
+	if flag {
+		this_.parseFastack(maxack, latest)
+	}
+
+	// 有新的确认, 扩大拥塞窗口
+	if kcpTimediff(this_.sndUna, prevUna) > 0 && this_.cwnd < this_.rmtWnd {
+		mss := this_.mss
+		if this_.cwnd < this_.ssthresh {
+			this_.cwnd++
+			this_.incr += mss
+		} else {
+			if this_.incr < mss {
+				this_.incr = mss
+			}
+
+			this_.incr += (mss*mss)/this_.incr + (mss / 16)
+			if (this_.cwnd+1)*mss <= this_.incr {
+				this_.cwnd = (this_.incr + mss - 1) / mss
+			}
+		}
+
+		if this_.cwnd > this_.rmtWnd {
+			this_.cwnd = this_.rmtWnd
+			this_.incr = this_.rmtWnd * mss
+		}
+	}
+
+	return nil
+}
+
+// update 驱动 kcp 状态, 需要以 interval 为周期调用
+func (this_ *kcp) update(current uint32) {
+	this_.current = current
+	if !this_.updated {
+		this_.updated = true
+		this_.tsFlush = current
+	}
+
+	slap := kcpTimediff(current, this_.tsFlush)
+	if slap >= 10000 || slap < -10000 {
+		this_.tsFlush = current
+		slap = 0
+	}
+
+	if slap >= 0 {
+		this_.tsFlush += this_.interval
+		if kcpTimediff(current, this_.tsFlush) >= 0 {
+			this_.tsFlush = current + this_.interval
+		}
+
+		this_.flush()
+	}
+}
+
+// flush 发送确认, 窗口探测以及待发送/需重传的分片
+func (this_ *kcp) flush() {
+	var (
+		current = this_.current
+		buffer  = this_.buffer
+		ptr     = 0
+	)
+
+	makeSpace := func(space int) {
+		if ptr+space > int(this_.mtu) {
+			this_.output(buffer[:ptr])
+			ptr = 0
+		}
+	}
+
+	seg := kcpSegment{
+		conv: this_.conv,
+		cmd:  KCP_CMD_ACK,
+		wnd:  this_.wndUnused(),
+		una:  this_.rcvNxt,
+	}
+
+	// 确认
+	for _, ack := range this_.ackList {
+		makeSpace(KCP_OVERHEAD)
+		seg.sn, seg.ts = ack.sn, ack.ts
+		ptr = seg.encode(buffer, ptr)
+	}
+	this_.ackList = this_.ackList[:0]
+
+	// 远端窗口为 0 时探测窗口
+	if this_.rmtWnd == 0 {
+		if this_.probeWait == 0 {
+			this_.probeWait = KCP_PROBE_INIT
+			this_.tsProbe = current + this_.probeWait
+		} else if kcpTimediff(current, this_.tsProbe) >= 0 {
+			if this_.probeWait < KCP_PROBE_INIT {
+				this_.probeWait = KCP_PROBE_INIT
+			}
+
+			this_.probeWait += this_.probeWait / 2
+			if this_.probeWait > KCP_PROBE_LIMIT {
+				this_.probeWait = KCP_PROBE_LIMIT
+			}
+
+			this_.tsProbe = current + this_.probeWait
+			this_.probe |= KCP_ASK_SEND
+		}
+	} else {
+		this_.tsProbe = 0
+		this_.probeWait = 0
+	}
+
+	seg.sn, seg.ts = 0, 0
+	if this_.probe&KCP_ASK_SEND != 0 {
+		seg.cmd = KCP_CMD_WASK
+		makeSpace(KCP_OVERHEAD)
+		ptr = seg.encode(buffer, ptr)
+	}
+
+	if this_.probe&KCP_ASK_TELL != 0 {
+		seg.cmd = KCP_CMD_WINS
+		makeSpace(KCP_OVERHEAD)
+		ptr = seg.encode(buffer, ptr)
+	}
+	this_.probe = 0
+
+	// 计算发送窗口
+	cwnd := this_.sndWnd
+	if this_.rmtWnd < cwnd {
+		cwnd = this_.rmtWnd
+	}
+
+	if !this_.nocwnd && this_.cwnd < cwnd {
+		cwnd = this_.cwnd
+	}
+
+	// 将发送队列中的分片移入发送缓冲区
+	for kcpTimediff(this_.sndNxt, this_.sndUna+cwnd) < 0 && len(this_.sndQueue) > 0 {
+		newseg := this_.sndQueue[0]
+		this_.sndQueue = this_.sndQueue[1:]
+
+		newseg.conv = this_.conv
+		newseg.cmd = KCP_CMD_PUSH
+		newseg.sn = this_.sndNxt
+		this_.sndBuf = append(this_.sndBuf, newseg)
+		this_.sndNxt++
+	}
+
+	resent := this_.fastresend
+	if resent == 0 {
+		resent = 0xffffffff
+	}
+
+	rtomin := uint32(0)
+	if !this_.nodelay {
+		rtomin = this_.rxRto >> 3
+	}
+
+	change, lost := false, false
+	for i := range this_.sndBuf {
+		segment := &this_.sndBuf[i]
+		needsend := false
+
+		if segment.xmit == 0 {
+			// 首次发送
+			needsend = true
+			segment.rto = this_.rxRto
+			segment.resendts = current + segment.rto + rtomin
+		} else if kcpTimediff(current, segment.resendts) >= 0 {
+			// 超时重传
+			needsend = true
+			if this_.nodelay {
+				segment.rto += this_.rxRto / 2
+			} else {
+				segment.rto += max(segment.rto, this_.rxRto)
+			}
+			segment.resendts = current + segment.rto
+			lost = true
+		} else if segment.fastack >= resent {
+			// 快速重传
+			needsend = true
+			segment.fastack = 0
+			segment.resendts = current + segment.rto
+			change = true
+		}
+
+		if needsend {
+			segment.xmit++
+			segment.ts = current
+			segment.wnd = seg.wnd
+			segment.una = this_.rcvNxt
+
+			makeSpace(KCP_OVERHEAD + len(segment.data))
+			ptr = segment.encode(buffer, ptr)
+			ptr += copy(buffer[ptr:], segment.data)
+
+			if segment.xmit >= this_.deadLink {
+				this_.state = 0xffffffff
+			}
+		}
+	}
+
+	if ptr > 0 {
+		this_.output(buffer[:ptr])
+	}
+
+	// 快速重传后调整拥塞窗口
+	if change {
+		inflight := this_.sndNxt - this_.sndUna
+		this_.ssthresh = max(inflight/2, KCP_THRESH_MIN)
+		this_.cwnd = this_.ssthresh + resent
+		this_.incr = this_.cwnd * this_.mss
+	}
+
+	// 超时重传后进入慢启动
+	if lost {
+		this_.ssthresh = max(cwnd/2, KCP_THRESH_MIN)
+		this_.cwnd = 1
+		this_.incr = this_.mss
+	}
+
+	if this_.cwnd < 1 {
+		this_.cwnd = 1
+		this_.incr = this_.mss
+	}
+}
+
+// wndUnused 接收窗口剩余大小
+func (this_ *kcp) wndUnused() uint16 {
+	if len(this_.rcvQueue) < int(this_.rcvWnd) {
+		return uint16(int(this_.rcvWnd) - len(this_.rcvQueue))
+	}
+
+	return 0
+}
+
+// updateAck 根据 rtt 样本更新 rto
+func (this_ *kcp) updateAck(rtt int32) {
+	if this_.rxSrtt == 0 {
+		this_.rxSrtt = rtt
+		this_.rxRttvar = rtt / 2
+	} else {
+		delta := rtt - this_.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+
+		this_.rxRttvar = (3*this_.rxRttvar + delta) / 4
+		this_.rxSrtt = (7*this_.rxSrtt + rtt) / 8
+		if this_.rxSrtt < 1 {
+			this_.rxSrtt = 1
+		}
+	}
+
+	rto := uint32(this_.rxSrtt) + max(this_.interval, uint32(4*this_.rxRttvar))
+	this_.rxRto = min(max(this_.rxMinrto, rto), KCP_RTO_MAX)
+}
+
+// shrinkBuf 更新 sndUna
+func (this_ *kcp) shrinkBuf() {
+	if len(this_.sndBuf) > 0 {
+		this_.sndUna = this_.sndBuf[0].sn
+	} else {
+		this_.sndUna = this_.sndNxt
+	}
+}
+
+// parseAck 移除被确认的分片
+func (this_ *kcp) parseAck(sn uint32) {
+	if kcpTimediff(sn, this_.sndUna) < 0 || kcpTimediff(sn, this_.sndNxt) >= 0 {
+		return
+	}
+
+	for i := range this_.sndBuf {
+		if sn == this_.sndBuf[i].sn {
+			this_.sndBuf = append(this_.sndBuf[:i], this_.sndBuf[i+1:]...)
+			break
+		}
+
+		if kcpTimediff(sn, this_.sndBuf[i].sn) < 0 {
+			break
+		}
+	}
+}
+
+// parseUna 移除 una 之前的所有分片
+func (this_ *kcp) parseUna(una uint32) {
+	count := 0
+	for i := range this_.sndBuf {
+		if kcpTimediff(una, this_.sndBuf[i].sn) <= 0 {
+			break
+		}
+		count++
+	}
+
+	if count > 0 {
+		this_.sndBuf = this_.sndBuf[count:]
+	}
+}
+
+// parseFastack 统计被跳过确认的次数, 用于快速重传
+func (this_ *kcp) parseFastack(sn, ts uint32) {
+	if kcpTimediff(sn, this_.sndUna) < 0 || kcpTimediff(sn, this_.sndNxt) >= 0 {
+		return
+	}
+
+	for i := range this_.sndBuf {
+		seg := &this_.sndBuf[i]
+		if kcpTimediff(sn, seg.sn) < 0 {
+			break
+		}
+
+		if sn != seg.sn && kcpTimediff(ts, seg.ts) >= 0 {
+			seg.fastack++
+		}
+	}
+}
+
+// parseData 将数据分片放入接收缓冲区并按序移入接收队列
+func (this_ *kcp) parseData(newseg kcpSegment) {
+	sn := newseg.sn
+	if kcpTimediff(sn, this_.rcvNxt+this_.rcvWnd) >= 0 || kcpTimediff(sn, this_.rcvNxt) < 0 {
+		return
+	}
+
+	// 从后向前查找插入位置
+	insert := len(this_.rcvBuf)
+	for i := len(this_.rcvBuf) - 1; i >= 0; i-- {
+		seg := &this_.rcvBuf[i]
+		if seg.sn == sn {
+			return // 重复分片
+		}
+
+		if kcpTimediff(sn, seg.sn) > 0 {
+			break
+		}
+
+		insert = i
+	}
+
+	this_.rcvBuf = append(this_.rcvBuf, kcpSegment{})
+	copy(this_.rcvBuf[insert+1:], this_.rcvBuf[insert:])
+	this_.rcvBuf[insert] = newseg
+
+	this_.moveRcvBuf()
+}
+
+// moveRcvBuf 将接收缓冲区中连续的分片移入接收队列
+func (this_ *kcp) moveRcvBuf() {
+	count := 0
+	for i := range this_.rcvBuf {
+		seg := &this_.rcvBuf[i]
+		if seg.sn != this_.rcvNxt || len(this_.rcvQueue) >= int(this_.rcvWnd) {
+			break
+		}
+
+		this_.rcvQueue = append(this_.rcvQueue, *seg)
+		this_.rcvNxt++
+		count++
+	}
+
+	if count > 0 {
+		this_.rcvBuf = this_.rcvBuf[count:]
+	}
+}
@@ -0,0 +1,188 @@
+package nw
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// KcpClient KCP(可靠udp)客户端
+//
+// 与 kcpServer 配合使用, 用法与 AsyncTCPClient 一致
+type KcpClient struct {
+	conn      *net.UDPConn
+	kcp       *kcp
+	readCh    chan []byte
+	closeCh   chan struct{}
+	wg        sync.WaitGroup
+	timeout   time.Duration
+	closeOnce sync.Once
+}
+
+// KcpClientConfig kcp 客户端配置
+type KcpClientConfig struct {
+	Timeout      time.Duration // 读超时, 超过该时间没有收到任何数据报则关闭客户端, 0 表示不超时
+	NoCongestion bool          // 是否关闭拥塞控制, 与服务端的 Config.KcpNoCongestion 对应
+}
+
+// NewKcpClient 创建 KCP 客户端
+//   - host: 服务端地址
+//   - timeout: 读超时, 超过该时间没有收到任何数据报则关闭客户端, 0 表示不超时
+func NewKcpClient(host string, timeout time.Duration) (*KcpClient, error) {
+	return NewKcpClientWithConfig(host, &KcpClientConfig{Timeout: timeout})
+}
+
+// NewKcpClientWithConfig 根据配置创建 KCP 客户端
+func NewKcpClientWithConfig(host string, c *KcpClientConfig) (*KcpClient, error) {
+	raddr, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var b [4]byte
+	if _, err = rand.Read(b[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	client := &KcpClient{
+		conn:    conn,
+		readCh:  make(chan []byte, 1024),
+		closeCh: make(chan struct{}),
+		timeout: c.Timeout,
+	}
+
+	client.kcp = newKcp(binary.LittleEndian.Uint32(b[:]), c.NoCongestion, func(buf []byte) {
+		conn.Write(buf)
+	})
+
+	client.wg.Add(2)
+	go client.readLoop()
+	go client.updateLoop()
+	return client, nil
+}
+
+// Write 发送消息
+func (c *KcpClient) Write(msg []byte) error {
+	select {
+	case <-c.closeCh:
+		return ErrKcpClosed
+	default:
+	}
+
+	c.kcp.mtx.Lock()
+	defer c.kcp.mtx.Unlock()
+
+	err := c.kcp.send(msg)
+	if err != nil {
+		return err
+	}
+
+	c.kcp.current = kcpClock()
+	c.kcp.flush()
+	return nil
+}
+
+// Read 读取消息
+func (c *KcpClient) Read() ([]byte, error) {
+	select {
+	case msg, ok := <-c.readCh:
+		if !ok {
+			return nil, io.EOF
+		}
+		return msg, nil
+	case <-c.closeCh:
+		return nil, io.EOF
+	}
+}
+
+// WaitSnd 等待发送(含未确认)的分片数
+func (c *KcpClient) WaitSnd() int {
+	c.kcp.mtx.Lock()
+	defer c.kcp.mtx.Unlock()
+	return c.kcp.waitSnd()
+}
+
+// Close 关闭客户端
+func (c *KcpClient) Close() error {
+	c.shutdown()
+	c.wg.Wait()
+	close(c.readCh)
+	return nil
+}
+
+func (c *KcpClient) shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.closeCh)
+		c.conn.Close()
+	})
+}
+
+// 后台读协程
+func (c *KcpClient) readLoop() {
+	defer c.wg.Done()
+	buf := make([]byte, UDP_MESSAGE_MAX_SIZE)
+	for {
+		if c.timeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.shutdown()
+			return
+		}
+
+		var msgs [][]byte
+
+		c.kcp.mtx.Lock()
+		err = c.kcp.input(buf[:n])
+		if err == nil {
+			for msg := c.kcp.recv(); msg != nil; msg = c.kcp.recv() {
+				msgs = append(msgs, msg)
+			}
+		}
+		c.kcp.mtx.Unlock()
+
+		for _, msg := range msgs {
+			select {
+			case c.readCh <- msg:
+			case <-c.closeCh:
+				return
+			}
+		}
+	}
+}
+
+// 后台驱动协程
+func (c *KcpClient) updateLoop() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(KCP_INTERVAL * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.kcp.mtx.Lock()
+			c.kcp.update(kcpClock())
+			dead := c.kcp.dead()
+			c.kcp.mtx.Unlock()
+
+			if dead {
+				c.shutdown()
+				return
+			}
+
+		case <-c.closeCh:
+			return
+		}
+	}
+}
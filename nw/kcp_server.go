@@ -0,0 +1,177 @@
+package nw
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/gox/frm/log"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// kcpServer KCP(可靠udp)服务器
+//
+// 在 udpServer 之上为每个对端维护一个 kcp 会话, 提供有序可靠的消息传输.
+// 会话编号(conv)由客户端选择, 同一地址出现新的 conv 时视为客户端重连, 旧会话将被关闭.
+// 只有格式正确且包含首个数据分片的数据报才会创建或替换会话.
+// kcp 没有断开握手, 会话在超时或重传失败后关闭
+type kcpServer struct {
+	udpServer
+	nocwnd bool // 是否关闭拥塞控制
+}
+
+// newKcpServer 创建一个新的 KCP 服务器
+//
+//   - owner: 所属服务
+//   - c: 配置
+//
+// 返回一个新的 kcpServer 实例
+func newKcpServer(owner *Service, c *Config) *kcpServer {
+	this_ := &kcpServer{nocwnd: c.KcpNoCongestion}
+
+	this_.udpServer.init(owner, this_, c.KcpHost)
+	this_.onSession = this_.newSession
+	return this_
+}
+
+// Proto 返回服务器的协议类型
+func (this_ *kcpServer) Proto() Protocol {
+	return Protocol_KCP
+}
+
+// OnTraffic 处理客户端数据报
+func (this_ *kcpServer) OnTraffic(c gnet.Conn) gnet.Action {
+	data, _ := c.Next(-1)
+
+	// 不完整或格式错误的数据报不创建会话, 也不影响已有会话
+	conv, first, err := kcpCheck(data)
+	if err != nil {
+		return gnet.None
+	}
+
+	key := c.RemoteAddr().String()
+
+	this_.mtx.Lock()
+	old := this_.sessions[key]
+	this_.mtx.Unlock()
+
+	// 新会话必须从序号为 0 的数据分片开始, 旧会话迟到的数据报不会创建或替换会话.
+	// 同一地址使用了新的 conv 时视为重连, 关闭旧会话
+	if old == nil || old.kcp.conv != conv {
+		if !first {
+			return gnet.None
+		}
+
+		if old != nil {
+			this_.Close(old)
+		}
+	}
+
+	cctx := this_.session(c, data)
+	if cctx == nil {
+		return gnet.None
+	}
+
+	cctx.countRead(len(data))
+	k := cctx.kcp
+	k.mtx.Lock()
+	err = k.input(data)
+	if err != nil {
+		k.mtx.Unlock()
+		log.Error("[%d:%v] kcp input failed: %v", cctx.Fd(), cctx.remoteAddr, err)
+		return gnet.None
+	}
+
+	var msgs [][]byte
+	for msg := k.recv(); msg != nil; msg = k.recv() {
+		msgs = append(msgs, msg)
+	}
+	k.mtx.Unlock()
+
+	// 内联分发时处理函数会在当前协程写入 kcp, 需要在释放锁之后投递
+	for _, msg := range msgs {
+		if !this_.owner.pushMessage(this_.msgPool.NewWithData(cctx, msg)) {
+			this_.Close(cctx)
+			return gnet.None
+		}
+	}
+
+	cctx.touch()
+	return gnet.None
+}
+
+// OnTick 驱动所有 kcp 会话, 并推进空闲检测时间轮和触发已关闭会话的 OnDisconnected
+func (this_ *kcpServer) OnTick() (time.Duration, gnet.Action) {
+	var (
+		current = kcpClock()
+		dead    []*ConnContext
+	)
+
+	this_.mtx.Lock()
+	cctxs := make([]*ConnContext, 0, len(this_.sessions))
+	for _, cctx := range this_.sessions {
+		cctxs = append(cctxs, cctx)
+	}
+	this_.mtx.Unlock()
+
+	for _, cctx := range cctxs {
+		k := cctx.kcp
+		k.mtx.Lock()
+		k.update(current)
+		if k.dead() {
+			dead = append(dead, cctx)
+		}
+		k.mtx.Unlock()
+	}
+
+	for _, cctx := range dead {
+		log.Warn("[%d:%v] kcp session dead link", cctx.Fd(), cctx.remoteAddr)
+		this_.Close(cctx)
+	}
+
+	this_.udpServer.OnTick()
+
+	return KCP_INTERVAL * time.Millisecond, gnet.None
+}
+
+// Write 通过 kcp 会话发送数据
+func (this_ *kcpServer) Write(cctx *ConnContext, data []byte) error {
+	k := cctx.kcp
+	if k == nil {
+		return ErrKcpClosed
+	}
+
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	cctx.touchWrite()
+	err := k.send(data)
+	if err != nil {
+		this_.owner.metrics.OnWriteError(Protocol_KCP, err)
+		return err
+	}
+	cctx.countWrite(len(data))
+
+	// 立即刷新, 降低延迟
+	k.current = kcpClock()
+	k.flush()
+	return nil
+}
+
+// writeFrame kcp 的分片与会话状态相关, 无法预先编码, 逐个会话发送
+func (this_ *kcpServer) writeFrame(cctx *ConnContext, frame []byte) error {
+	return this_.Write(cctx, frame)
+}
+
+// newSession 新会话创建时初始化 kcp
+func (this_ *kcpServer) newSession(cctx *ConnContext, data []byte) error {
+	conv := binary.LittleEndian.Uint32(data)
+	cctx.kcp = newKcp(conv, this_.nocwnd, func(buf []byte) {
+		_, err := this_.conn.WriteTo(buf, cctx.udpAddr)
+		if err != nil {
+			log.Error("[%d:%v] SendTo failed: %v", cctx.Fd(), cctx.remoteAddr, err)
+			this_.owner.metrics.OnWriteError(Protocol_KCP, err)
+		}
+	})
+
+	return nil
+}
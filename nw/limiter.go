@@ -0,0 +1,248 @@
+package nw
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LimitStats 限流统计
+type LimitStats struct {
+	Rejected    uint64 `json:"rejected"`     // 因 IP 名单或单 IP 连接数上限而拒绝的连接数
+	RateLimited uint64 `json:"rate_limited"` // 因收包速率超过上限而断开的连接数
+}
+
+// tokenBucket 令牌桶, 桶容量为一秒的令牌数. 只在连接所属的事件循环中访问, 不需要加锁
+type tokenBucket struct {
+	tokens float64
+	last   int64 // 上次更新时间, 纳秒
+}
+
+// take 取出 n 个令牌, 令牌不足时返回 false
+//   - rate: 每秒产生的令牌数
+func (this_ *tokenBucket) take(rate int, n int, now int64) bool {
+	if this_.last == 0 {
+		this_.tokens = float64(rate)
+	} else {
+		this_.tokens += float64(rate) * float64(now-this_.last) / float64(time.Second)
+		if this_.tokens > float64(rate) {
+			this_.tokens = float64(rate)
+		}
+	}
+
+	this_.last = now
+
+	// 桶满时允许超过桶容量的单次请求, 令牌数变为负数
+	if this_.tokens < float64(n) && this_.tokens < float64(rate) {
+		return false
+	}
+
+	this_.tokens -= float64(n)
+	return true
+}
+
+// connLimiter 连接限制: IP 黑白名单, 单 IP 连接数以及单连接收包速率
+type connLimiter struct {
+	allow    []*net.IPNet // 白名单, 为空表示不限制
+	deny     []*net.IPNet // 黑名单
+	proxies  []*net.IPNet // 可信代理
+	sources  []*net.IPNet // 发送 PROXY 头的可信来源
+	maxPerIP int          // 单 IP 最大连接数
+	msgRate  int          // 单连接每秒消息数上限
+	byteRate int          // 单连接每秒字节数上限
+	mtx      sync.Mutex
+	perIP    map[string]int // IP => 连接数
+	rejected atomic.Uint64
+	limited  atomic.Uint64
+}
+
+func newConnLimiter(c *Config) (*connLimiter, error) {
+	this_ := &connLimiter{
+		maxPerIP: c.MaxConnPerIP,
+		msgRate:  c.RateLimit,
+		byteRate: c.ByteRateLimit,
+		perIP:    make(map[string]int),
+	}
+
+	var err error
+	if this_.allow, err = parseIPNets(c.AllowIPs); err != nil {
+		return nil, err
+	}
+
+	if this_.deny, err = parseIPNets(c.DenyIPs); err != nil {
+		return nil, err
+	}
+
+	if this_.proxies, err = parseIPNets(c.TrustedProxies); err != nil {
+		return nil, err
+	}
+
+	if this_.sources, err = parseIPNets(c.ProxyProtocol); err != nil {
+		return nil, err
+	}
+
+	return this_, nil
+}
+
+// parseIPNets 解析 IP 地址或 CIDR 列表
+func parseIPNets(list []string) ([]*net.IPNet, error) {
+	res := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			_, ipnet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+
+			res = append(res, ipnet)
+			continue
+		}
+
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip address: %s", s)
+		}
+
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+
+		res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+
+	return res, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// trusted 连接是否来自可信代理
+func (this_ *connLimiter) trusted(cctx *ConnContext) bool {
+	return len(this_.proxies) > 0 && containsIP(this_.proxies, net.ParseIP(hostOf(cctx.remoteAddr)))
+}
+
+// expectProxy 连接是否来自发送 PROXY 头的可信来源, 在收到 PROXY 头之前调用
+func (this_ *connLimiter) expectProxy(cctx *ConnContext) bool {
+	return len(this_.sources) > 0 && containsIP(this_.sources, net.ParseIP(hostOf(cctx.remoteAddr)))
+}
+
+// clientIP 客户端 IP, 来自可信代理的连接使用代理转发的地址
+//
+// X-Forwarded-For 从右向左查找第一个不是可信代理的地址, 没有时使用 X-Real-IP
+func (this_ *connLimiter) clientIP(cctx *ConnContext) string {
+	ip := hostOf(cctx.remoteAddr)
+	if !this_.trusted(cctx) {
+		return ip
+	}
+
+	if len(cctx.xForwardedFor) > 0 {
+		parts := strings.Split(cctx.xForwardedFor, ",")
+		for i := len(parts) - 1; i >= 0; i-- {
+			addr := net.ParseIP(strings.TrimSpace(parts[i]))
+			if addr == nil {
+				break
+			}
+
+			ip = addr.String()
+			if !containsIP(this_.proxies, addr) {
+				break
+			}
+		}
+
+		return ip
+	}
+
+	if addr := net.ParseIP(strings.TrimSpace(cctx.xRealIP)); addr != nil {
+		return addr.String()
+	}
+
+	return ip
+}
+
+// admit 检查 IP 名单和单 IP 连接数, 通过后记录连接的客户端 IP
+func (this_ *connLimiter) admit(cctx *ConnContext) bool {
+	ip := this_.clientIP(cctx)
+	addr := net.ParseIP(ip)
+
+	if (len(this_.allow) > 0 && !containsIP(this_.allow, addr)) || containsIP(this_.deny, addr) {
+		this_.rejected.Add(1)
+		return false
+	}
+
+	if this_.maxPerIP > 0 {
+		this_.mtx.Lock()
+		if this_.perIP[ip] >= this_.maxPerIP {
+			this_.mtx.Unlock()
+			this_.rejected.Add(1)
+			return false
+		}
+		this_.perIP[ip]++
+		this_.mtx.Unlock()
+	}
+
+	cctx.clientIP = ip
+	return true
+}
+
+// release 连接关闭, 释放单 IP 连接数
+func (this_ *connLimiter) release(cctx *ConnContext) {
+	if len(cctx.clientIP) == 0 {
+		return
+	}
+
+	if this_.maxPerIP > 0 {
+		this_.mtx.Lock()
+		if this_.perIP[cctx.clientIP] <= 1 {
+			delete(this_.perIP, cctx.clientIP)
+		} else {
+			this_.perIP[cctx.clientIP]--
+		}
+		this_.mtx.Unlock()
+	}
+
+	cctx.clientIP = ""
+}
+
+// allowMessage 检查连接的收包速率, 超过上限返回 false
+func (this_ *connLimiter) allowMessage(cctx *ConnContext, size int) bool {
+	if this_.msgRate <= 0 && this_.byteRate <= 0 {
+		return true
+	}
+
+	now := time.Now().UnixNano()
+	if (this_.msgRate > 0 && !cctx.msgBucket.take(this_.msgRate, 1, now)) ||
+		(this_.byteRate > 0 && !cctx.byteBucket.take(this_.byteRate, size, now)) {
+		this_.limited.Add(1)
+		return false
+	}
+
+	return true
+}
+
+func (this_ *connLimiter) stats() LimitStats {
+	return LimitStats{
+		Rejected:    this_.rejected.Load(),
+		RateLimited: this_.limited.Load(),
+	}
+}
+
+// hostOf 去掉地址中的端口
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
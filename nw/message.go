@@ -2,13 +2,14 @@ package nw
 
 import (
 	"sync"
-	"sync/atomic"
 )
 
 // message 消息
 type message struct {
 	cctx    *ConnContext // 消息的发送者
+	id      uint64       // 投递时发送者的连接ID, 处理时不一致说明连接已关闭
 	len     int          // 数据长度
+	kind    MessageType  // 消息类型
 	buf     []byte       // 发送数据
 	msgPool *messagePool // 所属的消息池
 }
@@ -54,6 +55,7 @@ func (this_ *messagePool) New(cctx *ConnContext, data []byte) *message {
 	msg := this_.pool.Get().(*message)
 	msg.cctx = cctx
 	msg.len = len(data)
+	msg.kind = MessageType_Binary
 	msg.msgPool = this_
 	if msg.buf == nil || cap(msg.buf) < msg.len {
 		msg.buf = make([]byte, msg.len)
@@ -67,6 +69,7 @@ func (this_ *messagePool) NewWithData(cctx *ConnContext, data []byte) *message {
 	msg := this_.pool.Get().(*message)
 	msg.cctx = cctx
 	msg.len = len(data)
+	msg.kind = MessageType_Binary
 	msg.buf = data
 	msg.msgPool = this_
 	return msg
@@ -82,60 +85,3 @@ func (this_ *messagePool) Free(msg *message) {
 		this_.pool.Put(msg)
 	}
 }
-
-// messageWorker Message 工作者
-type messageWorker struct {
-	ch      chan *message
-	stopC   chan bool
-	handle  func(*message)
-	running int32
-}
-
-func newMessageWorker(handle func(*message)) *messageWorker {
-	return &messageWorker{
-		handle:  handle,
-		running: 0,
-	}
-}
-
-func (this_ *messageWorker) run(wg *sync.WaitGroup) {
-	if !atomic.CompareAndSwapInt32(&this_.running, 0, 1) {
-		return
-	}
-
-	this_.ch = make(chan *message, DEFAULT_CHAN_SIZE)
-	this_.stopC = make(chan bool, 1)
-
-MSG_LOOP:
-	for {
-		select {
-		case msg := <-this_.ch:
-			this_.handle(msg)
-
-		case <-this_.stopC:
-			break MSG_LOOP
-		}
-	}
-
-	close(this_.ch)
-	close(this_.stopC)
-
-	for msg := range this_.ch {
-		this_.handle(msg)
-	}
-
-	atomic.StoreInt32(&this_.running, 0)
-	wg.Done()
-}
-
-func (this_ *messageWorker) push(msg *message) {
-	this_.ch <- msg
-}
-
-func (this_ *messageWorker) stop() {
-	if atomic.LoadInt32(&this_.running) == 0 {
-		return
-	}
-
-	this_.stopC <- true
-}
@@ -0,0 +1,246 @@
+package nw
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// IMetrics 服务指标采集接口
+//
+// 在事件循环和消息处理协程中并发调用, 实现需要并发安全且不能阻塞
+type IMetrics interface {
+	OnAccept(proto Protocol)                   // 接受了一个连接, 包括之后被限流或拒绝的连接
+	OnRead(proto Protocol, n int)              // 收到一帧, n 为帧长度, 包括心跳和控制帧. udp 和 kcp 为一个数据报
+	OnWrite(proto Protocol, n int)             // 提交写入一帧, n 为帧长度. udp 和 kcp 为一条消息
+	OnWriteError(proto Protocol, err error)    // 写入失败, 包括异步写入回调中返回的错误
+	OnHandle(proto Protocol, d time.Duration)  // 处理完一条消息, d 为 OnData 或 OnMessage 的耗时
+	OnUpgradeFailed(proto Protocol, err error) // websocket 升级失败, 包括被拒绝的升级请求
+}
+
+// noopMetrics 未设置指标采集时使用, 不做任何处理
+type noopMetrics struct{}
+
+func (noopMetrics) OnAccept(Protocol)                {}
+func (noopMetrics) OnRead(Protocol, int)             {}
+func (noopMetrics) OnWrite(Protocol, int)            {}
+func (noopMetrics) OnWriteError(Protocol, error)     {}
+func (noopMetrics) OnHandle(Protocol, time.Duration) {}
+func (noopMetrics) OnUpgradeFailed(Protocol, error)  {}
+
+// IPrometheusWriter 可以输出 Prometheus 文本格式的指标采集实现, Service 的指标接口会一并输出
+type IPrometheusWriter interface {
+	WritePrometheus(w io.Writer) error
+}
+
+// METRICS_HANDLE_BUCKETS 消息处理耗时直方图的桶上限, 单位秒
+var METRICS_HANDLE_BUCKETS = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// protoMetrics 单个协议的指标
+type protoMetrics struct {
+	accepted   atomic.Uint64
+	readBytes  atomic.Uint64
+	readFrames atomic.Uint64
+	writeBytes atomic.Uint64
+	writes     atomic.Uint64
+	writeErrs  atomic.Uint64
+	upgradeErr atomic.Uint64
+	handleNs   atomic.Uint64   // 处理耗时总和, 纳秒
+	buckets    []atomic.Uint64 // 各桶的计数, 不累加, 最后一个为超过所有上限的计数
+}
+
+// Metrics 内置的指标采集, 按协议分别计数, 以 Prometheus 文本格式输出
+type Metrics struct {
+	protos [Protocol_KCP + 1]protoMetrics
+}
+
+// NewMetrics 创建内置的指标采集
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	for i := range m.protos {
+		m.protos[i].buckets = make([]atomic.Uint64, len(METRICS_HANDLE_BUCKETS)+1)
+	}
+
+	return m
+}
+
+// proto 协议对应的指标, 未知协议计入 Protocol_None
+func (this_ *Metrics) proto(proto Protocol) *protoMetrics {
+	if proto < 0 || int(proto) >= len(this_.protos) {
+		proto = Protocol_None
+	}
+
+	return &this_.protos[proto]
+}
+
+func (this_ *Metrics) OnAccept(proto Protocol) {
+	this_.proto(proto).accepted.Add(1)
+}
+
+func (this_ *Metrics) OnRead(proto Protocol, n int) {
+	p := this_.proto(proto)
+	p.readBytes.Add(uint64(n))
+	p.readFrames.Add(1)
+}
+
+func (this_ *Metrics) OnWrite(proto Protocol, n int) {
+	p := this_.proto(proto)
+	p.writeBytes.Add(uint64(n))
+	p.writes.Add(1)
+}
+
+func (this_ *Metrics) OnWriteError(proto Protocol, err error) {
+	this_.proto(proto).writeErrs.Add(1)
+}
+
+func (this_ *Metrics) OnHandle(proto Protocol, d time.Duration) {
+	p := this_.proto(proto)
+	p.handleNs.Add(uint64(d))
+
+	s := d.Seconds()
+	i := 0
+	for i < len(METRICS_HANDLE_BUCKETS) && s > METRICS_HANDLE_BUCKETS[i] {
+		i++
+	}
+	p.buckets[i].Add(1)
+}
+
+func (this_ *Metrics) OnUpgradeFailed(proto Protocol, err error) {
+	this_.proto(proto).upgradeErr.Add(1)
+}
+
+// WritePrometheus 以 Prometheus 文本格式输出所有协议的指标
+func (this_ *Metrics) WritePrometheus(w io.Writer) error {
+	pw := newPromWriter(w)
+
+	counters := []struct {
+		name, help string
+		value      func(*protoMetrics) uint64
+	}{
+		{"nw_connections_accepted_total", "Accepted connections.", func(p *protoMetrics) uint64 { return p.accepted.Load() }},
+		{"nw_read_bytes_total", "Bytes of received frames.", func(p *protoMetrics) uint64 { return p.readBytes.Load() }},
+		{"nw_read_frames_total", "Received frames.", func(p *protoMetrics) uint64 { return p.readFrames.Load() }},
+		{"nw_write_bytes_total", "Bytes of written frames.", func(p *protoMetrics) uint64 { return p.writeBytes.Load() }},
+		{"nw_write_frames_total", "Written frames.", func(p *protoMetrics) uint64 { return p.writes.Load() }},
+		{"nw_write_errors_total", "Failed writes.", func(p *protoMetrics) uint64 { return p.writeErrs.Load() }},
+		{"nw_upgrade_failures_total", "Failed or rejected websocket upgrades.", func(p *protoMetrics) uint64 { return p.upgradeErr.Load() }},
+	}
+
+	for _, c := range counters {
+		pw.header(c.name, "counter", c.help)
+		for proto := Protocol_TCP; proto <= Protocol_KCP; proto++ {
+			pw.sample(c.name, protoLabel(proto), float64(c.value(&this_.protos[proto])))
+		}
+	}
+
+	const name = "nw_handle_seconds"
+	pw.header(name, "histogram", "Message handler latency.")
+	for proto := Protocol_TCP; proto <= Protocol_KCP; proto++ {
+		p := &this_.protos[proto]
+		label := protoLabel(proto)
+
+		var total uint64
+		for i, le := range METRICS_HANDLE_BUCKETS {
+			total += p.buckets[i].Load()
+			pw.sample(name+"_bucket", label+`,le="`+strconv.FormatFloat(le, 'g', -1, 64)+`"`, float64(total))
+		}
+		total += p.buckets[len(METRICS_HANDLE_BUCKETS)].Load()
+		pw.sample(name+"_bucket", label+`,le="+Inf"`, float64(total))
+		pw.sample(name+"_sum", label, time.Duration(p.handleNs.Load()).Seconds())
+		pw.sample(name+"_count", label, float64(total))
+	}
+
+	return pw.flush()
+}
+
+// promWriter Prometheus 文本格式输出
+type promWriter struct {
+	w *bufio.Writer
+}
+
+func newPromWriter(w io.Writer) *promWriter {
+	return &promWriter{w: bufio.NewWriter(w)}
+}
+
+// header 输出指标的 HELP 和 TYPE 行
+func (this_ *promWriter) header(name, kind, help string) {
+	fmt.Fprintf(this_.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample 输出一个样本, labels 为不含花括号的标签列表, 可以为空
+func (this_ *promWriter) sample(name, labels string, value float64) {
+	if len(labels) > 0 {
+		fmt.Fprintf(this_.w, "%s{%s} %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+		return
+	}
+
+	fmt.Fprintf(this_.w, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (this_ *promWriter) flush() error {
+	return this_.w.Flush()
+}
+
+// protoLabel 协议标签
+func protoLabel(proto Protocol) string {
+	return `protocol="` + proto.String() + `"`
+}
+
+// WriteMetrics 以 Prometheus 文本格式输出服务的连接数和队列状态, 指标采集实现了 IPrometheusWriter 时一并输出
+func (this_ *Service) WriteMetrics(w io.Writer) error {
+	var conns [Protocol_KCP + 1]int
+	this_.conns.Range(func(id uint64, cctx *ConnContext) bool {
+		if p := cctx.Protocol(); p >= 0 && int(p) < len(conns) {
+			conns[p]++
+		}
+		return true
+	})
+
+	pw := newPromWriter(w)
+	pw.header("nw_connections", "gauge", "Current connections.")
+	for proto := Protocol_TCP; proto <= Protocol_KCP; proto++ {
+		pw.sample("nw_connections", protoLabel(proto), float64(conns[proto]))
+	}
+
+	qs, ls := this_.QueueStats(), this_.LimitStats()
+	stats := []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"nw_queue_depth", "gauge", "Messages waiting for handlers.", float64(qs.Queued)},
+		{"nw_inbound_dropped_total", "counter", "Inbound messages dropped by queue limits.", float64(qs.InboundDropped)},
+		{"nw_inbound_disconnected_total", "counter", "Connections closed by inbound queue limits.", float64(qs.InboundDisconnected)},
+		{"nw_outbound_blocked_total", "counter", "Writes blocked by pending byte limits.", float64(qs.OutboundBlocked)},
+		{"nw_outbound_dropped_total", "counter", "Writes dropped by pending byte limits.", float64(qs.OutboundDropped)},
+		{"nw_outbound_disconnected_total", "counter", "Connections closed by pending byte limits.", float64(qs.OutboundDisconnected)},
+		{"nw_connections_rejected_total", "counter", "Connections rejected by ip lists or per-ip limits.", float64(ls.Rejected)},
+		{"nw_connections_rate_limited_total", "counter", "Connections closed by rate limits.", float64(ls.RateLimited)},
+	}
+
+	for _, g := range stats {
+		pw.header(g.name, g.kind, g.help)
+		pw.sample(g.name, "", g.value)
+	}
+
+	if err := pw.flush(); err != nil {
+		return err
+	}
+
+	if m, ok := this_.metrics.(IPrometheusWriter); ok {
+		return m.WritePrometheus(w)
+	}
+
+	return nil
+}
+
+// MetricsHandler 输出 Prometheus 文本格式指标的 http 处理器, 可以挂载到 web.Server 的路由上
+func (this_ *Service) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		this_.WriteMetrics(w)
+	})
+}
@@ -0,0 +1,177 @@
+package nw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gox/frm/log"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// PROXY protocol
+//
+// 负载均衡器在连接开始时发送 PROXY 头, 携带客户端的真实地址. v1 为文本格式:
+// "PROXY TCP4 <src> <dst> <sport> <dport>\r\n", 最长 107 字节; v2 为二进制格式:
+// SIGNATURE[12] + VER_CMD[1] + FAM[1] + LEN[2] + ADDR[LEN], ADDR 之后的 TLV 被忽略.
+// LOCAL 命令 (负载均衡器的健康检查) 和 UNKNOWN 协议保留套接字的对端地址
+const (
+	PROXY_V1_MAX_SIZE    = 107 // v1 头的最大长度
+	PROXY_V2_HEADER_SIZE = 16  // v2 固定头长度
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+var ErrProxyHeader = errors.New("invalid proxy protocol header")
+
+// parseProxyHeader 从 data 开头解析 PROXY 头
+//   - addr: 客户端地址, 为空表示保留套接字的对端地址
+//   - n: 头的长度, 为 0 且 err 为 nil 时数据不足
+func parseProxyHeader(data []byte) (addr string, n int, err error) {
+	switch {
+	case hasPrefix(data, proxyV1Prefix):
+		return parseProxyV1(data)
+	case hasPrefix(data, proxyV2Signature):
+		return parseProxyV2(data)
+	}
+
+	return "", 0, ErrProxyHeader
+}
+
+// hasPrefix data 以 prefix 开头, 或 data 不足时是 prefix 的前缀
+func hasPrefix(data, prefix []byte) bool {
+	if len(data) < len(prefix) {
+		return bytes.HasPrefix(prefix, data)
+	}
+
+	return bytes.HasPrefix(data, prefix)
+}
+
+// parseProxyV1 解析文本格式的头
+func parseProxyV1(data []byte) (string, int, error) {
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 0 {
+		if len(data) >= PROXY_V1_MAX_SIZE {
+			return "", 0, ErrProxyHeader
+		}
+		return "", 0, nil
+	}
+
+	if end+2 > PROXY_V1_MAX_SIZE {
+		return "", 0, ErrProxyHeader
+	}
+
+	n := end + 2
+	fields := strings.Split(string(data[:end]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return "", n, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return "", 0, ErrProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return "", 0, ErrProxyHeader
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return "", 0, ErrProxyHeader
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), n, nil
+}
+
+// parseProxyV2 解析二进制格式的头
+func parseProxyV2(data []byte) (string, int, error) {
+	if len(data) < PROXY_V2_HEADER_SIZE {
+		return "", 0, nil
+	}
+
+	verCmd, fam := data[12], data[13]
+	n := PROXY_V2_HEADER_SIZE + int(binary.BigEndian.Uint16(data[14:]))
+	if verCmd>>4 != 2 {
+		return "", 0, ErrProxyHeader
+	}
+
+	if len(data) < n {
+		return "", 0, nil
+	}
+
+	// LOCAL 命令
+	if verCmd&0x0f == 0 {
+		return "", n, nil
+	}
+
+	if verCmd&0x0f != 1 {
+		return "", 0, ErrProxyHeader
+	}
+
+	body := data[PROXY_V2_HEADER_SIZE:n]
+	switch fam >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return "", 0, ErrProxyHeader
+		}
+		return net.JoinHostPort(net.IP(body[:4]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(body[8:])))), n, nil
+
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return "", 0, ErrProxyHeader
+		}
+		return net.JoinHostPort(net.IP(body[:16]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(body[32:])))), n, nil
+	}
+
+	// AF_UNSPEC 和 AF_UNIX
+	return "", n, nil
+}
+
+// readProxy 读取连接开始的 PROXY 头, 在 tls 和协议解析之前调用. 返回 false 表示头尚未完整或连接需要关闭
+//
+// 解析完成后使用头中的客户端地址检查连接限制, 不需要协议握手的连接随后触发 OnConnected
+func (this_ *baseServer) readProxy(cctx *ConnContext) (bool, gnet.Action) {
+	c := cctx.c
+	data, _ := c.Peek(-1)
+
+	addr, n, err := parseProxyHeader(data)
+	if err != nil {
+		log.Error("[%d:%v] read proxy header failed: %v", c.Fd(), cctx.remoteAddr, err)
+		return false, gnet.Close
+	}
+
+	if n == 0 {
+		return false, gnet.None
+	}
+
+	c.Discard(n)
+	cctx.proxied = false
+	if len(addr) > 0 {
+		cctx.proxyAddr = cctx.remoteAddr
+		cctx.remoteAddr = addr
+	}
+
+	if cctx.upgraded.Load() || !this_.owner.limiter.trusted(cctx) {
+		if !this_.owner.limiter.admit(cctx) {
+			log.Warn("[%d:%v] connection rejected", c.Fd(), cctx.remoteAddr)
+			return false, gnet.Close
+		}
+	}
+
+	// tls 连接在 tls 握手完成后触发, 需要协议握手的连接在协议握手完成后触发
+	if cctx.tls == nil && !this_.pending {
+		if err := this_.connected(cctx); err != nil {
+			log.Error("[%d:%v] connected failed: %v", c.Fd(), cctx.remoteAddr, err)
+			return false, gnet.Close
+		}
+	}
+
+	return true, gnet.None
+}
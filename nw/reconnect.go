@@ -0,0 +1,79 @@
+package nw
+
+import (
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	RECONNECT_MIN_DELAY  = 500 * time.Millisecond // 默认的第一次重连等待时间
+	RECONNECT_MAX_DELAY  = 30 * time.Second       // 默认的重连等待时间上限
+	RECONNECT_QUEUE_SIZE = 1024                   // 默认的重连期间待发送消息数上限
+)
+
+var (
+	ErrReconnectQueueFull = errors.New("reconnect queue full")       // 重连期间待发送的消息超过上限
+	ErrReconnectFailed    = errors.New("reconnect retries exceeded") // 连续重连失败的次数超过上限
+)
+
+// ReconnectConfig 客户端断线重连配置
+type ReconnectConfig struct {
+	MinDelay   time.Duration // 第一次重连前的等待时间, 默认为 RECONNECT_MIN_DELAY
+	MaxDelay   time.Duration // 重连等待时间上限, 默认为 RECONNECT_MAX_DELAY
+	MaxRetries int           // 连续重连失败的次数上限, 超过后客户端关闭, 0 表示不限制
+	QueueSize  int           // 重连期间待发送消息数上限, 超过时写入返回 ErrReconnectQueueFull, 默认为 RECONNECT_QUEUE_SIZE
+
+	// Resume 重连后恢复原会话, 需要服务端开启 Config.Resume. 服务端开启后所有客户端都需要开启.
+	// 恢复后双方重发对方未收到的消息; 服务端未恢复时 (如会话已过期) 原会话中未确认的消息被丢弃
+	Resume bool
+
+	OnConnect    func(resumed bool) // 重连成功后调用, resumed 表示服务端恢复了原会话
+	OnDisconnect func(err error)    // 连接断开后调用, 之后开始重连
+}
+
+// withDefaults 填充默认值后的配置
+func (this_ ReconnectConfig) withDefaults() *ReconnectConfig {
+	if this_.MinDelay <= 0 {
+		this_.MinDelay = RECONNECT_MIN_DELAY
+	}
+
+	if this_.MaxDelay <= 0 {
+		this_.MaxDelay = RECONNECT_MAX_DELAY
+	}
+
+	if this_.MaxDelay < this_.MinDelay {
+		this_.MaxDelay = this_.MinDelay
+	}
+
+	if this_.QueueSize <= 0 {
+		this_.QueueSize = RECONNECT_QUEUE_SIZE
+	}
+
+	return &this_
+}
+
+// backoff 第 n 次重连前的等待时间, 从 MinDelay 开始按指数增长到 MaxDelay,
+// 并在 [d/2, d] 之间随机, 避免大量客户端同时重连
+func (this_ *ReconnectConfig) backoff(n int) time.Duration {
+	d := this_.MaxDelay
+	if n < 32 && this_.MinDelay<<n < this_.MaxDelay && this_.MinDelay<<n > 0 {
+		d = this_.MinDelay << n
+	}
+
+	return d/2 + rand.N(d/2+1)
+}
+
+// notifyConnect 调用 OnConnect
+func (this_ *ReconnectConfig) notifyConnect(resumed bool) {
+	if this_.OnConnect != nil {
+		this_.OnConnect(resumed)
+	}
+}
+
+// notifyDisconnect 调用 OnDisconnect
+func (this_ *ReconnectConfig) notifyDisconnect(err error) {
+	if this_.OnDisconnect != nil {
+		this_.OnDisconnect(err)
+	}
+}
@@ -0,0 +1,529 @@
+package nw
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gox/frm/log"
+)
+
+// 会话恢复
+//
+// 开启后客户端发送的第一条消息 (tcp 加密会话建立之后) 必须是 HELLO, 服务端回复 WELCOME 后才触发
+// OnConnected 或 IResumeEvent.OnResumed. 之后双方的每条消息都以类型开头:
+//
+//	HELLO   = TYPE[1] + TOKEN[16] + RECV[8]            TOKEN 全为 0 表示新会话, RECV 为已收到的最后一条消息的序号
+//	WELCOME = TYPE[1] + TOKEN[16] + RECV[8] + FLAG[1]  FLAG 为 1 表示恢复了原会话, 否则 TOKEN 为新会话的令牌
+//	DATA    = TYPE[1] + SEQ[8] + DATA
+//	ACK     = TYPE[1] + SEQ[8]                         确认已收到 SEQ 及之前的所有消息
+//	CLOSE   = TYPE[1]                                  客户端主动关闭, 服务端不再保留会话
+//
+// 双方保存已发送但未确认的消息, 重连后从对方的 RECV 之后开始重发, 接收方丢弃序号重复的消息.
+// 连接断开后服务端保留会话 ResumeTimeout 秒, 期间发送的消息被缓存, 到期后才触发 OnDisconnected
+const (
+	RESUME_HELLO   = byte(1)
+	RESUME_WELCOME = byte(2)
+	RESUME_DATA    = byte(3)
+	RESUME_ACK     = byte(4)
+	RESUME_CLOSE   = byte(5)
+
+	RESUME_TOKEN_SIZE   = 16   // 会话令牌长度
+	RESUME_HEADER_SIZE  = 9    // DATA 和 ACK 的头部长度
+	RESUME_TIMEOUT      = 60   // 默认的会话保留时间, 单位秒
+	RESUME_BUFFER_SIZE  = 1024 // 默认的单个会话未确认消息数上限
+	RESUME_ACK_INTERVAL = 32   // 每收到多少条消息发送一次确认
+)
+
+var ErrResumeProtocol = errors.New("invalid resume message") // 会话恢复消息无效
+
+// IResumeEvent 需要感知会话恢复的服务事件, IServiceEvent 同时实现该接口时生效
+type IResumeEvent interface {
+	// OnResumed 客户端重连后恢复了原会话, 连接ID、用户数据和所在分组保持不变, 不会再次触发 OnConnected.
+	// 之前保存的 *ConnContext 已失效, 需要替换为参数中的连接
+	OnResumed(*ConnContext)
+}
+
+// resumeToken 会话令牌
+type resumeToken [RESUME_TOKEN_SIZE]byte
+
+// resumeState 会话恢复状态, 服务端在新旧连接之间转移, 客户端在重连之间保持
+type resumeState struct {
+	wmtx    sync.Mutex   // 保证消息序号与写入顺序一致, 服务端写入方持有直到数据提交
+	mtx     sync.Mutex   // 保护以下字段
+	token   resumeToken  // 会话令牌
+	sendSeq uint64       // 最后发送的消息序号
+	unacked [][]byte     // 已发送未确认的消息, 最后一条的序号为 sendSeq
+	limit   int          // unacked 上限, 超过时丢弃最早的消息, 0 表示不限制
+	dropped uint64       // 被丢弃的最后一条消息的序号, 对方没有收到时无法恢复
+	recvSeq uint64       // 最后收到的消息序号
+	acked   uint64       // 最后一次发送确认时的 recvSeq
+	conn    *ConnContext // 服务端当前的连接, 断开期间为 nil
+	closed  bool         // 服务端的会话已结束, 断开后不再保留
+}
+
+func newResumeState(limit int) *resumeState {
+	this_ := &resumeState{limit: limit}
+	rand.Read(this_.token[:])
+	return this_
+}
+
+// seal 分配序号并保存, 返回 DATA 消息
+func (this_ *resumeState) seal(data []byte) []byte {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	this_.sendSeq++
+	msg := resumeMessage(RESUME_DATA, this_.sendSeq, data)
+	this_.unacked = append(this_.unacked, msg)
+
+	if this_.limit > 0 && len(this_.unacked) > this_.limit {
+		this_.dropped = this_.sendSeq - uint64(len(this_.unacked)) + 1
+		this_.unacked[0] = nil
+		this_.unacked = this_.unacked[1:]
+	}
+
+	return msg
+}
+
+// ack 对方确认收到 seq 及之前的消息, 调用方需要持有 mtx
+func (this_ *resumeState) ack(seq uint64) {
+	if seq > this_.sendSeq {
+		seq = this_.sendSeq
+	}
+
+	n := len(this_.unacked) - int(this_.sendSeq-seq)
+	if n <= 0 {
+		return
+	}
+
+	clear(this_.unacked[:n])
+	this_.unacked = this_.unacked[n:]
+}
+
+// replay 对方最后收到的序号为 recv 时需要重发的消息, 无法恢复时返回 false. 调用方需要持有 mtx
+func (this_ *resumeState) replay(recv uint64) ([][]byte, bool) {
+	if recv > this_.sendSeq || (this_.dropped > 0 && recv < this_.dropped) {
+		return nil, false
+	}
+
+	this_.ack(recv)
+	return append([][]byte(nil), this_.unacked...), true
+}
+
+// receive 处理对方的 DATA 和 ACK 消息
+//
+// deliver 为 true 时 payload 需要交给业务层, 重复的消息和确认消息返回 false. ack 不为 nil 时需要发送给对方
+func (this_ *resumeState) receive(data []byte) (payload []byte, deliver bool, ack []byte, err error) {
+	if len(data) < RESUME_HEADER_SIZE {
+		return nil, false, nil, ErrResumeProtocol
+	}
+
+	seq := binary.BigEndian.Uint64(data[1:RESUME_HEADER_SIZE])
+
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	switch data[0] {
+	case RESUME_DATA:
+		if seq <= this_.recvSeq {
+			return nil, false, nil, nil
+		}
+
+		if seq != this_.recvSeq+1 {
+			return nil, false, nil, ErrResumeProtocol
+		}
+
+		this_.recvSeq = seq
+		if seq-this_.acked >= RESUME_ACK_INTERVAL {
+			this_.acked = seq
+			ack = resumeMessage(RESUME_ACK, seq, nil)
+		}
+
+		return data[RESUME_HEADER_SIZE:], true, ack, nil
+
+	case RESUME_ACK:
+		this_.ack(seq)
+		return nil, false, nil, nil
+	}
+
+	return nil, false, nil, ErrResumeProtocol
+}
+
+// hello 客户端的 HELLO 消息
+func (this_ *resumeState) hello() []byte {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	msg := make([]byte, 0, 1+RESUME_TOKEN_SIZE+8)
+	msg = append(msg, RESUME_HELLO)
+	msg = append(msg, this_.token[:]...)
+	return binary.BigEndian.AppendUint64(msg, this_.recvSeq)
+}
+
+// welcome 客户端处理服务端的 WELCOME, 返回是否恢复了原会话和需要重发的消息.
+// 未恢复时改用新会话的令牌, 原会话中未确认的消息被丢弃
+func (this_ *resumeState) welcome(data []byte) (bool, [][]byte, error) {
+	if len(data) != 2+RESUME_TOKEN_SIZE+8 || data[0] != RESUME_WELCOME {
+		return false, nil, ErrResumeProtocol
+	}
+
+	var token resumeToken
+	copy(token[:], data[1:])
+	recv := binary.BigEndian.Uint64(data[1+RESUME_TOKEN_SIZE:])
+
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	if data[len(data)-1] == 1 {
+		if token != this_.token {
+			return false, nil, ErrResumeProtocol
+		}
+
+		msgs, ok := this_.replay(recv)
+		if !ok {
+			return false, nil, ErrResumeProtocol
+		}
+		return true, msgs, nil
+	}
+
+	this_.token = token
+	this_.sendSeq, this_.recvSeq, this_.acked, this_.dropped = 0, 0, 0, 0
+	this_.unacked = nil
+	return false, nil, nil
+}
+
+// resumeMessage 编码 DATA 或 ACK 消息
+func resumeMessage(kind byte, seq uint64, data []byte) []byte {
+	msg := make([]byte, RESUME_HEADER_SIZE, RESUME_HEADER_SIZE+len(data))
+	msg[0] = kind
+	binary.BigEndian.PutUint64(msg[1:], seq)
+	return append(msg, data...)
+}
+
+// resumeWelcome 编码 WELCOME 消息
+func resumeWelcome(token resumeToken, recv uint64, resumed bool) []byte {
+	msg := make([]byte, 0, 2+RESUME_TOKEN_SIZE+8)
+	msg = append(msg, RESUME_WELCOME)
+	msg = append(msg, token[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, recv)
+	if resumed {
+		return append(msg, 1)
+	}
+
+	return append(msg, 0)
+}
+
+// resumer 支持会话恢复的服务, 由 baseServer 实现
+type resumer interface {
+	connected(*ConnContext) error       // 新会话握手完成
+	resumed(*ConnContext)               // 恢复了原会话
+	retain(*ConnContext, time.Duration) // 保留断开的会话, 到期后检查
+}
+
+// resumeManager 服务端保存的会话, 只用于 tcp 和 websocket
+type resumeManager struct {
+	mtx      sync.Mutex                   // 会话的建立、断开、恢复和到期都持有该锁
+	owner    *Service                     // 所属服务
+	sessions map[resumeToken]*ConnContext // 会话令牌 => 持有会话的连接
+	timeout  time.Duration                // 断开后保留会话的时间
+	limit    int                          // 单个会话未确认消息数上限
+}
+
+// newResumeManager 未开启会话恢复时返回 nil
+func newResumeManager(owner *Service, c *Config) *resumeManager {
+	if !c.Resume || (len(c.TcpHost) == 0 && len(c.WsHost) == 0) {
+		return nil
+	}
+
+	this_ := &resumeManager{
+		owner:    owner,
+		sessions: make(map[resumeToken]*ConnContext),
+		timeout:  time.Duration(c.ResumeTimeout) * time.Second,
+		limit:    c.ResumeBuffer,
+	}
+
+	if this_.timeout <= 0 {
+		this_.timeout = RESUME_TIMEOUT * time.Second
+	}
+
+	if this_.limit <= 0 {
+		this_.limit = RESUME_BUFFER_SIZE
+	}
+
+	return this_
+}
+
+// enabled 连接的协议是否使用会话恢复
+func (this_ *resumeManager) enabled(proto Protocol) bool {
+	return this_ != nil && (proto == Protocol_TCP || proto == Protocol_Websocket)
+}
+
+// receive 处理收到的消息, 返回 true 时消息已去掉头部, 需要交给业务层. 在事件循环中调用
+func (this_ *resumeManager) receive(msg *message) (bool, error) {
+	cctx := msg.cctx
+	data := msg.data()
+
+	if cctx.pending.Load() {
+		if len(data) != 1+RESUME_TOKEN_SIZE+8 || data[0] != RESUME_HELLO {
+			return false, ErrResumeProtocol
+		}
+
+		var token resumeToken
+		copy(token[:], data[1:])
+		return false, this_.attach(cctx, token, binary.BigEndian.Uint64(data[1+RESUME_TOKEN_SIZE:]))
+	}
+
+	r := cctx.resume
+	if len(data) == 1 && data[0] == RESUME_CLOSE {
+		r.mtx.Lock()
+		r.closed = true
+		r.mtx.Unlock()
+		return false, nil
+	}
+
+	payload, deliver, ack, err := r.receive(data)
+	if err != nil {
+		return false, err
+	}
+
+	if ack != nil {
+		if err := cctx.server.Write(cctx, ack); err != nil {
+			log.Warn("[%d:%v] send resume ack failed: %v", cctx.Fd(), cctx.RemoteAddr(), err)
+		}
+	}
+
+	// 已被新连接接管的旧连接上迟到的消息
+	r.mtx.Lock()
+	current := r.conn == cctx
+	r.mtx.Unlock()
+
+	if !deliver || !current {
+		return false, nil
+	}
+
+	msg.len = copy(msg.buf, payload)
+	return true, nil
+}
+
+// attach 处理 HELLO, 令牌对应的会话可以恢复时由新连接接管, 否则建立新会话
+func (this_ *resumeManager) attach(cctx *ConnContext, token resumeToken, recv uint64) error {
+	srv := cctx.server.(resumer)
+
+	this_.mtx.Lock()
+	old := this_.sessions[token]
+	if old != nil {
+		r := old.resume
+
+		// 持有 wmtx 直到重发完成, 期间的写入排在重发的消息之后
+		r.wmtx.Lock()
+		r.mtx.Lock()
+		if msgs, ok := r.replay(recv); ok && !r.closed {
+			prev := r.conn
+			r.conn = cctx
+			welcome := resumeWelcome(token, r.recvSeq, true)
+			r.mtx.Unlock()
+
+			this_.takeover(old, cctx)
+			this_.sessions[token] = cctx
+			this_.mtx.Unlock()
+
+			err := this_.resend(cctx, welcome, msgs)
+			r.wmtx.Unlock()
+
+			// 旧连接尚未断开, 关闭时会发现会话已被接管
+			if prev != nil {
+				prev.server.Close(prev)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			srv.resumed(cctx)
+			return nil
+		}
+
+		r.mtx.Unlock()
+		r.wmtx.Unlock()
+	}
+
+	r := newResumeState(this_.limit)
+	r.conn = cctx
+	cctx.resume = r
+	this_.sessions[r.token] = cctx
+	this_.mtx.Unlock()
+
+	// WELCOME 在 OnConnected 中的写入之前发送
+	err := cctx.server.Write(cctx, resumeWelcome(r.token, 0, false))
+	if err == nil {
+		err = srv.connected(cctx)
+	}
+
+	if err != nil {
+		this_.mtx.Lock()
+		delete(this_.sessions, r.token)
+		this_.mtx.Unlock()
+	}
+
+	return err
+}
+
+// takeover 新连接接管 old 的连接ID、用户数据和分组, old 随后失效. 调用方需要持有 mtx
+func (this_ *resumeManager) takeover(old, cctx *ConnContext) {
+	id := old.ID()
+
+	cctx.resume = old.resume
+	cctx.userData = old.userData
+	atomic.StoreInt64(&cctx.connectAt, atomic.LoadInt64(&old.connectAt))
+	atomic.StoreUint64(&cctx.id, id)
+	this_.owner.groups.replace(old, cctx)
+	this_.owner.conns.Set(id, cctx)
+	atomic.StoreUint64(&old.id, 0)
+}
+
+// resend 发送 WELCOME 和对方未收到的消息
+func (this_ *resumeManager) resend(cctx *ConnContext, welcome []byte, msgs [][]byte) error {
+	if err := cctx.server.Write(cctx, welcome); err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		if err := cctx.server.Write(cctx, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write 分配序号后发送, 连接断开期间只缓存
+func (this_ *resumeState) write(data []byte) error {
+	this_.wmtx.Lock()
+	defer this_.wmtx.Unlock()
+
+	msg := this_.seal(data)
+
+	this_.mtx.Lock()
+	conn := this_.conn
+	this_.mtx.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+
+	return conn.server.Write(conn, msg)
+}
+
+// detach 连接断开, 返回 true 表示会话被保留或已被新连接接管, 此时不触发 OnDisconnected
+func (this_ *resumeManager) detach(cctx *ConnContext) bool {
+	r := cctx.resume
+	if r == nil {
+		return false
+	}
+
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.conn != cctx {
+		return true
+	}
+
+	// 主动关闭的会话和停止中的服务不再保留
+	if r.closed || atomic.LoadInt32(&this_.owner.info.State) != ServiceState_Running {
+		delete(this_.sessions, r.token)
+		return false
+	}
+
+	r.conn = nil
+	cctx.server.(resumer).retain(cctx, this_.timeout)
+	return true
+}
+
+// expire 检查断开的会话是否到期
+//   - current: cctx 仍是会话当前的连接
+//   - ended: 会话结束, 需要触发 OnDisconnected
+func (this_ *resumeManager) expire(cctx *ConnContext) (current bool, ended bool) {
+	r := cctx.resume
+
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.conn == cctx {
+		return true, false
+	}
+
+	// 已被新连接接管
+	if r.conn != nil || this_.sessions[r.token] != cctx {
+		return false, false
+	}
+
+	delete(this_.sessions, r.token)
+	return false, true
+}
+
+// close 业务层关闭连接, 会话不再保留. 返回 true 表示连接已断开, 会话将在下一个 tick 结束
+func (this_ *resumeManager) close(cctx *ConnContext) bool {
+	// 已失效的连接
+	if cctx.ID() == 0 {
+		return true
+	}
+
+	r := cctx.resume
+
+	r.mtx.Lock()
+	r.closed = true
+	detached := r.conn == nil
+	r.mtx.Unlock()
+
+	if detached {
+		cctx.server.(resumer).retain(cctx, 0)
+	}
+
+	return detached
+}
+
+// resumed 恢复了原会话的连接就绪, 触发 OnResumed
+func (this_ *baseServer) resumed(cctx *ConnContext) {
+	cctx.pending.Store(false)
+	this_.addConn(cctx)
+
+	if e, ok := this_.owner.event.(IResumeEvent); ok {
+		e.OnResumed(cctx)
+	}
+}
+
+// retain 保留断开的会话, d 之后检查是否到期
+func (this_ *baseServer) retain(cctx *ConnContext, d time.Duration) {
+	if cctx.idle.task == nil {
+		cctx.idle.task = func() { this_.checkIdle(cctx) }
+	}
+
+	this_.wheel.schedule(&cctx.idle, d)
+}
+
+// detach 连接断开时尝试保留会话, 返回 true 时不触发 OnDisconnected
+func (this_ *baseServer) detach(cctx *ConnContext) bool {
+	return this_.owner.resume != nil && this_.owner.resume.detach(cctx)
+}
+
+// expire 检查断开的会话, 保留到期时触发 OnDisconnected. 返回 false 表示 cctx 仍是会话当前的连接
+func (this_ *baseServer) expire(cctx *ConnContext) bool {
+	current, ended := this_.owner.resume.expire(cctx)
+	if ended {
+		this_.removeConn(cctx)
+		this_.owner.event.OnDisconnected(cctx)
+		atomic.StoreUint64(&cctx.id, 0)
+	}
+
+	return !current
+}
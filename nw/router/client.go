@@ -0,0 +1,231 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gox/frm/log"
+	"github.com/gox/frm/nw"
+	"github.com/gox/frm/utils"
+)
+
+var ErrClientClosed = errors.New("router client closed")
+
+// RemoteError 服务端处理请求出错
+type RemoteError struct {
+	Cmd     uint32 // 命令号
+	Message string // 错误描述
+}
+
+func (this_ *RemoteError) Error() string {
+	return this_.Message
+}
+
+// transport 客户端传输
+type transport interface {
+	Write([]byte) error
+	Read() ([]byte, error)
+	Close() error
+}
+
+// wsTransport 适配 WsClient, WsClient 不支持并发写
+type wsTransport struct {
+	c   *nw.WsClient
+	mtx sync.Mutex
+}
+
+func (this_ *wsTransport) Write(data []byte) error {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	_, err := this_.c.Write(data)
+	return err
+}
+
+func (this_ *wsTransport) Read() ([]byte, error) {
+	return this_.c.Read()
+}
+
+func (this_ *wsTransport) Close() error {
+	return this_.c.Close()
+}
+
+// Client 请求/应答客户端
+//
+// 接管底层客户端的读取, 为每个请求分配序列号并将应答与请求关联. 创建后不能再直接调用底层客户端的 Read
+type Client struct {
+	t         transport
+	seq       uint32
+	timeout   time.Duration
+	mtx       sync.Mutex
+	pending   map[uint32]chan frame
+	onPush    func(Header, []byte)
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+type frame struct {
+	h    Header
+	body []byte
+}
+
+// NewTCPClient 基于 AsyncTCPClient 创建请求/应答客户端
+//   - timeout: 默认请求超时, 调用时 ctx 没有截止时间时使用, 0 表示不超时
+func NewTCPClient(c *nw.AsyncTCPClient, timeout time.Duration) *Client {
+	return newClient(c, timeout)
+}
+
+// NewWsClient 基于 WsClient 创建请求/应答客户端
+//   - timeout: 默认请求超时, 调用时 ctx 没有截止时间时使用, 0 表示不超时
+func NewWsClient(c *nw.WsClient, timeout time.Duration) *Client {
+	return newClient(&wsTransport{c: c}, timeout)
+}
+
+func newClient(t transport, timeout time.Duration) *Client {
+	this_ := &Client{
+		t:       t,
+		timeout: timeout,
+		pending: make(map[uint32]chan frame),
+		closeCh: make(chan struct{}),
+	}
+
+	go this_.readLoop()
+	return this_
+}
+
+// OnPush 设置服务端单向消息的处理函数, 在读协程中调用
+func (this_ *Client) OnPush(handler func(Header, []byte)) {
+	this_.mtx.Lock()
+	this_.onPush = handler
+	this_.mtx.Unlock()
+}
+
+// Call 发送请求并等待应答
+//   - ctx: 用于取消请求, 没有截止时间时使用默认超时
+//   - cmd: 命令号
+//   - body: 请求消息体
+func (this_ *Client) Call(ctx context.Context, cmd uint32, body []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok && this_.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, this_.timeout)
+		defer cancel()
+	}
+
+	seq := atomic.AddUint32(&this_.seq, 1)
+	ch := make(chan frame, 1)
+
+	this_.mtx.Lock()
+	if this_.err != nil {
+		this_.mtx.Unlock()
+		return nil, this_.err
+	}
+	this_.pending[seq] = ch
+	this_.mtx.Unlock()
+
+	defer func() {
+		this_.mtx.Lock()
+		delete(this_.pending, seq)
+		this_.mtx.Unlock()
+	}()
+
+	err := this_.t.Write(Header{Cmd: cmd, Seq: seq}.Encode(body))
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case f := <-ch:
+		if f.h.IsError() {
+			return nil, &RemoteError{Cmd: cmd, Message: string(f.body)}
+		}
+		return f.body, nil
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+
+	case <-this_.closeCh:
+		return nil, this_.closedErr()
+	}
+}
+
+// Notify 发送单向消息
+func (this_ *Client) Notify(cmd uint32, body []byte) error {
+	return this_.t.Write(Header{Cmd: cmd, Flags: Flag_Push}.Encode(body))
+}
+
+// Close 关闭客户端及底层连接
+func (this_ *Client) Close() error {
+	this_.shutdown(ErrClientClosed)
+	return this_.t.Close()
+}
+
+// Invoke 发送 protobuf 类型的请求并等待应答
+func Invoke[Req, Rsp any, PReq message[Req], PRsp message[Rsp]](ctx context.Context, c *Client, cmd uint32, req *Req) (*Rsp, error) {
+	data, err := c.Call(ctx, cmd, utils.PbEncode[Req, PReq](req))
+	if err != nil {
+		return nil, err
+	}
+
+	return utils.PbDecode[Rsp, PRsp](data)
+}
+
+func (this_ *Client) closedErr() error {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+	return this_.err
+}
+
+func (this_ *Client) shutdown(err error) {
+	this_.closeOnce.Do(func() {
+		this_.mtx.Lock()
+		this_.err = err
+		this_.mtx.Unlock()
+		close(this_.closeCh)
+	})
+}
+
+// readLoop 读取应答和单向消息
+func (this_ *Client) readLoop() {
+	for {
+		data, err := this_.t.Read()
+		if err != nil {
+			this_.shutdown(err)
+			return
+		}
+
+		h, body, err := Decode(data)
+		if err != nil {
+			log.Error("router client decode failed: %v", err)
+			continue
+		}
+
+		if !h.IsResponse() {
+			this_.mtx.Lock()
+			onPush := this_.onPush
+			this_.mtx.Unlock()
+
+			if onPush != nil {
+				onPush(h, body)
+			}
+			continue
+		}
+
+		this_.mtx.Lock()
+		ch, ok := this_.pending[h.Seq]
+		this_.mtx.Unlock()
+
+		// 请求已超时或取消
+		if !ok {
+			continue
+		}
+
+		select {
+		case ch <- frame{h: h, body: body}:
+		default:
+		}
+	}
+}
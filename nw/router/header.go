@@ -0,0 +1,67 @@
+package router
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// 帧标志
+const (
+	Flag_Response uint16 = 1 << 0 // 应答帧
+	Flag_Error    uint16 = 1 << 1 // 应答出错, 消息体为错误描述
+	Flag_Push     uint16 = 1 << 2 // 单向消息, 不需要应答
+)
+
+// HEADER_SIZE 帧头长度
+//
+// 帧格式(大端): CMD[uint32] + SEQ[uint32] + FLAGS[uint16] + BODY
+const HEADER_SIZE = 10
+
+var ErrInvalidFrame = errors.New("invalid frame")
+
+// Header 帧头
+type Header struct {
+	Cmd   uint32 // 命令号
+	Seq   uint32 // 序列号, 应答帧与请求帧相同, 用于关联请求与应答
+	Flags uint16 // 标志
+}
+
+// IsResponse 是否为应答帧
+func (this_ Header) IsResponse() bool {
+	return this_.Flags&Flag_Response != 0
+}
+
+// IsError 是否为出错的应答帧
+func (this_ Header) IsError() bool {
+	return this_.Flags&Flag_Error != 0
+}
+
+// IsPush 是否为单向消息
+func (this_ Header) IsPush() bool {
+	return this_.Flags&Flag_Push != 0
+}
+
+// Encode 编码帧
+func (this_ Header) Encode(body []byte) []byte {
+	data := make([]byte, HEADER_SIZE+len(body))
+	binary.BigEndian.PutUint32(data, this_.Cmd)
+	binary.BigEndian.PutUint32(data[4:], this_.Seq)
+	binary.BigEndian.PutUint16(data[8:], this_.Flags)
+	copy(data[HEADER_SIZE:], body)
+	return data
+}
+
+// Decode 解码帧, 返回的消息体引用 data
+func Decode(data []byte) (Header, []byte, error) {
+	if len(data) < HEADER_SIZE {
+		return Header{}, nil, ErrInvalidFrame
+	}
+
+	h := Header{
+		Cmd:   binary.BigEndian.Uint32(data),
+		Seq:   binary.BigEndian.Uint32(data[4:]),
+		Flags: binary.BigEndian.Uint16(data[8:]),
+	}
+
+	return h, data[HEADER_SIZE:], nil
+}
@@ -0,0 +1,158 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gox/frm/log"
+	"github.com/gox/frm/nw"
+	"github.com/gox/frm/utils"
+	"google.golang.org/protobuf/proto"
+)
+
+// ERR_INTERNAL 处理函数返回的错误不是 *Error 时发给客户端的错误描述, 原始错误只记录日志
+const ERR_INTERNAL = "internal error"
+
+// Error 可以发给客户端的错误
+//
+// 处理函数返回的错误是(或包装了) *Error 时 Message 原样发给客户端, 其他错误发送 ERR_INTERNAL, 避免泄露内部细节
+type Error struct {
+	Message string // 错误描述
+}
+
+func (this_ *Error) Error() string {
+	return this_.Message
+}
+
+// Errorf 创建可以发给客户端的错误
+func Errorf(format string, args ...any) *Error {
+	return &Error{Message: fmt.Sprintf(format, args...)}
+}
+
+// message protobuf 消息约束, 与 utils.PbEncode 一致
+type message[T any] interface {
+	*T
+	proto.Message
+}
+
+// Context 请求上下文
+type Context struct {
+	Conn   *nw.ConnContext // 请求所属连接
+	Header Header          // 请求帧头
+}
+
+// HandlerFunc 请求处理函数, 返回应答消息体. 单向消息的返回值被忽略
+type HandlerFunc func(ctx *Context, body []byte) ([]byte, error)
+
+// Router 命令路由
+//
+// 在 IServiceEvent.OnData 中调用 Router.OnData, 按命令号分发到注册的处理函数, 并将处理结果作为应答写回
+type Router struct {
+	mtx      sync.RWMutex
+	handlers map[uint32]HandlerFunc
+	notFound HandlerFunc
+}
+
+// New 创建路由
+func New() *Router {
+	return &Router{
+		handlers: make(map[uint32]HandlerFunc),
+	}
+}
+
+// Handle 注册命令处理函数, 重复注册会覆盖之前的处理函数
+func (this_ *Router) Handle(cmd uint32, handler HandlerFunc) {
+	this_.mtx.Lock()
+	this_.handlers[cmd] = handler
+	this_.mtx.Unlock()
+}
+
+// NotFound 设置未注册命令的处理函数, 默认应答错误
+func (this_ *Router) NotFound(handler HandlerFunc) {
+	this_.mtx.Lock()
+	this_.notFound = handler
+	this_.mtx.Unlock()
+}
+
+// Register 注册 protobuf 类型的命令处理函数
+//
+//	router.Register(r, CMD_LOGIN, func(ctx *router.Context, req *pb.LoginReq) (*pb.LoginRsp, error) {
+//		...
+//	})
+func Register[Req, Rsp any, PReq message[Req], PRsp message[Rsp]](r *Router, cmd uint32, handler func(*Context, *Req) (*Rsp, error)) {
+	r.Handle(cmd, func(ctx *Context, body []byte) ([]byte, error) {
+		req, err := utils.PbDecode[Req, PReq](body)
+		if err != nil {
+			log.Error("[%d:%v] decode request %d failed: %v", ctx.Conn.Fd(), ctx.Conn.RemoteAddr(), cmd, err)
+			return nil, &Error{Message: "invalid request"}
+		}
+
+		rsp, err := handler(ctx, req)
+		if err != nil || rsp == nil {
+			return nil, err
+		}
+
+		return utils.PbEncode[Rsp, PRsp](rsp), nil
+	})
+}
+
+// OnData 处理一帧数据, 在 IServiceEvent.OnData 中调用
+//
+// 返回错误表示帧格式不正确, 调用方应关闭连接; 处理函数返回的错误以出错应答的形式发给客户端, 见 Error
+func (this_ *Router) OnData(cctx *nw.ConnContext, data []byte) error {
+	h, body, err := Decode(data)
+	if err != nil {
+		return err
+	}
+
+	this_.mtx.RLock()
+	handler, ok := this_.handlers[h.Cmd]
+	if !ok {
+		handler = this_.notFound
+	}
+	this_.mtx.RUnlock()
+
+	var rsp []byte
+	if handler == nil {
+		err = Errorf("unknown command %d", h.Cmd)
+	} else {
+		rsp, err = handler(&Context{Conn: cctx, Header: h}, body)
+	}
+
+	if h.IsPush() {
+		if err != nil {
+			log.Error("[%d:%v] handle push %d failed: %v", cctx.Fd(), cctx.RemoteAddr(), h.Cmd, err)
+		}
+		return nil
+	}
+
+	flags := Flag_Response
+	if err != nil {
+		flags |= Flag_Error
+		rsp = []byte(clientError(cctx, h.Cmd, err))
+	}
+
+	return cctx.Write(Header{Cmd: h.Cmd, Seq: h.Seq, Flags: flags}.Encode(rsp))
+}
+
+// clientError 发给客户端的错误描述
+func clientError(cctx *nw.ConnContext, cmd uint32, err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Message
+	}
+
+	log.Error("[%d:%v] handle request %d failed: %v", cctx.Fd(), cctx.RemoteAddr(), cmd, err)
+	return ERR_INTERNAL
+}
+
+// Push 向客户端发送单向消息
+func Push(cctx *nw.ConnContext, cmd uint32, body []byte) error {
+	return cctx.Write(Header{Cmd: cmd, Flags: Flag_Push}.Encode(body))
+}
+
+// PushPb 向客户端发送 protobuf 类型的单向消息
+func PushPb[T any, U message[T]](cctx *nw.ConnContext, cmd uint32, msg *T) error {
+	return Push(cctx, cmd, utils.PbEncode[T, U](msg))
+}
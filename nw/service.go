@@ -1,10 +1,11 @@
 package nw
 
 import (
+	"context"
 	"encoding/json"
-	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/gox/frm/log"
@@ -19,6 +20,7 @@ const (
 	Protocol_TCP       Protocol = 1
 	Protocol_Websocket Protocol = 2
 	Protocol_UDP       Protocol = 3
+	Protocol_KCP       Protocol = 4
 )
 
 func (this_ Protocol) String() string {
@@ -29,6 +31,8 @@ func (this_ Protocol) String() string {
 		return "websocket"
 	case Protocol_UDP:
 		return "udp"
+	case Protocol_KCP:
+		return "kcp"
 	}
 
 	return "none"
@@ -48,35 +52,117 @@ const (
 	TCP_HEADER_SIZE  = int(unsafe.Sizeof(uint32(0))) // 消息头长度
 	MESSAGE_MAX_SIZE = uint32(1024 * 1024 * 2)       // 消息体最大长度
 
-	DEFAULT_CHAN_SIZE = 1000000
+	SHUTDOWN_POLL_INTERVAL = 10 * time.Millisecond // 平滑关闭时检查连接状态的周期
 )
 
 // IServiceEvent 服务事件
 type IServiceEvent interface {
-	OnInit(*Service) error             // 初始化事件
-	OnConnected(*ConnContext) error    // 客户端连接事件
-	OnDisconnected(*ConnContext)       // 客户端连接断开事件
-	OnStopped(*Service)                // 服务停止事件
-	OnData(*ConnContext, []byte) error // 消息事件
+	OnInit(*Service) error               // 初始化事件
+	OnConnected(*ConnContext) error      // 客户端连接事件
+	OnDisconnected(*ConnContext)         // 客户端连接断开事件
+	OnStopped(*Service)                  // 服务停止事件
+	OnData(*ConnContext, []byte) error   // 消息事件
+	OnIdle(*ConnContext, IdleState) bool // 连接空闲事件, 返回 false 时关闭连接. 在 gnet 的定时任务协程(OnTick)中调用, 与事件循环并发, 不能阻塞
+}
+
+// MessageType 消息类型, 只有 websocket 区分文本和二进制消息, 其它协议均为二进制
+type MessageType int
+
+const (
+	MessageType_Binary MessageType = 0 // 二进制消息
+	MessageType_Text   MessageType = 1 // 文本消息, 内容为合法的 UTF-8
+)
+
+func (this_ MessageType) String() string {
+	switch this_ {
+	case MessageType_Binary:
+		return "binary"
+	case MessageType_Text:
+		return "text"
+	}
+
+	return "unknown"
+}
+
+// IMessageEvent 需要区分消息类型的服务事件, IServiceEvent 同时实现该接口时由 OnMessage 代替 OnData 接收消息
+type IMessageEvent interface {
+	OnMessage(*ConnContext, MessageType, []byte) error // 消息事件
 }
 
 // Config 服务配置
 type Config struct {
 	TcpHost   string `json:"tcp_host,omitempty"` // tcp 监听地址
 	WsHost    string `json:"ws_host,omitempty"`  // websocket 监听地址
-	HeadBlend uint32 `json:"-"`                  // tcp 消息头混合值
+	UdpHost   string `json:"udp_host,omitempty"` // udp 监听地址
+	KcpHost   string `json:"kcp_host,omitempty"` // kcp(可靠udp) 监听地址
+	HeadBlend uint32 `json:"-"`                  // tcp 消息头混合值, 只对默认编解码器有效
+	Codec     Codec  `json:"-"`                  // tcp 帧编解码器, 为 nil 时使用 DefaultCodec(HeadBlend)
+	TlsCert   string `json:"tls_cert,omitempty"` // tls 证书文件, 设置后 tcp 和 websocket 均启用 tls
+	TlsKey    string `json:"tls_key,omitempty"`  // tls 私钥文件
+	TlsCA     string `json:"tls_ca,omitempty"`   // 客户端 CA 文件, 设置后启用双向认证
 	MaxConn   int    `json:"max_conn"`           // 最大连接数
-	Timeout   int64  `json:"timeout"`            // 客户端超时值
+	Timeout   int64  `json:"timeout"`            // 客户端超时值, 单位秒, 即读空闲超时, 设置 ReadIdle 后无效
+	Heartbeat bool   `json:"heartbeat"`          // 服务端是否主动发送心跳并测量 RTT. tcp 使用默认编解码器时同时启用心跳帧, 客户端需要设置 TCPClientConfig.Heartbeat
+
+	ReadIdle          int64 `json:"read_idle,omitempty"`          // 读空闲超时, 单位秒, 默认为 Timeout
+	WriteIdle         int64 `json:"write_idle,omitempty"`         // 写空闲超时, 单位秒, 0 表示不检测
+	AllIdle           int64 `json:"all_idle,omitempty"`           // 读写空闲超时, 单位秒, 0 表示不检测
+	HeartbeatInterval int64 `json:"heartbeat_interval,omitempty"` // 心跳周期, 单位秒, 默认为 HEART_BEAT_INTERVAL
+
+	Dispatch DispatchMode `json:"dispatch"`          // 消息分发模式, 默认按连接保序
+	Workers  int          `json:"workers,omitempty"` // 消息处理协程数, 默认为 CPU 核数, 内联模式无效
+
+	QueueSize     int            `json:"queue_size,omitempty"`      // 待处理消息总数上限, 默认为 DEFAULT_QUEUE_SIZE
+	ConnQueueSize int            `json:"conn_queue_size,omitempty"` // 单个连接待处理消息数上限, 0 表示不限制
+	QueuePolicy   OverflowPolicy `json:"queue_policy"`              // 待处理消息超过上限时的策略, 默认阻塞事件循环
+	MaxPending    int            `json:"max_pending,omitempty"`     // 单个连接待发送字节数上限, 0 表示不限制. 仅对 tcp 和 websocket 有效
+	PendingPolicy OverflowPolicy `json:"pending_policy"`            // 待发送字节数超过上限时的策略, 默认阻塞写入方
+
+	KcpNoCongestion bool `json:"kcp_no_congestion"` // kcp 是否关闭拥塞控制, 关闭后延迟更低, 但丢包时仍以满窗口发送, 可能加剧网络拥塞
+
+	TcpEncrypt    bool   `json:"tcp_encrypt"`               // tcp 连接是否要求建立加密会话, 客户端需要设置 TCPClientConfig.Cipher
+	TcpEncryptKey string `json:"tcp_encrypt_key,omitempty"` // 加密会话的预共享密钥, 用于认证对端和防止中间人, 客户端需要使用相同的值. 为空时只能防止被动窃听
+
+	Resume        bool  `json:"resume"`                   // tcp 和 websocket 是否支持断线重连后恢复会话, 客户端需要开启 ReconnectConfig.Resume
+	ResumeTimeout int64 `json:"resume_timeout,omitempty"` // 连接断开后保留会话的时间, 单位秒, 默认为 RESUME_TIMEOUT
+	ResumeBuffer  int   `json:"resume_buffer,omitempty"`  // 单个会话保存的未确认消息数上限, 超过后无法恢复, 默认为 RESUME_BUFFER_SIZE
+
+	TcpCompress          CompressType `json:"tcp_compress"`                     // tcp 消息压缩算法, 开启后消息体增加 1 字节压缩标志, 客户端需要同时开启
+	TcpCompressThreshold int          `json:"tcp_compress_threshold,omitempty"` // 小于该长度的 tcp 消息不压缩, 默认为 TCP_COMPRESS_THRESHOLD
+
+	WsCompress              bool `json:"ws_compress"`                     // websocket 是否协商 permessage-deflate 压缩
+	WsCompressThreshold     int  `json:"ws_compress_threshold,omitempty"` // 小于该长度的消息不压缩, 默认为 WS_COMPRESS_THRESHOLD
+	WsServerContextTakeover bool `json:"ws_server_context_takeover"`      // 服务端压缩是否保留上下文, 压缩率更高但每个连接需要独占压缩器
+	WsClientContextTakeover bool `json:"ws_client_context_takeover"`      // 是否允许客户端压缩保留上下文, 需要为每个连接保存解压窗口
+
+	WsAllowOrigins []string `json:"ws_allow_origins,omitempty"` // 允许的 websocket Origin, 支持 https://*.example.com 形式的通配符. 为空时不检查, 没有 Origin 头的请求总是允许
+
+	RateLimit      int      `json:"rate_limit,omitempty"`      // 单个连接每秒消息数上限, 超过后断开连接, 0 表示不限制
+	ByteRateLimit  int      `json:"byte_rate_limit,omitempty"` // 单个连接每秒字节数上限, 超过后断开连接, 0 表示不限制
+	MaxConnPerIP   int      `json:"max_conn_per_ip,omitempty"` // 单个 IP 最大连接数, 0 表示不限制
+	AllowIPs       []string `json:"allow_ips,omitempty"`       // IP 白名单, 支持 CIDR, 设置后只接受名单中的地址
+	DenyIPs        []string `json:"deny_ips,omitempty"`        // IP 黑名单, 支持 CIDR
+	TrustedProxies []string `json:"trusted_proxies,omitempty"` // 可信代理, 支持 CIDR. 来自可信代理的 websocket 连接使用 X-Forwarded-For / X-Real-IP 作为客户端 IP
+	ProxyProtocol  []string `json:"proxy_protocol,omitempty"`  // 发送 PROXY protocol 头的可信来源 (如负载均衡器), 支持 CIDR. 来自这些地址的 tcp 和 websocket 连接必须以 v1 或 v2 头开始, 之后使用头中的客户端地址
+
+	Metrics    IMetrics `json:"-"`                     // 指标采集, 为 nil 且设置了 AdminHost 时使用 NewMetrics(), 否则不采集
+	AdminHost  string   `json:"admin_host,omitempty"`  // 管理接口监听地址, 在 /metrics 提供 Prometheus 格式的指标. 为空时不监听, 可以通过 MetricsHandler 挂载到已有的 http 服务
+	AdminToken string   `json:"admin_token,omitempty"` // 管理 API 的访问令牌, 设置后管理接口在 /admin/ 下提供 AdminHandler 的接口
 }
 
 // serverInfo 服务信息
 type serverInfo struct {
-	State    int32  `json:"state"`              // 服务状态
-	CurrConn int    `json:"curr_conn"`          // 当前连接数
-	MaxConn  int    `json:"max_conn"`           // 最大连接数
-	Timeout  int64  `json:"timeout"`            // 超时值
-	TcpHost  string `json:"tcp_host,omitempty"` // cp 监听地址
-	WsHost   string `json:"ws_host,omitempty"`  // websocket 监听地址
+	State     int32  `json:"state"`              // 服务状态
+	CurrConn  int    `json:"curr_conn"`          // 当前连接数
+	MaxConn   int    `json:"max_conn"`           // 最大连接数
+	Timeout   int64  `json:"timeout"`            // 超时值
+	TcpHost   string `json:"tcp_host,omitempty"` // cp 监听地址
+	WsHost    string `json:"ws_host,omitempty"`  // websocket 监听地址
+	UdpHost   string `json:"udp_host,omitempty"` // udp 监听地址
+	KcpHost   string `json:"kcp_host,omitempty"` // kcp 监听地址
+	Tls       bool   `json:"tls"`                // 是否启用 tls
+	Heartbeat bool   `json:"heartbeat"`          // 是否主动发送心跳
+	Dispatch  string `json:"dispatch"`           // 消息分发模式
 }
 
 func (this_ *serverInfo) String() string {
@@ -86,22 +172,34 @@ func (this_ *serverInfo) String() string {
 
 // Service 网络服务
 type Service struct {
-	info    *serverInfo                       // 服务信息
-	tcpSvr  *tcpServer                        // tcp服务
-	wsSvr   *wsServer                         // websocket服务
-	conns   *utils.SafeMap[int, *ConnContext] // 客户端连接池
-	wkrPool []*messageWorker                  // 消息工作池
-	event   IServiceEvent                     // 事件
-	wg      sync.WaitGroup                    // 协程同步
+	info     *serverInfo                          // 服务信息
+	tcpSvr   *tcpServer                           // tcp服务
+	wsSvr    *wsServer                            // websocket服务
+	udpSvr   *udpServer                           // udp服务
+	kcpSvr   *kcpServer                           // kcp服务
+	certs    *certLoader                          // tls 证书
+	conns    *utils.SafeMap[uint64, *ConnContext] // 客户端连接池, 连接ID => 连接上下文
+	groups   *groupManager                        // 分组
+	dispatch dispatcher                           // 消息分发器
+	bp       *backpressure                        // 队列上限控制
+	limiter  *connLimiter                         // 连接限制
+	resume   *resumeManager                       // 会话恢复, 未开启时为 nil
+	metrics  IMetrics                             // 指标采集, 未设置时为 noopMetrics
+	admin    *adminServer                         // 管理接口, 未设置 AdminHost 时为 nil
+	idle     idleConfig                           // 空闲检测配置
+	event    IServiceEvent                        // 事件
+	msgEvent IMessageEvent                        // 区分消息类型的事件, event 未实现时为 nil
+	wg       sync.WaitGroup                       // 协程同步
+	lastID   uint64                               // 最后分配的连接ID
 }
 
 // NewService 创建一个新的 Service
 //   - c: 服务配置
 //   - event: 服务事件接口
 //
-// 注意: 必须至少提供一个监听地址 (TcpHost 或 WsHost)
+// 注意: 必须至少提供一个监听地址 (TcpHost, WsHost, UdpHost 或 KcpHost)
 func NewService(c *Config, event IServiceEvent) *Service {
-	if len(c.TcpHost) == 0 && len(c.WsHost) == 0 {
+	if len(c.TcpHost) == 0 && len(c.WsHost) == 0 && len(c.UdpHost) == 0 && len(c.KcpHost) == 0 {
 		log.Fatal("must bind a listen address")
 		return nil
 	}
@@ -112,31 +210,87 @@ func NewService(c *Config, event IServiceEvent) *Service {
 
 	// 创建服务对象
 	this_ := &Service{
-		conns: utils.NewSafeMap[int, *ConnContext](),
+		conns:  utils.NewSafeMap[uint64, *ConnContext](),
+		groups: newGroupManager(),
 		info: &serverInfo{
-			State:   ServiceState_Stopped,
-			MaxConn: c.MaxConn,
-			TcpHost: c.TcpHost,
-			WsHost:  c.WsHost,
-			Timeout: c.Timeout,
+			State:     ServiceState_Stopped,
+			MaxConn:   c.MaxConn,
+			TcpHost:   c.TcpHost,
+			WsHost:    c.WsHost,
+			UdpHost:   c.UdpHost,
+			KcpHost:   c.KcpHost,
+			Timeout:   c.Timeout,
+			Dispatch:  c.Dispatch.String(),
+			Heartbeat: c.Heartbeat,
 		},
+		idle:  newIdleConfig(c),
 		event: event,
 	}
 
-	// 创建消息工作池
-	n := runtime.NumCPU()
-	for i := 0; i < n; i++ {
-		this_.wkrPool = append(this_.wkrPool, newMessageWorker(this_.messageHandle))
+	this_.msgEvent, _ = event.(IMessageEvent)
+
+	// 加载 tls 证书
+	if len(c.TlsCert) > 0 {
+		certs, err := newCertLoader(c.TlsCert, c.TlsKey, c.TlsCA)
+		if err != nil {
+			log.Fatal("load certificate failed: %v", err)
+			return nil
+		}
+
+		this_.certs = certs
+		this_.info.Tls = true
 	}
 
+	limiter, err := newConnLimiter(c)
+	if err != nil {
+		log.Fatal("invalid ip list: %v", err)
+		return nil
+	}
+	this_.limiter = limiter
+	this_.resume = newResumeManager(this_, c)
+
+	this_.metrics = c.Metrics
+	if this_.metrics == nil && len(c.AdminHost) > 0 {
+		this_.metrics = NewMetrics()
+	}
+	if this_.metrics == nil {
+		this_.metrics = noopMetrics{}
+	}
+
+	if len(c.AdminHost) > 0 {
+		this_.admin = newAdminServer(this_, c.AdminHost, c.AdminToken)
+	}
+
+	// 创建消息分发器
+	this_.bp = newBackpressure(c)
+	handle := this_.messageHandle
+	if c.Dispatch == DispatchMode_Inline {
+		handle = this_.inlineHandle
+	}
+	this_.dispatch = newDispatcher(c.Dispatch, c.Workers, cap(this_.bp.queue), handle)
+
 	if len(c.TcpHost) > 0 {
-		this_.tcpSvr = newTcpServer(this_, c)
+		fc, err := newFrameCompressor(c.TcpCompress, c.TcpCompressThreshold)
+		if err != nil {
+			log.Fatal("invalid tcp compress: %v", err)
+			return nil
+		}
+
+		this_.tcpSvr = newTcpServer(this_, c, fc)
 	}
 
 	if len(c.WsHost) > 0 {
 		this_.wsSvr = newWsServer(this_, c)
 	}
 
+	if len(c.UdpHost) > 0 {
+		this_.udpSvr = newUdpServer(this_, c)
+	}
+
+	if len(c.KcpHost) > 0 {
+		this_.kcpSvr = newKcpServer(this_, c)
+	}
+
 	return this_
 }
 
@@ -163,6 +317,130 @@ func (this_ *Service) WsHost() string {
 	return ""
 }
 
+// UdpHost udp 监听地址
+func (this_ *Service) UdpHost() string {
+	if this_.udpSvr != nil {
+		return this_.udpSvr.host
+	}
+
+	return ""
+}
+
+// KcpHost kcp 监听地址
+func (this_ *Service) KcpHost() string {
+	if this_.kcpSvr != nil {
+		return this_.kcpSvr.host
+	}
+
+	return ""
+}
+
+// ReloadCertificate 重新加载 tls 证书, 只影响之后建立的连接
+//
+// 证书文件变更后也会被自动加载, 该方法用于需要立即生效的场景 (如收到 SIGHUP)
+func (this_ *Service) ReloadCertificate() error {
+	if this_.certs == nil {
+		return nil
+	}
+
+	return this_.certs.Reload()
+}
+
+// GetConn 根据连接ID获取连接, 连接不存在或已关闭时返回 nil
+func (this_ *Service) GetConn(id uint64) *ConnContext {
+	return this_.conns.Get(id)
+}
+
+// Write 根据连接ID发送数据
+//
+// 连接ID不会被复用, 异步任务应保存连接ID而不是 *ConnContext, 连接关闭后写入会返回 *StaleConnError
+func (this_ *Service) Write(id uint64, data []byte) error {
+	cctx, err := this_.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	return cctx.Write(data)
+}
+
+// WriteText 根据连接ID发送文本消息, 见 ConnContext.WriteText
+func (this_ *Service) WriteText(id uint64, data []byte) error {
+	cctx, err := this_.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	return cctx.WriteText(data)
+}
+
+// Close 根据连接ID关闭连接, 连接已关闭时返回 *StaleConnError
+func (this_ *Service) Close(id uint64) error {
+	cctx, err := this_.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	cctx.Close()
+	return nil
+}
+
+// CloseWithStatus 根据连接ID关闭连接, 见 ConnContext.CloseWithStatus
+func (this_ *Service) CloseWithStatus(id uint64, code uint16, reason string) error {
+	cctx, err := this_.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	cctx.CloseWithStatus(code, reason)
+	return nil
+}
+
+// ConnInfo 根据连接ID获取连接信息, 连接已关闭或在读取期间关闭时返回 *StaleConnError
+func (this_ *Service) ConnInfo(id uint64) (ConnInfo, error) {
+	cctx, err := this_.lookup(id)
+	if err != nil {
+		return ConnInfo{}, err
+	}
+
+	// 连接ID不会被复用, 读取后ID仍未变化说明信息属于该连接
+	info := cctx.Info()
+	if cctx.ID() != id {
+		return ConnInfo{}, &StaleConnError{ID: id}
+	}
+
+	return info, nil
+}
+
+// lookup 根据连接ID查找连接, 连接不存在或上下文已被复用时返回 *StaleConnError
+func (this_ *Service) lookup(id uint64) (*ConnContext, error) {
+	cctx := this_.conns.Get(id)
+	if cctx == nil || cctx.ID() != id {
+		return nil, &StaleConnError{ID: id}
+	}
+
+	return cctx, nil
+}
+
+// newConnID 分配连接ID
+func (this_ *Service) newConnID() uint64 {
+	return atomic.AddUint64(&this_.lastID, 1)
+}
+
+// QueueStats 队列统计
+func (this_ *Service) QueueStats() QueueStats {
+	return this_.bp.stats()
+}
+
+// LimitStats 限流统计
+func (this_ *Service) LimitStats() LimitStats {
+	return this_.limiter.stats()
+}
+
+// Metrics 指标采集, 未设置时为不做任何处理的实现
+func (this_ *Service) Metrics() IMetrics {
+	return this_.metrics
+}
+
 // CurrConn 当前在线人数
 func (this_ *Service) CurrConn() int {
 	return this_.conns.Count()
@@ -174,10 +452,7 @@ func (this_ *Service) Run() {
 		return
 	}
 
-	this_.wg.Add(len(this_.wkrPool))
-	for _, wkr := range this_.wkrPool {
-		go wkr.run(&this_.wg)
-	}
+	this_.dispatch.start(&this_.wg)
 
 	err := this_.event.OnInit(this_)
 	if err != nil {
@@ -206,17 +481,140 @@ func (this_ *Service) Run() {
 		}()
 	}
 
+	if this_.udpSvr != nil {
+		this_.wg.Add(1)
+		go func() {
+			err := Run(this_.udpSvr)
+			if err != nil {
+				log.Error("udp server run failed: %v", err)
+			}
+			this_.wg.Done()
+		}()
+	}
+
+	if this_.kcpSvr != nil {
+		this_.wg.Add(1)
+		go func() {
+			err := Run(this_.kcpSvr)
+			if err != nil {
+				log.Error("kcp server run failed: %v", err)
+			}
+			this_.wg.Done()
+		}()
+	}
+
+	if this_.admin != nil {
+		this_.wg.Add(1)
+		go func() {
+			err := this_.admin.run()
+			if err != nil {
+				log.Error("admin server run failed: %v", err)
+			}
+			this_.wg.Done()
+		}()
+	}
+
 	this_.wg.Wait()
 	this_.event.OnStopped(this_)
 	atomic.StoreInt32(&this_.info.State, ServiceState_Stopped)
 }
 
 // Stop 停止服务
+//
+// 立即停止, 未处理的消息和未发送的数据会被丢弃, 需要平滑关闭时使用 Shutdown
 func (this_ *Service) Stop() {
 	if !atomic.CompareAndSwapInt32(&this_.info.State, ServiceState_Running, ServiceState_Stopping) {
 		return
 	}
 
+	this_.stop()
+}
+
+// ShutdownResult 平滑关闭结果
+type ShutdownResult struct {
+	Drained int `json:"drained"` // 排空后正常关闭的连接数
+	Killed  int `json:"killed"`  // 到达截止时间后强制关闭的连接数
+}
+
+// Shutdown 平滑关闭服务
+//   - ctx: 截止时间, 到达后强制关闭剩余连接
+//   - goAway: 关闭前发送给所有客户端的通知, 为 nil 时不发送. websocket 客户端收到的是 1001 (going away) 关闭帧
+//
+// 关闭流程: 停止接受新连接 -> 发送 goAway -> 等待每个连接的消息处理完成且发送数据全部写出后关闭该连接
+// -> 到达截止时间后强制关闭剩余连接 -> 停止服务. 有连接被强制关闭时返回 ctx.Err()
+func (this_ *Service) Shutdown(ctx context.Context, goAway []byte) (ShutdownResult, error) {
+	var res ShutdownResult
+
+	// 状态变为 Stopping 后不再接受新连接
+	if !atomic.CompareAndSwapInt32(&this_.info.State, ServiceState_Running, ServiceState_Stopping) {
+		return res, nil
+	}
+
+	if goAway != nil {
+		this_.conns.Range(func(id uint64, cctx *ConnContext) bool {
+			if err := cctx.goAway(goAway); err != nil {
+				log.Warn("[%d:%v] send go away failed: %v", id, cctx.RemoteAddr(), err)
+			}
+			return true
+		})
+	}
+
+	closing := map[*ConnContext]bool{}
+	ticker := time.NewTicker(SHUTDOWN_POLL_INTERVAL)
+	defer ticker.Stop()
+
+DRAIN_LOOP:
+	for {
+		var idle []*ConnContext
+		this_.conns.Range(func(id uint64, cctx *ConnContext) bool {
+			if !closing[cctx] && cctx.drained() {
+				idle = append(idle, cctx)
+			}
+			return true
+		})
+
+		for _, cctx := range idle {
+			closing[cctx] = true
+			cctx.Close()
+		}
+		res.Drained += len(idle)
+
+		if this_.conns.Count() == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			var remain []*ConnContext
+			this_.conns.Range(func(id uint64, cctx *ConnContext) bool {
+				if !closing[cctx] {
+					remain = append(remain, cctx)
+				}
+				return true
+			})
+
+			for _, cctx := range remain {
+				cctx.Close()
+			}
+			res.Killed = len(remain)
+			break DRAIN_LOOP
+
+		case <-ticker.C:
+		}
+	}
+
+	this_.stop()
+	this_.wg.Wait()
+
+	if res.Killed > 0 {
+		return res, ctx.Err()
+	}
+
+	return res, nil
+}
+
+// stop 停止所有服务器和消息分发器
+func (this_ *Service) stop() {
 	if this_.tcpSvr != nil {
 		this_.tcpSvr.Stop()
 	}
@@ -225,20 +623,92 @@ func (this_ *Service) Stop() {
 		this_.wsSvr.Stop()
 	}
 
-	for _, wkr := range this_.wkrPool {
-		wkr.stop()
+	if this_.udpSvr != nil {
+		this_.udpSvr.Stop()
+	}
+
+	if this_.kcpSvr != nil {
+		this_.kcpSvr.Stop()
+	}
+
+	if this_.admin != nil {
+		this_.admin.stop()
 	}
+
+	this_.dispatch.stop()
 }
 
 // messageHandle 消息处理
 func (this_ *Service) messageHandle(msg *message) {
-	err := this_.event.OnData(msg.cctx, msg.data())
-	if err != nil {
-		msg.cctx.Close()
+	cctx := msg.cctx
+
+	// 连接在消息处理前已关闭, 丢弃消息
+	if cctx.ID() == msg.id {
+		var err error
+		start := time.Now()
+		if this_.msgEvent != nil {
+			err = this_.msgEvent.OnMessage(cctx, msg.kind, msg.data())
+		} else {
+			err = this_.event.OnData(cctx, msg.data())
+		}
+		this_.metrics.OnHandle(cctx.Protocol(), time.Since(start))
+
+		if err != nil {
+			cctx.Close()
+		}
 	}
+
+	atomic.AddInt64(&cctx.inflight, -1)
+	this_.bp.release(cctx)
 	msg.release()
+	cctx.release()
+}
+
+// inlineHandle 内联模式下在事件循环中处理消息, 处理期间的写入不等待待发送数据减少
+func (this_ *Service) inlineHandle(msg *message) {
+	defer this_.bp.enterLoop(msg.cctx.c)()
+	this_.messageHandle(msg)
 }
 
-func (this_ *Service) pushMessage(msg *message) {
-	this_.wkrPool[msg.cctx.Fd()%len(this_.wkrPool)].push(msg)
+// pushMessage 投递消息, 返回 false 表示连接超过了速率或待处理消息上限需要断开
+func (this_ *Service) pushMessage(msg *message) bool {
+	cctx := msg.cctx
+	if this_.resume.enabled(cctx.Protocol()) {
+		deliver, err := this_.resume.receive(msg)
+		if err != nil {
+			msg.release()
+			log.Error("[%d:%v] resume failed: %v", cctx.Fd(), cctx.RemoteAddr(), err)
+			return false
+		}
+
+		if !deliver {
+			msg.release()
+			return true
+		}
+	}
+
+	if !this_.limiter.allowMessage(cctx, msg.len) {
+		msg.release()
+		log.Warn("[%d:%v] rate limit exceeded, disconnect", cctx.Fd(), cctx.RemoteAddr())
+		return false
+	}
+
+	if !this_.bp.acquire(cctx) {
+		msg.release()
+		if this_.bp.queuePolicy == OverflowPolicy_Disconnect {
+			this_.bp.inClosed.Add(1)
+			log.Warn("[%d:%v] inbound queue over limit, disconnect", cctx.Fd(), cctx.RemoteAddr())
+			return false
+		}
+
+		this_.bp.inDropped.Add(1)
+		return true
+	}
+
+	// 消息持有连接上下文的引用, 处理完成前连接上下文不会被复用
+	msg.id = cctx.ID()
+	cctx.retain()
+	atomic.AddInt64(&cctx.inflight, 1)
+	this_.dispatch.dispatch(msg)
+	return true
 }
@@ -0,0 +1,190 @@
+package nw
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gox/frm/utils"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CipherType tcp 加密会话的算法
+type CipherType int
+
+const (
+	CipherType_None             CipherType = 0 // 不加密
+	CipherType_AesGcm           CipherType = 1 // AES-256-GCM, 适合支持 AES 指令的设备
+	CipherType_ChaCha20Poly1305 CipherType = 2 // ChaCha20-Poly1305, 适合没有 AES 指令的移动设备
+)
+
+func (this_ CipherType) String() string {
+	switch this_ {
+	case CipherType_None:
+		return "none"
+	case CipherType_AesGcm:
+		return "aes-gcm"
+	case CipherType_ChaCha20Poly1305:
+		return "chacha20-poly1305"
+	}
+
+	return "unknown"
+}
+
+// tcp 加密会话
+//
+// 连接建立后客户端发送 HELLO 帧, 服务端回复 HELLO 帧, 双方用 X25519 交换临时公钥,
+// 以共享密钥为输入、预共享密钥为盐用 HKDF-SHA256 派生两个方向各自的密钥. HELLO 帧格式为
+// VERSION[1] + CIPHER[1] + PUBKEY[32], 服务端使用客户端选择的算法.
+//
+// 之后的每个数据帧和心跳帧的消息体都是密文, nonce 为各方向独立递增的 64 位序号, 不随帧发送.
+// 重放、丢弃、重排或伪造的帧无法通过认证, 接收方直接关闭连接. 会话建立前收到心跳帧同样关闭连接.
+//
+// 预共享密钥为空时双方不认证对端, 只能防止被动窃听, 无法防止中间人
+const (
+	SESSION_VERSION    = byte(1)              // 握手协议版本
+	SESSION_KEY_SIZE   = 32                   // 单个方向的密钥长度
+	SESSION_HELLO_SIZE = 2 + SESSION_KEY_SIZE // HELLO 帧消息体长度
+	SESSION_TAG_SIZE   = 16                   // 认证标签长度, 两种算法相同
+	SESSION_INFO       = "gox/frm nw session" // HKDF 的 info 前缀
+)
+
+var (
+	ErrSessionNotReady = errors.New("session not established") // 加密会话尚未建立
+	ErrSessionHello    = errors.New("invalid session hello")   // HELLO 帧无效
+)
+
+// sessionKey 握手时使用的临时密钥
+type sessionKey struct {
+	kind CipherType
+	priv *ecdh.PrivateKey
+}
+
+// newSessionKey 生成临时 X25519 密钥
+func newSessionKey(kind CipherType) (*sessionKey, error) {
+	if _, err := newAEAD(kind, make([]byte, SESSION_KEY_SIZE)); err != nil {
+		return nil, err
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionKey{kind: kind, priv: priv}, nil
+}
+
+// hello 本方的 HELLO 消息体
+func (this_ *sessionKey) hello() []byte {
+	data := make([]byte, 0, SESSION_HELLO_SIZE)
+	data = append(data, SESSION_VERSION, byte(this_.kind))
+	return append(data, this_.priv.PublicKey().Bytes()...)
+}
+
+// parseHello 解析对方的 HELLO 消息体, 返回算法和公钥
+func parseHello(data []byte) (CipherType, []byte, error) {
+	if len(data) != SESSION_HELLO_SIZE || data[0] != SESSION_VERSION {
+		return CipherType_None, nil, ErrSessionHello
+	}
+
+	return CipherType(data[1]), data[2:], nil
+}
+
+// session 根据对方公钥派生加密会话
+//   - peer: 对方公钥
+//   - psk: 预共享密钥, 两端不一致时第一个数据帧无法解密. 为空时不认证对端
+//   - client: 本方是否为客户端, 决定两个方向使用的密钥
+func (this_ *sessionKey) session(peer, psk []byte, client bool) (*cipherSession, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := this_.priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	// info 绑定算法和双方公钥, 防止握手内容被替换
+	local := this_.priv.PublicKey().Bytes()
+	info := SESSION_INFO + string([]byte{byte(this_.kind)})
+	if client {
+		info += string(local) + string(peer)
+	} else {
+		info += string(peer) + string(local)
+	}
+
+	keys, err := hkdf.Key(sha256.New, shared, psk, info, 2*SESSION_KEY_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	// 前半部分用于客户端到服务端, 后半部分用于服务端到客户端
+	sendKey, recvKey := keys[:SESSION_KEY_SIZE], keys[SESSION_KEY_SIZE:]
+	if !client {
+		sendKey, recvKey = recvKey, sendKey
+	}
+
+	sess := &cipherSession{}
+	if sess.send, err = newAEAD(this_.kind, sendKey); err != nil {
+		return nil, err
+	}
+	if sess.recv, err = newAEAD(this_.kind, recvKey); err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+// newAEAD 创建指定算法的加密器
+func newAEAD(kind CipherType, key []byte) (cipher.AEAD, error) {
+	switch kind {
+	case CipherType_AesGcm:
+		return utils.NewAesGcm(key)
+	case CipherType_ChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+
+	return nil, fmt.Errorf("unsupported cipher: %v", kind)
+}
+
+// cipherSession 已建立的加密会话
+type cipherSession struct {
+	mtx     sync.Mutex  // 保证加密顺序与发送顺序一致, 发送方在数据提交写入前持有
+	send    cipher.AEAD // 发送方向的加密器
+	sendSeq uint64      // 下一个发送帧的序号
+	recv    cipher.AEAD // 接收方向的加密器
+	recvSeq uint64      // 下一个接收帧的序号, 只在读取方使用
+}
+
+// seal 加密一帧消息体, 调用方需要持有 mtx 直到密文提交写入
+func (this_ *cipherSession) seal(plain []byte) []byte {
+	nonce := sessionNonce(this_.sendSeq)
+	this_.sendSeq++
+	return this_.send.Seal(nil, nonce[:], plain, nil)
+}
+
+// open 解密一帧消息体
+func (this_ *cipherSession) open(data []byte) ([]byte, error) {
+	nonce := sessionNonce(this_.recvSeq)
+	plain, err := this_.recv.Open(nil, nonce[:], data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	this_.recvSeq++
+	return plain, nil
+}
+
+// sessionNonce 由序号生成 nonce, 两种算法的 nonce 都是 12 字节
+func sessionNonce(seq uint64) [chacha20poly1305.NonceSize]byte {
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
@@ -1,61 +1,488 @@
 package nw
 
 import (
-	"encoding/binary"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/gox/frm/log"
 )
 
+// TCP_CLIENT_READ_SIZE 客户端读缓冲区的初始大小
+const TCP_CLIENT_READ_SIZE = 4096
+
 type AsyncTCPClient struct {
-	conn      *net.TCPConn
-	writeCh   chan []byte
-	readCh    chan []byte
-	closeCh   chan struct{}
-	wg        sync.WaitGroup
-	timeout   time.Duration
-	closeOnce sync.Once
+	host         string
+	conf         TCPClientConfig
+	mtx          sync.Mutex // 保护 conn 的切换
+	conn         net.Conn
+	writeCh      chan outMessage
+	readCh       chan []byte
+	closeCh      chan struct{}
+	wg           sync.WaitGroup
+	timeout      time.Duration
+	closeOnce    sync.Once
+	readOnce     sync.Once        // 保证多次 Close 时 readCh 只关闭一次
+	rtt          int64            // 最近一次心跳的往返时间, 纳秒
+	codec        Codec            // 帧编解码器
+	hb           *LengthCodec     // 支持心跳帧时不为 nil
+	fc           *frameCompressor // 消息压缩, 不压缩时为 nil
+	sess         *cipherSession   // 加密会话, 不加密时为 nil, 每次连接重新建立
+	reconnect    *ReconnectConfig // 断线重连配置, 为 nil 时不重连
+	resume       *resumeState     // 会话恢复状态, 未开启时为 nil
+	reconnecting atomic.Bool      // 连接已断开, 正在重连
+	rbuf         []byte           // 读缓冲区, rbuf[r:w] 为已读取但尚未解码的数据
+	r, w         int
+	wbufPool     BufferPool                    // 写对象池
+	onMessage    func(*AsyncTCPClient, []byte) // 消息回调, 为 nil 时消息通过 Read 读取
+	bytesIn      atomic.Uint64                 // 收到的字节数
+	bytesOut     atomic.Uint64                 // 发送的字节数
+	framesIn     atomic.Uint64                 // 收到的帧数
+	framesOut    atomic.Uint64                 // 发送的帧数
+}
+
+// TCPClientStats 客户端统计
+type TCPClientStats struct {
+	BytesIn   uint64 `json:"bytes_in"`   // 收到的字节数
+	BytesOut  uint64 `json:"bytes_out"`  // 发送的字节数
+	FramesIn  uint64 `json:"frames_in"`  // 收到的帧数, 包括心跳帧
+	FramesOut uint64 `json:"frames_out"` // 发送的帧数, 包括心跳帧
+	Queued    int    `json:"queued"`     // 写队列中待发送的消息数
+}
+
+// outMessage 写队列中的数据
+type outMessage struct {
+	data  []byte
+	buf   *Buffer       // 不为 nil 时 data 为 buf 中的数据, 写出后归还写对象池
+	frame bool          // data 为已编码的帧, 直接写出
+	hb    bool          // data 为心跳消息体, 写出前按需加密并编码为心跳帧
+	ctrl  bool          // data 为会话恢复的控制消息, 不分配序号
+	done  chan struct{} // 不为 nil 时写出后关闭
+}
+
+// tcpLink 客户端的一次连接, 读写协程退出后由 run 协程重连
+type tcpLink struct {
+	conn net.Conn
+	done chan struct{}
+	once sync.Once
+	err  error // 断开的原因
+	wg   sync.WaitGroup
+}
+
+// fail 连接出错, 通知读写协程退出
+func (this_ *tcpLink) fail(err error) {
+	this_.once.Do(func() {
+		this_.err = err
+		close(this_.done)
+	})
+}
+
+// TCPClientConfig tcp 客户端配置
+type TCPClientConfig struct {
+	Timeout time.Duration // 连接和读写超时
+	TLS     *tls.Config   // tls 配置, 不为 nil 时使用 tls. 双向认证时需要设置 Certificates
+	Codec   Codec         // 帧编解码器, 需要与服务端一致, 为 nil 时使用 DefaultCodec(0)
+
+	Heartbeat bool // 是否定期发送心跳并测量 RTT, 需要服务端开启 Config.Heartbeat. 使用默认编解码器时同时启用心跳帧
+
+	Compress          CompressType // 消息压缩算法, 需要与服务端同时开启
+	CompressThreshold int          // 小于该长度的消息不压缩, 默认为 TCP_COMPRESS_THRESHOLD
+
+	Cipher     CipherType // 加密会话算法, 需要服务端开启 TcpEncrypt, 为 CipherType_None 时不加密
+	EncryptKey string     // 加密会话的预共享密钥, 需要与服务端的 TcpEncryptKey 一致. 为空时不认证服务端, 无法防止中间人
+
+	Reconnect *ReconnectConfig // 断线重连配置, 为 nil 时连接断开后客户端关闭
+
+	// OnMessage 消息回调, 设置后在读协程中按顺序调用, Read 不再返回消息.
+	// msg 在回调返回后失效, 需要保留时自行复制. 回调阻塞时不再读取后续消息
+	OnMessage func(c *AsyncTCPClient, msg []byte)
 }
 
 func NewAsyncTCPClient(host string, timeout time.Duration) (*AsyncTCPClient, error) {
-	dialer := net.Dialer{Timeout: timeout}
-	conn, err := dialer.Dial("tcp", host)
+	return NewAsyncTCPClientWithConfig(host, &TCPClientConfig{Timeout: timeout})
+}
+
+// NewAsyncTLSClient 创建使用 tls 的客户端
+//   - config: tls 配置, 双向认证时需要设置 Certificates
+func NewAsyncTLSClient(host string, timeout time.Duration, config *tls.Config) (*AsyncTCPClient, error) {
+	return NewAsyncTCPClientWithConfig(host, &TCPClientConfig{Timeout: timeout, TLS: config})
+}
+
+// NewAsyncTCPClientWithConfig 根据配置创建客户端
+func NewAsyncTCPClientWithConfig(host string, c *TCPClientConfig) (*AsyncTCPClient, error) {
+	fc, err := newFrameCompressor(c.Compress, c.CompressThreshold)
 	if err != nil {
 		return nil, err
 	}
-	tcpConn := conn.(*net.TCPConn)
 
-	client := &AsyncTCPClient{
-		conn:    tcpConn,
-		writeCh: make(chan []byte, 1024),
-		readCh:  make(chan []byte, 1024),
-		closeCh: make(chan struct{}),
-		timeout: timeout,
-	}
-	client.wg.Add(2)
-	go client.readLoop()
-	go client.writeLoop()
+	if c.Cipher != CipherType_None && c.EncryptKey == "" {
+		log.Warn("tcp client %v cipher is enabled without EncryptKey: the server is NOT authenticated and a man-in-the-middle can read and forge traffic", host)
+	}
+
+	client := newAsyncTCPClient(host, c, fc)
+	if _, err = client.connect(); err != nil {
+		return nil, err
+	}
+
+	client.wg.Add(1)
+	go client.run()
 	return client, nil
 }
 
+func newAsyncTCPClient(host string, c *TCPClientConfig, fc *frameCompressor) *AsyncTCPClient {
+	client := &AsyncTCPClient{
+		host:      host,
+		conf:      *c,
+		readCh:    make(chan []byte, 1024),
+		closeCh:   make(chan struct{}),
+		timeout:   c.Timeout,
+		codec:     c.Codec,
+		fc:        fc,
+		rbuf:      make([]byte, TCP_CLIENT_READ_SIZE),
+		wbufPool:  NewBufferPool(),
+		onMessage: c.OnMessage,
+	}
+
+	if client.codec == nil {
+		codec := DefaultCodec(0)
+		codec.Heartbeat = c.Heartbeat
+		client.codec = codec
+	}
+	client.hb = heartbeatOf(client.codec)
+
+	queue := 1024
+	if c.Reconnect != nil {
+		client.reconnect = c.Reconnect.withDefaults()
+		queue = client.reconnect.QueueSize
+		if client.reconnect.Resume {
+			client.resume = &resumeState{}
+		}
+	}
+	client.writeCh = make(chan outMessage, queue)
+
+	return client
+}
+
+// connect 建立连接并完成握手, 返回服务端是否恢复了原会话
+func (c *AsyncTCPClient) connect() (bool, error) {
+	var (
+		dialer = net.Dialer{Timeout: c.timeout}
+		conn   net.Conn
+		err    error
+	)
+
+	if c.conf.TLS != nil {
+		conn, err = tls.DialWithDialer(&dialer, "tcp", c.host, c.conf.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", c.host)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	c.mtx.Lock()
+	select {
+	case <-c.closeCh:
+		c.mtx.Unlock()
+		conn.Close()
+		return false, errors.New("client closed")
+	default:
+	}
+	c.conn = conn
+	c.mtx.Unlock()
+
+	c.r, c.w = 0, 0
+	c.sess = nil
+
+	resumed, err := c.handshake()
+	if err != nil {
+		conn.Close()
+		return false, err
+	}
+
+	return resumed, nil
+}
+
+// handshake 按配置建立加密会话和恢复会话, 在启动读写协程之前调用
+func (c *AsyncTCPClient) handshake() (bool, error) {
+	if c.conf.Cipher != CipherType_None {
+		if err := c.handshakeSession(c.conf.Cipher, []byte(c.conf.EncryptKey)); err != nil {
+			return false, err
+		}
+	}
+
+	if c.resume == nil {
+		return false, nil
+	}
+
+	return c.handshakeResume()
+}
+
+// handshakeSession 建立加密会话
+//   - kind: 加密算法
+//   - psk: 预共享密钥
+func (c *AsyncTCPClient) handshakeSession(kind CipherType, psk []byte) error {
+	key, err := newSessionKey(kind)
+	if err != nil {
+		return err
+	}
+
+	frame, err := encodeFrame(c.codec, nil, key.hello())
+	if err != nil {
+		return err
+	}
+
+	if err = c.writeConn(frame); err != nil {
+		return err
+	}
+
+	for {
+		body, heartbeat, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+
+		if heartbeat {
+			if err = c.onHeartbeat(nil, body); err != nil {
+				return err
+			}
+			continue
+		}
+
+		accepted, peer, err := parseHello(body)
+		if err != nil {
+			return err
+		}
+
+		if accepted != kind {
+			return ErrSessionHello
+		}
+
+		c.sess, err = key.session(peer, psk, true)
+		return err
+	}
+}
+
+// handshakeResume 发送 HELLO 并等待 WELCOME, 恢复了原会话时重发服务端未收到的消息
+func (c *AsyncTCPClient) handshakeResume() (bool, error) {
+	if err := c.writeMessage(c.resume.hello()); err != nil {
+		return false, err
+	}
+
+	for {
+		body, heartbeat, err := c.readFrame()
+		if err != nil {
+			return false, err
+		}
+
+		if heartbeat {
+			if err = c.onHeartbeat(nil, body); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		msg, err := c.decode(body)
+		if err != nil {
+			return false, err
+		}
+
+		resumed, replay, err := c.resume.welcome(msg)
+		if err != nil {
+			return false, err
+		}
+
+		for _, msg := range replay {
+			if err = c.writeMessage(msg); err != nil {
+				return false, err
+			}
+		}
+
+		return resumed, nil
+	}
+}
+
+// run 后台协程, 启动连接的读写协程, 断开后按配置重连
+func (c *AsyncTCPClient) run() {
+	defer c.wg.Done()
+
+	for {
+		link := c.start()
+
+		select {
+		case <-link.done:
+		case <-c.closeCh:
+			link.fail(io.EOF)
+		}
+
+		link.conn.Close()
+		link.wg.Wait()
+
+		select {
+		case <-c.closeCh:
+			return
+		default:
+		}
+
+		if c.reconnect == nil {
+			c.shutdown()
+			return
+		}
+
+		c.reconnecting.Store(true)
+		c.reconnect.notifyDisconnect(link.err)
+
+		resumed, err := c.redial()
+		if err != nil {
+			log.Error("tcp client %v reconnect failed: %v", c.host, err)
+			c.shutdown()
+			return
+		}
+
+		c.reconnecting.Store(false)
+		c.reconnect.notifyConnect(resumed)
+	}
+}
+
+// redial 按退避策略重连, 返回服务端是否恢复了原会话
+func (c *AsyncTCPClient) redial() (bool, error) {
+	for n := 0; c.reconnect.MaxRetries <= 0 || n < c.reconnect.MaxRetries; n++ {
+		timer := time.NewTimer(c.reconnect.backoff(n))
+		select {
+		case <-timer.C:
+		case <-c.closeCh:
+			timer.Stop()
+			return false, errors.New("client closed")
+		}
+
+		resumed, err := c.connect()
+		if err == nil {
+			return resumed, nil
+		}
+
+		log.Warn("tcp client %v reconnect failed: %v", c.host, err)
+	}
+
+	return false, ErrReconnectFailed
+}
+
+// start 启动当前连接的读写协程
+func (c *AsyncTCPClient) start() *tcpLink {
+	link := &tcpLink{conn: c.conn, done: make(chan struct{})}
+
+	link.wg.Add(2)
+	go c.readLoop(link)
+	go c.writeLoop(link)
+
+	// 未开启心跳或编解码器不支持心跳帧时由业务层保持连接活跃
+	if c.conf.Heartbeat && c.hb != nil {
+		link.wg.Add(1)
+		go c.heartbeatLoop(link)
+	}
+
+	return link
+}
+
+// shutdown 连接断开且不再重连, 之后读写都返回错误
+func (c *AsyncTCPClient) shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.closeCh)
+	})
+}
+
 // Async write: 投递消息到写队列
+//
+// 重连期间不阻塞, 待发送消息超过 ReconnectConfig.QueueSize 时返回 ErrReconnectQueueFull.
+// 加密或恢复会话的消息在写协程中编码, 编码失败时丢弃并记录日志
 func (c *AsyncTCPClient) Write(msg []byte) error {
-	if len(msg) > 0xFFFFFFF { // 256MB 限制
-		return errors.New("message too large")
+	// 重连失败关闭后写队列仍可能有空间, 先检查避免 select 随机选中投递
+	if c.Closed() {
+		return errors.New("client closed")
+	}
+
+	m := outMessage{buf: c.wbufPool.Get()}
+	if c.conf.Cipher == CipherType_None && c.resume == nil {
+		// 帧与连接无关, 重连后可以原样发送
+		if err := encodeMessage(m.buf, c.codec, c.fc, msg); err != nil {
+			c.wbufPool.Put(m.buf)
+			return err
+		}
+		m.frame = true
+	} else {
+		m.buf.Write(msg)
 	}
-	buf := make([]byte, 4+len(msg))
-	binary.BigEndian.PutUint32(buf[:4], uint32(len(msg)))
-	copy(buf[4:], msg)
+	m.data = m.buf.Bytes()
+
+	if c.reconnecting.Load() {
+		select {
+		case c.writeCh <- m:
+			return nil
+		case <-c.closeCh:
+			c.wbufPool.Put(m.buf)
+			return errors.New("client closed")
+		default:
+			c.wbufPool.Put(m.buf)
+			return ErrReconnectQueueFull
+		}
+	}
+
 	select {
-	case c.writeCh <- buf:
+	case c.writeCh <- m:
 		return nil
 	case <-c.closeCh:
+		c.wbufPool.Put(m.buf)
 		return errors.New("client closed")
 	}
 }
 
+// encode 编码一条消息写入 buf, 按需压缩和加密
+func (c *AsyncTCPClient) encode(buf *Buffer, msg []byte) error {
+	if c.sess == nil {
+		return encodeMessage(buf, c.codec, c.fc, msg)
+	}
+
+	plain := msg
+	if c.fc != nil {
+		tmp := c.wbufPool.Get()
+		defer c.wbufPool.Put(tmp)
+		c.fc.pack(tmp, msg)
+		plain = tmp.Bytes()
+	}
+
+	c.sess.mtx.Lock()
+	defer c.sess.mtx.Unlock()
+
+	return c.codec.Encode(buf, c.sess.seal(plain))
+}
+
+// writeMessage 编码一条消息并写入当前连接
+func (c *AsyncTCPClient) writeMessage(msg []byte) error {
+	buf := c.wbufPool.Get()
+	defer c.wbufPool.Put(buf)
+
+	if err := c.encode(buf, msg); err != nil {
+		return err
+	}
+
+	return c.writeConn(buf.Bytes())
+}
+
+// decode 还原一帧的消息体, 按需解密和解压
+func (c *AsyncTCPClient) decode(body []byte) ([]byte, error) {
+	if c.sess != nil {
+		var err error
+		if body, err = c.sess.open(body); err != nil {
+			return nil, err
+		}
+	}
+
+	return decodeMessage(c.fc, body)
+}
+
 // Async read: 业务层从 readCh 取消息
 func (c *AsyncTCPClient) Read() ([]byte, error) {
 	select {
@@ -65,67 +492,301 @@ func (c *AsyncTCPClient) Read() ([]byte, error) {
 		}
 		return msg, nil
 	case <-c.closeCh:
+		// 先取完断开前收到的消息
+		select {
+		case msg, ok := <-c.readCh:
+			if ok {
+				return msg, nil
+			}
+		default:
+		}
 		return nil, io.EOF
 	}
 }
 
-// 关闭客户端
+// RTT 最近一次心跳的往返时间, 没有收到过心跳应答时为 0
+func (c *AsyncTCPClient) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// Pending 写队列中待发送的消息数
+func (c *AsyncTCPClient) Pending() int {
+	return len(c.writeCh)
+}
+
+// Stats 客户端统计
+func (c *AsyncTCPClient) Stats() TCPClientStats {
+	return TCPClientStats{
+		BytesIn:   c.bytesIn.Load(),
+		BytesOut:  c.bytesOut.Load(),
+		FramesIn:  c.framesIn.Load(),
+		FramesOut: c.framesOut.Load(),
+		Queued:    len(c.writeCh),
+	}
+}
+
+// Closed 客户端是否已关闭, 包括重连失败后关闭
+func (c *AsyncTCPClient) Closed() bool {
+	select {
+	case <-c.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reconnecting 连接是否已断开并正在重连
+func (c *AsyncTCPClient) Reconnecting() bool {
+	return c.reconnecting.Load()
+}
+
+// 关闭客户端, 恢复会话时先通知服务端不再保留会话
 func (c *AsyncTCPClient) Close() error {
+	if c.resume != nil && !c.reconnecting.Load() {
+		m := outMessage{data: []byte{RESUME_CLOSE}, ctrl: true, done: make(chan struct{})}
+		select {
+		case c.writeCh <- m:
+			select {
+			case <-m.done:
+			case <-c.closeCh:
+			case <-time.After(time.Second):
+			}
+		case <-c.closeCh:
+		default:
+		}
+	}
+
 	c.closeOnce.Do(func() {
 		close(c.closeCh)
-		c.conn.Close()
 	})
+
+	c.mtx.Lock()
+	c.conn.Close()
+	c.mtx.Unlock()
+
 	c.wg.Wait()
-	close(c.readCh)
+	c.readOnce.Do(func() {
+		close(c.readCh)
+	})
 	return nil
 }
 
 // 后台读协程
-func (c *AsyncTCPClient) readLoop() {
-	defer c.wg.Done()
-	header := make([]byte, 4)
+func (c *AsyncTCPClient) readLoop(link *tcpLink) {
+	defer link.wg.Done()
 	for {
-		if c.timeout > 0 {
-			c.conn.SetReadDeadline(time.Now().Add(c.timeout))
-		}
-		_, err := io.ReadFull(c.conn, header)
+		body, heartbeat, err := c.readFrame()
 		if err != nil {
-			break
+			link.fail(err)
+			return
 		}
-		bodyLen := binary.BigEndian.Uint32(header)
-		if bodyLen == 0 || bodyLen > 0xFFFFFFF {
-			break
+
+		if heartbeat {
+			if err = c.onHeartbeat(link, body); err != nil {
+				link.fail(err)
+				return
+			}
+			continue
 		}
-		body := make([]byte, bodyLen)
-		_, err = io.ReadFull(c.conn, body)
+
+		msg, err := c.decode(body)
 		if err != nil {
-			break
+			link.fail(err)
+			return
+		}
+
+		if c.resume != nil {
+			payload, deliver, ack, err := c.resume.receive(msg)
+			if err != nil {
+				link.fail(err)
+				return
+			}
+
+			if ack != nil {
+				c.queue(link, outMessage{data: ack, ctrl: true})
+			}
+
+			if !deliver {
+				continue
+			}
+			msg = payload
+		}
+
+		// 回调直接使用读缓冲区中的数据, 不复制
+		if c.onMessage != nil {
+			c.onMessage(c, msg)
+			continue
 		}
+
 		select {
-		case c.readCh <- body:
+		case c.readCh <- append([]byte(nil), msg...):
 		case <-c.closeCh:
 			return
 		}
 	}
 }
 
+// readFrame 读取一帧, heartbeat 为 true 时为心跳消息体. 返回的数据在下一次读取前有效
+func (c *AsyncTCPClient) readFrame() ([]byte, bool, error) {
+	for {
+		body, n, heartbeat, err := decodeFrame(c.codec, c.hb, c.rbuf[c.r:c.w])
+		if err != nil {
+			return nil, false, err
+		}
+
+		if n > 0 {
+			c.r += n
+			c.framesIn.Add(1)
+			return body, heartbeat, nil
+		}
+
+		// 数据不足一帧, 将剩余数据移到开头, 缓冲区已满时扩容
+		c.w = copy(c.rbuf, c.rbuf[c.r:c.w])
+		c.r = 0
+		if c.w == len(c.rbuf) {
+			c.rbuf = append(c.rbuf, make([]byte, len(c.rbuf))...)
+		}
+
+		if c.timeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+		m, err := c.conn.Read(c.rbuf[c.w:])
+		c.w += m
+		c.bytesIn.Add(uint64(m))
+		if err != nil {
+			return nil, false, err
+		}
+	}
+}
+
 // 后台写协程
-func (c *AsyncTCPClient) writeLoop() {
-	defer c.wg.Done()
+func (c *AsyncTCPClient) writeLoop(link *tcpLink) {
+	defer link.wg.Done()
 	for {
 		select {
-		case buf, ok := <-c.writeCh:
-			if !ok {
+		case m := <-c.writeCh:
+			frame := m.data
+			var out *Buffer
+			if m.hb {
+				frame = c.encodeHeartbeat(m.data)
+			} else if !m.frame {
+				msg := m.data
+				if c.resume != nil && !m.ctrl {
+					msg = c.resume.seal(msg)
+				}
+
+				out = c.wbufPool.Get()
+				if err := c.encode(out, msg); err != nil {
+					log.Error("tcp client %v encode failed: %v", c.host, err)
+					c.wbufPool.Put(m.buf)
+					c.wbufPool.Put(out)
+					continue
+				}
+				frame = out.Bytes()
+			}
+
+			err := c.writeConn(frame)
+			c.wbufPool.Put(m.buf)
+			c.wbufPool.Put(out)
+			if err != nil {
+				link.fail(err)
 				return
 			}
-			if c.timeout > 0 {
-				c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+
+			if m.done != nil {
+				close(m.done)
 			}
-			_, err := c.conn.Write(buf)
-			if err != nil {
+
+		case <-link.done:
+			return
+		}
+	}
+}
+
+// writeConn 写入当前连接
+func (c *AsyncTCPClient) writeConn(frame []byte) error {
+	if c.timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+
+	n, err := c.conn.Write(frame)
+	c.bytesOut.Add(uint64(n))
+	if err == nil {
+		c.framesOut.Add(1)
+	}
+	return err
+}
+
+// onHeartbeat 处理心跳帧, 加密会话中无法认证的心跳帧返回错误
+//   - link: 当前连接, 握手期间为 nil
+func (c *AsyncTCPClient) onHeartbeat(link *tcpLink, body []byte) error {
+	if c.sess != nil {
+		var err error
+		if body, err = c.sess.open(body); err != nil {
+			return err
+		}
+	} else if c.conf.Cipher != CipherType_None {
+		return ErrSessionNotReady
+	}
+
+	kind, ts, _ := decodeHeartbeat(body)
+	switch kind {
+	case HEARTBEAT_PING:
+		c.queue(link, outMessage{data: heartbeatBody(HEARTBEAT_PONG, ts), hb: true})
+	case HEARTBEAT_PONG:
+		atomic.StoreInt64(&c.rtt, rtt(ts))
+	}
+	return nil
+}
+
+// encodeHeartbeat 编码心跳帧, 建立加密会话后加密, 与数据帧共用发送序号
+func (c *AsyncTCPClient) encodeHeartbeat(body []byte) []byte {
+	if c.sess == nil {
+		return c.hb.encodeHeartbeat(body)
+	}
+
+	c.sess.mtx.Lock()
+	defer c.sess.mtx.Unlock()
+
+	return c.hb.encodeHeartbeat(c.sess.seal(body))
+}
+
+// queue 投递到写队列, 连接断开或客户端关闭时返回 false
+func (c *AsyncTCPClient) queue(link *tcpLink, m outMessage) bool {
+	// 握手期间写协程尚未启动, 队列已满时丢弃
+	if link == nil {
+		select {
+		case c.writeCh <- m:
+			return true
+		default:
+			return false
+		}
+	}
+
+	select {
+	case c.writeCh <- m:
+		return true
+	case <-link.done:
+		return false
+	case <-c.closeCh:
+		return false
+	}
+}
+
+// 后台心跳协程, 定期发送心跳请求, 防止空闲连接被服务端超时关闭
+func (c *AsyncTCPClient) heartbeatLoop(link *tcpLink) {
+	defer link.wg.Done()
+
+	ticker := time.NewTicker(heartbeatInterval(c.timeout))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !c.queue(link, outMessage{data: heartbeatBody(HEARTBEAT_PING, time.Now().UnixNano()), hb: true}) {
 				return
 			}
-		case <-c.closeCh:
+		case <-link.done:
 			return
 		}
 	}
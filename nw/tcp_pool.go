@@ -0,0 +1,150 @@
+package nw
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// PoolBalance 连接池选择连接的策略
+type PoolBalance int
+
+const (
+	PoolBalance_RoundRobin   PoolBalance = 0 // 轮询
+	PoolBalance_LeastPending PoolBalance = 1 // 选择写队列中待发送消息最少的连接
+)
+
+func (this_ PoolBalance) String() string {
+	switch this_ {
+	case PoolBalance_RoundRobin:
+		return "round_robin"
+	case PoolBalance_LeastPending:
+		return "least_pending"
+	}
+
+	return "unknown"
+}
+
+var (
+	ErrPoolHandler = errors.New("tcp client pool requires OnMessage") // 连接池的客户端需要设置消息回调
+	ErrPoolClosed  = errors.New("tcp client pool closed")             // 连接池中没有可用的连接
+)
+
+// TCPClientPool 连接同一地址的多个 tcp 客户端, 写入时按策略选择其中一个.
+// 收到的消息通过 TCPClientConfig.OnMessage 回调, 不同连接的回调并发调用
+type TCPClientPool struct {
+	clients []*AsyncTCPClient
+	balance PoolBalance
+	next    atomic.Uint64 // 轮询的下一个位置
+}
+
+// NewTCPClientPool 创建连接池, 任一连接失败时关闭已建立的连接并返回错误
+//   - size: 连接数, 小于 1 时为 1
+//   - balance: 选择连接的策略
+//   - c: 每个客户端的配置, 需要设置 OnMessage
+func NewTCPClientPool(host string, size int, balance PoolBalance, c *TCPClientConfig) (*TCPClientPool, error) {
+	if c.OnMessage == nil {
+		return nil, ErrPoolHandler
+	}
+
+	if size < 1 {
+		size = 1
+	}
+
+	pool := &TCPClientPool{
+		clients: make([]*AsyncTCPClient, 0, size),
+		balance: balance,
+	}
+
+	for i := 0; i < size; i++ {
+		client, err := NewAsyncTCPClientWithConfig(host, c)
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+
+		pool.clients = append(pool.clients, client)
+	}
+
+	return pool, nil
+}
+
+// Pick 按策略选择一个连接, 优先选择未断开的连接, 所有连接都已关闭时返回 nil
+func (this_ *TCPClientPool) Pick() *AsyncTCPClient {
+	var (
+		best  *AsyncTCPClient
+		score int
+	)
+
+	n := len(this_.clients)
+	start := int(this_.next.Add(1) % uint64(n))
+	for i := 0; i < n; i++ {
+		client := this_.clients[(start+i)%n]
+		if client.Closed() {
+			continue
+		}
+
+		// 重连中的连接排在所有正常连接之后
+		s := 0
+		if this_.balance == PoolBalance_LeastPending {
+			s = client.Pending()
+		}
+		if client.Reconnecting() {
+			s += client.reconnect.QueueSize + 1
+		}
+
+		if best == nil || s < score {
+			best, score = client, s
+		}
+
+		// 轮询时第一个正常连接即可
+		if this_.balance == PoolBalance_RoundRobin && s == 0 {
+			break
+		}
+	}
+
+	return best
+}
+
+// Write 选择一个连接写入消息
+func (this_ *TCPClientPool) Write(msg []byte) error {
+	client := this_.Pick()
+	if client == nil {
+		return ErrPoolClosed
+	}
+
+	return client.Write(msg)
+}
+
+// Clients 连接池中的所有客户端
+func (this_ *TCPClientPool) Clients() []*AsyncTCPClient {
+	return this_.clients
+}
+
+// Size 连接数
+func (this_ *TCPClientPool) Size() int {
+	return len(this_.clients)
+}
+
+// Stats 所有连接的统计之和
+func (this_ *TCPClientPool) Stats() TCPClientStats {
+	var stats TCPClientStats
+	for _, client := range this_.clients {
+		s := client.Stats()
+		stats.BytesIn += s.BytesIn
+		stats.BytesOut += s.BytesOut
+		stats.FramesIn += s.FramesIn
+		stats.FramesOut += s.FramesOut
+		stats.Queued += s.Queued
+	}
+
+	return stats
+}
+
+// Close 关闭所有连接
+func (this_ *TCPClientPool) Close() error {
+	for _, client := range this_.clients {
+		client.Close()
+	}
+
+	return nil
+}
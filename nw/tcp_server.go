@@ -1,7 +1,6 @@
 package nw
 
 import (
-	"encoding/binary"
 	"time"
 
 	"github.com/gox/frm/log"
@@ -10,24 +9,50 @@ import (
 
 // tcpServer TCP服务器
 //
-// TCP 协议格式：HEADER[sizeof(uint32)] + DATA
+// TCP 协议格式由 Config.Codec 决定, 默认为 HEADER[sizeof(uint32)] + DATA.
+// 开启加密时消息体先压缩再加密, 连接在加密会话建立后才触发 OnConnected
 type tcpServer struct {
 	baseServer
-	headBlend uint32
+	codec   Codec            // 帧编解码器
+	hb      *LengthCodec     // 支持心跳帧时不为 nil
+	fc      *frameCompressor // 消息压缩, 不压缩时为 nil
+	encrypt bool             // 是否要求建立加密会话
+	psk     []byte           // 加密会话的预共享密钥
 }
 
 // NewTcpServer 创建一个新的 TCP 服务器
 //
 //   - owner: 所属服务
 //   - c: 配置
+//   - fc: 消息压缩, 不压缩时为 nil
 //
 // 返回一个新的 tcpServer 实例
-func newTcpServer(owner *Service, c *Config) *tcpServer {
+func newTcpServer(owner *Service, c *Config, fc *frameCompressor) *tcpServer {
 	this_ := &tcpServer{
-		headBlend: c.HeadBlend,
+		codec:   c.Codec,
+		fc:      fc,
+		encrypt: c.TcpEncrypt,
+		psk:     []byte(c.TcpEncryptKey),
+	}
+
+	// 默认编解码器只在开启心跳时使用心跳标志, 未开启时帧格式与不支持心跳的客户端兼容
+	if this_.codec == nil {
+		codec := DefaultCodec(c.HeadBlend)
+		codec.Heartbeat = c.Heartbeat
+		this_.codec = codec
+	}
+	this_.hb = heartbeatOf(this_.codec)
+
+	if this_.encrypt && len(this_.psk) == 0 {
+		log.Warn("tcp encrypt is enabled without tcp_encrypt_key: clients are NOT authenticated and a man-in-the-middle can read and forge traffic")
 	}
 
 	this_.baseServer = *newBaseServer(owner, this_, c.TcpHost)
+	this_.pending = this_.pending || this_.encrypt
+	if owner.certs != nil {
+		this_.tlsConf = owner.certs.TLSConfig()
+	}
+
 	return this_
 }
 
@@ -38,50 +63,242 @@ func (this_ *tcpServer) Proto() Protocol {
 
 // OnTraffic 处理客户端数据
 func (this_ *tcpServer) OnTraffic(c gnet.Conn) gnet.Action {
-	// 获取客户端缓冲区大小
-	n := c.InboundBuffered()
+	cctx := c.Context().(*ConnContext)
 
-	if n < TCP_HEADER_SIZE {
-		return gnet.None
+	if cctx.proxied {
+		if ok, action := this_.readProxy(cctx); !ok {
+			return action
+		}
 	}
 
-	// 查看数据头
-	data, _ := c.Peek(TCP_HEADER_SIZE)
-	dlen := binary.BigEndian.Uint32(data) ^ this_.headBlend
-	if dlen > MESSAGE_MAX_SIZE {
-		log.Error("[%d:%v]read data over max data length", c.Fd(), c.RemoteAddr())
-		return gnet.Close
+	if cctx.tls != nil {
+		if ok, action := this_.readTLS(cctx); !ok {
+			return action
+		}
 	}
 
-	mlen := int(dlen) + TCP_HEADER_SIZE
-	if n < mlen {
-		return gnet.None
-	}
+	in := cctx.inbound()
+	for {
+		// 获取客户端缓冲区中的全部数据
+		n := in.InboundBuffered()
+		if n == 0 {
+			return gnet.None
+		}
+
+		data, _ := in.Peek(n)
+		body, mlen, heartbeat, err := decodeFrame(this_.codec, this_.hb, data)
+		if err != nil {
+			log.Error("[%d:%v]decode frame failed: %v", c.Fd(), c.RemoteAddr(), err)
+			return gnet.Close
+		}
+
+		if mlen == 0 {
+			return gnet.None
+		}
 
-	// 查看消息体数据
-	data, _ = c.Peek(mlen)
-	// 消费数据
-	c.Discard(mlen)
+		cctx.countRead(mlen)
+		cctx.touch()
+		sess := cctx.sess.Load()
+		if heartbeat {
+			if body, err = this_.openHeartbeat(sess, body); err != nil {
+				log.Error("[%d:%v]invalid heartbeat: %v", c.Fd(), c.RemoteAddr(), err)
+				return gnet.Close
+			}
 
-	cctx := c.Context().(*ConnContext)
-	cctx.lastUpdate = time.Now().Unix()
+			kind, ts, _ := decodeHeartbeat(body)
+			in.Discard(mlen)
+
+			switch kind {
+			case HEARTBEAT_PING:
+				this_.writeHeartbeat(cctx, HEARTBEAT_PONG, ts)
+			case HEARTBEAT_PONG:
+				cctx.onPong(ts)
+			}
+			continue
+		}
+
+		if this_.encrypt && sess == nil {
+			err = this_.accept(cctx, body)
+			in.Discard(mlen)
+			if err != nil {
+				log.Error("[%d:%v]session handshake failed: %v", c.Fd(), c.RemoteAddr(), err)
+				return gnet.Close
+			}
+			continue
+		}
+
+		if sess != nil {
+			if body, err = sess.open(body); err != nil {
+				log.Error("[%d:%v]decrypt failed: %v", c.Fd(), c.RemoteAddr(), err)
+				return gnet.Close
+			}
+		}
+
+		if body, err = decodeMessage(this_.fc, body); err != nil {
+			log.Error("[%d:%v]decompress failed: %v", c.Fd(), c.RemoteAddr(), err)
+			return gnet.Close
+		}
 
-	// 使用baseServer的消息池
-	this_.owner.pushMessage(this_.msgPool.New(cctx, data[TCP_HEADER_SIZE:]))
-	return gnet.None
+		// 使用baseServer的消息池, 拷贝后再消费数据
+		ok := this_.owner.pushMessage(this_.msgPool.New(cctx, body))
+		in.Discard(mlen)
+		if !ok {
+			return gnet.Close
+		}
+	}
 }
 
 func (this_ *tcpServer) Write(cctx *ConnContext, data []byte) error {
+	if this_.encrypt {
+		return this_.writeSealed(cctx, this_.pack(data))
+	}
+
 	buf := this_.wbufPool.Get()
-	buf.WriteUint32BE(uint32(len(data)) ^ this_.headBlend)
-	buf.Write(data)
+	if err := encodeMessage(buf, this_.codec, this_.fc, data); err != nil {
+		this_.wbufPool.Put(buf)
+		return err
+	}
 
-	return cctx.c.AsyncWrite(buf.Bytes(), func(c gnet.Conn, err error) error {
+	return cctx.asyncWrite(buf.Bytes(), func(c gnet.Conn, err error) error {
 		if err != nil {
-			log.Error("AsyncWrite failed: %v", err)
+			this_.writeFailed(err)
 		}
 
 		this_.wbufPool.Put(buf)
 		return nil
 	})
 }
+
+// ping 发送心跳请求, 编解码器不支持心跳帧时只依靠空闲检测
+func (this_ *tcpServer) ping(cctx *ConnContext) error {
+	if this_.hb == nil {
+		return nil
+	}
+
+	return this_.writeHeartbeat(cctx, HEARTBEAT_PING, time.Now().UnixNano())
+}
+
+// writeHeartbeat 发送心跳帧, 建立加密会话后加密, 与数据帧共用发送序号. 要求加密时会话建立前不发送
+func (this_ *tcpServer) writeHeartbeat(cctx *ConnContext, kind byte, ts int64) error {
+	body := heartbeatBody(kind, ts)
+	sess := cctx.sess.Load()
+	if sess == nil {
+		if this_.encrypt {
+			return nil
+		}
+		return cctx.rawWrite(this_.hb.encodeHeartbeat(body), nil)
+	}
+
+	sess.mtx.Lock()
+	defer sess.mtx.Unlock()
+
+	return cctx.rawWrite(this_.hb.encodeHeartbeat(sess.seal(body)), nil)
+}
+
+// openHeartbeat 还原心跳消息体. 要求加密时会话建立前的心跳帧无法认证, 返回错误
+func (this_ *tcpServer) openHeartbeat(sess *cipherSession, body []byte) ([]byte, error) {
+	if sess != nil {
+		return sess.open(body)
+	}
+
+	if this_.encrypt {
+		return nil, ErrSessionNotReady
+	}
+
+	return body, nil
+}
+
+// encode 编码 tcp 帧. 加密使用各连接自己的密钥, 此时只预先完成压缩
+func (this_ *tcpServer) encode(data []byte) ([]byte, error) {
+	if this_.encrypt {
+		return this_.pack(data), nil
+	}
+
+	return encodeFrame(this_.codec, this_.fc, data)
+}
+
+// writeFrame 写入已编码的 tcp 帧
+func (this_ *tcpServer) writeFrame(cctx *ConnContext, frame []byte) error {
+	if this_.encrypt {
+		return this_.writeSealed(cctx, frame)
+	}
+
+	return cctx.asyncWrite(frame, func(c gnet.Conn, err error) error {
+		if err != nil {
+			this_.writeFailed(err)
+		}
+		return nil
+	})
+}
+
+// pack 按需压缩消息, 返回加密前的消息体
+func (this_ *tcpServer) pack(data []byte) []byte {
+	if this_.fc == nil {
+		return data
+	}
+
+	buf := &Buffer{}
+	this_.fc.pack(buf, data)
+	return buf.Bytes()
+}
+
+// writeSealed 加密消息体并写入. 持有会话的锁直到数据提交写入, 保证 nonce 序号与发送顺序一致
+func (this_ *tcpServer) writeSealed(cctx *ConnContext, plain []byte) error {
+	sess := cctx.sess.Load()
+	if sess == nil {
+		return ErrSessionNotReady
+	}
+
+	buf := this_.wbufPool.Get()
+
+	sess.mtx.Lock()
+	defer sess.mtx.Unlock()
+
+	if err := this_.codec.Encode(buf, sess.seal(plain)); err != nil {
+		this_.wbufPool.Put(buf)
+		return err
+	}
+
+	return cctx.asyncWrite(buf.Bytes(), func(c gnet.Conn, err error) error {
+		if err != nil {
+			this_.writeFailed(err)
+		}
+
+		this_.wbufPool.Put(buf)
+		return nil
+	})
+}
+
+// accept 处理客户端的 HELLO 帧, 回复本方公钥并建立加密会话, 然后触发 OnConnected. 开启会话恢复时继续等待恢复握手
+func (this_ *tcpServer) accept(cctx *ConnContext, hello []byte) error {
+	kind, peer, err := parseHello(hello)
+	if err != nil {
+		return err
+	}
+
+	key, err := newSessionKey(kind)
+	if err != nil {
+		return err
+	}
+
+	sess, err := key.session(peer, this_.psk, false)
+	if err != nil {
+		return err
+	}
+
+	frame, err := encodeFrame(this_.codec, nil, key.hello())
+	if err != nil {
+		return err
+	}
+
+	if err = cctx.rawWrite(frame, nil); err != nil {
+		return err
+	}
+
+	cctx.sess.Store(sess)
+	if this_.owner.resume != nil {
+		return nil
+	}
+
+	return this_.connected(cctx)
+}
@@ -0,0 +1,143 @@
+package nw
+
+import (
+	"sync"
+	"time"
+)
+
+// 分层时间轮参数
+const (
+	TIMING_WHEEL_TICK   = time.Second                                           // 时间轮精度
+	TIMING_WHEEL_BITS   = 6                                                     // 每层槽数的位数
+	TIMING_WHEEL_SLOTS  = 1 << TIMING_WHEEL_BITS                                // 每层的槽数
+	TIMING_WHEEL_MASK   = TIMING_WHEEL_SLOTS - 1                                // 槽下标掩码
+	TIMING_WHEEL_LEVELS = 4                                                     // 层数
+	TIMING_WHEEL_SPAN   = int64(1) << (TIMING_WHEEL_BITS * TIMING_WHEEL_LEVELS) // 最长定时的 tick 数
+)
+
+// wheelTimer 时间轮定时器, 以侵入式双向链表挂在槽上, 增删不需要分配内存
+type wheelTimer struct {
+	expire int64       // 到期 tick
+	task   func()      // 到期回调, 在推进时间轮的协程中执行
+	prev   *wheelTimer // 前一个节点
+	next   *wheelTimer // 后一个节点
+	slot   *wheelTimer // 所在槽的哨兵节点, 为 nil 表示未挂载
+}
+
+// timingWheel 分层时间轮
+//
+// 第 n 层的每个槽对应 64^n 个 tick, 低层转完一圈时将高层对应槽中的定时器降级到低层.
+// 添加和删除定时器的开销与定时器数量无关, 推进时只处理到期的槽
+type timingWheel struct {
+	mtx   sync.Mutex
+	tick  time.Duration                                       // 精度
+	start time.Time                                           // 创建时间, tick 从此开始计数
+	now   int64                                               // 当前 tick
+	slots [TIMING_WHEEL_LEVELS][TIMING_WHEEL_SLOTS]wheelTimer // 各槽的哨兵节点
+}
+
+func newTimingWheel(tick time.Duration) *timingWheel {
+	this_ := &timingWheel{
+		tick:  tick,
+		start: time.Now(),
+	}
+
+	for l := range this_.slots {
+		for i := range this_.slots[l] {
+			s := &this_.slots[l][i]
+			s.prev, s.next = s, s
+		}
+	}
+
+	return this_
+}
+
+// schedule 设置定时器在 d 之后到期, 已挂载的定时器会先被移除. 不足一个 tick 时按一个 tick 计算
+func (this_ *timingWheel) schedule(t *wheelTimer, d time.Duration) {
+	ticks := int64((d + this_.tick - 1) / this_.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	this_.mtx.Lock()
+	this_.unlink(t)
+	t.expire = this_.now + ticks
+	this_.link(t)
+	this_.mtx.Unlock()
+}
+
+// cancel 移除定时器
+func (this_ *timingWheel) cancel(t *wheelTimer) {
+	this_.mtx.Lock()
+	this_.unlink(t)
+	this_.mtx.Unlock()
+}
+
+// advance 推进到 now 对应的 tick, 执行所有到期的定时器. 回调在释放锁之后执行, 可以重新设置定时器
+func (this_ *timingWheel) advance(now time.Time) {
+	var (
+		target  = int64(now.Sub(this_.start) / this_.tick)
+		expired []*wheelTimer
+	)
+
+	this_.mtx.Lock()
+	for this_.now < target {
+		this_.now++
+
+		// 低层转完一圈, 将高层当前槽中的定时器降级
+		for l := 1; l < TIMING_WHEEL_LEVELS; l++ {
+			if this_.now&(int64(1)<<(TIMING_WHEEL_BITS*l)-1) != 0 {
+				break
+			}
+
+			s := &this_.slots[l][(this_.now>>(TIMING_WHEEL_BITS*l))&TIMING_WHEEL_MASK]
+			for t := s.next; t != s; t = s.next {
+				this_.unlink(t)
+				this_.link(t)
+			}
+		}
+
+		s := &this_.slots[0][this_.now&TIMING_WHEEL_MASK]
+		for t := s.next; t != s; t = s.next {
+			this_.unlink(t)
+			expired = append(expired, t)
+		}
+	}
+	this_.mtx.Unlock()
+
+	for _, t := range expired {
+		t.task()
+	}
+}
+
+// link 根据到期时间将定时器挂到对应层的槽上, 超过最长定时的按最长定时计算
+func (this_ *timingWheel) link(t *wheelTimer) {
+	delta := t.expire - this_.now
+	if delta < 0 {
+		delta, t.expire = 0, this_.now
+	} else if delta >= TIMING_WHEEL_SPAN {
+		delta, t.expire = TIMING_WHEEL_SPAN-1, this_.now+TIMING_WHEEL_SPAN-1
+	}
+
+	level := 0
+	for delta >= int64(1)<<(TIMING_WHEEL_BITS*(level+1)) {
+		level++
+	}
+
+	s := &this_.slots[level][(t.expire>>(TIMING_WHEEL_BITS*level))&TIMING_WHEEL_MASK]
+	t.slot = s
+	t.prev = s.prev
+	t.next = s
+	s.prev.next = t
+	s.prev = t
+}
+
+func (this_ *timingWheel) unlink(t *wheelTimer) {
+	if t.slot == nil {
+		return
+	}
+
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev, t.next, t.slot = nil, nil, nil
+}
@@ -0,0 +1,93 @@
+package nw
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimingWheel(t *testing.T) {
+	const TICK = time.Second
+
+	wheel := newTimingWheel(TICK)
+	base := time.Now()
+
+	var (
+		now   int64
+		fired = map[string]int64{}
+	)
+	schedule := func(name string, d time.Duration) *wheelTimer {
+		timer := &wheelTimer{task: func() { fired[name] = now }}
+		wheel.schedule(timer, d)
+		return timer
+	}
+	advance := func(tick int64) {
+		now = tick
+		wheel.advance(base.Add(time.Duration(tick) * TICK))
+	}
+
+	// 跨越各层的定时器在到期的 tick 触发, 超过最长定时按最长定时计算
+	expects := []struct {
+		name string
+		tick int64
+	}{
+		{"l0", 3}, {"moved", 20}, {"l0_last", 63}, {"l1", 64}, {"l1_mid", 65}, {"l1_last", 4095},
+		{"l2", 4096}, {"l2_mid", 5000}, {"l3", 300000}, {"over_span", TIMING_WHEEL_SPAN - 1},
+	}
+	for _, e := range expects {
+		switch e.name {
+		case "over_span":
+			schedule(e.name, time.Duration(TIMING_WHEEL_SPAN+100)*TICK)
+		case "moved":
+			// 重新设置时先从原来的槽中移除
+			wheel.schedule(schedule(e.name, 10*TICK), time.Duration(e.tick)*TICK)
+		default:
+			schedule(e.name, time.Duration(e.tick)*TICK)
+		}
+	}
+	wheel.cancel(schedule("canceled", 10*TICK))
+
+	for _, e := range expects {
+		advance(e.tick - 1)
+		if _, ok := fired[e.name]; ok {
+			t.Fatalf("%s fired before tick %d", e.name, e.tick)
+		}
+
+		advance(e.tick)
+		if fired[e.name] != e.tick {
+			t.Fatalf("%s fired at %d, want %d", e.name, fired[e.name], e.tick)
+		}
+	}
+
+	if _, ok := fired["canceled"]; ok {
+		t.Fatalf("canceled timer fired")
+	}
+}
+
+func TestTimingWheelReschedule(t *testing.T) {
+	const TICK = 10 * time.Millisecond
+
+	wheel := newTimingWheel(TICK)
+	base := time.Now()
+
+	// 不足一个 tick 按一个 tick 计算, 回调中可以重新设置定时器
+	var (
+		now   int64
+		ticks []int64
+		timer wheelTimer
+	)
+	timer.task = func() {
+		ticks = append(ticks, now)
+		if len(ticks) < 3 {
+			wheel.schedule(&timer, 5*TICK)
+		}
+	}
+	wheel.schedule(&timer, TICK/2)
+
+	for now = 1; now <= 30; now++ {
+		wheel.advance(base.Add(time.Duration(now) * TICK))
+	}
+
+	if len(ticks) != 3 || ticks[0] != 1 || ticks[1] != 6 || ticks[2] != 11 {
+		t.Fatalf("fired at %v, want [1 6 11]", ticks)
+	}
+}
@@ -0,0 +1,345 @@
+package nw
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gox/frm/log"
+	"github.com/panjf2000/gnet/v2"
+)
+
+const (
+	TLS_HANDSHAKE_TIMEOUT = 10 * time.Second // tls 握手超时
+	TLS_RELOAD_INTERVAL   = 30 * time.Second // 证书文件变更检查周期
+)
+
+// tlsWouldBlock 非阻塞读取时没有可用数据
+//
+// crypto/tls 遇到 Temporary 错误时不会记录为永久错误, 下次可以继续读取
+type tlsWouldBlock struct{}
+
+func (tlsWouldBlock) Error() string   { return "tls would block" }
+func (tlsWouldBlock) Timeout() bool   { return true }
+func (tlsWouldBlock) Temporary() bool { return true }
+
+// certLoader 证书加载器, 支持热更新
+//
+// 证书, 私钥以及客户端 CA 文件发生变化后, 新的握手会自动使用新证书
+type certLoader struct {
+	certFile  string
+	keyFile   string
+	caFile    string
+	mtx       sync.Mutex
+	modTime   time.Time                  // 最后一次加载时的文件修改时间
+	lastCheck atomic.Int64               // 最后一次检查文件的时间
+	config    atomic.Pointer[tls.Config] // 当前使用的配置
+}
+
+// newCertLoader 创建证书加载器
+//   - certFile: 证书文件
+//   - keyFile: 私钥文件
+//   - caFile: 客户端 CA 文件, 为空表示不校验客户端证书
+func newCertLoader(certFile, keyFile, caFile string) (*certLoader, error) {
+	this_ := &certLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+
+	if err := this_.Reload(); err != nil {
+		return nil, err
+	}
+
+	return this_, nil
+}
+
+// Reload 重新加载证书
+func (this_ *certLoader) Reload() error {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	cert, err := tls.LoadX509KeyPair(this_.certFile, this_.keyFile)
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if len(this_.caFile) > 0 {
+		pem, err := os.ReadFile(this_.caFile)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no valid certificate in client ca file")
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	this_.modTime = this_.latestModTime()
+	this_.lastCheck.Store(time.Now().Unix())
+	this_.config.Store(config)
+	return nil
+}
+
+// TLSConfig 服务端使用的 tls 配置
+func (this_ *certLoader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			this_.checkReload()
+			return this_.config.Load(), nil
+		},
+	}
+}
+
+// checkReload 文件发生变化时重新加载
+func (this_ *certLoader) checkReload() {
+	tnow := time.Now().Unix()
+	last := this_.lastCheck.Load()
+	if tnow-last < int64(TLS_RELOAD_INTERVAL/time.Second) || !this_.lastCheck.CompareAndSwap(last, tnow) {
+		return
+	}
+
+	this_.mtx.Lock()
+	changed := this_.latestModTime().After(this_.modTime)
+	this_.mtx.Unlock()
+
+	if changed {
+		if err := this_.Reload(); err != nil {
+			log.Error("reload certificate failed: %v", err)
+		} else {
+			log.Info("certificate reloaded")
+		}
+	}
+}
+
+// latestModTime 证书相关文件中最新的修改时间
+func (this_ *certLoader) latestModTime() time.Time {
+	var latest time.Time
+	for _, file := range []string{this_.certFile, this_.keyFile, this_.caFile} {
+		if len(file) == 0 {
+			continue
+		}
+
+		fi, err := os.Stat(file)
+		if err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest
+}
+
+// tlsConn 在 gnet 连接之上实现 tls
+//
+// gnet 事件循环不能阻塞, 而 crypto/tls 的握手只能以阻塞方式进行, 所以握手在独立协程中完成;
+// 握手完成后由事件循环以非阻塞方式解密数据, 解密后的明文供协议解析使用
+type tlsConn struct {
+	c      gnet.Conn
+	conn   *tls.Conn
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	cipher []byte // 待解密的密文
+	plain  []byte // 已解密的明文, 仅在事件循环中访问
+	state  int32  // 状态
+	laddr  net.Addr
+	raddr  net.Addr
+	out    *outbound // 待发送数据统计
+}
+
+const (
+	tlsState_Handshaking int32 = 0 // 正在握手
+	tlsState_Established int32 = 1 // 握手完成
+	tlsState_Closed      int32 = 2 // 已关闭
+)
+
+// newTlsConn 创建服务端 tls 连接
+func newTlsConn(c gnet.Conn, config *tls.Config, out *outbound) *tlsConn {
+	this_ := &tlsConn{
+		c:     c,
+		laddr: c.LocalAddr(),
+		raddr: c.RemoteAddr(),
+		out:   out,
+	}
+
+	this_.cond = sync.NewCond(&this_.mtx)
+	this_.conn = tls.Server(&tlsTransport{this_}, config)
+	return this_
+}
+
+// handshake 握手, 在独立协程中调用
+//   - established: 握手成功后调用, 返回错误时握手视为失败. 调用期间连接不会被标记为关闭
+func (this_ *tlsConn) handshake(established func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), TLS_HANDSHAKE_TIMEOUT)
+	defer cancel()
+
+	err := this_.conn.HandshakeContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	if this_.state == tlsState_Closed {
+		return net.ErrClosed
+	}
+
+	if err = established(); err != nil {
+		return err
+	}
+
+	this_.state = tlsState_Established
+	return nil
+}
+
+// established 是否握手完成
+func (this_ *tlsConn) established() bool {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+	return this_.state == tlsState_Established
+}
+
+// close 关闭, 唤醒阻塞中的握手协程. 返回关闭前是否已握手完成
+func (this_ *tlsConn) close() bool {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	established := this_.state == tlsState_Established
+	this_.state = tlsState_Closed
+	this_.cond.Broadcast()
+	return established
+}
+
+// feed 读取 gnet 连接中的密文, 握手完成后解密到明文缓冲区. 返回是否可以解析明文
+func (this_ *tlsConn) feed(c gnet.Conn) (bool, error) {
+	data, _ := c.Next(-1)
+
+	this_.mtx.Lock()
+	this_.cipher = append(this_.cipher, data...)
+	state := this_.state
+	this_.cond.Broadcast()
+	this_.mtx.Unlock()
+
+	if state != tlsState_Established {
+		return false, nil
+	}
+
+	var buf [16384]byte
+	for {
+		n, err := this_.conn.Read(buf[:])
+		this_.plain = append(this_.plain, buf[:n]...)
+		if err != nil {
+			var wb tlsWouldBlock
+			if errors.As(err, &wb) {
+				return true, nil
+			}
+
+			return true, err
+		}
+	}
+}
+
+// InboundBuffered 明文缓冲区长度
+func (this_ *tlsConn) InboundBuffered() int {
+	return len(this_.plain)
+}
+
+// Peek 查看明文, n 为 -1 时返回全部
+func (this_ *tlsConn) Peek(n int) ([]byte, error) {
+	if n < 0 || n > len(this_.plain) {
+		n = len(this_.plain)
+	}
+
+	return this_.plain[:n], nil
+}
+
+// Discard 丢弃明文
+func (this_ *tlsConn) Discard(n int) (int, error) {
+	if n > len(this_.plain) {
+		n = len(this_.plain)
+	}
+
+	this_.plain = this_.plain[:copy(this_.plain, this_.plain[n:])]
+	return n, nil
+}
+
+// Read 读取明文
+func (this_ *tlsConn) Read(p []byte) (int, error) {
+	if len(this_.plain) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, this_.plain)
+	this_.Discard(n)
+	return n, nil
+}
+
+// Write 加密并发送数据
+func (this_ *tlsConn) Write(p []byte) (int, error) {
+	return this_.conn.Write(p)
+}
+
+// tlsTransport tls 底层传输, 实现 net.Conn
+type tlsTransport struct {
+	*tlsConn
+}
+
+// Read 读取密文, 握手期间阻塞等待, 握手完成后非阻塞
+func (this_ *tlsTransport) Read(p []byte) (int, error) {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	for len(this_.cipher) == 0 {
+		switch this_.state {
+		case tlsState_Closed:
+			return 0, net.ErrClosed
+
+		case tlsState_Established:
+			return 0, tlsWouldBlock{}
+		}
+
+		this_.cond.Wait()
+	}
+
+	n := copy(p, this_.cipher)
+	this_.cipher = this_.cipher[:copy(this_.cipher, this_.cipher[n:])]
+	return n, nil
+}
+
+// Write 发送密文
+func (this_ *tlsTransport) Write(p []byte) (int, error) {
+	err := this_.c.AsyncWrite(append([]byte(nil), p...), this_.out.add(len(p), nil))
+	if err != nil {
+		this_.out.done(len(p))
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (this_ *tlsTransport) Close() error {
+	this_.close()
+	return nil
+}
+
+func (this_ *tlsTransport) LocalAddr() net.Addr                { return this_.laddr }
+func (this_ *tlsTransport) RemoteAddr() net.Addr               { return this_.raddr }
+func (this_ *tlsTransport) SetDeadline(t time.Time) error      { return nil }
+func (this_ *tlsTransport) SetReadDeadline(t time.Time) error  { return nil }
+func (this_ *tlsTransport) SetWriteDeadline(t time.Time) error { return nil }
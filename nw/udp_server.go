@@ -0,0 +1,268 @@
+package nw
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gox/frm/log"
+	"github.com/panjf2000/gnet/v2"
+)
+
+const (
+	UDP_MESSAGE_MAX_SIZE = 65507   // udp 单个数据报最大长度
+	UDP_VIRTUAL_FD_BASE  = 1 << 30 // udp 虚拟描述符起始值, 避免与真实描述符冲突
+)
+
+var ErrUdpMessageTooLarge = errors.New("udp message too large")
+
+// udpServer UDP服务器
+//
+// UDP 协议格式: 一个数据报即一条消息, 不附加消息头
+//
+// udp 没有连接的概念, udpServer 以对端地址区分客户端, 收到新地址的第一个数据报时
+// 创建 ConnContext 并触发 OnConnected, 空闲超时后关闭并触发 OnDisconnected.
+// gnet 的 udp 连接对象只在当前数据报的回调中有效, 会话只保存对端地址, 通过监听套接字的副本发送数据报.
+// 会话可能在任意协程中被关闭, OnDisconnected 统一在推进时间轮的协程中触发
+type udpServer struct {
+	baseServer
+	mtx      sync.Mutex              // 保护 sessions, closing 和 nextFd
+	conn     net.PacketConn          // 监听套接字的副本, 用于发送数据报
+	sessions map[string]*ConnContext // 对端地址 => 连接上下文
+	closing  []*ConnContext          // 已关闭但尚未触发 OnDisconnected 的会话
+	nextFd   int                     // 下一个虚拟描述符
+
+	onSession func(*ConnContext, []byte) error // 新会话创建时的回调, 在 OnConnected 之前调用
+}
+
+// newUdpServer 创建一个新的 UDP 服务器
+//
+//   - owner: 所属服务
+//   - c: 配置
+//
+// 返回一个新的 udpServer 实例
+func newUdpServer(owner *Service, c *Config) *udpServer {
+	this_ := &udpServer{}
+	this_.init(owner, this_, c.UdpHost)
+	return this_
+}
+
+// init 初始化, 供基于 udp 的服务器复用
+//   - owner: 所属服务
+//   - server: 实际的服务
+//   - host: 监听地址
+func (this_ *udpServer) init(owner *Service, server IServer, host string) {
+	this_.baseServer = *newBaseServer(owner, server, host)
+	this_.sessions = make(map[string]*ConnContext)
+	this_.nextFd = UDP_VIRTUAL_FD_BASE
+}
+
+// Proto 返回服务器的协议类型
+func (this_ *udpServer) Proto() Protocol {
+	return Protocol_UDP
+}
+
+// OnBoot 启动事件, 复制监听套接字用于在事件循环之外发送数据报
+func (this_ *udpServer) OnBoot(eng gnet.Engine) gnet.Action {
+	fd, err := eng.Dup()
+	if err != nil {
+		log.Error("dup udp listener failed: %v", err)
+		return gnet.Shutdown
+	}
+
+	f := os.NewFile(uintptr(fd), this_.host)
+	conn, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		log.Error("dup udp listener failed: %v", err)
+		return gnet.Shutdown
+	}
+
+	// 启动前已被停止
+	if action := this_.baseServer.OnBoot(eng); action != gnet.None {
+		conn.Close()
+		return action
+	}
+
+	this_.conn = conn
+	return gnet.None
+}
+
+// OnTraffic 处理客户端数据报
+func (this_ *udpServer) OnTraffic(c gnet.Conn) gnet.Action {
+	data, _ := c.Next(-1)
+	if len(data) == 0 {
+		return gnet.None
+	}
+
+	cctx := this_.session(c, data)
+	if cctx == nil {
+		return gnet.None
+	}
+
+	cctx.countRead(len(data))
+	cctx.touch()
+	if !this_.owner.pushMessage(this_.msgPool.New(cctx, data)) {
+		this_.Close(cctx)
+	}
+	return gnet.None
+}
+
+// OnShutdown 引擎停止时关闭所有 udp 会话
+func (this_ *udpServer) OnShutdown(eng gnet.Engine) {
+	this_.mtx.Lock()
+	for key, cctx := range this_.sessions {
+		delete(this_.sessions, key)
+		this_.closing = append(this_.closing, cctx)
+	}
+	this_.mtx.Unlock()
+
+	this_.closeSessions()
+
+	if this_.conn != nil {
+		this_.conn.Close()
+	}
+}
+
+// OnTick 推进空闲检测时间轮, 并触发已关闭会话的 OnDisconnected
+func (this_ *udpServer) OnTick() (time.Duration, gnet.Action) {
+	d, action := this_.baseServer.OnTick()
+	this_.closeSessions()
+	return d, action
+}
+
+// Close 关闭 udp 会话, 可以在任意协程中调用. 会话立即失效, OnDisconnected 在下一个 tick 触发
+func (this_ *udpServer) Close(cctx *ConnContext) {
+	key := cctx.remoteAddr
+
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	if this_.sessions[key] != cctx {
+		return
+	}
+	delete(this_.sessions, key)
+	this_.closing = append(this_.closing, cctx)
+}
+
+// closeSessions 触发已关闭会话的 OnDisconnected 并释放连接上下文
+func (this_ *udpServer) closeSessions() {
+	this_.mtx.Lock()
+	closing := this_.closing
+	this_.closing = nil
+	this_.mtx.Unlock()
+
+	for _, cctx := range closing {
+		this_.removeConn(cctx)
+		this_.owner.limiter.release(cctx)
+		this_.owner.event.OnDisconnected(cctx)
+		this_.freeConn(cctx)
+	}
+}
+
+// Write 向对端发送一个数据报
+func (this_ *udpServer) Write(cctx *ConnContext, data []byte) error {
+	if len(data) > UDP_MESSAGE_MAX_SIZE {
+		return ErrUdpMessageTooLarge
+	}
+
+	cctx.touchWrite()
+	_, err := this_.conn.WriteTo(data, cctx.udpAddr)
+	if err != nil {
+		log.Error("[%d:%v] SendTo failed: %v", cctx.Fd(), cctx.remoteAddr, err)
+		this_.owner.metrics.OnWriteError(Protocol_UDP, err)
+		return err
+	}
+
+	cctx.countWrite(len(data))
+	return nil
+}
+
+// encode udp 数据报不需要编码
+func (this_ *udpServer) encode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// writeFrame 发送数据报
+func (this_ *udpServer) writeFrame(cctx *ConnContext, frame []byte) error {
+	return this_.Write(cctx, frame)
+}
+
+// session 获取对端地址对应的会话, 不存在时创建
+//   - c: 数据报对应的连接
+//   - data: 触发创建会话的数据报
+func (this_ *udpServer) session(c gnet.Conn, data []byte) *ConnContext {
+	key := c.RemoteAddr().String()
+
+	this_.mtx.Lock()
+	cctx, ok := this_.sessions[key]
+	this_.mtx.Unlock()
+	if ok {
+		return cctx
+	}
+
+	// 服务停止中, 不再接受新会话
+	if atomic.LoadInt32(&this_.owner.info.State) != ServiceState_Running {
+		return nil
+	}
+
+	if this_.owner.info.MaxConn > 0 && this_.owner.conns.Count() >= this_.owner.info.MaxConn {
+		return nil
+	}
+
+	// gnet 的 udp 连接对象在 OnTraffic 返回后即被释放, 只保留对端地址的拷贝
+	cctx = this_.newConnContext(c)
+	cctx.c = nil
+	cctx.udpAddr = cloneUDPAddr(c.RemoteAddr())
+
+	this_.mtx.Lock()
+	cctx.fd = this_.nextFd
+	this_.nextFd++
+	this_.mtx.Unlock()
+
+	if !this_.owner.limiter.admit(cctx) {
+		this_.freeConn(cctx)
+		return nil
+	}
+
+	if this_.onSession != nil {
+		if err := this_.onSession(cctx, data); err != nil {
+			log.Error("[%d:%v] create session failed: %v", cctx.Fd(), key, err)
+			this_.owner.limiter.release(cctx)
+			this_.freeConn(cctx)
+			return nil
+		}
+	}
+
+	if err := this_.owner.event.OnConnected(cctx); err != nil {
+		log.Error("[%d:%v] connected failed: %v", cctx.Fd(), key, err)
+		this_.owner.limiter.release(cctx)
+		this_.freeConn(cctx)
+		return nil
+	}
+
+	this_.mtx.Lock()
+	this_.sessions[key] = cctx
+	this_.mtx.Unlock()
+
+	this_.addConn(cctx)
+	return cctx
+}
+
+// cloneUDPAddr 深拷贝 udp 地址
+func cloneUDPAddr(addr net.Addr) net.Addr {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return addr
+	}
+
+	return &net.UDPAddr{
+		IP:   append(net.IP(nil), ua.IP...),
+		Port: ua.Port,
+		Zone: strings.Clone(ua.Zone),
+	}
+}
@@ -1,9 +1,12 @@
 package nw
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -12,27 +15,156 @@ import (
 )
 
 type WsClient struct {
-	connected int32           // 连接状态
-	fd        int64           // 原始文件描述符
-	recvSeq   int64           // 接收序列
-	sendSeq   int64           // 发送序列
-	timeout   time.Duration   // 读超时
-	conn      *websocket.Conn // 连接对象
-	realIP    string          // 真实IP
-	userData  any             // 用户数据
+	connected    int32             // 连接状态
+	fd           int64             // 原始文件描述符
+	recvSeq      int64             // 接收序列
+	sendSeq      int64             // 发送序列
+	timeout      time.Duration     // 读超时
+	conn         *websocket.Conn   // 连接对象
+	realIP       string            // 真实IP
+	userData     any               // 用户数据
+	rtt          int64             // 最近一次心跳的往返时间, 纳秒
+	closeCh      chan struct{}     // 关闭通知
+	threshold    int               // 压缩阈值, 为 0 表示不压缩
+	dialer       *websocket.Dialer // 重连时使用
+	url          string            // 连接地址
+	reconnect    *ReconnectConfig  // 断线重连配置, 为 nil 时不重连
+	resume       *resumeState      // 会话恢复状态, 未开启时为 nil
+	wmtx         sync.Mutex        // 保证写入顺序, 写入方持有直到数据写出
+	mtx          sync.Mutex        // 保护 conn 的切换和重连状态
+	cond         *sync.Cond        // 重连结束时通知等待的读取方
+	reconnecting bool              // 连接已断开, 正在重连
+	queue        [][]byte          // 重连期间待发送的消息
+	err          error             // 重连失败的原因, 不为 nil 时客户端已关闭
+}
+
+// WsClientConfig websocket 客户端配置
+type WsClientConfig struct {
+	Timeout           time.Duration // 读写超时
+	TLS               *tls.Config   // tls 配置, 不为 nil 时使用 wss. 双向认证时需要设置 Certificates
+	Compress          bool          // 是否协商 permessage-deflate 压缩, 只支持不保留上下文的模式
+	CompressThreshold int           // 小于该长度的消息不压缩, 默认为 WS_COMPRESS_THRESHOLD
+
+	Reconnect *ReconnectConfig // 断线重连配置, 为 nil 时连接断开后读写返回错误
 }
 
 func NewWsClient(addr string, timeout time.Duration) (*WsClient, error) {
+	return NewWsClientWithConfig(addr, &WsClientConfig{Timeout: timeout})
+}
+
+// NewWssClient 创建使用 tls 的 websocket 客户端
+//   - config: tls 配置, 双向认证时需要设置 Certificates
+func NewWssClient(addr string, timeout time.Duration, config *tls.Config) (*WsClient, error) {
+	return NewWsClientWithConfig(addr, &WsClientConfig{Timeout: timeout, TLS: config})
+}
+
+// NewWsClientWithConfig 根据配置创建 websocket 客户端
+func NewWsClientWithConfig(addr string, c *WsClientConfig) (*WsClient, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = c.Compress
+
 	u := url.URL{Scheme: "ws", Host: addr, Path: "/ws"}
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if c.TLS != nil {
+		dialer.TLSClientConfig = c.TLS
+		u.Scheme = "wss"
+	}
+
+	this_ := newWsClient(&dialer, u.String(), c.Timeout)
+
+	if c.Compress {
+		this_.threshold = c.CompressThreshold
+		if this_.threshold <= 0 {
+			this_.threshold = WS_COMPRESS_THRESHOLD
+		}
+	}
+
+	if c.Reconnect != nil {
+		this_.reconnect = c.Reconnect.withDefaults()
+		if this_.reconnect.Resume {
+			this_.resume = &resumeState{}
+		}
+	}
+
+	conn, _, _, err := this_.dial()
 	if err != nil {
 		return nil, err
 	}
 
-	rawConn, err := conn.NetConn().(*net.TCPConn).SyscallConn()
+	if err = this_.attach(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	this_.connected = 1
+	return this_, nil
+}
+
+func newWsClient(dialer *websocket.Dialer, urlStr string, timeout time.Duration) *WsClient {
+	this_ := &WsClient{
+		recvSeq:  0,
+		sendSeq:  0,
+		timeout:  timeout,
+		userData: nil,
+		closeCh:  make(chan struct{}),
+		dialer:   dialer,
+		url:      urlStr,
+	}
+
+	this_.cond = sync.NewCond(&this_.mtx)
+	return this_
+}
+
+// dial 建立连接, 开启会话恢复时完成恢复握手, 返回是否恢复了原会话和需要重发的消息
+func (this_ *WsClient) dial() (*websocket.Conn, bool, [][]byte, error) {
+	conn, _, err := this_.dialer.Dial(this_.url, nil)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	if this_.resume == nil {
+		return conn, false, nil, nil
+	}
+
+	resumed, replay, err := this_.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, false, nil, err
+	}
+
+	return conn, resumed, replay, nil
+}
+
+// handshake 发送 HELLO 并等待 WELCOME
+func (this_ *WsClient) handshake(conn *websocket.Conn) (bool, [][]byte, error) {
+	if this_.timeout > 0 {
+		deadline := time.Now().Add(this_.timeout)
+		conn.SetWriteDeadline(deadline)
+		conn.SetReadDeadline(deadline)
+	}
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, this_.resume.hello()); err != nil {
+		return false, nil, err
+	}
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return false, nil, err
+	}
+
+	return this_.resume.welcome(data)
+}
+
+// attach 切换到新连接并启动心跳. 重连时调用方需要持有 mtx
+func (this_ *WsClient) attach(conn *websocket.Conn) error {
+	netConn := conn.NetConn()
+	if tc, ok := netConn.(*tls.Conn); ok {
+		netConn = tc.NetConn()
+	}
+
+	rawConn, err := netConn.(*net.TCPConn).SyscallConn()
 	if err != nil {
 		log.Error(err)
-		return nil, err
+		return err
 	}
 
 	ch := make(chan int64, 1)
@@ -40,18 +172,15 @@ func NewWsClient(addr string, timeout time.Duration) (*WsClient, error) {
 		ch <- int64(fd)
 	})
 
-	fd := <-ch
+	atomic.StoreInt64(&this_.fd, <-ch)
+	this_.conn = conn
+	this_.realIP = conn.RemoteAddr().(*net.TCPAddr).IP.String()
 
-	return &WsClient{
-		connected: 1,
-		fd:        fd,
-		recvSeq:   0,
-		sendSeq:   0,
-		timeout:   timeout,
-		conn:      conn,
-		realIP:    conn.RemoteAddr().(*net.TCPAddr).IP.String(),
-		userData:  nil,
-	}, nil
+	conn.SetPongHandler(func(data string) error {
+		return this_.onPong(conn, data)
+	})
+	go this_.heartbeatLoop(conn)
+	return nil
 }
 
 func (this_ *WsClient) IsConnected() bool {
@@ -59,91 +188,308 @@ func (this_ *WsClient) IsConnected() bool {
 }
 
 func (this_ *WsClient) SockFd() int64 {
-	return this_.fd
+	return atomic.LoadInt64(&this_.fd)
 }
 
 func (this_ *WsClient) LocalAddr() net.Addr {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
 	return this_.conn.LocalAddr()
-
 }
 
 func (this_ *WsClient) RemoteAddr() net.Addr {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
 	return this_.conn.RemoteAddr()
 }
 
 func (this_ *WsClient) RealRemoteIP() string {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
 	return this_.realIP
 }
 
+// Close 关闭客户端, 恢复会话时先通知服务端不再保留会话
 func (this_ *WsClient) Close() error {
 	if atomic.CompareAndSwapInt32(&this_.connected, 1, 0) {
-		err := this_.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		close(this_.closeCh)
+
+		this_.mtx.Lock()
+		this_.cond.Broadcast()
+		conn, reconnecting := this_.conn, this_.reconnecting
+		this_.mtx.Unlock()
+
+		if this_.resume != nil && !reconnecting {
+			this_.wmtx.Lock()
+			this_.writeMessage(conn, []byte{RESUME_CLOSE})
+			this_.wmtx.Unlock()
+		}
+
+		// 重连期间原连接已关闭
+		if reconnecting {
+			return nil
+		}
+
+		err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
 		if err != nil {
 			log.Warn("WsClient[%v] write control close message failed: %v", this_.realIP, err)
 		}
 
-		err = this_.conn.Close()
+		err = conn.Close()
 		return err
 	}
 
 	return nil
 }
 
+// Write 发送消息
+//
+// 开启重连时写入失败不返回错误, 消息在重连后发送. 重连期间待发送消息超过 ReconnectConfig.QueueSize 时返回 ErrReconnectQueueFull
 func (this_ *WsClient) Write(data []byte) (int, error) {
-	var err error
+	this_.wmtx.Lock()
+	defer this_.wmtx.Unlock()
 
-	if this_.timeout > 0 {
-		err = this_.conn.SetWriteDeadline(time.Now().Add(this_.timeout))
-		if err != nil {
-			log.Error(err)
-			return -1, err
+	this_.mtx.Lock()
+	if this_.reconnecting {
+		defer this_.mtx.Unlock()
+		if len(this_.queue) >= this_.reconnect.QueueSize {
+			return -1, ErrReconnectQueueFull
 		}
+
+		this_.queue = append(this_.queue, append([]byte(nil), data...))
+		this_.sendSeq++
+		return len(data), nil
 	}
 
-	err = this_.conn.WriteMessage(websocket.BinaryMessage, data)
+	conn, err := this_.conn, this_.err
+	this_.mtx.Unlock()
+
 	if err != nil {
 		return -1, err
 	}
 
+	msg := data
+	if this_.resume != nil {
+		msg = this_.resume.seal(data)
+	}
+
+	if err = this_.writeMessage(conn, msg); err != nil {
+		if this_.reconnect == nil || !this_.IsConnected() {
+			return -1, err
+		}
+
+		this_.mtx.Lock()
+		// 恢复会话时消息已保存在未确认消息中, 否则重连后重新发送
+		if this_.resume == nil {
+			this_.queue = append(this_.queue, append([]byte(nil), data...))
+		}
+		this_.lost(conn, err)
+		this_.mtx.Unlock()
+	}
+
 	this_.sendSeq++
 	return len(data), nil
 }
 
-func (this_ *WsClient) Read() ([]byte, error) {
+// writeMessage 写入一条二进制消息, 调用方需要持有 wmtx
+func (this_ *WsClient) writeMessage(conn *websocket.Conn, data []byte) error {
 	if this_.timeout > 0 {
-		err := this_.conn.SetReadDeadline(time.Now().Add(this_.timeout))
+		err := conn.SetWriteDeadline(time.Now().Add(this_.timeout))
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+
+	// 未协商压缩时设置无效
+	conn.EnableWriteCompression(this_.threshold > 0 && len(data) >= this_.threshold)
+
+	return conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// Read 读取消息
+//
+// 开启重连时连接断开后等待重连完成再继续读取, 重连失败时返回 ErrReconnectFailed
+func (this_ *WsClient) Read() ([]byte, error) {
+	for {
+		conn, err := this_.current()
+		if err != nil {
+			return nil, err
+		}
+
+		t, data, err := this_.readMessage(conn)
 		if err != nil {
-			if websocket.IsCloseError(err,
-				websocket.CloseAbnormalClosure,
-				websocket.CloseNormalClosure,
-				websocket.CloseGoingAway,
-				websocket.CloseNoStatusReceived) || IsConnReset(err) {
-				return nil, fmt.Errorf("WsClient[%v] PASSIVE close: %v", this_.RemoteAddr(), err)
+			if this_.reconnect == nil || !this_.IsConnected() {
+				return nil, err
+			}
+
+			this_.mtx.Lock()
+			this_.lost(conn, err)
+			this_.mtx.Unlock()
+			continue
+		}
+
+		if t != websocket.BinaryMessage {
+			return nil, fmt.Errorf("WsClient[%v] ACTIVE close: message type is invalid", conn.RemoteAddr())
+		}
+
+		if this_.resume != nil {
+			payload, deliver, ack, err := this_.resume.receive(data)
+			if err != nil {
+				return nil, fmt.Errorf("WsClient[%v] ACTIVE close: %v", conn.RemoteAddr(), err)
 			}
 
-			return nil, fmt.Errorf("WsClient[%v] ACTIVE close: %v", this_.RemoteAddr(), err)
+			if ack != nil {
+				this_.wmtx.Lock()
+				this_.writeMessage(conn, ack)
+				this_.wmtx.Unlock()
+			}
+
+			if !deliver {
+				continue
+			}
+			data = payload
+		}
+
+		this_.recvSeq++
+		return data, nil
+	}
+}
+
+// readMessage 从连接读取一条消息
+func (this_ *WsClient) readMessage(conn *websocket.Conn) (int, []byte, error) {
+	if this_.timeout > 0 {
+		err := conn.SetReadDeadline(time.Now().Add(this_.timeout))
+		if err != nil {
+			return 0, nil, closeError(conn, err)
 		}
 	}
 
-	t, data, err := this_.conn.ReadMessage()
+	t, data, err := conn.ReadMessage()
 	if err != nil {
-		if websocket.IsCloseError(err,
-			websocket.CloseAbnormalClosure,
-			websocket.CloseNormalClosure,
-			websocket.CloseGoingAway,
-			websocket.CloseNoStatusReceived) || IsConnReset(err) {
-			return nil, fmt.Errorf("WsClient[%v] PASSIVE close: %v", this_.RemoteAddr(), err)
+		return 0, nil, closeError(conn, err)
+	}
+
+	return t, data, nil
+}
+
+// closeError 区分对方关闭和本方关闭
+func closeError(conn *websocket.Conn, err error) error {
+	if websocket.IsCloseError(err,
+		websocket.CloseAbnormalClosure,
+		websocket.CloseNormalClosure,
+		websocket.CloseGoingAway,
+		websocket.CloseNoStatusReceived) || IsConnReset(err) {
+		return fmt.Errorf("WsClient[%v] PASSIVE close: %v", conn.RemoteAddr(), err)
+	}
+
+	return fmt.Errorf("WsClient[%v] ACTIVE close: %v", conn.RemoteAddr(), err)
+}
+
+// current 当前连接, 重连期间等待重连结束
+func (this_ *WsClient) current() (*websocket.Conn, error) {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	for this_.reconnecting && this_.IsConnected() {
+		this_.cond.Wait()
+	}
+
+	if this_.err != nil {
+		return nil, this_.err
+	}
+
+	return this_.conn, nil
+}
+
+// lost 连接断开, 开始后台重连. 调用方需要持有 mtx
+func (this_ *WsClient) lost(conn *websocket.Conn, err error) {
+	if conn != this_.conn || this_.reconnecting || !this_.IsConnected() {
+		return
+	}
+
+	this_.reconnecting = true
+	conn.Close()
+	go this_.redial(err)
+}
+
+// redial 后台重连协程, 按退避策略重连, 超过重试次数后关闭客户端
+func (this_ *WsClient) redial(cause error) {
+	this_.reconnect.notifyDisconnect(cause)
+
+	for n := 0; this_.reconnect.MaxRetries <= 0 || n < this_.reconnect.MaxRetries; n++ {
+		timer := time.NewTimer(this_.reconnect.backoff(n))
+		select {
+		case <-timer.C:
+		case <-this_.closeCh:
+			timer.Stop()
+			return
 		}
 
-		return nil, fmt.Errorf("WsClient[%v] ACTIVE close: %v", this_.RemoteAddr(), err)
+		conn, resumed, replay, err := this_.dial()
+		if err == nil {
+			if err = this_.restore(conn, replay); err == nil {
+				this_.reconnect.notifyConnect(resumed)
+				return
+			}
+			conn.Close()
+		}
+
+		log.Warn("WsClient %v reconnect failed: %v", this_.url, err)
+	}
+
+	log.Error("WsClient %v reconnect failed: %v", this_.url, ErrReconnectFailed)
+
+	this_.mtx.Lock()
+	this_.err = ErrReconnectFailed
+	this_.reconnecting = false
+	if atomic.CompareAndSwapInt32(&this_.connected, 1, 0) {
+		close(this_.closeCh)
+	}
+	this_.cond.Broadcast()
+	this_.mtx.Unlock()
+}
+
+// restore 在新连接上重发对方未收到的消息和重连期间缓存的消息, 然后切换到新连接
+func (this_ *WsClient) restore(conn *websocket.Conn, replay [][]byte) error {
+	this_.wmtx.Lock()
+	defer this_.wmtx.Unlock()
+
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+
+	if !this_.IsConnected() {
+		return net.ErrClosed
+	}
+
+	for _, msg := range replay {
+		if err := this_.writeMessage(conn, msg); err != nil {
+			return err
+		}
+	}
+
+	for len(this_.queue) > 0 {
+		msg := this_.queue[0]
+		if this_.resume != nil {
+			msg = this_.resume.seal(msg)
+		}
+
+		// 已分配序号的消息在下次恢复时重发
+		if err := this_.writeMessage(conn, msg); err != nil && this_.resume == nil {
+			return err
+		}
+
+		this_.queue[0] = nil
+		this_.queue = this_.queue[1:]
 	}
 
-	if t != websocket.BinaryMessage {
-		return nil, fmt.Errorf("WsClient[%v] ACTIVE close: message type is invalid", this_.RemoteAddr())
+	if err := this_.attach(conn); err != nil {
+		return err
 	}
 
-	this_.recvSeq++
-	return data, nil
+	this_.reconnecting = false
+	this_.cond.Broadcast()
+	return nil
 }
 
 func (this_ *WsClient) GetUserData() any {
@@ -161,3 +507,48 @@ func (this_ *WsClient) GetRecvSeq() int64 {
 func (this_ *WsClient) GetSendSeq() int64 {
 	return this_.sendSeq
 }
+
+// RTT 最近一次心跳的往返时间, 没有收到过心跳应答时为 0
+func (this_ *WsClient) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this_.rtt))
+}
+
+// onPong 收到心跳应答, 在 Read 中调用
+func (this_ *WsClient) onPong(conn *websocket.Conn, data string) error {
+	if len(data) == 8 {
+		atomic.StoreInt64(&this_.rtt, rtt(int64(binary.BigEndian.Uint64([]byte(data)))))
+	}
+
+	if this_.timeout > 0 {
+		return conn.SetReadDeadline(time.Now().Add(this_.timeout))
+	}
+
+	return nil
+}
+
+// heartbeatLoop 定期发送 ping 控制帧, 防止空闲连接被服务端超时关闭. 应答在 Read 中处理. 发送失败时开始重连并退出
+func (this_ *WsClient) heartbeatLoop(conn *websocket.Conn) {
+	ticker := time.NewTicker(heartbeatInterval(this_.timeout))
+	defer ticker.Stop()
+
+	var payload [8]byte
+	for {
+		select {
+		case <-ticker.C:
+			binary.BigEndian.PutUint64(payload[:], uint64(time.Now().UnixNano()))
+			err := conn.WriteControl(websocket.PingMessage, payload[:], time.Now().Add(time.Second))
+			if err != nil {
+				// 没有读取方时也能发现连接断开
+				if this_.reconnect != nil {
+					this_.mtx.Lock()
+					this_.lost(conn, err)
+					this_.mtx.Unlock()
+				}
+				return
+			}
+
+		case <-this_.closeCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package nw
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws/wsflate"
+)
+
+const (
+	WS_COMPRESS_THRESHOLD = 256             // 默认的压缩阈值, 小于该长度的消息不压缩
+	WS_COMPRESS_LEVEL     = flate.BestSpeed // 压缩级别, 服务端优先考虑吞吐量
+)
+
+// wsDeflateTail 压缩数据去掉的同步标记, 解压时补回. 之后附加一个空的结束块, 使解压器正常结束
+var wsDeflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+var errWsMessageTooBig = errors.New("websocket message too big")
+
+var (
+	flateWriterPool = sync.Pool{
+		New: func() any {
+			fw, _ := flate.NewWriter(nil, WS_COMPRESS_LEVEL)
+			return fw
+		},
+	}
+
+	flateReaderPool = sync.Pool{
+		New: func() any {
+			return flate.NewReader(bytes.NewReader(nil))
+		},
+	}
+)
+
+// wsDeflateConfig permessage-deflate 配置
+type wsDeflateConfig struct {
+	enable         bool // 是否协商压缩
+	threshold      int  // 压缩阈值
+	serverTakeover bool // 服务端压缩是否保留上下文
+	clientTakeover bool // 是否允许客户端压缩保留上下文
+}
+
+func newWsDeflateConfig(c *Config) wsDeflateConfig {
+	conf := wsDeflateConfig{
+		enable:         c.WsCompress,
+		threshold:      c.WsCompressThreshold,
+		serverTakeover: c.WsServerContextTakeover,
+		clientTakeover: c.WsClientContextTakeover,
+	}
+
+	if conf.threshold <= 0 {
+		conf.threshold = WS_COMPRESS_THRESHOLD
+	}
+
+	return conf
+}
+
+// negotiate 协商 permessage-deflate 参数, 不接受时返回空的选项和 nil
+//
+// 客户端要求的 no_context_takeover 总是被接受; 标准库的压缩器固定使用 32K 窗口, 客户端限制服务端窗口时拒绝
+func (this_ *wsDeflateConfig) negotiate(opt httphead.Option) (httphead.Option, *wsDeflate) {
+	if !this_.enable || !bytes.Equal(opt.Name, wsflate.ExtensionNameBytes) {
+		return httphead.Option{}, nil
+	}
+
+	var offer wsflate.Parameters
+	if err := offer.Parse(opt); err != nil {
+		return httphead.Option{}, nil
+	}
+
+	if offer.ServerMaxWindowBits.Defined() && offer.ServerMaxWindowBits < 15 {
+		return httphead.Option{}, nil
+	}
+
+	params := wsflate.Parameters{
+		ServerNoContextTakeover: offer.ServerNoContextTakeover || !this_.serverTakeover,
+		ClientNoContextTakeover: offer.ClientNoContextTakeover || !this_.clientTakeover,
+	}
+
+	return params.Option(), &wsDeflate{
+		serverTakeover: !params.ServerNoContextTakeover,
+		clientTakeover: !params.ClientNoContextTakeover,
+	}
+}
+
+// wsDeflate 连接协商后的 permessage-deflate 状态
+type wsDeflate struct {
+	serverTakeover bool          // 压缩时保留上下文
+	clientTakeover bool          // 解压时保留上下文
+	mtx            sync.Mutex    // 保留上下文时保证压缩顺序与发送顺序一致
+	fw             *flate.Writer // 保留上下文时连接独占的压缩器
+	fbuf           bytes.Buffer  // 保留上下文时的压缩输出
+	window         []byte        // 保留上下文时最近解压的数据, 作为下一条消息的字典
+}
+
+// compress 压缩消息, 返回去掉同步标记的数据. 保留上下文时调用方需要持有 mtx 直到数据提交写入
+func (this_ *wsDeflate) compress(data []byte) []byte {
+	if this_.serverTakeover {
+		if this_.fw == nil {
+			this_.fw, _ = flate.NewWriter(&this_.fbuf, WS_COMPRESS_LEVEL)
+		}
+
+		this_.fbuf.Reset()
+		this_.fw.Write(data)
+		this_.fw.Flush()
+		return this_.fbuf.Bytes()[:this_.fbuf.Len()-4]
+	}
+
+	var buf bytes.Buffer
+	fw := flateWriterPool.Get().(*flate.Writer)
+	fw.Reset(&buf)
+	fw.Write(data)
+	fw.Flush()
+	flateWriterPool.Put(fw)
+	return buf.Bytes()[:buf.Len()-4]
+}
+
+// decompress 解压消息, 解压后超过 MESSAGE_MAX_SIZE 时返回 errWsMessageTooBig. 只在连接所属的事件循环中调用
+func (this_ *wsDeflate) decompress(data []byte) ([]byte, error) {
+	fr := flateReaderPool.Get().(io.ReadCloser)
+	defer flateReaderPool.Put(fr)
+
+	src := io.MultiReader(bytes.NewReader(data), bytes.NewReader(wsDeflateTail))
+	if err := fr.(flate.Resetter).Reset(src, this_.window); err != nil {
+		return nil, err
+	}
+
+	out, err := io.ReadAll(io.LimitReader(fr, int64(MESSAGE_MAX_SIZE)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out) > int(MESSAGE_MAX_SIZE) {
+		return nil, errWsMessageTooBig
+	}
+
+	if this_.clientTakeover {
+		this_.window = append(this_.window, out...)
+		if n := len(this_.window) - wsflate.MaxLZ77WindowSize; n > 0 {
+			this_.window = this_.window[:copy(this_.window, this_.window[n:])]
+		}
+	}
+
+	return out, nil
+}
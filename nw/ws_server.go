@@ -2,24 +2,54 @@ package nw
 
 import (
 	"bytes"
-	"errors"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"net/http"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"github.com/gobwas/httphead"
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 	"github.com/gox/frm/log"
 	"github.com/panjf2000/gnet/v2"
 )
 
+const (
+	WS_UPGRADE_MAX_SIZE = 16 * 1024 // websocket 升级请求的最大长度
+	WS_CONTROL_MAX_SIZE = 125       // websocket 控制帧负载的最大长度
+)
+
+// wsState websocket 连接的协议状态, 除 closing 外只在连接所属的事件循环中访问
+type wsState struct {
+	op         ws.OpCode   // 未完成的分片消息的类型, 为 0 表示没有
+	compressed bool        // 未完成的分片消息是否被压缩
+	buf        []byte      // 未完成的分片消息已收到的数据
+	closing    atomic.Bool // 是否已发送关闭帧
+	deflate    *wsDeflate  // 协商的压缩状态, 为 nil 表示未启用压缩, 升级完成后不再改变
+}
+
 type wsServer struct {
 	baseServer
+	deflate   wsDeflateConfig // 压缩配置
+	origins   []string        // 允许的 Origin
+	onUpgrade IUpgradeEvent   // 升级请求检查, 事件未实现时为 nil
 }
 
 func newWsServer(owner *Service, c *Config) *wsServer {
-	this_ := &wsServer{}
+	this_ := &wsServer{
+		deflate: newWsDeflateConfig(c),
+		origins: c.WsAllowOrigins,
+	}
+	this_.onUpgrade, _ = owner.event.(IUpgradeEvent)
 
 	this_.baseServer = *newBaseServer(owner, this_, c.WsHost)
+	if owner.certs != nil {
+		this_.tlsConf = owner.certs.TLSConfig()
+	}
+
 	return this_
 }
 
@@ -30,8 +60,20 @@ func (this_ *wsServer) Proto() Protocol {
 func (this_ *wsServer) OnTraffic(c gnet.Conn) gnet.Action {
 	cctx := c.Context().(*ConnContext)
 
+	if cctx.proxied {
+		if ok, action := this_.readProxy(cctx); !ok {
+			return action
+		}
+	}
+
+	if cctx.tls != nil {
+		if ok, action := this_.readTLS(cctx); !ok {
+			return action
+		}
+	}
+
 	// 升级websocket 协议
-	if !cctx.upgraded {
+	if !cctx.upgraded.Load() {
 		return this_.upgrade(cctx)
 	}
 
@@ -40,20 +82,104 @@ func (this_ *wsServer) OnTraffic(c gnet.Conn) gnet.Action {
 }
 
 func (this_ *wsServer) Write(cctx *ConnContext, data []byte) error {
+	return this_.writeMessage(cctx, ws.OpBinary, data)
+}
+
+// writeText 发送文本消息
+func (this_ *wsServer) writeText(cctx *ConnContext, data []byte) error {
+	return this_.writeMessage(cctx, ws.OpText, data)
+}
+
+// writeMessage 发送消息, 协商了压缩且长度达到阈值时压缩
+func (this_ *wsServer) writeMessage(cctx *ConnContext, op ws.OpCode, data []byte) error {
 	buf := this_.wbufPool.Get()
-	wsutil.WriteMessage(buf, ws.StateServerSide, ws.OpBinary, data)
+	callback := func(c gnet.Conn, err error) error {
+		if err != nil {
+			this_.writeFailed(err)
+		}
+		this_.wbufPool.Put(buf)
+		return nil
+	}
+
+	d := cctx.wsState.deflate
+	if d == nil || len(data) < this_.deflate.threshold {
+		wsutil.WriteMessage(buf, ws.StateServerSide, op, data)
+		return cctx.asyncWrite(buf.Bytes(), callback)
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	payload := d.compress(data)
+	ws.WriteHeader(buf, ws.Header{Fin: true, Rsv: ws.Rsv(true, false, false), OpCode: op, Length: int64(len(payload))})
+	buf.Write(payload)
+	return cctx.asyncWrite(buf.Bytes(), callback)
+}
 
-	return cctx.c.AsyncWrite(buf.Bytes(), func(c gnet.Conn, err error) error {
+// encode 编码 websocket 二进制帧
+func (this_ *wsServer) encode(data []byte) ([]byte, error) {
+	return ws.CompileFrame(ws.NewBinaryFrame(data))
+}
+
+// writeFrame 写入已编码的 websocket 帧
+func (this_ *wsServer) writeFrame(cctx *ConnContext, frame []byte) error {
+	return cctx.asyncWrite(frame, func(c gnet.Conn, err error) error {
 		if err != nil {
-			log.Error("AsyncWrite failed: %v", err)
+			this_.writeFailed(err)
 		}
+		return nil
+	})
+}
+
+// writeGoAway 发送 1001 (going away) 关闭帧, 未完成升级的连接不发送
+func (this_ *wsServer) writeGoAway(cctx *ConnContext, data []byte) error {
+	if !cctx.upgraded.Load() {
+		return nil
+	}
+
+	body := ws.NewCloseFrameBody(ws.StatusGoingAway, "")
+	buf := this_.wbufPool.Get()
+	ws.WriteFrame(buf, ws.NewCloseFrame(body))
+
+	return cctx.asyncWrite(buf.Bytes(), func(c gnet.Conn, err error) error {
 		this_.wbufPool.Put(buf)
 		return nil
 	})
 }
 
 func (this_ *wsServer) upgrade(cctx *ConnContext) gnet.Action {
+	// 等待完整的 http 请求, tls 握手完成后的唤醒也会进入这里
+	data, _ := cctx.inbound().Peek(-1)
+	if !bytes.Contains(data, []byte("\r\n\r\n")) {
+		if len(data) > WS_UPGRADE_MAX_SIZE {
+			log.Error("[%d:%v] upgrade request too large", cctx.Fd(), cctx.remoteAddr)
+			return gnet.Close
+		}
+		return gnet.None
+	}
+
+	var (
+		req    *UpgradeRequest // 只在实现了 IUpgradeEvent 时收集
+		origin string
+	)
+
 	u := ws.Upgrader{
+		OnRequest: func(uri []byte) error {
+			log.Debug("URI: %s", string(uri))
+			if this_.onUpgrade == nil {
+				return nil
+			}
+
+			var err error
+			req, err = newUpgradeRequest(uri)
+			return err
+		},
+		OnHost: func(host []byte) error {
+			if req != nil {
+				req.Host = string(host)
+			}
+			return nil
+		},
 		OnHeader: func(key, value []byte) error {
 			switch string(key) {
 			case "X-Forwarded-For":
@@ -61,44 +187,314 @@ func (this_ *wsServer) upgrade(cctx *ConnContext) gnet.Action {
 
 			case "X-Real-IP":
 				cctx.xRealIP = string(value)
+
+			case "Origin":
+				origin = string(value)
+			}
+
+			if req != nil {
+				req.Header.Add(string(key), string(value))
 			}
 			return nil
 		},
-		OnRequest: func(uri []byte) error {
-			log.Debug("URI: %s", string(uri))
-			return nil
+		// 只收集子协议列表, 由 OnUpgrade 选择
+		ProtocolCustom: func(value []byte) (string, bool) {
+			if req != nil {
+				req.addProtocols(value)
+			}
+			return "", true
+		},
+		Negotiate: func(opt httphead.Option) (httphead.Option, error) {
+			if cctx.wsState.deflate != nil {
+				return httphead.Option{}, nil
+			}
+
+			accept, d := this_.deflate.negotiate(opt)
+			cctx.wsState.deflate = d
+			return accept, nil
+		},
+		OnBeforeUpgrade: func() (ws.HandshakeHeader, error) {
+			if !originAllowed(this_.origins, origin) {
+				return nil, ws.RejectConnectionError(ws.RejectionStatus(http.StatusForbidden), ws.RejectionReason("origin not allowed"))
+			}
+
+			if req == nil {
+				return nil, nil
+			}
+
+			if err := this_.onUpgrade.OnUpgrade(cctx, req); err != nil {
+				return nil, rejection(err)
+			}
+
+			if len(req.Protocol) == 0 {
+				return nil, nil
+			}
+
+			if !req.selected() {
+				return nil, fmt.Errorf("subprotocol %q not requested by client", req.Protocol)
+			}
+
+			return ws.HandshakeHeaderHTTP(http.Header{"Sec-Websocket-Protocol": {req.Protocol}}), nil
 		},
 	}
 
-	_, err := u.Upgrade(cctx.c)
+	_, err := u.Upgrade(cctx.readWriter())
 	if err != nil {
-		log.Error("upgrade failed: %v", err)
+		this_.owner.metrics.OnUpgradeFailed(Protocol_Websocket, err)
+		if _, ok := err.(*ws.ConnectionRejectedError); ok {
+			log.Warn("[%d:%v] upgrade rejected: %v", cctx.Fd(), cctx.RemoteAddr(), err)
+		} else {
+			log.Error("[%d:%v] upgrade failed: %v", cctx.Fd(), cctx.RemoteAddr(), err)
+		}
+
+		// tls 连接的拒绝响应是异步写入的, 在其之后关闭连接客户端才能收到响应
+		if cctx.tls != nil {
+			cctx.c.Close()
+			return gnet.None
+		}
 		return gnet.Close
 	}
 
-	cctx.upgraded = true
+	// 来自可信代理的连接根据转发的客户端地址检查
+	if len(cctx.clientIP) == 0 && !this_.owner.limiter.admit(cctx) {
+		log.Warn("[%d:%v] connection rejected", cctx.Fd(), cctx.RemoteAddr())
+		return gnet.Close
+	}
+
+	cctx.upgraded.Store(true)
 	return gnet.None
 }
 
+// readData 读取缓冲区中所有完整的帧, 分片消息重组完成后投递
 func (this_ *wsServer) readData(cctx *ConnContext) gnet.Action {
-	// 读取数据
-	var err error
+	in := cctx.inbound()
 
-	n := cctx.c.InboundBuffered()
-	data, _ := cctx.c.Peek(n)
+	// 已发送关闭帧, 丢弃之后收到的数据
+	if cctx.wsState.closing.Load() {
+		in.Discard(in.InboundBuffered())
+		return gnet.None
+	}
 
-	data, err = wsutil.ReadClientBinary(bytes.NewBuffer(data))
-	if err != nil {
-		if err == io.ErrUnexpectedEOF || err == io.EOF || errors.Is(err, io.ErrShortBuffer) {
+	for {
+		n := in.InboundBuffered()
+		data, _ := in.Peek(n)
+
+		r := bytes.NewReader(data)
+		h, err := ws.ReadHeader(r)
+		if err != nil {
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				return gnet.None
+			}
+			log.Error("[%d:%v] read websocket header failed: %v", cctx.Fd(), cctx.RemoteAddr(), err)
+			return this_.closeWith(cctx, ws.StatusProtocolError, "")
+		}
+
+		if code := this_.checkHeader(cctx, h); code != 0 {
+			log.Error("[%d:%v] invalid websocket frame: %v, status %d", cctx.Fd(), cctx.RemoteAddr(), h.OpCode, code)
+			return this_.closeWith(cctx, code, "")
+		}
+
+		hlen := n - r.Len()
+		flen := hlen + int(h.Length)
+		if n < flen {
 			return gnet.None
 		}
-		return gnet.Close
+
+		payload := append([]byte(nil), data[hlen:flen]...)
+		ws.Cipher(payload, h.Mask, 0)
+
+		in.Discard(flen)
+		cctx.touch()
+		cctx.countRead(flen)
+
+		if h.OpCode.IsControl() {
+			if action := this_.control(cctx, h, payload); action != gnet.None || cctx.wsState.closing.Load() {
+				return action
+			}
+			continue
+		}
+
+		// 分片消息的第一帧记录消息类型, 后续为 continuation 帧
+		state := &cctx.wsState
+		if h.OpCode != ws.OpContinuation {
+			state.op = h.OpCode
+			state.compressed = h.Rsv1()
+		}
+
+		if !h.Fin {
+			state.buf = append(state.buf, payload...)
+			continue
+		}
+
+		if len(state.buf) > 0 {
+			payload = append(state.buf, payload...)
+			state.buf = nil
+		}
+
+		if state.compressed {
+			payload, err = state.deflate.decompress(payload)
+			if err != nil {
+				log.Error("[%d:%v] decompress websocket message failed: %v", cctx.Fd(), cctx.RemoteAddr(), err)
+				if err == errWsMessageTooBig {
+					return this_.closeWith(cctx, ws.StatusMessageTooBig, "")
+				}
+				return this_.closeWith(cctx, ws.StatusInvalidFramePayloadData, "")
+			}
+		}
+
+		kind := MessageType_Binary
+		if state.op == ws.OpText {
+			if !utf8.Valid(payload) {
+				log.Error("[%d:%v] invalid utf-8 text message", cctx.Fd(), cctx.RemoteAddr())
+				return this_.closeWith(cctx, ws.StatusInvalidFramePayloadData, "")
+			}
+			kind = MessageType_Text
+		}
+		state.op = 0
+
+		msg := this_.msgPool.NewWithData(cctx, payload)
+		msg.kind = kind
+		if !this_.owner.pushMessage(msg) {
+			return this_.closeWith(cctx, ws.StatusPolicyViolation, "")
+		}
+	}
+}
+
+// checkHeader 检查帧头, 返回需要关闭连接时使用的状态码, 合法时返回 0
+func (this_ *wsServer) checkHeader(cctx *ConnContext, h ws.Header) ws.StatusCode {
+	// 客户端的帧必须使用掩码, 只有协商了压缩时消息的第一帧可以设置 RSV1
+	if !h.Masked || h.Rsv2() || h.Rsv3() {
+		return ws.StatusProtocolError
+	}
+
+	if h.Rsv1() && (cctx.wsState.deflate == nil || h.OpCode.IsControl() || h.OpCode == ws.OpContinuation) {
+		return ws.StatusProtocolError
+	}
+
+	switch h.OpCode {
+	case ws.OpPing, ws.OpPong, ws.OpClose:
+		if !h.Fin || h.Length > WS_CONTROL_MAX_SIZE {
+			return ws.StatusProtocolError
+		}
+		return 0
+
+	case ws.OpContinuation:
+		if cctx.wsState.op == 0 {
+			return ws.StatusProtocolError
+		}
+
+	case ws.OpText, ws.OpBinary:
+		if cctx.wsState.op != 0 {
+			return ws.StatusProtocolError
+		}
+
+	default:
+		return ws.StatusProtocolError
+	}
+
+	if int64(len(cctx.wsState.buf))+h.Length > int64(MESSAGE_MAX_SIZE) {
+		return ws.StatusMessageTooBig
+	}
+
+	return 0
+}
+
+// control 处理控制帧
+func (this_ *wsServer) control(cctx *ConnContext, h ws.Header, payload []byte) gnet.Action {
+	switch h.OpCode {
+	case ws.OpPing:
+		cctx.rawWrite(ws.MustCompileFrame(ws.NewPongFrame(payload)), nil)
+
+	case ws.OpPong:
+		if len(payload) == 8 {
+			cctx.onPong(int64(binary.BigEndian.Uint64(payload)))
+		}
+
+	case ws.OpClose:
+		// 回应客户端发起的关闭握手, 原样带回状态码
+		if len(payload) == 0 {
+			return this_.closeWith(cctx, ws.StatusNormalClosure, "")
+		}
+
+		code, reason := ws.ParseCloseFrameData(payload)
+		if len(payload) < 2 || !validCloseCode(code) {
+			return this_.closeWith(cctx, ws.StatusProtocolError, "")
+		}
+
+		if !utf8.ValidString(reason) {
+			return this_.closeWith(cctx, ws.StatusInvalidFramePayloadData, "")
+		}
+
+		return this_.closeWith(cctx, code, "")
 	}
 
-	msg := this_.msgPool.NewWithData(cctx, data)
-	cctx.c.Discard(n)
-	cctx.lastUpdate = time.Now().Unix()
+	return gnet.None
+}
+
+// closeWith 发送关闭帧, 写出后关闭连接. 之后收到的数据都会被丢弃
+func (this_ *wsServer) closeWith(cctx *ConnContext, code ws.StatusCode, reason string) gnet.Action {
+	if !cctx.wsState.closing.CompareAndSwap(false, true) {
+		return gnet.None
+	}
+
+	frame := ws.MustCompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason)))
+	err := cctx.rawWrite(frame, func(c gnet.Conn, err error) error {
+		return c.Close()
+	})
+
+	if err != nil {
+		return gnet.Close
+	}
 
-	this_.owner.pushMessage(msg)
 	return gnet.None
 }
+
+// closeWithStatus 以指定的状态码关闭连接, 未完成升级的连接直接关闭
+//
+// 可以在任意协程中调用, 关闭帧在事件循环中发送, 调度前连接已关闭时不做任何处理
+func (this_ *wsServer) closeWithStatus(cctx *ConnContext, code uint16, reason string) {
+	id := cctx.ID()
+	if id == 0 {
+		return
+	}
+
+	// 关闭帧的负载不能超过控制帧上限
+	if len(reason) > WS_CONTROL_MAX_SIZE-2 {
+		reason = reason[:WS_CONTROL_MAX_SIZE-2]
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+
+	err := cctx.c.Wake(func(c gnet.Conn, err error) error {
+		if err != nil || cctx.ID() != id {
+			return nil
+		}
+
+		if !cctx.upgraded.Load() || this_.closeWith(cctx, ws.StatusCode(code), reason) == gnet.Close {
+			return c.Close()
+		}
+		return nil
+	})
+
+	if err != nil {
+		this_.Close(cctx)
+	}
+}
+
+// validCloseCode 关闭帧中的状态码是否合法, 1005, 1006, 1015 等只能在本地使用
+func validCloseCode(code ws.StatusCode) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	}
+
+	return code >= 3000 && code <= 4999
+}
+
+// ping 发送心跳请求, 负载为发送时间
+func (this_ *wsServer) ping(cctx *ConnContext) error {
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], uint64(time.Now().UnixNano()))
+	return cctx.rawWrite(ws.MustCompileFrame(ws.NewPingFrame(payload[:])), nil)
+}
@@ -0,0 +1,135 @@
+package nw
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gobwas/ws"
+)
+
+// IUpgradeEvent 需要检查 websocket 升级请求的服务事件, IServiceEvent 同时实现该接口时生效
+//
+// OnUpgrade 在升级响应发送之前调用, 可以设置用户数据和选择子协议, 返回错误时拒绝升级.
+// 返回 *UpgradeError 时使用其中的状态码, 其它错误使用 403. 在事件循环中调用, 不能阻塞
+type IUpgradeEvent interface {
+	OnUpgrade(*ConnContext, *UpgradeRequest) error
+}
+
+// UpgradeRequest websocket 升级请求
+type UpgradeRequest struct {
+	URI       string      // 请求行中的 URI, 包含路径和查询参数
+	Path      string      // 路径
+	Query     url.Values  // 查询参数
+	Host      string      // Host 头
+	Header    http.Header // 请求头, 不包含 websocket 协议相关的头
+	Protocols []string    // 客户端请求的子协议
+	Protocol  string      // 选择的子协议, 在 OnUpgrade 中设置, 必须是 Protocols 之一
+}
+
+// Origin 请求头中的 Origin
+func (this_ *UpgradeRequest) Origin() string {
+	return this_.Header.Get("Origin")
+}
+
+// Cookie 获取指定名称的 cookie
+func (this_ *UpgradeRequest) Cookie(name string) (*http.Cookie, error) {
+	req := http.Request{Header: this_.Header}
+	return req.Cookie(name)
+}
+
+// Cookies 获取所有 cookie
+func (this_ *UpgradeRequest) Cookies() []*http.Cookie {
+	req := http.Request{Header: this_.Header}
+	return req.Cookies()
+}
+
+// UpgradeError 拒绝 websocket 升级
+type UpgradeError struct {
+	Status int         // http 状态码
+	Reason string      // 响应内容
+	Header http.Header // 额外的响应头, 可以为 nil
+}
+
+func (this_ *UpgradeError) Error() string {
+	return fmt.Sprintf("upgrade rejected: %d %s", this_.Status, this_.Reason)
+}
+
+// rejection 转换为 ws 库的拒绝错误, 由其写入 http 响应
+func rejection(err error) error {
+	e, ok := err.(*UpgradeError)
+	if !ok {
+		return ws.RejectConnectionError(ws.RejectionStatus(http.StatusForbidden), ws.RejectionReason(err.Error()))
+	}
+
+	status := e.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+
+	opts := []ws.RejectOption{ws.RejectionStatus(status), ws.RejectionReason(e.Reason)}
+	if e.Header != nil {
+		opts = append(opts, ws.RejectionHeader(ws.HandshakeHeaderHTTP(e.Header)))
+	}
+
+	return ws.RejectConnectionError(opts...)
+}
+
+// newUpgradeRequest 根据请求行创建升级请求
+func newUpgradeRequest(uri []byte) (*UpgradeRequest, error) {
+	u, err := url.ParseRequestURI(string(uri))
+	if err != nil {
+		return nil, ws.RejectConnectionError(ws.RejectionStatus(http.StatusBadRequest), ws.RejectionReason("invalid request uri"))
+	}
+
+	return &UpgradeRequest{
+		URI:    string(uri),
+		Path:   u.Path,
+		Query:  u.Query(),
+		Header: make(http.Header),
+	}, nil
+}
+
+// addProtocols 解析 Sec-WebSocket-Protocol 头中的子协议列表
+func (this_ *UpgradeRequest) addProtocols(value []byte) {
+	for _, p := range bytes.Split(value, []byte(",")) {
+		if p = bytes.TrimSpace(p); len(p) > 0 {
+			this_.Protocols = append(this_.Protocols, string(p))
+		}
+	}
+}
+
+// selected 选择的子协议是否是客户端请求的
+func (this_ *UpgradeRequest) selected() bool {
+	for _, p := range this_.Protocols {
+		if p == this_.Protocol {
+			return true
+		}
+	}
+
+	return false
+}
+
+// originAllowed 检查 Origin 是否在允许列表中, 支持 https://*.example.com 形式的通配符. 列表为空或请求没有 Origin 时允许
+func originAllowed(allow []string, origin string) bool {
+	if len(allow) == 0 || len(origin) == 0 {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	for _, pattern := range allow {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+
+		if ok, _ := path.Match(pattern, origin); ok {
+			return true
+		}
+	}
+
+	return false
+}
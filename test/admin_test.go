@@ -0,0 +1,316 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gox/frm/nw"
+	"github.com/gox/frm/web"
+)
+
+// userDataEvent 连接建立时设置较长的用户数据
+type userDataEvent struct {
+	*echoEvent
+}
+
+func (this_ *userDataEvent) OnConnected(cctx *nw.ConnContext) error {
+	cctx.SetUserData(strings.Repeat("u", nw.ADMIN_USER_DATA_SIZE+44))
+	return this_.echoEvent.OnConnected(cctx)
+}
+
+// adminList 连接列表的响应
+type adminList struct {
+	Total int           `json:"total"`
+	Conns []nw.ConnInfo `json:"conns"`
+}
+
+// adminDo 发送管理接口请求, 返回状态码并将响应解析到 out
+func adminDo(t *testing.T, h http.Handler, method, url, token, body string, out any) int {
+	t.Helper()
+
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decode %q failed: %v", method, url, rec.Body.String(), err)
+		}
+	}
+
+	return rec.Code
+}
+
+func TestAdminAuth(t *testing.T) {
+	svc := nw.NewService(&nw.Config{TcpHost: "127.0.0.1:22201", Timeout: 60}, newEchoEvent())
+	h := svc.AdminHandler("secret")
+
+	var rsp map[string]string
+	if code := adminDo(t, h, http.MethodGet, "/info", "", "", &rsp); code != http.StatusUnauthorized || rsp["error"] != "unauthorized" {
+		t.Fatalf("no token: %d %v", code, rsp)
+	}
+
+	if code := adminDo(t, h, http.MethodGet, "/info", "wrong", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: %d", code)
+	}
+
+	if code := adminDo(t, h, http.MethodGet, "/info", "secret", "", nil); code != http.StatusOK {
+		t.Fatalf("bearer token: %d", code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/conns", nil)
+	req.Header.Set("X-Admin-Token", "secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("header token: %d", rec.Code)
+	}
+
+	// 令牌为空时拒绝所有请求
+	if code := adminDo(t, svc.AdminHandler(""), http.MethodGet, "/info", "", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("empty token: %d", code)
+	}
+}
+
+func TestAdminConns(t *testing.T) {
+	const (
+		TCP_HOST   = "127.0.0.1:22202"
+		WS_HOST    = "127.0.0.1:22203"
+		ADMIN_HOST = "127.0.0.1:22204"
+	)
+
+	event := &userDataEvent{newEchoEvent()}
+	svc := startService(t, &nw.Config{TcpHost: TCP_HOST, WsHost: WS_HOST, AdminHost: ADMIN_HOST, AdminToken: "secret", Timeout: 60}, event)
+
+	tcp, err := nw.NewAsyncTCPClient(TCP_HOST, WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer tcp.Close()
+
+	tcp.Write([]byte("hi"))
+	if msg, err := tcp.Read(); err != nil || string(msg) != "hi" {
+		t.Fatalf("tcp echo %q: %v", msg, err)
+	}
+	tcpID := receive(t, event.connected, "tcp connect").ID()
+
+	ws, err := nw.NewWsClient(WS_HOST, WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial ws failed: %v", err)
+	}
+	defer ws.Close()
+	wsID := receive(t, event.connected, "ws connect").ID()
+
+	// 通过管理监听地址访问, 需要令牌
+	base := "http://" + ADMIN_HOST + "/admin"
+	resp, err := http.Get(base + "/conns")
+	if err != nil {
+		t.Fatalf("get conns failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("admin listener without token: %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, base+"/conns", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("get conns failed: %v", err)
+	}
+	var list adminList
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := json.Unmarshal(body, &list); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("conns %d %q: %v", resp.StatusCode, body, err)
+	}
+
+	// 按连接ID排序
+	if list.Total != 2 || len(list.Conns) != 2 || list.Conns[0].ID != tcpID || list.Conns[1].ID != wsID {
+		t.Fatalf("conns %+v, want ids %d %d", list, tcpID, wsID)
+	}
+
+	info := list.Conns[0]
+	if info.Protocol != "tcp" || info.BytesIn == 0 || info.BytesOut == 0 || info.ConnectTime == 0 || info.LastUpdate < info.ConnectTime || info.TLS {
+		t.Fatalf("tcp conn info %+v", info)
+	}
+	if want := strings.Repeat("u", nw.ADMIN_USER_DATA_SIZE) + "..."; info.UserData != want {
+		t.Fatalf("user data %d bytes, want truncated to %d", len(info.UserData), len(want))
+	}
+	if list.Conns[1].Protocol != "websocket" {
+		t.Fatalf("ws conn info %+v", list.Conns[1])
+	}
+
+	// 挂载到 web.Server 的路由上
+	server, err := web.NewServer("127.0.0.1:0", true, false)
+	if err != nil {
+		t.Fatalf("new web server failed: %v", err)
+	}
+	server.Mount("/nw", svc.AdminHandler("tk"))
+	h := server.Router()
+
+	list = adminList{}
+	if code := adminDo(t, h, http.MethodGet, "/nw/conns?protocol=websocket", "tk", "", &list); code != http.StatusOK || list.Total != 1 || list.Conns[0].ID != wsID {
+		t.Fatalf("filter by protocol: %d %+v", code, list)
+	}
+
+	list = adminList{}
+	if code := adminDo(t, h, http.MethodGet, "/nw/conns?offset=1&limit=5", "tk", "", &list); code != http.StatusOK || list.Total != 2 || len(list.Conns) != 1 || list.Conns[0].ID != wsID {
+		t.Fatalf("offset: %d %+v", code, list)
+	}
+
+	list = adminList{}
+	if code := adminDo(t, h, http.MethodGet, "/nw/conns?limit=1", "tk", "", &list); code != http.StatusOK || list.Total != 2 || len(list.Conns) != 1 || list.Conns[0].ID != tcpID {
+		t.Fatalf("limit: %d %+v", code, list)
+	}
+
+	var conn nw.ConnInfo
+	if code := adminDo(t, h, http.MethodGet, fmt.Sprint("/nw/conns/", tcpID), "tk", "", &conn); code != http.StatusOK || conn.ID != tcpID || conn.Protocol != "tcp" {
+		t.Fatalf("get conn: %d %+v", code, conn)
+	}
+
+	var rsp map[string]any
+	if code := adminDo(t, h, http.MethodGet, "/nw/conns/999999", "tk", "", &rsp); code != http.StatusNotFound || rsp["error"] == nil {
+		t.Fatalf("unknown conn: %d %v", code, rsp)
+	}
+	if code := adminDo(t, h, http.MethodGet, "/nw/conns/abc", "tk", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("invalid id: %d", code)
+	}
+
+	var status struct {
+		Service map[string]any `json:"service"`
+		Queue   map[string]any `json:"queue"`
+		Limit   map[string]any `json:"limit"`
+	}
+	if code := adminDo(t, h, http.MethodGet, "/nw/info", "tk", "", &status); code != http.StatusOK || status.Service["curr_conn"] != float64(2) || status.Queue == nil || status.Limit == nil {
+		t.Fatalf("info: %d %+v", code, status)
+	}
+
+	// 发送测试消息
+	rsp = nil
+	if code := adminDo(t, h, http.MethodPost, fmt.Sprint("/nw/conns/", tcpID, "/send"), "tk", "pushed", &rsp); code != http.StatusOK || rsp["bytes"] != float64(6) {
+		t.Fatalf("send: %d %v", code, rsp)
+	}
+	if msg, err := tcp.Read(); err != nil || string(msg) != "pushed" {
+		t.Fatalf("pushed message %q: %v", msg, err)
+	}
+
+	// websocket 按指定的状态码关闭
+	if code := adminDo(t, h, http.MethodPost, fmt.Sprint("/nw/conns/", wsID, "/kick?code=abc"), "tk", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("kick with invalid code: %d", code)
+	}
+	if code := adminDo(t, h, http.MethodPost, fmt.Sprint("/nw/conns/", wsID, "/kick?code=4000&reason=bye"), "tk", "", nil); code != http.StatusOK {
+		t.Fatalf("kick ws: %d", code)
+	}
+	if _, err := ws.Read(); err == nil || !strings.Contains(err.Error(), "4000") {
+		t.Fatalf("ws read after kick: %v", err)
+	}
+	if got := receive(t, event.disconnected, "ws kick"); got != wsID {
+		t.Fatalf("disconnected %d, want %d", got, wsID)
+	}
+
+	if code := adminDo(t, h, http.MethodPost, fmt.Sprint("/nw/conns/", tcpID, "/kick"), "tk", "", nil); code != http.StatusOK {
+		t.Fatalf("kick tcp: %d", code)
+	}
+	if got := receive(t, event.disconnected, "tcp kick"); got != tcpID {
+		t.Fatalf("disconnected %d, want %d", got, tcpID)
+	}
+
+	// 关闭后的连接不再可见
+	if code := adminDo(t, h, http.MethodPost, fmt.Sprint("/nw/conns/", tcpID, "/send"), "tk", "x", nil); code != http.StatusNotFound {
+		t.Fatalf("send to kicked conn: %d", code)
+	}
+}
+
+func TestAdminWithoutToken(t *testing.T) {
+	const ADMIN_HOST = "127.0.0.1:22206"
+	startService(t, &nw.Config{TcpHost: "127.0.0.1:22205", AdminHost: ADMIN_HOST, Timeout: 60}, newEchoEvent())
+
+	// 没有令牌时管理监听地址只提供指标
+	for path, want := range map[string]int{"/metrics": http.StatusOK, "/admin/conns": http.StatusNotFound} {
+		resp, err := http.Get("http://" + ADMIN_HOST + path)
+		if err != nil {
+			t.Fatalf("get %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != want {
+			t.Fatalf("%s: status %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestServiceConnByID(t *testing.T) {
+	const TCP_HOST = "127.0.0.1:22263"
+
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{TcpHost: TCP_HOST, Timeout: 60}, event)
+
+	old, err := nw.NewAsyncTCPClient(TCP_HOST, WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer old.Close()
+	id := receive(t, event.connected, "connect").ID()
+
+	if info, err := svc.ConnInfo(id); err != nil || info.ID != id || info.Protocol != "tcp" {
+		t.Fatalf("conn info %+v: %v", info, err)
+	}
+
+	// tcp 的文本消息与二进制消息相同
+	if err := svc.WriteText(id, []byte("text")); err != nil {
+		t.Fatalf("write text failed: %v", err)
+	}
+	if msg, err := old.Read(); err != nil || string(msg) != "text" {
+		t.Fatalf("read %q: %v", msg, err)
+	}
+
+	if err := svc.Close(id); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if got := receive(t, event.disconnected, "close"); got != id {
+		t.Fatalf("disconnected %d, want %d", got, id)
+	}
+
+	// 新连接可能复用旧连接的上下文, 按旧ID的操作都不会影响新连接
+	client, err := nw.NewAsyncTCPClient(TCP_HOST, WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer client.Close()
+	newID := receive(t, event.connected, "reconnect").ID()
+
+	var stale *nw.StaleConnError
+	if _, err := svc.ConnInfo(id); !errors.As(err, &stale) || stale.ID != id {
+		t.Fatalf("conn info of closed conn: %v", err)
+	}
+	for name, err := range map[string]error{
+		"write":             svc.Write(id, []byte("stale")),
+		"write text":        svc.WriteText(id, []byte("stale")),
+		"close":             svc.Close(id),
+		"close with status": svc.CloseWithStatus(id, 4000, "stale"),
+	} {
+		if !errors.As(err, &stale) {
+			t.Fatalf("%s closed conn: %v", name, err)
+		}
+	}
+
+	if err := svc.Write(newID, []byte("fresh")); err != nil {
+		t.Fatalf("write new conn failed: %v", err)
+	}
+	if msg, err := client.Read(); err != nil || string(msg) != "fresh" {
+		t.Fatalf("new conn read %q: %v", msg, err)
+	}
+	if svc.CurrConn() != 1 {
+		t.Fatalf("%d conns, want 1", svc.CurrConn())
+	}
+}
@@ -0,0 +1,223 @@
+package test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+// holdEvent 消息处理阻塞到 release 关闭, 记录处理的消息数
+type holdEvent struct {
+	*echoEvent
+	release chan struct{}
+	handled atomic.Int64
+}
+
+func (this_ *holdEvent) OnData(cctx *nw.ConnContext, data []byte) error {
+	<-this_.release
+	this_.handled.Add(1)
+	return nil
+}
+
+// pushEvent 收到消息后连续写出大量数据, 返回第一个写入错误
+type pushEvent struct {
+	*echoEvent
+	result chan error
+}
+
+// PUSH_COUNT, PUSH_SIZE 写出的次数和每次的大小
+const PUSH_COUNT, PUSH_SIZE = 100, 256 * 1024
+
+func (this_ *pushEvent) OnData(cctx *nw.ConnContext, data []byte) error {
+	big := make([]byte, PUSH_SIZE)
+	for i := 0; i < PUSH_COUNT; i++ {
+		if err := cctx.Write(big); err != nil {
+			this_.result <- err
+			return nil
+		}
+	}
+
+	this_.result <- nil
+	return nil
+}
+
+// floodTcp 发送 n 条单字节消息
+func floodTcp(t *testing.T, host string, n int) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	for i := 0; i < n; i++ {
+		conn.Write([]byte{0, 0, 0, 1, 'x'})
+	}
+
+	return conn
+}
+
+func TestInboundDropNewest(t *testing.T) {
+	event := &holdEvent{echoEvent: newEchoEvent(), release: make(chan struct{})}
+	svc := startService(t, &nw.Config{TcpHost: "127.0.0.1:22071", Timeout: 60, ConnQueueSize: 2, QueuePolicy: nw.OverflowPolicy_DropNewest}, event)
+
+	// 第一条消息阻塞处理, 第二条排队, 其余超过上限被丢弃
+	floodTcp(t, "127.0.0.1:22071", 10)
+	waitFor(t, "inbound drop", func() bool { return svc.QueueStats().InboundDropped == 8 })
+	if stats := svc.QueueStats(); stats.Queued != 2 || stats.InboundDisconnected != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+
+	close(event.release)
+	waitFor(t, "queue drain", func() bool { return svc.QueueStats().Queued == 0 })
+	if n := event.handled.Load(); n != 2 || svc.CurrConn() != 1 {
+		t.Fatalf("handled %d conns %d", n, svc.CurrConn())
+	}
+}
+
+func TestInboundDisconnect(t *testing.T) {
+	event := &holdEvent{echoEvent: newEchoEvent(), release: make(chan struct{})}
+	defer close(event.release)
+	svc := startService(t, &nw.Config{TcpHost: "127.0.0.1:22072", Timeout: 60, ConnQueueSize: 2, QueuePolicy: nw.OverflowPolicy_Disconnect}, event)
+
+	conn := floodTcp(t, "127.0.0.1:22072", 10)
+	receive(t, event.disconnected, "overflow disconnect")
+	if stats := svc.QueueStats(); stats.InboundDisconnected != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(WAIT_TIMEOUT))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("connection alive after overflow")
+	}
+}
+
+func TestOutboundDropNewest(t *testing.T) {
+	event := &pushEvent{echoEvent: newEchoEvent(), result: make(chan error, 1)}
+	svc := startService(t, &nw.Config{TcpHost: "127.0.0.1:22073", Timeout: 60, MaxPending: 1024 * 1024, PendingPolicy: nw.OverflowPolicy_DropNewest}, event)
+
+	// 客户端不读取, 待发送数据超过上限后写入失败, 连接保持
+	floodTcp(t, "127.0.0.1:22073", 1)
+	if err := receive(t, event.result, "push result"); !errors.Is(err, nw.ErrOutboundOverflow) {
+		t.Fatalf("push: %v", err)
+	}
+
+	if stats := svc.QueueStats(); stats.OutboundDropped != 1 || stats.OutboundDisconnected != 0 || svc.CurrConn() != 1 {
+		t.Fatalf("stats %+v conns %d", stats, svc.CurrConn())
+	}
+}
+
+func TestOutboundDisconnect(t *testing.T) {
+	event := &pushEvent{echoEvent: newEchoEvent(), result: make(chan error, 1)}
+	svc := startService(t, &nw.Config{TcpHost: "127.0.0.1:22074", Timeout: 60, MaxPending: 1024 * 1024, PendingPolicy: nw.OverflowPolicy_Disconnect}, event)
+
+	floodTcp(t, "127.0.0.1:22074", 1)
+	if err := receive(t, event.result, "push result"); !errors.Is(err, nw.ErrOutboundOverflow) {
+		t.Fatalf("push: %v", err)
+	}
+
+	receive(t, event.disconnected, "overflow disconnect")
+	if stats := svc.QueueStats(); stats.OutboundDisconnected != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestOutboundBlock(t *testing.T) {
+	event := &pushEvent{echoEvent: newEchoEvent(), result: make(chan error, 1)}
+	svc := startService(t, &nw.Config{TcpHost: "127.0.0.1:22075", Timeout: 60, MaxPending: 1024 * 1024, PendingPolicy: nw.OverflowPolicy_Block}, event)
+
+	// 客户端延迟读取, 写入方阻塞等待而不丢弃数据
+	conn := floodTcp(t, "127.0.0.1:22075", 1)
+	time.Sleep(300 * time.Millisecond)
+
+	conn.SetReadDeadline(time.Now().Add(WAIT_TIMEOUT))
+	n, err := io.CopyN(io.Discard, conn, PUSH_COUNT*(PUSH_SIZE+4))
+	if err != nil {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+
+	if err := receive(t, event.result, "push result"); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	if stats := svc.QueueStats(); stats.OutboundBlocked == 0 || stats.OutboundDisconnected != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestOutboundBlockInline(t *testing.T) {
+	event := &pushEvent{echoEvent: newEchoEvent(), result: make(chan error, 1)}
+	svc := startService(t, &nw.Config{TcpHost: "127.0.0.1:22251", Timeout: 60, MaxPending: 1024 * 1024, PendingPolicy: nw.OverflowPolicy_Block, Dispatch: nw.DispatchMode_Inline}, event)
+
+	// 事件循环中的写入不等待, 超过上限时立即失败, 连接保持
+	start := time.Now()
+	floodTcp(t, "127.0.0.1:22251", 1)
+	if err := receive(t, event.result, "push result"); !errors.Is(err, nw.ErrOutboundOverflow) {
+		t.Fatalf("push: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed >= nw.OUTBOUND_BLOCK_TIMEOUT/2 {
+		t.Fatalf("inline write blocked for %v", elapsed)
+	}
+	if stats := svc.QueueStats(); stats.OutboundBlocked != 0 || stats.OutboundDropped != 1 || stats.OutboundDisconnected != 0 || svc.CurrConn() != 1 {
+		t.Fatalf("stats %+v conns %d", stats, svc.CurrConn())
+	}
+}
+
+func TestBroadcastSkipSlow(t *testing.T) {
+	const (
+		TCP_HOST = "127.0.0.1:22252"
+		COUNT    = 40
+	)
+
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{TcpHost: TCP_HOST, Timeout: 60, MaxPending: 1024 * 1024, PendingPolicy: nw.OverflowPolicy_Block}, event)
+
+	// slow 不读取, fast 持续读取
+	slow, err := net.Dial("tcp", TCP_HOST)
+	if err != nil {
+		t.Fatalf("dial slow failed: %v", err)
+	}
+	defer slow.Close()
+
+	fast, err := net.Dial("tcp", TCP_HOST)
+	if err != nil {
+		t.Fatalf("dial fast failed: %v", err)
+	}
+	defer fast.Close()
+
+	receive(t, event.connected, "slow connect")
+	receive(t, event.connected, "fast connect")
+
+	read := make(chan error, 1)
+	go func() {
+		fast.SetReadDeadline(time.Now().Add(2 * WAIT_TIMEOUT))
+		_, err := io.CopyN(io.Discard, fast, COUNT*(PUSH_SIZE+4))
+		read <- err
+	}()
+
+	// 慢连接超过上限后被跳过, 广播不等待. 按 fast 能跟上的速度广播
+	big := make([]byte, PUSH_SIZE)
+	skipped := 0
+	for i := 0; i < COUNT; i++ {
+		start := time.Now()
+		skipped += 2 - svc.Broadcast(big)
+		if elapsed := time.Since(start); elapsed >= nw.OUTBOUND_BLOCK_TIMEOUT/2 {
+			t.Fatalf("broadcast blocked for %v", elapsed)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	if err := receive(t, read, "fast read"); err != nil {
+		t.Fatalf("fast read: %v", err)
+	}
+	if stats := svc.QueueStats(); skipped == 0 || stats.OutboundDropped != uint64(skipped) || stats.OutboundBlocked != 0 || svc.CurrConn() != 2 {
+		t.Fatalf("skipped %d stats %+v conns %d", skipped, stats, svc.CurrConn())
+	}
+}
@@ -0,0 +1,155 @@
+package test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+// groupEvent 收到的消息作为分组名加入分组, 回复 ok
+type groupEvent struct {
+	*echoEvent
+	svc *nw.Service
+}
+
+// OnInit 在引擎启动前调用, 之后的事件中可以使用 svc
+func (this_ *groupEvent) OnInit(svc *nw.Service) error {
+	this_.svc = svc
+	return nil
+}
+
+func (this_ *groupEvent) OnData(cctx *nw.ConnContext, data []byte) error {
+	this_.svc.Join(string(data), cctx)
+	return cctx.Write([]byte("ok"))
+}
+
+// readUdp 读取一个数据报
+func readUdp(t *testing.T, conn net.Conn) string {
+	t.Helper()
+
+	buf := make([]byte, nw.UDP_MESSAGE_MAX_SIZE)
+	conn.SetReadDeadline(time.Now().Add(WAIT_TIMEOUT))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("udp read failed: %v", err)
+	}
+
+	return string(buf[:n])
+}
+
+func TestBroadcastGroup(t *testing.T) {
+	event := &groupEvent{echoEvent: newEchoEvent()}
+	svc := startService(t, &nw.Config{
+		TcpHost: "127.0.0.1:22041",
+		WsHost:  "127.0.0.1:22042",
+		UdpHost: "127.0.0.1:22043",
+		Timeout: 60,
+	}, event)
+
+	tcp, err := nw.NewAsyncTCPClient("127.0.0.1:22041", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer tcp.Close()
+
+	ws, err := nw.NewWsClient("127.0.0.1:22042", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("new ws client failed: %v", err)
+	}
+	defer ws.Close()
+
+	udp, err := net.Dial("udp", "127.0.0.1:22043")
+	if err != nil {
+		t.Fatalf("dial udp failed: %v", err)
+	}
+	defer udp.Close()
+
+	// readAll 三个客户端各读取一条消息
+	readAll := func(want string) {
+		t.Helper()
+		if rsp, err := tcp.Read(); err != nil || string(rsp) != want {
+			t.Fatalf("tcp read %q: %v, want %q", rsp, err, want)
+		}
+		if rsp, err := ws.Read(); err != nil || string(rsp) != want {
+			t.Fatalf("ws read %q: %v, want %q", rsp, err, want)
+		}
+		if rsp := readUdp(t, udp); rsp != want {
+			t.Fatalf("udp read %q, want %q", rsp, want)
+		}
+	}
+
+	cctxs := map[nw.Protocol]*nw.ConnContext{}
+	tcp.Write([]byte("room1"))
+	ws.Write([]byte("room1"))
+	udp.Write([]byte("room2"))
+	readAll("ok")
+	for i := 0; i < 3; i++ {
+		cctx := receive(t, event.connected, "connect")
+		cctxs[cctx.Protocol()] = cctx
+	}
+
+	if n := svc.Broadcast([]byte("all")); n != 3 {
+		t.Fatalf("broadcast to %d conns, want 3", n)
+	}
+	readAll("all")
+
+	if n := len(svc.Members("room1")); n != 2 {
+		t.Fatalf("room1 has %d members, want 2", n)
+	}
+
+	// 分组消息只发送给分组成员, udp 客户端先收到的是 room2 的消息
+	if n := svc.SendGroup("room1", []byte("r1")); n != 2 {
+		t.Fatalf("send room1 to %d conns, want 2", n)
+	}
+	if n := svc.SendGroup("room2", []byte("r2")); n != 1 {
+		t.Fatalf("send room2 to %d conns, want 1", n)
+	}
+	if rsp, err := tcp.Read(); err != nil || string(rsp) != "r1" {
+		t.Fatalf("tcp read %q: %v", rsp, err)
+	}
+	if rsp, err := ws.Read(); err != nil || string(rsp) != "r1" {
+		t.Fatalf("ws read %q: %v", rsp, err)
+	}
+	if rsp := readUdp(t, udp); rsp != "r2" {
+		t.Fatalf("udp read %q, want r2", rsp)
+	}
+
+	// 不存在的连接被忽略
+	if n := svc.SendTo([]uint64{cctxs[nw.Protocol_TCP].ID(), 1 << 40}, []byte("to")); n != 1 {
+		t.Fatalf("send to %d conns, want 1", n)
+	}
+	if rsp, err := tcp.Read(); err != nil || string(rsp) != "to" {
+		t.Fatalf("tcp read %q: %v", rsp, err)
+	}
+
+	svc.Leave("room1", cctxs[nw.Protocol_Websocket])
+	if members := svc.Members("room1"); len(members) != 1 || members[0] != cctxs[nw.Protocol_TCP] {
+		t.Fatalf("room1 members after leave: %d", len(members))
+	}
+
+	// 连接关闭后自动退出分组
+	id := cctxs[nw.Protocol_TCP].ID()
+	tcp.Close()
+	if got := receive(t, event.disconnected, "tcp disconnect"); got != id {
+		t.Fatalf("disconnected %d, want %d", got, id)
+	}
+	if n := len(svc.Members("room1")); n != 0 {
+		t.Fatalf("room1 has %d members after close", n)
+	}
+	if n := len(svc.Members("room2")); n != 1 {
+		t.Fatalf("room2 has %d members, want 1", n)
+	}
+
+	// 关闭后的连接上下文不能再加入分组, 也不会收到按旧ID发送的消息
+	if svc.Join("room1", cctxs[nw.Protocol_TCP]) {
+		t.Fatalf("closed conn joined room1")
+	}
+	if n := len(svc.Members("room1")); n != 0 {
+		t.Fatalf("room1 has %d members after stale join", n)
+	}
+	if n := svc.SendTo([]uint64{id}, []byte("stale")); n != 0 {
+		t.Fatalf("send to closed conn %d, want 0", n)
+	}
+}
@@ -0,0 +1,306 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+	"github.com/gox/frm/nw/cluster"
+)
+
+// newClusterEvents 记录集群事件, 格式为 "kind id"
+func newClusterEvents(c *cluster.Cluster) chan string {
+	ch := make(chan string, 64)
+	c.OnEvent(func(e cluster.Event) {
+		ch <- e.Kind.String() + " " + e.Node.ID
+	})
+
+	return ch
+}
+
+// expectEvents 依次等待指定的事件
+func expectEvents(t *testing.T, ch chan string, wants ...string) {
+	t.Helper()
+
+	for _, want := range wants {
+		if got := receive(t, ch, want); got != want {
+			t.Fatalf("event %q, want %q", got, want)
+		}
+	}
+}
+
+// startCluster 创建并启动集群, 测试结束时关闭
+func startCluster(t *testing.T, store cluster.Store, c *cluster.Config, nodes ...cluster.Node) (*cluster.Cluster, chan string) {
+	t.Helper()
+
+	cl := cluster.New(store, c)
+	events := newClusterEvents(cl)
+	for _, n := range nodes {
+		if err := cl.Register(nil, n); err != nil {
+			t.Fatalf("register %s failed: %v", n.ID, err)
+		}
+	}
+
+	if err := cl.Start(); err != nil {
+		t.Fatalf("start cluster failed: %v", err)
+	}
+	t.Cleanup(func() { cl.Close() })
+
+	return cl, events
+}
+
+func TestHashRing(t *testing.T) {
+	if got := cluster.NewHashRing(nil, cluster.CLUSTER_REPLICAS).Get("k"); got != "" {
+		t.Fatalf("empty ring returned %q", got)
+	}
+
+	// 结果与节点顺序无关
+	a := cluster.NewHashRing([]string{"n1", "n2", "n3"}, cluster.CLUSTER_REPLICAS)
+	b := cluster.NewHashRing([]string{"n3", "n1", "n2"}, cluster.CLUSTER_REPLICAS)
+
+	const KEYS = 3000
+	count := map[string]int{}
+	for i := 0; i < KEYS; i++ {
+		key := fmt.Sprint("user-", i)
+		if a.Get(key) != b.Get(key) {
+			t.Fatalf("%s: %s and %s for different node orders", key, a.Get(key), b.Get(key))
+		}
+		count[a.Get(key)]++
+	}
+
+	// 虚拟节点使分布大致均匀
+	for _, id := range []string{"n1", "n2", "n3"} {
+		if count[id] < KEYS/6 {
+			t.Fatalf("distribution %v", count)
+		}
+	}
+
+	// 增加节点时只有归属新节点的键改变, 移除节点时只有该节点的键改变
+	c := cluster.NewHashRing([]string{"n1", "n2", "n3", "n4"}, cluster.CLUSTER_REPLICAS)
+	d := cluster.NewHashRing([]string{"n1", "n3"}, cluster.CLUSTER_REPLICAS)
+	moved := 0
+	for i := 0; i < KEYS; i++ {
+		key := fmt.Sprint("user-", i)
+		if old, now := a.Get(key), c.Get(key); old != now {
+			if now != "n4" {
+				t.Fatalf("%s moved from %s to %s after adding n4", key, old, now)
+			}
+			moved++
+		}
+
+		if old, now := a.Get(key), d.Get(key); old != "n2" && old != now {
+			t.Fatalf("%s moved from %s to %s after removing n2", key, old, now)
+		}
+	}
+
+	if moved == 0 || moved > KEYS/2 {
+		t.Fatalf("%d of %d keys moved to the new node", moved, KEYS)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := cluster.NewMemoryStore()
+	ctx := context.Background()
+
+	store.Set(ctx, "p:a", "1", 0)
+	store.Set(ctx, "p:b", "2", 200*time.Millisecond)
+	store.Set(ctx, "q:c", "3", 0)
+
+	kvs, err := store.Scan(ctx, "p:")
+	if err != nil || len(kvs) != 2 || kvs["p:a"] != "1" || kvs["p:b"] != "2" {
+		t.Fatalf("scan %v: %v", kvs, err)
+	}
+
+	// 过期的键不再出现
+	time.Sleep(300 * time.Millisecond)
+	if kvs, _ = store.Scan(ctx, "p:"); len(kvs) != 1 || kvs["p:a"] != "1" {
+		t.Fatalf("scan after ttl %v", kvs)
+	}
+
+	store.Del(ctx, "p:a")
+	if kvs, _ = store.Scan(ctx, "p:"); len(kvs) != 0 {
+		t.Fatalf("scan after del %v", kvs)
+	}
+
+	// 发布给所有订阅者, 取消订阅后关闭通道
+	subCtx, cancel := context.WithCancel(ctx)
+	ch1, _ := store.Subscribe(subCtx, "events")
+	ch2, _ := store.Subscribe(ctx, "events")
+	other, _ := store.Subscribe(ctx, "other")
+
+	store.Publish(ctx, "events", "hello")
+	if msg := receive(t, ch1, "subscriber 1"); msg != "hello" {
+		t.Fatalf("subscriber 1 received %q", msg)
+	}
+	if msg := receive(t, ch2, "subscriber 2"); msg != "hello" {
+		t.Fatalf("subscriber 2 received %q", msg)
+	}
+	if len(other) != 0 {
+		t.Fatalf("other channel received %d messages", len(other))
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ch1:
+		if ok {
+			t.Fatalf("message after unsubscribe")
+		}
+	case <-time.After(WAIT_TIMEOUT):
+		t.Fatalf("channel not closed after unsubscribe")
+	}
+}
+
+func TestClusterJoinLeave(t *testing.T) {
+	store := cluster.NewMemoryStore()
+	conf := &cluster.Config{Prefix: "test", TTL: 3}
+
+	c1, events1 := startCluster(t, store, conf, cluster.Node{ID: "game-1", Type: "game", TcpHost: "10.0.0.1:9000", Load: 5})
+	c2, events2 := startCluster(t, store, conf, cluster.Node{ID: "game-2", Type: "game", TcpHost: "10.0.0.2:9000", Load: 3})
+
+	// 启动时已存在的节点以加入事件通知, 之后加入的节点通过频道通知
+	expectEvents(t, events1, "join game-1", "join game-2")
+	expectEvents(t, events2, "join game-2", "join game-1")
+
+	for _, c := range []*cluster.Cluster{c1, c2} {
+		nodes := c.Nodes("game")
+		if len(nodes) != 2 || nodes[0].ID != "game-1" || nodes[1].ID != "game-2" || nodes[1].TcpHost != "10.0.0.2:9000" || nodes[0].UpdateAt == 0 {
+			t.Fatalf("nodes %+v", nodes)
+		}
+
+		if n, ok := c.PickLeast("game"); !ok || n.ID != "game-2" {
+			t.Fatalf("pick least %+v %v", n, ok)
+		}
+	}
+
+	// 同一 key 在所有进程中选中环上的同一节点
+	ring := cluster.NewHashRing([]string{"game-1", "game-2"}, cluster.CLUSTER_REPLICAS)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("user-", i)
+		n1, ok1 := c1.Pick("game", key)
+		n2, ok2 := c2.Pick("game", key)
+		if !ok1 || !ok2 || n1.ID != n2.ID || n1.ID != ring.Get(key) {
+			t.Fatalf("%s: picked %s and %s, want %s", key, n1.ID, n2.ID, ring.Get(key))
+		}
+	}
+
+	if _, ok := c1.Pick("chat", "user-1"); ok {
+		t.Fatalf("picked node of unknown type")
+	}
+	if _, ok := c1.PickLeast("chat"); ok {
+		t.Fatalf("picked least node of unknown type")
+	}
+
+	// 注册和注销的错误
+	if err := c1.Register(nil, cluster.Node{ID: "x"}); !errors.Is(err, cluster.ErrInvalidNode) {
+		t.Fatalf("register without type: %v", err)
+	}
+	if err := c1.Register(nil, cluster.Node{ID: "game-1", Type: "game"}); !errors.Is(err, cluster.ErrNodeExists) {
+		t.Fatalf("register duplicate: %v", err)
+	}
+	if err := c1.Deregister("game-2"); !errors.Is(err, cluster.ErrUnknownNode) {
+		t.Fatalf("deregister remote node: %v", err)
+	}
+	if err := c1.Start(); !errors.Is(err, cluster.ErrStarted) {
+		t.Fatalf("start twice: %v", err)
+	}
+
+	// 注销的节点在所有进程中离开, 键被删除
+	if err := c2.Deregister("game-2"); err != nil {
+		t.Fatalf("deregister failed: %v", err)
+	}
+	expectEvents(t, events1, "leave game-2")
+	expectEvents(t, events2, "leave game-2")
+
+	if _, ok := c1.Node("game-2"); ok {
+		t.Fatalf("node still present after leave")
+	}
+	if kvs, _ := store.Scan(context.Background(), "test:node:"); len(kvs) != 1 {
+		t.Fatalf("keys after deregister %v", kvs)
+	}
+	for i := 0; i < 10; i++ {
+		if n, ok := c1.Pick("game", fmt.Sprint("user-", i)); !ok || n.ID != "game-1" {
+			t.Fatalf("picked %+v %v after leave", n, ok)
+		}
+	}
+
+	// 关闭时注销本进程的所有节点
+	c1.Close()
+	expectEvents(t, events2, "leave game-1")
+	if nodes := c2.Nodes(""); len(nodes) != 0 {
+		t.Fatalf("nodes after close %+v", nodes)
+	}
+}
+
+func TestClusterExpire(t *testing.T) {
+	store := cluster.NewMemoryStore()
+	c, events := startCluster(t, store, &cluster.Config{Prefix: "test", TTL: 2})
+
+	// 没有心跳的节点在键过期后由完整同步发现离开
+	data, _ := json.Marshal(cluster.Node{ID: "ghost", Type: "game", UpdateAt: time.Now().UnixMilli()})
+	store.Set(context.Background(), "test:node:ghost", string(data), 1500*time.Millisecond)
+
+	expectEvents(t, events, "join ghost")
+	if n, ok := c.Pick("game", "any"); !ok || n.ID != "ghost" {
+		t.Fatalf("pick %+v %v", n, ok)
+	}
+
+	expectEvents(t, events, "leave ghost")
+	if _, ok := c.Node("ghost"); ok {
+		t.Fatalf("expired node still present")
+	}
+	if _, ok := c.Pick("game", "any"); ok {
+		t.Fatalf("picked expired node")
+	}
+
+	// 不同前缀的集群互不可见
+	data, _ = json.Marshal(cluster.Node{ID: "other", Type: "game"})
+	store.Set(context.Background(), "prod:node:other", string(data), 0)
+	time.Sleep(1500 * time.Millisecond)
+	if nodes := c.Nodes(""); len(nodes) != 0 {
+		t.Fatalf("nodes from another prefix %+v", nodes)
+	}
+}
+
+func TestClusterRegisterService(t *testing.T) {
+	const (
+		TCP_HOST = "127.0.0.1:22241"
+		WS_HOST  = "127.0.0.1:22242"
+	)
+
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{TcpHost: TCP_HOST, WsHost: WS_HOST, Timeout: 60}, event)
+
+	store := cluster.NewMemoryStore()
+	gate := cluster.New(store, &cluster.Config{Prefix: "test", TTL: 3})
+	if err := gate.Register(svc, cluster.Node{ID: "gate-1", Type: "gate"}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if err := gate.Start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	defer gate.Close()
+
+	// 监听地址和负载来自服务
+	watcher, _ := startCluster(t, store, &cluster.Config{Prefix: "test", TTL: 3})
+	n, ok := watcher.Node("gate-1")
+	if !ok || n.TcpHost != TCP_HOST || n.WsHost != WS_HOST || n.Load != 0 {
+		t.Fatalf("node %+v %v", n, ok)
+	}
+
+	client, err := nw.NewAsyncTCPClient(TCP_HOST, WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer client.Close()
+	receive(t, event.connected, "connect")
+
+	// 心跳更新负载
+	waitFor(t, "load update", func() bool {
+		n, ok := watcher.Node("gate-1")
+		return ok && n.Load == 1
+	})
+}
@@ -0,0 +1,229 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	length, _ := nw.NewLengthCodec(2, binary.LittleEndian, 1000, 0xabcd)
+	delim, _ := nw.NewDelimiterCodec([]byte("\r\n"), 64)
+	fixed, _ := nw.NewFixedCodec(4)
+
+	cases := []struct {
+		name  string
+		codec nw.Codec
+		msgs  []string
+	}{
+		{"default", nw.DefaultCodec(0x01020304), []string{"hello", "", "world"}},
+		{"length", length, []string{"abc", "", "defgh"}},
+		{"width1", &nw.LengthCodec{Width: 1}, []string{"a", "bc"}},
+		{"width8", &nw.LengthCodec{Width: 8, Order: binary.LittleEndian, Blend: 0x55}, []string{"a", "bc"}},
+		{"varint", nw.NewVarintCodec(0), []string{"x", string(make([]byte, 300)), ""}},
+		{"line", nw.NewLineCodec(64), []string{"line1", "", "line2"}},
+		{"delimiter", delim, []string{"a\nb", "c"}},
+		{"fixed", fixed, []string{"abcd", "efgh"}},
+	}
+
+	for _, c := range cases {
+		// 多条消息连续编码, 依次解码
+		buf := nw.NewBuffer()
+		for _, msg := range c.msgs {
+			if err := c.codec.Encode(buf, []byte(msg)); err != nil {
+				t.Fatalf("%s: encode %q failed: %v", c.name, msg, err)
+			}
+		}
+
+		data := buf.Bytes()
+		for _, msg := range c.msgs {
+			body, n, err := c.codec.Decode(data)
+			if err != nil || n == 0 || string(body) != msg {
+				t.Fatalf("%s: decode %q, n %d: %v, want %q", c.name, body, n, err, msg)
+			}
+
+			// 数据不足一帧时等待更多数据
+			for i := 0; i < n; i++ {
+				if _, m, err := c.codec.Decode(data[:i]); m != 0 || err != nil {
+					t.Fatalf("%s: decode %d of %d bytes returned n %d: %v", c.name, i, n, m, err)
+				}
+			}
+
+			data = data[n:]
+		}
+
+		if len(data) != 0 {
+			t.Fatalf("%s: %d bytes left", c.name, len(data))
+		}
+	}
+}
+
+func TestCodecHeader(t *testing.T) {
+	// 长度头与混合值异或, 使用指定的字节序
+	length, _ := nw.NewLengthCodec(2, binary.LittleEndian, 1000, 0xabcd)
+	buf := nw.NewBuffer()
+	length.Encode(buf, []byte("abc"))
+	if want := binary.LittleEndian.AppendUint16(nil, 3^0xabcd); !bytes.Equal(buf.Bytes()[:2], want) {
+		t.Fatalf("header % x, want % x", buf.Bytes()[:2], want)
+	}
+
+	buf = nw.NewBuffer()
+	nw.DefaultCodec(0x01020304).Encode(buf, []byte("abc"))
+	if want := binary.BigEndian.AppendUint32(nil, 3^0x01020304); !bytes.Equal(buf.Bytes()[:4], want) {
+		t.Fatalf("header % x, want % x", buf.Bytes()[:4], want)
+	}
+
+	if _, err := nw.NewLengthCodec(3, binary.BigEndian, 0, 0); !errors.Is(err, nw.ErrLengthWidth) {
+		t.Fatalf("width 3 accepted")
+	}
+	if _, err := nw.NewFixedCodec(0); err == nil {
+		t.Fatalf("size 0 accepted")
+	}
+	if _, err := nw.NewDelimiterCodec(nil, 0); err == nil {
+		t.Fatalf("empty delimiter accepted")
+	}
+}
+
+func TestCodecLimit(t *testing.T) {
+	length, _ := nw.NewLengthCodec(2, binary.BigEndian, 1000, 0)
+	fixed, _ := nw.NewFixedCodec(4)
+
+	encodes := []struct {
+		name  string
+		codec nw.Codec
+		msg   []byte
+		err   error
+	}{
+		{"length max size", length, make([]byte, 1001), nw.ErrFrameTooLarge},
+		// 开启心跳标志时长度头的最高位不能用于长度
+		{"heartbeat bit", &nw.LengthCodec{Width: 1, Heartbeat: true}, make([]byte, 128), nw.ErrFrameTooLarge},
+		{"width limit", &nw.LengthCodec{Width: 1}, make([]byte, 256), nw.ErrFrameTooLarge},
+		{"varint max size", nw.NewVarintCodec(10), make([]byte, 11), nw.ErrFrameTooLarge},
+		{"line max size", nw.NewLineCodec(4), []byte("12345"), nw.ErrFrameTooLarge},
+		{"line delimiter", nw.NewLineCodec(64), []byte("a\nb"), nw.ErrFrameDelim},
+		{"fixed size", fixed, []byte("abc"), nw.ErrFrameSize},
+	}
+	for _, e := range encodes {
+		if err := e.codec.Encode(nw.NewBuffer(), e.msg); !errors.Is(err, e.err) {
+			t.Fatalf("%s: encode %v, want %v", e.name, err, e.err)
+		}
+	}
+
+	if err := (&nw.LengthCodec{Width: 1, Heartbeat: true}).Encode(nw.NewBuffer(), make([]byte, 127)); err != nil {
+		t.Fatalf("encode 127 bytes with heartbeat bit: %v", err)
+	}
+
+	decodes := []struct {
+		name  string
+		codec nw.Codec
+		data  []byte
+	}{
+		{"length header", length, []byte{0x03, 0xe9}},
+		{"varint header", nw.NewVarintCodec(10), []byte{11}},
+		{"varint overflow", nw.NewVarintCodec(0), bytes.Repeat([]byte{0xff}, 11)},
+		// 超过上限仍没有分隔符
+		{"line without delimiter", nw.NewLineCodec(4), []byte("123456")},
+	}
+	for _, d := range decodes {
+		if _, _, err := d.codec.Decode(d.data); !errors.Is(err, nw.ErrFrameTooLarge) {
+			t.Fatalf("%s: decode %v", d.name, err)
+		}
+	}
+
+	if body, n, err := nw.NewLineCodec(64).Decode([]byte("crlf\r\n")); err != nil || n != 6 || string(body) != "crlf" {
+		t.Fatalf("decode crlf %q %d: %v", body, n, err)
+	}
+
+	// 直接构造的编解码器在编解码时检查长度头字节数
+	for _, width := range []int{0, 3, 9, 16} {
+		lc := &nw.LengthCodec{Width: width, Heartbeat: true}
+		if err := lc.Encode(nw.NewBuffer(), []byte("abc")); !errors.Is(err, nw.ErrLengthWidth) {
+			t.Fatalf("width %d: encode %v", width, err)
+		}
+		if _, _, err := lc.Decode(make([]byte, 32)); !errors.Is(err, nw.ErrLengthWidth) {
+			t.Fatalf("width %d: decode %v", width, err)
+		}
+	}
+}
+
+func TestCodecService(t *testing.T) {
+	length, _ := nw.NewLengthCodec(2, binary.LittleEndian, 1000, 0xabcd)
+	fixed, _ := nw.NewFixedCodec(4)
+
+	cases := []struct {
+		name   string
+		server nw.Codec // 为 nil 时使用 DefaultCodec(HeadBlend)
+		client nw.Codec
+		msgs   []string
+	}{
+		{"blend", nil, nw.DefaultCodec(0x01020304), []string{"hello", "", "world"}},
+		{"length", length, length, []string{"abc", "defgh"}},
+		{"varint", nw.NewVarintCodec(0), nw.NewVarintCodec(0), []string{"x", string(make([]byte, 300))}},
+		{"line", nw.NewLineCodec(64), nw.NewLineCodec(64), []string{"line1", "line2"}},
+		{"fixed", fixed, fixed, []string{"abcd", "efgh"}},
+	}
+
+	for i, c := range cases {
+		host := fmt.Sprintf("127.0.0.1:%d", 22141+i)
+		startService(t, &nw.Config{TcpHost: host, HeadBlend: 0x01020304, Codec: c.server, Timeout: 60}, newEchoEvent())
+
+		client, err := nw.NewAsyncTCPClientWithConfig(host, &nw.TCPClientConfig{Timeout: WAIT_TIMEOUT, Codec: c.client})
+		if err != nil {
+			t.Fatalf("%s: new tcp client failed: %v", c.name, err)
+		}
+		defer client.Close()
+
+		for _, msg := range c.msgs {
+			if err := client.Write([]byte(msg)); err != nil {
+				t.Fatalf("%s: write failed: %v", c.name, err)
+			}
+			if rsp, err := client.Read(); err != nil || string(rsp) != msg {
+				t.Fatalf("%s: read %q: %v, want %q", c.name, rsp, err, msg)
+			}
+		}
+	}
+}
+
+func TestCodecHeartbeatBlend(t *testing.T) {
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{TcpHost: "127.0.0.1:22146", HeadBlend: 0x01020304, Timeout: 2, Heartbeat: true, HeartbeatInterval: 1}, event)
+
+	// 心跳帧的长度头同样与混合值异或
+	codec := nw.DefaultCodec(0x01020304)
+	codec.Heartbeat = true
+	client, err := nw.NewAsyncTCPClientWithConfig("127.0.0.1:22146", &nw.TCPClientConfig{Timeout: 1500 * time.Millisecond, Codec: codec, Heartbeat: true})
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer client.Close()
+
+	cctx := receive(t, event.connected, "connect")
+	waitFor(t, "heartbeat rtt", func() bool { return client.RTT() > 0 && cctx.RTT() > 0 })
+
+	client.Write([]byte("hello"))
+	if rsp, err := client.Read(); err != nil || string(rsp) != "hello" {
+		t.Fatalf("read %q: %v", rsp, err)
+	}
+
+	// 混合值不一致的客户端解析出超长的帧, 连接被关闭
+	other, err := nw.NewAsyncTCPClientWithConfig("127.0.0.1:22146", &nw.TCPClientConfig{Timeout: WAIT_TIMEOUT, Codec: nw.DefaultCodec(0)})
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer other.Close()
+
+	id := receive(t, event.connected, "connect").ID()
+	other.Write([]byte("hello"))
+	if got := receive(t, event.disconnected, "blend mismatch disconnect"); got != id {
+		t.Fatalf("disconnected %d, want %d", got, id)
+	}
+
+	if svc.CurrConn() != 1 {
+		t.Fatalf("conns %d, want 1", svc.CurrConn())
+	}
+}
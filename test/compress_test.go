@@ -0,0 +1,119 @@
+package test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/gox/frm/nw"
+	"github.com/klauspost/compress/zstd"
+)
+
+// stateSync 可压缩的消息
+var stateSync = bytes.Repeat([]byte("state-sync "), 5000)
+
+// readTcpFrame 读取默认编解码器的一帧
+func readTcpFrame(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(WAIT_TIMEOUT))
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		t.Fatalf("read header failed: %v", err)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatalf("read body failed: %v", err)
+	}
+
+	return body
+}
+
+// writeTcpFrame 以默认编解码器写入一帧
+func writeTcpFrame(conn net.Conn, body []byte) {
+	conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...))
+}
+
+func TestCompressClient(t *testing.T) {
+	kinds := []nw.CompressType{nw.CompressType_Gzip, nw.CompressType_Snappy, nw.CompressType_Zstd}
+	for i, kind := range kinds {
+		host := fmt.Sprintf("127.0.0.1:%d", 22151+i)
+		startService(t, &nw.Config{TcpHost: host, TcpCompress: kind, Timeout: 60}, newEchoEvent())
+
+		// 解压按消息中的标志处理, 客户端可以使用不同的算法
+		client, err := nw.NewAsyncTCPClientWithConfig(host, &nw.TCPClientConfig{Timeout: WAIT_TIMEOUT, Compress: kinds[(i+1)%len(kinds)]})
+		if err != nil {
+			t.Fatalf("%v: new tcp client failed: %v", kind, err)
+		}
+		defer client.Close()
+
+		for _, msg := range [][]byte{[]byte("small"), stateSync, {}} {
+			if err := client.Write(msg); err != nil {
+				t.Fatalf("%v: write failed: %v", kind, err)
+			}
+			if rsp, err := client.Read(); err != nil || !bytes.Equal(rsp, msg) {
+				t.Fatalf("%v: read %d bytes, want %d: %v", kind, len(rsp), len(msg), err)
+			}
+		}
+	}
+}
+
+func TestCompressWire(t *testing.T) {
+	decompress := map[nw.CompressType]func([]byte) ([]byte, error){
+		nw.CompressType_Gzip: func(data []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(r)
+		},
+		nw.CompressType_Snappy: func(data []byte) ([]byte, error) {
+			return snappy.Decode(nil, data)
+		},
+		nw.CompressType_Zstd: func(data []byte) ([]byte, error) {
+			d, _ := zstd.NewReader(nil)
+			defer d.Close()
+			return d.DecodeAll(data, nil)
+		},
+	}
+
+	for i, kind := range []nw.CompressType{nw.CompressType_Gzip, nw.CompressType_Snappy, nw.CompressType_Zstd} {
+		host := fmt.Sprintf("127.0.0.1:%d", 22154+i)
+		event := newEchoEvent()
+		startService(t, &nw.Config{TcpHost: host, TcpCompress: kind, Timeout: 60}, event)
+
+		conn, err := net.Dial("tcp", host)
+		if err != nil {
+			t.Fatalf("dial tcp failed: %v", err)
+		}
+		defer conn.Close()
+
+		// 小于阈值的消息不压缩, 标志为 0
+		writeTcpFrame(conn, append([]byte{0}, "small"...))
+		if body := readTcpFrame(t, conn); !bytes.Equal(body, append([]byte{0}, "small"...)) {
+			t.Fatalf("%v: small message % x", kind, body)
+		}
+
+		// 超过阈值的消息使用服务端的算法压缩
+		writeTcpFrame(conn, append([]byte{0}, stateSync...))
+		body := readTcpFrame(t, conn)
+		if nw.CompressType(body[0]) != kind || len(body) >= len(stateSync)/10 {
+			t.Fatalf("%v: flag %d, %d bytes", kind, body[0], len(body))
+		}
+
+		if data, err := decompress[kind](body[1:]); err != nil || !bytes.Equal(data, stateSync) {
+			t.Fatalf("%v: decompress %d bytes: %v", kind, len(data), err)
+		}
+
+		// 未知的压缩标志关闭连接
+		writeTcpFrame(conn, []byte{9, 'x'})
+		receive(t, event.disconnected, "unknown flag disconnect")
+	}
+}
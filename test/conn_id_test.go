@@ -0,0 +1,111 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+// addrEvent 消息内容是客户端的本地地址, 记录投递到其他连接的消息数
+type addrEvent struct {
+	*echoEvent
+	handled    atomic.Int64
+	mismatched atomic.Int64
+}
+
+func (this_ *addrEvent) OnData(cctx *nw.ConnContext, data []byte) error {
+	time.Sleep(time.Millisecond)
+	this_.handled.Add(1)
+	if cctx.RemoteAddr() != string(data) {
+		this_.mismatched.Add(1)
+	}
+
+	return nil
+}
+
+func TestConnID(t *testing.T) {
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{TcpHost: "127.0.0.1:22051", Timeout: 60}, event)
+
+	client, err := nw.NewAsyncTCPClient("127.0.0.1:22051", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+
+	cctx := receive(t, event.connected, "connect")
+	id, fd := cctx.ID(), cctx.Fd()
+	if id == 0 || svc.GetConn(id) != cctx {
+		t.Fatalf("id %d, lookup %p, want %p", id, svc.GetConn(id), cctx)
+	}
+
+	if err := svc.Write(id, []byte("hi")); err != nil {
+		t.Fatalf("write by id failed: %v", err)
+	}
+	if rsp, err := client.Read(); err != nil || string(rsp) != "hi" {
+		t.Fatalf("read %q: %v", rsp, err)
+	}
+
+	client.Close()
+	receive(t, event.disconnected, "disconnect")
+
+	// 新连接通常复用同一个 fd, 但 ID 不同
+	client, err = nw.NewAsyncTCPClient("127.0.0.1:22051", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer client.Close()
+
+	cctx = receive(t, event.connected, "reconnect")
+	if cctx.ID() <= id {
+		t.Fatalf("new id %d, old id %d (fd %d/%d)", cctx.ID(), id, cctx.Fd(), fd)
+	}
+
+	var stale *nw.StaleConnError
+	if err := svc.Write(id, []byte("stale")); !errors.As(err, &stale) || stale.ID != id {
+		t.Fatalf("write stale id: %v", err)
+	}
+	if svc.GetConn(id) != nil {
+		t.Fatalf("stale id found")
+	}
+
+	// 旧连接的数据不会发送到新连接
+	if err := svc.Write(cctx.ID(), []byte("new")); err != nil {
+		t.Fatalf("write by id failed: %v", err)
+	}
+	if rsp, err := client.Read(); err != nil || string(rsp) != "new" {
+		t.Fatalf("read %q: %v", rsp, err)
+	}
+}
+
+func TestConnIDReuse(t *testing.T) {
+	event := &addrEvent{echoEvent: newEchoEvent()}
+	startService(t, &nw.Config{TcpHost: "127.0.0.1:22052", Timeout: 60, Workers: 1}, event)
+
+	// 消息处理较慢, 连接关闭时仍有消息在队列中, 关闭后的连接上下文和 fd 被新连接复用
+	const CONNS, MESSAGES = 20, 20
+	for i := 0; i < CONNS; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:22052")
+		if err != nil {
+			t.Fatalf("dial tcp failed: %v", err)
+		}
+
+		addr := conn.LocalAddr().String()
+		for j := 0; j < MESSAGES; j++ {
+			conn.Write(append([]byte{0, 0, 0, byte(len(addr))}, addr...))
+		}
+		conn.Close()
+	}
+
+	for i := 0; i < CONNS; i++ {
+		receive(t, event.disconnected, fmt.Sprintf("disconnect %d", i))
+	}
+
+	if n := event.mismatched.Load(); n > 0 {
+		t.Fatalf("%d of %d messages handled on another connection", n, event.handled.Load())
+	}
+}
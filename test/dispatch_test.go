@@ -0,0 +1,134 @@
+package test
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+// SLOW_HANDLE 慢消息的处理时间
+const SLOW_HANDLE = 500 * time.Millisecond
+
+// blockingEvent 收到 slow 时阻塞一段时间再回显
+type blockingEvent struct {
+	*echoEvent
+}
+
+func (this_ *blockingEvent) OnData(cctx *nw.ConnContext, data []byte) error {
+	if string(data) == "slow" {
+		time.Sleep(SLOW_HANDLE)
+	}
+
+	return cctx.Write(data)
+}
+
+// dispatchClients 启动服务并连接两个客户端, a 先发送慢消息再连续发送 count 条消息
+func dispatchClients(t *testing.T, host string, mode nw.DispatchMode, count int) (*nw.AsyncTCPClient, *nw.AsyncTCPClient) {
+	t.Helper()
+
+	startService(t, &nw.Config{TcpHost: host, Timeout: 60, Dispatch: mode, Workers: 2}, &blockingEvent{newEchoEvent()})
+
+	a, err := nw.NewAsyncTCPClient(host, WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	t.Cleanup(func() { a.Close() })
+
+	b, err := nw.NewAsyncTCPClient(host, WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	a.Write([]byte("slow"))
+	for i := 0; i < count; i++ {
+		a.Write([]byte(fmt.Sprint(i)))
+	}
+
+	return a, b
+}
+
+// fastReply 慢消息处理期间其他连接的消息不受影响
+func fastReply(t *testing.T, b *nw.AsyncTCPClient) {
+	t.Helper()
+
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	b.Write([]byte("fast"))
+	if rsp, err := b.Read(); err != nil || string(rsp) != "fast" {
+		t.Fatalf("read %q: %v", rsp, err)
+	}
+
+	if elapsed := time.Since(start); elapsed >= SLOW_HANDLE/2 {
+		t.Fatalf("fast reply took %v", elapsed)
+	}
+}
+
+func TestDispatchOrdered(t *testing.T) {
+	a, b := dispatchClients(t, "127.0.0.1:22061", nw.DispatchMode_Ordered, 200)
+	fastReply(t, b)
+
+	// 同一连接的消息按顺序处理
+	if rsp, err := a.Read(); err != nil || string(rsp) != "slow" {
+		t.Fatalf("read %q: %v", rsp, err)
+	}
+	for i := 0; i < 200; i++ {
+		if rsp, err := a.Read(); err != nil || string(rsp) != fmt.Sprint(i) {
+			t.Fatalf("read %d: %q %v", i, rsp, err)
+		}
+	}
+}
+
+func TestDispatchUnordered(t *testing.T) {
+	a, b := dispatchClients(t, "127.0.0.1:22062", nw.DispatchMode_Unordered, 200)
+	fastReply(t, b)
+
+	// 不保序, 但每条消息都被处理
+	var got []string
+	for i := 0; i < 201; i++ {
+		rsp, err := a.Read()
+		if err != nil {
+			t.Fatalf("read %d failed: %v", i, err)
+		}
+		got = append(got, string(rsp))
+	}
+
+	// 慢消息在其他消息之后完成
+	if got[len(got)-1] != "slow" {
+		t.Fatalf("slow message is not the last one")
+	}
+
+	want := []string{"slow"}
+	for i := 0; i < 200; i++ {
+		want = append(want, fmt.Sprint(i))
+	}
+
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestDispatchInline(t *testing.T) {
+	event := newEchoEvent()
+	startService(t, &nw.Config{TcpHost: "127.0.0.1:22063", Timeout: 60, Dispatch: nw.DispatchMode_Inline}, event)
+
+	client, err := nw.NewAsyncTCPClient("127.0.0.1:22063", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 200; i++ {
+		client.Write([]byte(fmt.Sprint(i)))
+	}
+	for i := 0; i < 200; i++ {
+		if rsp, err := client.Read(); err != nil || string(rsp) != fmt.Sprint(i) {
+			t.Fatalf("read %d: %q %v", i, rsp, err)
+		}
+	}
+}
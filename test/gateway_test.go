@@ -0,0 +1,572 @@
+package test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+	"github.com/gox/frm/nw/cluster"
+	"github.com/gox/frm/nw/gateway"
+	"github.com/gox/frm/nw/router"
+)
+
+const (
+	GW_CMD_LOGIN  = 1
+	GW_CMD_WHO    = 100 // 应答 "节点ID|身份|请求体"
+	GW_CMD_KICK   = 101 // 后端关闭会话
+	GW_CMD_PUSH   = 102 // 应答后推送一条消息
+	GW_CMD_CHAT   = 200
+	GW_CMD_PUSHED = 999
+)
+
+// linkFrame 按内部链路的格式编码一帧
+func linkFrame(kind gateway.LinkKind, session uint64, body []byte) []byte {
+	data := []byte{byte(kind)}
+	data = binary.BigEndian.AppendUint64(data, session)
+	return append(data, body...)
+}
+
+// readLinkFrame 从链路读取一帧并解码
+func readLinkFrame(t *testing.T, link *nw.AsyncTCPClient) (gateway.LinkKind, uint64, []byte) {
+	t.Helper()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		data, err := link.Read()
+		ch <- result{data, err}
+	}()
+
+	r := receive(t, ch, "link frame")
+	if r.err != nil {
+		t.Fatalf("read link frame failed: %v", r.err)
+	}
+	if len(r.data) < gateway.LINK_HEADER_SIZE {
+		t.Fatalf("short link frame % x", r.data)
+	}
+
+	return gateway.LinkKind(r.data[0]), binary.BigEndian.Uint64(r.data[1:]), r.data[gateway.LINK_HEADER_SIZE:]
+}
+
+// gatewayBackend 测试用的后端事件
+type gatewayBackend struct {
+	id     string
+	opened chan gateway.SessionInfo
+	closed chan uint64
+}
+
+func (this_ *gatewayBackend) OnOpen(s *gateway.Session) error {
+	this_.opened <- s.Info()
+	return nil
+}
+
+func (this_ *gatewayBackend) OnData(s *gateway.Session, data []byte) error {
+	h, body, err := router.Decode(data)
+	if err != nil {
+		return err
+	}
+
+	switch h.Cmd {
+	case GW_CMD_WHO, GW_CMD_CHAT:
+		return s.Reply(h, []byte(this_.id+"|"+s.Identity()+"|"+string(body)), nil)
+	case GW_CMD_PUSH:
+		s.Reply(h, nil, nil)
+		return s.Push(GW_CMD_PUSHED, []byte("pushed by "+this_.id))
+	case GW_CMD_KICK:
+		s.Close()
+	}
+
+	return nil
+}
+
+func (this_ *gatewayBackend) OnClose(s *gateway.Session) {
+	this_.closed <- s.ID()
+}
+
+// startBackend 启动后端节点
+func startBackend(t *testing.T, id, host string) (*gateway.Backend, *gatewayBackend) {
+	t.Helper()
+
+	event := &gatewayBackend{
+		id:     id,
+		opened: make(chan gateway.SessionInfo, 64),
+		closed: make(chan uint64, 64),
+	}
+	backend := gateway.NewBackend(event)
+	startService(t, &nw.Config{TcpHost: host, Timeout: 60}, backend)
+	return backend, event
+}
+
+// gatewayAuth 登录命令的请求体作为身份, "bad" 认证失败
+func gatewayAuth(cctx *nw.ConnContext, h router.Header, body []byte) (string, []byte, error) {
+	if h.Cmd != GW_CMD_LOGIN {
+		return "", nil, errors.New("login first")
+	}
+
+	if string(body) == "bad" {
+		return "", nil, errors.New("bad token")
+	}
+
+	return string(body), []byte("welcome"), nil
+}
+
+// gatewayCall 发送请求, 出错时返回 "ERR " 加错误描述
+func gatewayCall(c *router.Client, cmd uint32, body string) string {
+	rsp, err := c.Call(context.Background(), cmd, []byte(body))
+	if err != nil {
+		return "ERR " + err.Error()
+	}
+
+	return string(rsp)
+}
+
+// dialGateway 连接网关并登录
+func dialGateway(t *testing.T, host, identity string) *router.Client {
+	t.Helper()
+
+	conn, err := nw.NewAsyncTCPClient(host, WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial gateway failed: %v", err)
+	}
+
+	c := router.NewTCPClient(conn, WAIT_TIMEOUT)
+	t.Cleanup(func() { c.Close() })
+
+	if rsp := gatewayCall(c, GW_CMD_LOGIN, identity); rsp != "welcome" {
+		t.Fatalf("login %s: %s", identity, rsp)
+	}
+
+	return c
+}
+
+// whoNode 请求 GW_CMD_WHO, 返回处理的节点ID
+func whoNode(t *testing.T, c *router.Client) string {
+	t.Helper()
+
+	rsp := gatewayCall(c, GW_CMD_WHO, "")
+	if strings.HasPrefix(rsp, "ERR") {
+		t.Fatalf("who: %s", rsp)
+	}
+
+	return strings.Split(rsp, "|")[0]
+}
+
+func TestGatewayLinkKind(t *testing.T) {
+	kinds := map[gateway.LinkKind]string{
+		gateway.LinkKind_Open:  "open",
+		gateway.LinkKind_Data:  "data",
+		gateway.LinkKind_Close: "close",
+		gateway.LinkKind_Reset: "reset",
+		gateway.LinkKind(0):    "unknown",
+	}
+	for kind, want := range kinds {
+		if kind.String() != want {
+			t.Fatalf("link kind %d: %s, want %s", kind, kind, want)
+		}
+	}
+
+	if gateway.Balance_LeastSessions.String() == gateway.Balance_Hash.String() {
+		t.Fatalf("balance names %v %v", gateway.Balance_LeastSessions, gateway.Balance_Hash)
+	}
+}
+
+func TestGatewayBackendLink(t *testing.T) {
+	const BACKEND_HOST = "127.0.0.1:22221"
+
+	backend, event := startBackend(t, "b1", BACKEND_HOST)
+
+	link, err := nw.NewAsyncTCPClient(BACKEND_HOST, WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial backend failed: %v", err)
+	}
+	defer link.Close()
+
+	// 没有打开的会话, 后端交还被拒绝的帧
+	req := router.Header{Cmd: GW_CMD_WHO, Seq: 1}.Encode([]byte("hi"))
+	link.Write(linkFrame(gateway.LinkKind_Data, 7, req))
+	if kind, id, body := readLinkFrame(t, link); kind != gateway.LinkKind_Reset || id != 7 || string(body) != string(req) {
+		t.Fatalf("unknown session: %v %d % x", kind, id, body)
+	}
+
+	// 打开会话, 会话信息随帧发送
+	info := gateway.SessionInfo{ID: 7, Identity: "alice", RemoteAddr: "192.0.2.1:5000", Protocol: "tcp"}
+	open, _ := json.Marshal(info)
+	link.Write(linkFrame(gateway.LinkKind_Open, 7, open))
+	if got := receive(t, event.opened, "open"); got != info {
+		t.Fatalf("opened %+v, want %+v", got, info)
+	}
+
+	link.Write(linkFrame(gateway.LinkKind_Data, 7, req))
+	kind, id, body := readLinkFrame(t, link)
+	if kind != gateway.LinkKind_Data || id != 7 {
+		t.Fatalf("reply frame %v %d", kind, id)
+	}
+	if h, rsp, err := router.Decode(body); err != nil || !h.IsResponse() || h.Seq != 1 || string(rsp) != "b1|alice|hi" {
+		t.Fatalf("reply %+v %q: %v", h, rsp, err)
+	}
+
+	// 重复打开同一会话被忽略
+	link.Write(linkFrame(gateway.LinkKind_Open, 7, open))
+	link.Write(linkFrame(gateway.LinkKind_Data, 7, req))
+	readLinkFrame(t, link)
+	if backend.Sessions() != 1 || len(event.opened) != 0 {
+		t.Fatalf("sessions %d opened %d after duplicate open", backend.Sessions(), len(event.opened))
+	}
+
+	// 后端关闭会话时通知网关
+	link.Write(linkFrame(gateway.LinkKind_Data, 7, router.Header{Cmd: GW_CMD_KICK, Seq: 2}.Encode(nil)))
+	if kind, id, _ := readLinkFrame(t, link); kind != gateway.LinkKind_Close || id != 7 {
+		t.Fatalf("kick frame %v %d", kind, id)
+	}
+	if got := receive(t, event.closed, "kick close"); got != 7 {
+		t.Fatalf("closed %d, want 7", got)
+	}
+
+	// 网关通知客户端断开
+	open, _ = json.Marshal(gateway.SessionInfo{ID: 8})
+	link.Write(linkFrame(gateway.LinkKind_Open, 8, open))
+	receive(t, event.opened, "open 8")
+	link.Write(linkFrame(gateway.LinkKind_Close, 8, nil))
+	if got := receive(t, event.closed, "gateway close"); got != 8 {
+		t.Fatalf("closed %d, want 8", got)
+	}
+
+	// 不同链路上的会话ID互不影响, 链路断开时关闭其上的所有会话
+	link2, err := nw.NewAsyncTCPClient(BACKEND_HOST, WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial backend failed: %v", err)
+	}
+	defer link2.Close()
+
+	open, _ = json.Marshal(gateway.SessionInfo{ID: 9})
+	link.Write(linkFrame(gateway.LinkKind_Open, 9, open))
+	link2.Write(linkFrame(gateway.LinkKind_Open, 9, open))
+	receive(t, event.opened, "open 9")
+	receive(t, event.opened, "open 9 on link2")
+	if backend.Sessions() != 2 {
+		t.Fatalf("sessions %d, want 2", backend.Sessions())
+	}
+
+	link.Close()
+	if got := receive(t, event.closed, "link close"); got != 9 {
+		t.Fatalf("closed %d, want 9", got)
+	}
+	waitFor(t, "sessions on link2", func() bool { return backend.Sessions() == 1 })
+
+	// 不足帧头长度的帧关闭链路
+	link2.Write([]byte{byte(gateway.LinkKind_Data), 0, 0})
+	if got := receive(t, event.closed, "invalid frame"); got != 9 {
+		t.Fatalf("closed %d, want 9", got)
+	}
+	if _, err := link2.Read(); err == nil {
+		t.Fatalf("link not closed after invalid frame")
+	}
+}
+
+func TestGatewayRoute(t *testing.T) {
+	const GATEWAY_HOST = "127.0.0.1:22225"
+
+	_, g1 := startBackend(t, "g1", "127.0.0.1:22222")
+	_, g2 := startBackend(t, "g2", "127.0.0.1:22223")
+	_, c1 := startBackend(t, "c1", "127.0.0.1:22224")
+
+	gw := gateway.New(&gateway.Config{Link: nw.TCPClientConfig{Timeout: WAIT_TIMEOUT}, Auth: gatewayAuth})
+	gw.RouteRange(100, 199, "game")
+	gw.Route(GW_CMD_CHAT, "chat")
+	nodes := []gateway.Node{
+		{ID: "g1", Type: "game", Host: "127.0.0.1:22222"},
+		{ID: "g2", Type: "game", Host: "127.0.0.1:22223"},
+		{ID: "c1", Type: "chat", Host: "127.0.0.1:22224"},
+	}
+	for _, n := range nodes {
+		if err := gw.AddNode(n); err != nil {
+			t.Fatalf("add node %s failed: %v", n.ID, err)
+		}
+	}
+
+	if err := gw.AddNode(nodes[0]); !errors.Is(err, gateway.ErrNodeExists) {
+		t.Fatalf("add duplicate node: %v", err)
+	}
+	if err := gw.RemoveNode("x"); !errors.Is(err, gateway.ErrUnknownNode) {
+		t.Fatalf("remove unknown node: %v", err)
+	}
+
+	event := newEchoEvent()
+	startService(t, &nw.Config{TcpHost: GATEWAY_HOST, Timeout: 60}, &gatewayEvent{Gateway: gw, connected: event.connected})
+
+	// 认证之前的帧不转发, 认证失败关闭连接
+	conn, err := nw.NewAsyncTCPClient(GATEWAY_HOST, WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial gateway failed: %v", err)
+	}
+	anon := router.NewTCPClient(conn, WAIT_TIMEOUT)
+	if rsp := gatewayCall(anon, GW_CMD_WHO, ""); rsp != "ERR login first" {
+		t.Fatalf("unauthenticated call: %s", rsp)
+	}
+	if _, err := conn.Read(); err == nil {
+		t.Fatalf("unauthenticated connection not closed")
+	}
+	receive(t, event.connected, "anonymous connect")
+
+	// 按会话数选择节点, 选定后粘滞
+	var (
+		clients []*router.Client
+		ids     []uint64
+		pushes  = make(chan string, 16)
+		count   = map[string]int{}
+	)
+	for i := 0; i < 4; i++ {
+		identity := fmt.Sprint("user-", i)
+		c := dialGateway(t, GATEWAY_HOST, identity)
+		c.OnPush(func(h router.Header, body []byte) { pushes <- fmt.Sprint(h.Cmd, " ", string(body)) })
+		ids = append(ids, receive(t, event.connected, "connect").ID())
+
+		rsp := gatewayCall(c, GW_CMD_WHO, "a")
+		node := strings.Split(rsp, "|")[0]
+		if rsp != node+"|"+identity+"|a" {
+			t.Fatalf("who %s", rsp)
+		}
+		for j := 0; j < 3; j++ {
+			if rsp := gatewayCall(c, GW_CMD_WHO, "b"); !strings.HasPrefix(rsp, node+"|") {
+				t.Fatalf("session moved from %s: %s", node, rsp)
+			}
+		}
+		if rsp := gatewayCall(c, GW_CMD_CHAT, "hi"); rsp != "c1|"+identity+"|hi" {
+			t.Fatalf("chat %s", rsp)
+		}
+
+		count[node]++
+		clients = append(clients, c)
+	}
+
+	if count["g1"] != 2 || count["g2"] != 2 {
+		t.Fatalf("sessions per node %v", count)
+	}
+	if len(g1.opened) != 2 || len(g2.opened) != 2 || len(c1.opened) != 4 {
+		t.Fatalf("opened g1 %d g2 %d c1 %d", len(g1.opened), len(g2.opened), len(c1.opened))
+	}
+	if info := (<-c1.opened); info.ID != ids[0] || info.Identity != "user-0" || info.Protocol != "tcp" {
+		t.Fatalf("session info %+v", info)
+	}
+
+	infos := gw.Nodes()
+	if len(infos) != 3 || infos[0].ID != "c1" || infos[0].Sessions != 4 || !infos[0].Connected || infos[1].Sessions != 2 {
+		t.Fatalf("nodes %+v", infos)
+	}
+	if info, ok := gw.Session(ids[1]); !ok || info.Identity != "user-1" {
+		t.Fatalf("session %d: %+v %v", ids[1], info, ok)
+	}
+
+	// 后端推送发回对应的连接
+	if rsp := gatewayCall(clients[0], GW_CMD_PUSH, ""); rsp != "" {
+		t.Fatalf("push reply %q", rsp)
+	}
+	if push := receive(t, pushes, "push"); !strings.HasPrefix(push, fmt.Sprint(GW_CMD_PUSHED, " pushed by g")) {
+		t.Fatalf("push %q", push)
+	}
+
+	// 没有路由的命令
+	if rsp := gatewayCall(clients[0], 5000, ""); rsp != "ERR unknown command 5000" {
+		t.Fatalf("unknown command: %s", rsp)
+	}
+
+	// 指定节点
+	node := whoNode(t, clients[1])
+	other := map[string]string{"g1": "g2", "g2": "g1"}[node]
+	if err := gw.Bind(ids[1], other); err != nil {
+		t.Fatalf("bind failed: %v", err)
+	}
+	if got := whoNode(t, clients[1]); got != other {
+		t.Fatalf("bound session on %s, want %s", got, other)
+	}
+	if err := gw.Bind(ids[1], "x"); !errors.Is(err, gateway.ErrUnknownNode) {
+		t.Fatalf("bind unknown node: %v", err)
+	}
+
+	// 客户端断开, 打开过会话的节点都收到关闭
+	clients[3].Close()
+	if got := receive(t, c1.closed, "chat close"); got != ids[3] {
+		t.Fatalf("chat closed %d, want %d", got, ids[3])
+	}
+	select {
+	case got := <-g1.closed:
+		if got != ids[3] {
+			t.Fatalf("g1 closed %d, want %d", got, ids[3])
+		}
+	case got := <-g2.closed:
+		if got != ids[3] {
+			t.Fatalf("g2 closed %d, want %d", got, ids[3])
+		}
+	case <-time.After(WAIT_TIMEOUT):
+		t.Fatalf("close not forwarded to game node")
+	}
+	if err := gw.Bind(ids[3], "g1"); !errors.Is(err, gateway.ErrNoSession) {
+		t.Fatalf("bind closed session: %v", err)
+	}
+
+	// 后端关闭会话后网关关闭客户端连接
+	gatewayCall(clients[2], GW_CMD_KICK, "")
+	if rsp := gatewayCall(clients[2], GW_CMD_WHO, ""); !strings.HasPrefix(rsp, "ERR") {
+		t.Fatalf("kicked client alive: %s", rsp)
+	}
+
+	// 移除节点后粘滞的会话重新选择节点
+	node = whoNode(t, clients[0])
+	other = map[string]string{"g1": "g2", "g2": "g1"}[node]
+	if err := gw.RemoveNode(node); err != nil {
+		t.Fatalf("remove node failed: %v", err)
+	}
+	if got := whoNode(t, clients[0]); got != other {
+		t.Fatalf("session on %s after removing %s, want %s", got, node, other)
+	}
+
+	gw.RemoveNode(other)
+	if rsp := gatewayCall(clients[0], GW_CMD_WHO, ""); rsp != "ERR no available node: game" {
+		t.Fatalf("no node: %s", rsp)
+	}
+}
+
+// gatewayEvent 记录网关的连接
+type gatewayEvent struct {
+	*gateway.Gateway
+	connected chan *nw.ConnContext
+}
+
+func (this_ *gatewayEvent) OnConnected(cctx *nw.ConnContext) error {
+	if err := this_.Gateway.OnConnected(cctx); err != nil {
+		return err
+	}
+
+	this_.connected <- cctx
+	return nil
+}
+
+// resetBackend 丢弃每个会话打开后的第一帧并交还给网关, 模拟链路恢复前后端丢失会话
+type resetBackend struct {
+	*echoEvent
+	frames chan gateway.LinkKind
+	reset  map[uint64]bool // 只有一条链路, 按连接保序处理时依次访问
+}
+
+func (this_ *resetBackend) OnData(cctx *nw.ConnContext, data []byte) error {
+	kind, id := gateway.LinkKind(data[0]), binary.BigEndian.Uint64(data[1:])
+	body := data[gateway.LINK_HEADER_SIZE:]
+	this_.frames <- kind
+
+	if kind != gateway.LinkKind_Data {
+		return nil
+	}
+
+	if !this_.reset[id] {
+		this_.reset[id] = true
+		return cctx.Write(linkFrame(gateway.LinkKind_Reset, id, body))
+	}
+
+	h, req, _ := router.Decode(body)
+	rsp := router.Header{Cmd: h.Cmd, Seq: h.Seq, Flags: router.Flag_Response}.Encode(append([]byte("resent "), req...))
+	return cctx.Write(linkFrame(gateway.LinkKind_Data, id, rsp))
+}
+
+func TestGatewayReset(t *testing.T) {
+	backend := &resetBackend{echoEvent: newEchoEvent(), frames: make(chan gateway.LinkKind, 16), reset: make(map[uint64]bool)}
+	startService(t, &nw.Config{TcpHost: "127.0.0.1:22226", Timeout: 60}, backend)
+
+	gw := gateway.New(&gateway.Config{Link: nw.TCPClientConfig{Timeout: WAIT_TIMEOUT}, DefaultType: "game"})
+	if err := gw.AddNode(gateway.Node{ID: "r1", Type: "game", Host: "127.0.0.1:22226"}); err != nil {
+		t.Fatalf("add node failed: %v", err)
+	}
+	startService(t, &nw.Config{TcpHost: "127.0.0.1:22227", Timeout: 60}, gw)
+
+	conn, err := nw.NewAsyncTCPClient("127.0.0.1:22227", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial gateway failed: %v", err)
+	}
+	c := router.NewTCPClient(conn, WAIT_TIMEOUT)
+	defer c.Close()
+
+	// 被拒绝的帧在重新打开会话后重发
+	if rsp := gatewayCall(c, 1, "hello"); rsp != "resent hello" {
+		t.Fatalf("call after reset: %s", rsp)
+	}
+
+	want := []gateway.LinkKind{gateway.LinkKind_Open, gateway.LinkKind_Data, gateway.LinkKind_Open, gateway.LinkKind_Data}
+	for i, kind := range want {
+		if got := receive(t, backend.frames, fmt.Sprint("frame ", i)); got != kind {
+			t.Fatalf("frame %d: %v, want %v", i, got, kind)
+		}
+	}
+
+	// 之后的帧直接转发
+	if rsp := gatewayCall(c, 1, "again"); rsp != "resent again" {
+		t.Fatalf("call after resend: %s", rsp)
+	}
+	if got := receive(t, backend.frames, "frame after resend"); got != gateway.LinkKind_Data {
+		t.Fatalf("frame after resend: %v", got)
+	}
+}
+
+func TestGatewayHashBalance(t *testing.T) {
+	const GATEWAY_HOST = "127.0.0.1:22234"
+
+	ids := []string{"h1", "h2", "h3"}
+	gw := gateway.New(&gateway.Config{Link: nw.TCPClientConfig{Timeout: WAIT_TIMEOUT}, Auth: gatewayAuth, Balance: gateway.Balance_Hash})
+	gw.RouteRange(100, 199, "game")
+	for i, id := range ids {
+		host := fmt.Sprintf("127.0.0.1:%d", 22231+i)
+		startBackend(t, id, host)
+		if err := gw.AddNode(gateway.Node{ID: id, Type: "game", Host: host}); err != nil {
+			t.Fatalf("add node %s failed: %v", id, err)
+		}
+	}
+	startService(t, &nw.Config{TcpHost: GATEWAY_HOST, Timeout: 60}, gw)
+
+	// 同一身份总是选中环上的同一节点, 与连接无关
+	ring := cluster.NewHashRing(ids, cluster.CLUSTER_REPLICAS)
+	placed := map[string]string{}
+	used := map[string]bool{}
+	for i := 0; i < 12; i++ {
+		identity := fmt.Sprint("player-", i)
+		want := ring.Get(identity)
+		for j := 0; j < 2; j++ {
+			c := dialGateway(t, GATEWAY_HOST, identity)
+			if got := whoNode(t, c); got != want {
+				t.Fatalf("%s on %s, want %s", identity, got, want)
+			}
+			c.Close()
+		}
+
+		placed[identity] = want
+		used[want] = true
+	}
+	if len(used) < 2 {
+		t.Fatalf("all identities on %v", used)
+	}
+
+	// 移除节点后只有该节点上的身份改变节点
+	removed := placed["player-0"]
+	if err := gw.RemoveNode(removed); err != nil {
+		t.Fatalf("remove node failed: %v", err)
+	}
+
+	for identity, node := range placed {
+		c := dialGateway(t, GATEWAY_HOST, identity)
+		got := whoNode(t, c)
+		c.Close()
+
+		if node != removed && got != node {
+			t.Fatalf("%s moved from %s to %s after removing %s", identity, node, got, removed)
+		}
+		if got == removed {
+			t.Fatalf("%s on removed node %s", identity, removed)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+func TestHeartbeatKeepAlive(t *testing.T) {
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{
+		TcpHost:           "127.0.0.1:22091",
+		WsHost:            "127.0.0.1:22092",
+		Timeout:           2,
+		Heartbeat:         true,
+		HeartbeatInterval: 1,
+	}, event)
+
+	// 客户端的心跳周期为读超时的三分之一
+	client, err := nw.NewAsyncTCPClientWithConfig("127.0.0.1:22091", &nw.TCPClientConfig{Timeout: 1500 * time.Millisecond, Heartbeat: true})
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer client.Close()
+
+	ws, err := nw.NewWsClient("127.0.0.1:22092", 1500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("new ws client failed: %v", err)
+	}
+	defer ws.Close()
+
+	// websocket 的控制帧在读取时处理
+	wsMsgs := make(chan []byte, 1)
+	go func() {
+		for {
+			msg, err := ws.Read()
+			if err != nil {
+				close(wsMsgs)
+				return
+			}
+			wsMsgs <- msg
+		}
+	}()
+
+	cctxs := []*nw.ConnContext{receive(t, event.connected, "connect"), receive(t, event.connected, "connect")}
+
+	// 没有业务数据, 超过服务端和客户端的超时时间后连接仍然保持
+	time.Sleep(3500 * time.Millisecond)
+	if svc.CurrConn() != 2 {
+		t.Fatalf("conns %d after idle, want 2", svc.CurrConn())
+	}
+
+	for _, cctx := range cctxs {
+		if cctx.RTT() <= 0 {
+			t.Fatalf("server rtt of %v not measured", cctx.Protocol())
+		}
+	}
+	if client.RTT() <= 0 || ws.RTT() <= 0 {
+		t.Fatalf("client rtt %v, ws rtt %v", client.RTT(), ws.RTT())
+	}
+
+	client.Write([]byte("tcp"))
+	if rsp, err := client.Read(); err != nil || string(rsp) != "tcp" {
+		t.Fatalf("read %q: %v", rsp, err)
+	}
+
+	ws.Write([]byte("ws"))
+	if rsp := receive(t, wsMsgs, "ws echo"); string(rsp) != "ws" {
+		t.Fatalf("ws read %q", rsp)
+	}
+}
+
+func TestHeartbeatFrame(t *testing.T) {
+	event := newEchoEvent()
+	startService(t, &nw.Config{TcpHost: "127.0.0.1:22093", Timeout: 60, Heartbeat: true}, event)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:22093")
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(WAIT_TIMEOUT))
+
+	// 心跳请求和普通消息连续发送, 心跳由框架应答, 不会进入 OnData
+	ping := make([]byte, 4+nw.HEARTBEAT_SIZE)
+	binary.BigEndian.PutUint32(ping, nw.TCP_HEARTBEAT_FLAG|nw.HEARTBEAT_SIZE)
+	ping[4] = nw.HEARTBEAT_PING
+	binary.BigEndian.PutUint64(ping[5:], 12345)
+	conn.Write(append(ping, 0, 0, 0, 1, 'x'))
+
+	pong := make([]byte, 4+nw.HEARTBEAT_SIZE)
+	if _, err := io.ReadFull(conn, pong); err != nil {
+		t.Fatalf("read pong failed: %v", err)
+	}
+	if binary.BigEndian.Uint32(pong) != nw.TCP_HEARTBEAT_FLAG|nw.HEARTBEAT_SIZE || pong[4] != nw.HEARTBEAT_PONG {
+		t.Fatalf("pong % x", pong)
+	}
+	if ts := binary.BigEndian.Uint64(pong[5:]); ts != 12345 {
+		t.Fatalf("pong timestamp %d, want 12345", ts)
+	}
+
+	echo := make([]byte, 5)
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "\x00\x00\x00\x01x" {
+		t.Fatalf("read echo % x: %v", echo, err)
+	}
+
+	// 带心跳标志但长度不对的帧关闭连接
+	conn.Write([]byte{0x80, 0, 0, 5, 1, 2, 3, 4, 5})
+	receive(t, event.disconnected, "invalid heartbeat disconnect")
+}
+
+func TestHeartbeatOptIn(t *testing.T) {
+	event := newEchoEvent()
+	startService(t, &nw.Config{TcpHost: "127.0.0.1:22264", Timeout: 60}, event)
+
+	// 未开启心跳时默认编解码器的帧格式不变, 长度头最高位属于长度, 超过上限后关闭连接
+	conn, err := net.Dial("tcp", "127.0.0.1:22264")
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer conn.Close()
+
+	id := receive(t, event.connected, "connect").ID()
+	ping := make([]byte, 4+nw.HEARTBEAT_SIZE)
+	binary.BigEndian.PutUint32(ping, nw.TCP_HEARTBEAT_FLAG|nw.HEARTBEAT_SIZE)
+	ping[4] = nw.HEARTBEAT_PING
+	conn.Write(ping)
+	if got := receive(t, event.disconnected, "heartbeat flag disconnect"); got != id {
+		t.Fatalf("disconnected %d, want %d", got, id)
+	}
+
+	// 未开启心跳的客户端不发送心跳
+	ln, err := net.Listen("tcp", "127.0.0.1:22265")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	client, err := nw.NewAsyncTCPClient("127.0.0.1:22265", time.Second)
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer client.Close()
+
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	defer peer.Close()
+
+	// 心跳周期为读超时的三分之一, 在读超时之前检查
+	peer.SetReadDeadline(time.Now().Add(700 * time.Millisecond))
+	if n, err := peer.Read(make([]byte, 64)); n > 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("client without heartbeat sent %d bytes: %v", n, err)
+	}
+}
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+// idleEvent 记录空闲事件, 写空闲时保持连接, 其他空闲关闭连接. 收到的消息不回复
+type idleEvent struct {
+	*echoEvent
+	states chan nw.IdleState
+}
+
+func (this_ *idleEvent) OnData(cctx *nw.ConnContext, data []byte) error { return nil }
+
+func (this_ *idleEvent) OnIdle(cctx *nw.ConnContext, state nw.IdleState) bool {
+	this_.states <- state
+	return state == nw.IdleState_Write
+}
+
+func TestIdleReadWrite(t *testing.T) {
+	event := &idleEvent{echoEvent: newEchoEvent(), states: make(chan nw.IdleState, 64)}
+	startService(t, &nw.Config{TcpHost: "127.0.0.1:22101", ReadIdle: 3, WriteIdle: 1}, event)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:22101")
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	receive(t, event.connected, "connect")
+
+	// 写空闲每秒触发一次且保持连接, 读空闲关闭连接
+	writes := 0
+	for state := receive(t, event.states, "idle"); state != nw.IdleState_Read; state = receive(t, event.states, "idle") {
+		if state != nw.IdleState_Write {
+			t.Fatalf("unexpected idle state %v", state)
+		}
+		writes++
+	}
+	receive(t, event.disconnected, "read idle disconnect")
+
+	if elapsed := time.Since(start); writes < 2 || elapsed < 2*time.Second || elapsed > 5*time.Second {
+		t.Fatalf("%d write idle events, closed after %v", writes, elapsed)
+	}
+}
+
+func TestIdleAll(t *testing.T) {
+	event := &idleEvent{echoEvent: newEchoEvent(), states: make(chan nw.IdleState, 64)}
+	startService(t, &nw.Config{TcpHost: "127.0.0.1:22102", Timeout: 60, AllIdle: 2}, event)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:22102")
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer conn.Close()
+	receive(t, event.connected, "connect")
+
+	// 持续收到数据时不触发读写空闲
+	for i := 0; i < 10; i++ {
+		conn.Write([]byte{0, 0, 0, 1, 'x'})
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	select {
+	case state := <-event.states:
+		t.Fatalf("idle %v while receiving", state)
+	default:
+	}
+
+	if state := receive(t, event.states, "all idle"); state != nw.IdleState_All {
+		t.Fatalf("idle state %v, want all", state)
+	}
+	receive(t, event.disconnected, "all idle disconnect")
+}
@@ -0,0 +1,311 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+func TestKcpEcho(t *testing.T) {
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{KcpHost: "127.0.0.1:22011", Timeout: 60}, event)
+
+	client, err := nw.NewKcpClient("127.0.0.1:22011", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("new kcp client failed: %v", err)
+	}
+	defer client.Close()
+
+	// 超过一个分片的消息需要拆分和重组
+	for i := 0; i < 50; i++ {
+		msg := bytes.Repeat([]byte(fmt.Sprint(i)), 1+i*200)
+		if err := client.Write(msg); err != nil {
+			t.Fatalf("write %d failed: %v", i, err)
+		}
+
+		rsp, err := client.Read()
+		if err != nil || !bytes.Equal(rsp, msg) {
+			t.Fatalf("read %d: len %d, want %d, err %v", i, len(rsp), len(msg), err)
+		}
+	}
+
+	cctx := receive(t, event.connected, "kcp session")
+	if cctx.Protocol() != nw.Protocol_KCP || svc.CurrConn() != 1 {
+		t.Fatalf("protocol %v conns %d", cctx.Protocol(), svc.CurrConn())
+	}
+
+	// 连续发送的消息按顺序到达
+	for i := 0; i < 100; i++ {
+		if err := client.Write([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("write %d failed: %v", i, err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		rsp, err := client.Read()
+		if err != nil || string(rsp) != fmt.Sprint(i) {
+			t.Fatalf("read %d: %q %v", i, rsp, err)
+		}
+	}
+
+	id := cctx.ID()
+	cctx.Close()
+	if got := receive(t, event.disconnected, "kcp disconnect"); got != id {
+		t.Fatalf("disconnected %d, want %d", got, id)
+	}
+}
+
+func TestKcpClientTimeout(t *testing.T) {
+	// 没有服务端时客户端在读超时后关闭
+	client, err := nw.NewKcpClient("127.0.0.1:22012", 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("new kcp client failed: %v", err)
+	}
+	defer client.Close()
+
+	client.Write([]byte("hello"))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Read()
+		done <- err
+	}()
+
+	if err := receive(t, done, "kcp client timeout"); err == nil {
+		t.Fatalf("read without server succeeded")
+	}
+}
+
+func TestKcpNoCongestion(t *testing.T) {
+	startService(t, &nw.Config{KcpHost: "127.0.0.1:22253", Timeout: 60, KcpNoCongestion: true}, newEchoEvent())
+
+	client, err := nw.NewKcpClientWithConfig("127.0.0.1:22253", &nw.KcpClientConfig{Timeout: WAIT_TIMEOUT, NoCongestion: true})
+	if err != nil {
+		t.Fatalf("new kcp client failed: %v", err)
+	}
+	defer client.Close()
+
+	// 关闭拥塞控制后发送只受窗口限制, 大量消息同样按顺序到达
+	msg := bytes.Repeat([]byte("x"), 3000)
+	for i := 0; i < 200; i++ {
+		if err := client.Write(append([]byte(fmt.Sprint(i, ":")), msg...)); err != nil {
+			t.Fatalf("write %d failed: %v", i, err)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		rsp, err := client.Read()
+		if err != nil || !bytes.HasPrefix(rsp, []byte(fmt.Sprint(i, ":"))) || len(rsp) != len(fmt.Sprint(i, ":"))+len(msg) {
+			t.Fatalf("read %d: len %d %v", i, len(rsp), err)
+		}
+	}
+}
+
+// kcpRawSegment 构造 kcp 分片: conv[4] + cmd[1] + frg[1] + wnd[2] + ts[4] + sn[4] + una[4] + len[4] + DATA
+func kcpRawSegment(conv uint32, cmd byte, sn uint32, data []byte) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, conv)
+	b = append(b, cmd, 0)
+	b = binary.LittleEndian.AppendUint16(b, 128)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, sn)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+func TestKcpSessionValidate(t *testing.T) {
+	const (
+		KCP_HOST = "127.0.0.1:22254"
+		PUSH     = 81
+		ACK      = 82
+	)
+
+	event := newEchoEvent()
+	startService(t, &nw.Config{KcpHost: KCP_HOST, Timeout: 60}, event)
+
+	conn, err := net.Dial("udp", KCP_HOST)
+	if err != nil {
+		t.Fatalf("dial udp failed: %v", err)
+	}
+	defer conn.Close()
+
+	// 格式错误或不包含首个数据分片的数据报不创建会话
+	invalid := map[string][]byte{
+		"garbage":       bytes.Repeat([]byte{0xff}, 32),
+		"bad cmd":       kcpRawSegment(1, 99, 0, nil),
+		"short data":    kcpRawSegment(1, PUSH, 0, []byte("hello"))[:30],
+		"mixed conv":    append(kcpRawSegment(1, ACK, 0, nil), kcpRawSegment(2, PUSH, 0, []byte("x"))...),
+		"ack only":      kcpRawSegment(1, ACK, 0, nil),
+		"late fragment": kcpRawSegment(1, PUSH, 5, []byte("x")),
+	}
+	for name, data := range invalid {
+		conn.Write(data)
+		time.Sleep(20 * time.Millisecond)
+		select {
+		case <-event.connected:
+			t.Fatalf("%s created a session", name)
+		default:
+		}
+	}
+
+	conn.Write(kcpRawSegment(1, PUSH, 0, []byte("hello")))
+	id := receive(t, event.connected, "session").ID()
+
+	// 同一地址的其他会话的无效数据报不关闭已有会话
+	for _, data := range [][]byte{kcpRawSegment(2, 99, 0, nil), kcpRawSegment(2, ACK, 0, nil), kcpRawSegment(2, PUSH, 3, []byte("x"))} {
+		conn.Write(data)
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case got := <-event.disconnected:
+		t.Fatalf("session %d closed by invalid datagram", got)
+	default:
+	}
+
+	// 新会话的首个数据分片替换旧会话
+	conn.Write(kcpRawSegment(2, PUSH, 0, []byte("again")))
+	if got := receive(t, event.disconnected, "replaced"); got != id {
+		t.Fatalf("disconnected %d, want %d", got, id)
+	}
+	if cctx := receive(t, event.connected, "new session"); cctx.ID() == id {
+		t.Fatalf("new session reused id %d", id)
+	}
+}
+
+// lossyRelay 在客户端和服务端之间转发数据报, 每个方向丢弃第 8n 个数据报, 并将第 7n 个数据报推迟到下一个之后发送
+type lossyRelay struct {
+	mtx     sync.Mutex
+	dropped int
+}
+
+// startLossyRelay 监听 host 并转发到 target
+func startLossyRelay(t *testing.T, host, target string) *lossyRelay {
+	t.Helper()
+
+	laddr, _ := net.ResolveUDPAddr("udp", host)
+	front, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatalf("listen relay failed: %v", err)
+	}
+
+	back, err := net.Dial("udp", target)
+	if err != nil {
+		front.Close()
+		t.Fatalf("dial target failed: %v", err)
+	}
+
+	var (
+		relay  = &lossyRelay{}
+		client atomic.Pointer[net.UDPAddr]
+		wg     sync.WaitGroup
+	)
+
+	// forward 从 read 读取数据报, 按规则丢弃或乱序后交给 write
+	forward := func(read func([]byte) (int, error), write func([]byte)) {
+		defer wg.Done()
+
+		var (
+			buf  = make([]byte, nw.UDP_MESSAGE_MAX_SIZE)
+			held []byte
+		)
+		for i := 1; ; i++ {
+			n, err := read(buf)
+			if err != nil {
+				return
+			}
+
+			switch {
+			case i%8 == 0:
+				relay.mtx.Lock()
+				relay.dropped++
+				relay.mtx.Unlock()
+			case i%7 == 0 && held == nil:
+				held = append([]byte(nil), buf[:n]...)
+			default:
+				write(buf[:n])
+				if held != nil {
+					write(held)
+					held = nil
+				}
+			}
+		}
+	}
+
+	wg.Add(2)
+	go forward(func(b []byte) (int, error) {
+		n, addr, err := front.ReadFromUDP(b)
+		if err == nil {
+			client.Store(addr)
+		}
+		return n, err
+	}, func(b []byte) { back.Write(b) })
+	go forward(back.Read, func(b []byte) {
+		if addr := client.Load(); addr != nil {
+			front.WriteToUDP(b, addr)
+		}
+	})
+
+	t.Cleanup(func() {
+		front.Close()
+		back.Close()
+		wg.Wait()
+	})
+
+	return relay
+}
+
+func (this_ *lossyRelay) droppedCount() int {
+	this_.mtx.Lock()
+	defer this_.mtx.Unlock()
+	return this_.dropped
+}
+
+func TestKcpLossyLink(t *testing.T) {
+	cases := []struct {
+		name       string
+		relay, svc string
+		nc         bool
+	}{
+		{"congestion", "127.0.0.1:22255", "127.0.0.1:22256", false},
+		{"no congestion", "127.0.0.1:22257", "127.0.0.1:22258", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			startService(t, &nw.Config{KcpHost: c.svc, Timeout: 60, KcpNoCongestion: c.nc}, newEchoEvent())
+			relay := startLossyRelay(t, c.relay, c.svc)
+
+			client, err := nw.NewKcpClientWithConfig(c.relay, &nw.KcpClientConfig{Timeout: WAIT_TIMEOUT, NoCongestion: c.nc})
+			if err != nil {
+				t.Fatalf("new kcp client failed: %v", err)
+			}
+			defer client.Close()
+
+			// 丢失和乱序的分片经重传后按顺序交付, 包括跨多个分片的消息
+			const COUNT = 100
+			msg := func(i int) []byte {
+				return bytes.Repeat([]byte(fmt.Sprint(i, ",")), 1+i*i%600)
+			}
+			for i := 0; i < COUNT; i++ {
+				if err := client.Write(msg(i)); err != nil {
+					t.Fatalf("write %d failed: %v", i, err)
+				}
+			}
+			for i := 0; i < COUNT; i++ {
+				rsp, err := client.Read()
+				if err != nil || !bytes.Equal(rsp, msg(i)) {
+					t.Fatalf("read %d: len %d, want %d, err %v", i, len(rsp), len(msg(i)), err)
+				}
+			}
+
+			if relay.droppedCount() == 0 {
+				t.Fatalf("relay dropped nothing")
+			}
+		})
+	}
+}
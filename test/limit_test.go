@@ -0,0 +1,175 @@
+package test
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/gox/frm/nw"
+)
+
+// remoteAddrEvent 记录收到消息的连接的客户端地址. 升级完成后才能确定 websocket 客户端的地址
+type remoteAddrEvent struct {
+	*echoEvent
+	addrs chan string
+}
+
+func (this_ *remoteAddrEvent) OnData(cctx *nw.ConnContext, data []byte) error {
+	this_.addrs <- cctx.RemoteAddr()
+	return nil
+}
+
+// expectClosed 等待服务端关闭连接
+func expectClosed(t *testing.T, conn net.Conn, what string) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(WAIT_TIMEOUT))
+	if _, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Fatalf("%s: connection not closed", what)
+	}
+}
+
+func TestLimitConnPerIP(t *testing.T) {
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{TcpHost: "127.0.0.1:22081", Timeout: 60, MaxConnPerIP: 2}, event)
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:22081")
+		if err != nil {
+			t.Fatalf("dial tcp failed: %v", err)
+		}
+		defer conn.Close()
+
+		receive(t, event.connected, "connect")
+		conns = append(conns, conn)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:22081")
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer conn.Close()
+
+	expectClosed(t, conn, "third connection")
+	if stats := svc.LimitStats(); stats.Rejected != 1 || svc.CurrConn() != 2 {
+		t.Fatalf("stats %+v conns %d", stats, svc.CurrConn())
+	}
+
+	// 关闭一个连接后可以重新建立
+	conns[0].Close()
+	receive(t, event.disconnected, "disconnect")
+
+	conn, err = net.Dial("tcp", "127.0.0.1:22081")
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer conn.Close()
+
+	receive(t, event.connected, "connect after close")
+}
+
+func TestLimitRate(t *testing.T) {
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{TcpHost: "127.0.0.1:22082", Timeout: 60, RateLimit: 5}, event)
+
+	client, err := nw.NewAsyncTCPClient("127.0.0.1:22082", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer client.Close()
+
+	// 速率以内的消息正常处理
+	for i := 0; i < 3; i++ {
+		client.Write([]byte("x"))
+		if rsp, err := client.Read(); err != nil || string(rsp) != "x" {
+			t.Fatalf("read %q: %v", rsp, err)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		client.Write([]byte("x"))
+	}
+
+	receive(t, event.disconnected, "rate limit disconnect")
+	if stats := svc.LimitStats(); stats.RateLimited != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestLimitByteRate(t *testing.T) {
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{TcpHost: "127.0.0.1:22083", Timeout: 60, ByteRateLimit: 1024}, event)
+
+	client, err := nw.NewAsyncTCPClient("127.0.0.1:22083", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer client.Close()
+
+	client.Write(make([]byte, 100))
+	if rsp, err := client.Read(); err != nil || len(rsp) != 100 {
+		t.Fatalf("read %d bytes: %v", len(rsp), err)
+	}
+
+	client.Write(make([]byte, 4096))
+	receive(t, event.disconnected, "byte rate disconnect")
+	if stats := svc.LimitStats(); stats.RateLimited != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestLimitAllowIPs(t *testing.T) {
+	svc := startService(t, &nw.Config{TcpHost: "127.0.0.1:22084", Timeout: 60, AllowIPs: []string{"10.0.0.0/8"}}, newEchoEvent())
+
+	conn, err := net.Dial("tcp", "127.0.0.1:22084")
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer conn.Close()
+
+	expectClosed(t, conn, "not allowed ip")
+	if stats := svc.LimitStats(); stats.Rejected != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestLimitTrustedProxy(t *testing.T) {
+	event := &remoteAddrEvent{echoEvent: newEchoEvent(), addrs: make(chan string, 1)}
+	svc := startService(t, &nw.Config{
+		WsHost:         "127.0.0.1:22085",
+		Timeout:        60,
+		DenyIPs:        []string{"10.1.2.3"},
+		TrustedProxies: []string{"127.0.0.0/8"},
+	}, event)
+
+	// 来自可信代理的连接使用 X-Forwarded-For 中的客户端地址
+	header := http.Header{}
+	header.Set("X-Forwarded-For", "10.1.2.3, 127.0.0.5")
+	if conn, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:22085/", header); err == nil {
+		conn.SetReadDeadline(time.Now().Add(WAIT_TIMEOUT))
+		_, _, err = conn.ReadMessage()
+		conn.Close()
+		if err == nil {
+			t.Fatalf("denied ip accepted")
+		}
+	}
+
+	if stats := svc.LimitStats(); stats.Rejected != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+
+	header.Set("X-Forwarded-For", "10.9.9.9")
+	conn, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:22085/", header)
+	if err != nil {
+		t.Fatalf("dial ws failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.BinaryMessage, []byte("addr"))
+	if addr := receive(t, event.addrs, "remote addr"); addr != "10.9.9.9" {
+		t.Fatalf("remote addr %s", addr)
+	}
+}
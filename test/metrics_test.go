@@ -0,0 +1,250 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+	"github.com/gox/frm/web"
+)
+
+// missingMetrics 返回 text 中缺少的指标行
+func missingMetrics(text string, wants []string) []string {
+	var missing []string
+	for _, want := range wants {
+		if !strings.Contains(text, want+"\n") {
+			missing = append(missing, want)
+		}
+	}
+
+	return missing
+}
+
+// fetchMetrics 从管理接口获取指标
+func fetchMetrics(t *testing.T, url string) string {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("get metrics failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read metrics failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("metrics status %d content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	return string(body)
+}
+
+func TestMetricsPrometheus(t *testing.T) {
+	m := nw.NewMetrics()
+	m.OnAccept(nw.Protocol_TCP)
+	m.OnAccept(nw.Protocol_TCP)
+	m.OnRead(nw.Protocol_TCP, 10)
+	m.OnRead(nw.Protocol_TCP, 5)
+	m.OnWrite(nw.Protocol_Websocket, 7)
+	m.OnWriteError(nw.Protocol_Websocket, errors.New("broken pipe"))
+	m.OnUpgradeFailed(nw.Protocol_Websocket, errors.New("bad origin"))
+	m.OnHandle(nw.Protocol_TCP, 200*time.Microsecond)
+	m.OnHandle(nw.Protocol_TCP, 2*time.Millisecond)
+	m.OnHandle(nw.Protocol_TCP, time.Minute)
+	// 未知协议计入 Protocol_None, 不输出
+	m.OnRead(nw.Protocol(99), 1)
+
+	var buf bytes.Buffer
+	if err := m.WritePrometheus(&buf); err != nil {
+		t.Fatalf("write prometheus failed: %v", err)
+	}
+
+	text := buf.String()
+	missing := missingMetrics(text, []string{
+		"# TYPE nw_connections_accepted_total counter",
+		`nw_connections_accepted_total{protocol="tcp"} 2`,
+		`nw_connections_accepted_total{protocol="websocket"} 0`,
+		`nw_read_bytes_total{protocol="tcp"} 15`,
+		`nw_read_frames_total{protocol="tcp"} 2`,
+		`nw_write_bytes_total{protocol="websocket"} 7`,
+		`nw_write_frames_total{protocol="websocket"} 1`,
+		`nw_write_errors_total{protocol="websocket"} 1`,
+		`nw_upgrade_failures_total{protocol="websocket"} 1`,
+		"# TYPE nw_handle_seconds histogram",
+		`nw_handle_seconds_bucket{protocol="tcp",le="0.0001"} 0`,
+		`nw_handle_seconds_bucket{protocol="tcp",le="0.0005"} 1`,
+		`nw_handle_seconds_bucket{protocol="tcp",le="0.005"} 2`,
+		`nw_handle_seconds_bucket{protocol="tcp",le="5"} 2`,
+		`nw_handle_seconds_bucket{protocol="tcp",le="+Inf"} 3`,
+		`nw_handle_seconds_count{protocol="tcp"} 3`,
+		`nw_handle_seconds_count{protocol="websocket"} 0`,
+	})
+	if len(missing) > 0 {
+		t.Fatalf("missing %q in:\n%s", missing, text)
+	}
+
+	if strings.Contains(text, `protocol="none"`) {
+		t.Fatalf("unknown protocol exported:\n%s", text)
+	}
+}
+
+func TestServiceMetrics(t *testing.T) {
+	const (
+		TCP_HOST   = "127.0.0.1:22191"
+		WS_HOST    = "127.0.0.1:22192"
+		ADMIN_HOST = "127.0.0.1:22193"
+	)
+
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{
+		TcpHost:        TCP_HOST,
+		WsHost:         WS_HOST,
+		AdminHost:      ADMIN_HOST,
+		Timeout:        60,
+		WsAllowOrigins: []string{"https://ok.com"},
+	}, event)
+
+	if _, ok := svc.Metrics().(*nw.Metrics); !ok {
+		t.Fatalf("metrics %T with admin host", svc.Metrics())
+	}
+
+	tcp, err := nw.NewAsyncTCPClient(TCP_HOST, WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer tcp.Close()
+
+	for i := 0; i < 10; i++ {
+		tcp.Write([]byte("hello"))
+		if msg, err := tcp.Read(); err != nil || string(msg) != "hello" {
+			t.Fatalf("tcp echo %q: %v", msg, err)
+		}
+	}
+
+	ws, err := nw.NewWsClient(WS_HOST, WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial ws failed: %v", err)
+	}
+	defer ws.Close()
+
+	ws.Write([]byte("x"))
+	if msg, err := ws.Read(); err != nil || string(msg) != "x" {
+		t.Fatalf("ws echo %q: %v", msg, err)
+	}
+
+	// 不允许的 origin, 升级失败
+	req, _ := http.NewRequest(http.MethodGet, "http://"+WS_HOST+"/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Origin", "https://bad.com")
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+
+	// 默认编解码器的帧头 4 字节, 每帧 9 字节. 处理耗时在回显之后记录, 等待计数完成
+	wants := []string{
+		`nw_connections{protocol="tcp"} 1`,
+		`nw_connections{protocol="websocket"} 1`,
+		`nw_connections_accepted_total{protocol="tcp"} 1`,
+		`nw_connections_accepted_total{protocol="websocket"} 2`,
+		`nw_read_frames_total{protocol="tcp"} 10`,
+		`nw_read_bytes_total{protocol="tcp"} 90`,
+		`nw_write_frames_total{protocol="tcp"} 10`,
+		`nw_write_bytes_total{protocol="tcp"} 90`,
+		`nw_handle_seconds_count{protocol="tcp"} 10`,
+		`nw_handle_seconds_bucket{protocol="tcp",le="+Inf"} 10`,
+		`nw_handle_seconds_count{protocol="websocket"} 1`,
+		`nw_upgrade_failures_total{protocol="websocket"} 1`,
+		`nw_write_errors_total{protocol="tcp"} 0`,
+		"nw_queue_depth 0",
+		"nw_connections_rejected_total 0",
+	}
+
+	var text string
+	deadline := time.Now().Add(WAIT_TIMEOUT)
+	for {
+		text = fetchMetrics(t, "http://"+ADMIN_HOST+"/metrics")
+		missing := missingMetrics(text, wants)
+		if len(missing) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("missing %q in:\n%s", missing, text)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// 挂载到 web.Server 的路由上输出相同的指标
+	server, err := web.NewServer("127.0.0.1:0", true, false)
+	if err != nil {
+		t.Fatalf("new web server failed: %v", err)
+	}
+	server.Mount("/debug/metrics", svc.MetricsHandler())
+
+	rec := httptest.NewRecorder()
+	server.Router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/metrics", nil))
+	if missing := missingMetrics(rec.Body.String(), wants[:2]); rec.Code != http.StatusOK || len(missing) > 0 {
+		t.Fatalf("mounted metrics status %d missing %q", rec.Code, missing)
+	}
+
+	// 服务停止后管理接口关闭
+	svc.Stop()
+	if resp, err := http.Get("http://" + ADMIN_HOST + "/metrics"); err == nil {
+		resp.Body.Close()
+		t.Fatalf("admin listener still up after stop")
+	}
+}
+
+// countMetrics 只记录连接数的指标采集
+type countMetrics struct {
+	accepted chan nw.Protocol
+}
+
+func (this_ *countMetrics) OnAccept(proto nw.Protocol) { this_.accepted <- proto }
+
+func (this_ *countMetrics) OnRead(nw.Protocol, int)             {}
+func (this_ *countMetrics) OnWrite(nw.Protocol, int)            {}
+func (this_ *countMetrics) OnWriteError(nw.Protocol, error)     {}
+func (this_ *countMetrics) OnHandle(nw.Protocol, time.Duration) {}
+func (this_ *countMetrics) OnUpgradeFailed(nw.Protocol, error)  {}
+
+func TestServiceCustomMetrics(t *testing.T) {
+	m := &countMetrics{accepted: make(chan nw.Protocol, 4)}
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{TcpHost: "127.0.0.1:22194", Timeout: 60, Metrics: m}, event)
+
+	if svc.Metrics() != m {
+		t.Fatalf("metrics %T, want custom", svc.Metrics())
+	}
+
+	client, err := nw.NewAsyncTCPClient("127.0.0.1:22194", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer client.Close()
+
+	if proto := receive(t, m.accepted, "accept"); proto != nw.Protocol_TCP {
+		t.Fatalf("accepted %v", proto)
+	}
+	receive(t, event.connected, "connect")
+
+	// 自定义的采集没有实现 IPrometheusWriter 时只输出服务自身的指标
+	var buf bytes.Buffer
+	if err := svc.WriteMetrics(&buf); err != nil {
+		t.Fatalf("write metrics failed: %v", err)
+	}
+	if text := buf.String(); strings.Contains(text, "nw_read_frames_total") || len(missingMetrics(text, []string{`nw_connections{protocol="tcp"} 1`})) > 0 {
+		t.Fatalf("metrics:\n%s", text)
+	}
+}
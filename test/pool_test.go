@@ -0,0 +1,192 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+// poolRecorder 记录连接池每个客户端收到的消息
+type poolRecorder struct {
+	mtx  sync.Mutex
+	msgs map[*nw.AsyncTCPClient][]string
+	done chan struct{}
+}
+
+func newPoolRecorder() *poolRecorder {
+	return &poolRecorder{
+		msgs: make(map[*nw.AsyncTCPClient][]string),
+		done: make(chan struct{}, 1024),
+	}
+}
+
+func (this_ *poolRecorder) onMessage(c *nw.AsyncTCPClient, msg []byte) {
+	this_.mtx.Lock()
+	this_.msgs[c] = append(this_.msgs[c], string(msg))
+	this_.mtx.Unlock()
+	this_.done <- struct{}{}
+}
+
+// wait 等待收到 n 条消息
+func (this_ *poolRecorder) wait(t *testing.T, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		receive(t, this_.done, fmt.Sprintf("pool message %d", i))
+	}
+}
+
+func TestTCPClientPoolHandler(t *testing.T) {
+	if _, err := nw.NewTCPClientPool("127.0.0.1:22181", 2, nw.PoolBalance_RoundRobin, &nw.TCPClientConfig{}); !errors.Is(err, nw.ErrPoolHandler) {
+		t.Fatalf("pool without OnMessage: %v", err)
+	}
+
+	// 任一连接失败时返回错误
+	if _, err := nw.NewTCPClientPool("127.0.0.1:22181", 2, nw.PoolBalance_RoundRobin, &nw.TCPClientConfig{
+		Timeout:   time.Second,
+		OnMessage: func(*nw.AsyncTCPClient, []byte) {},
+	}); err == nil {
+		t.Fatalf("pool to closed port succeeded")
+	}
+}
+
+func TestTCPClientPoolRoundRobin(t *testing.T) {
+	const (
+		SIZE  = 4
+		COUNT = 400
+	)
+
+	startService(t, &nw.Config{TcpHost: "127.0.0.1:22182", Timeout: 60, TcpCompress: nw.CompressType_Zstd, TcpCompressThreshold: 16}, newEchoEvent())
+
+	rec := newPoolRecorder()
+	pool, err := nw.NewTCPClientPool("127.0.0.1:22182", SIZE, nw.PoolBalance_RoundRobin, &nw.TCPClientConfig{
+		Timeout:           WAIT_TIMEOUT,
+		Compress:          nw.CompressType_Zstd,
+		CompressThreshold: 16,
+		OnMessage:         rec.onMessage,
+	})
+	if err != nil {
+		t.Fatalf("new pool failed: %v", err)
+	}
+	defer pool.Close()
+
+	if pool.Size() != SIZE || len(pool.Clients()) != SIZE {
+		t.Fatalf("pool size %d clients %d", pool.Size(), len(pool.Clients()))
+	}
+
+	for i := 0; i < COUNT; i++ {
+		if err := pool.Write([]byte(fmt.Sprintf("round-robin-message-%d", i))); err != nil {
+			t.Fatalf("write %d failed: %v", i, err)
+		}
+	}
+	rec.wait(t, COUNT)
+
+	// 所有连接都正常时依次轮流, 每个连接分到相同数量的消息, 同一连接的回调按发送顺序调用
+	rec.mtx.Lock()
+	defer rec.mtx.Unlock()
+	if len(rec.msgs) != SIZE {
+		t.Fatalf("messages on %d clients, want %d", len(rec.msgs), SIZE)
+	}
+
+	seen := make(map[string]bool, COUNT)
+	for _, client := range pool.Clients() {
+		msgs := rec.msgs[client]
+		if len(msgs) != COUNT/SIZE {
+			t.Fatalf("client received %d messages, want %d", len(msgs), COUNT/SIZE)
+		}
+
+		for i, msg := range msgs {
+			seen[msg] = true
+			if i > 0 {
+				var prev, curr int
+				fmt.Sscanf(msgs[i-1], "round-robin-message-%d", &prev)
+				fmt.Sscanf(msg, "round-robin-message-%d", &curr)
+				if curr != prev+SIZE {
+					t.Fatalf("client received %q after %q", msg, msgs[i-1])
+				}
+			}
+		}
+	}
+
+	if len(seen) != COUNT {
+		t.Fatalf("%d distinct messages, want %d", len(seen), COUNT)
+	}
+
+	stats := pool.Stats()
+	if stats.FramesOut < COUNT || stats.FramesIn < COUNT || stats.BytesOut == 0 || stats.BytesIn == 0 {
+		t.Fatalf("pool stats %+v", stats)
+	}
+
+	var sum nw.TCPClientStats
+	for _, client := range pool.Clients() {
+		s := client.Stats()
+		sum.FramesOut += s.FramesOut
+		sum.BytesIn += s.BytesIn
+	}
+	if sum.FramesOut != stats.FramesOut || sum.BytesIn != stats.BytesIn {
+		t.Fatalf("pool stats %+v, sum of clients %+v", stats, sum)
+	}
+}
+
+func TestTCPClientPoolSkipClosed(t *testing.T) {
+	event := newEchoEvent()
+	startService(t, &nw.Config{TcpHost: "127.0.0.1:22183", Timeout: 60}, event)
+
+	for _, balance := range []nw.PoolBalance{nw.PoolBalance_RoundRobin, nw.PoolBalance_LeastPending} {
+		rec := newPoolRecorder()
+		pool, err := nw.NewTCPClientPool("127.0.0.1:22183", 3, balance, &nw.TCPClientConfig{
+			Timeout:   WAIT_TIMEOUT,
+			OnMessage: rec.onMessage,
+		})
+		if err != nil {
+			t.Fatalf("%v: new pool failed: %v", balance, err)
+		}
+
+		// 关闭的连接不再被选择
+		closed := pool.Clients()[1]
+		closed.Close()
+		for i := 0; i < 30; i++ {
+			if client := pool.Pick(); client == nil || client == closed {
+				t.Fatalf("%v: picked closed client", balance)
+			}
+		}
+
+		for i := 0; i < 30; i++ {
+			if err := pool.Write([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+				t.Fatalf("%v: write %d failed: %v", balance, i, err)
+			}
+		}
+		rec.wait(t, 30)
+
+		rec.mtx.Lock()
+		if len(rec.msgs[closed]) != 0 || len(rec.msgs[pool.Clients()[0]])+len(rec.msgs[pool.Clients()[2]]) != 30 {
+			t.Fatalf("%v: messages per client %d/%d/%d", balance,
+				len(rec.msgs[pool.Clients()[0]]), len(rec.msgs[closed]), len(rec.msgs[pool.Clients()[2]]))
+		}
+		rec.mtx.Unlock()
+
+		// 所有连接关闭后写入失败
+		pool.Close()
+		pool.Close()
+		if pool.Pick() != nil {
+			t.Fatalf("%v: pick after close", balance)
+		}
+		if err := pool.Write([]byte("x")); !errors.Is(err, nw.ErrPoolClosed) {
+			t.Fatalf("%v: write after close: %v", balance, err)
+		}
+
+		for i := 0; i < 3; i++ {
+			receive(t, event.disconnected, "pool disconnect")
+		}
+	}
+}
+
+func TestPoolBalanceString(t *testing.T) {
+	if nw.PoolBalance_RoundRobin.String() != "round_robin" || nw.PoolBalance_LeastPending.String() != "least_pending" || nw.PoolBalance(9).String() != "unknown" {
+		t.Fatalf("pool balance names %v %v %v", nw.PoolBalance_RoundRobin, nw.PoolBalance_LeastPending, nw.PoolBalance(9))
+	}
+}
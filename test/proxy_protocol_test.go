@@ -0,0 +1,233 @@
+package test
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/gox/frm/nw"
+)
+
+// proxyAddrEvent 记录连接建立时的客户端地址和负载均衡器地址
+type proxyAddrEvent struct {
+	*echoEvent
+	addrs chan [2]string
+}
+
+func newProxyAddrEvent() *proxyAddrEvent {
+	return &proxyAddrEvent{echoEvent: newEchoEvent(), addrs: make(chan [2]string, 16)}
+}
+
+func (this_ *proxyAddrEvent) OnConnected(cctx *nw.ConnContext) error {
+	this_.addrs <- [2]string{cctx.RemoteAddr(), cctx.ProxyAddr()}
+	return nil
+}
+
+// proxyV2Header 构造 v2 头
+//   - cmd: 0 为 LOCAL, 1 为 PROXY
+//   - fam: 地址族和传输协议
+//   - body: 地址和 TLV
+func proxyV2Header(cmd, fam byte, body []byte) []byte {
+	h := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	h = append(h, 0x20|cmd, fam)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(body)))
+	return append(h, body...)
+}
+
+// proxyV2Addr v2 头的地址部分: 源地址, 目的地址, 源端口, 目的端口
+func proxyV2Addr(src, dst string, sport, dport uint16) []byte {
+	s, d := net.ParseIP(src), net.ParseIP(dst)
+	if s4 := s.To4(); s4 != nil {
+		s, d = s4, d.To4()
+	}
+
+	body := append(append([]byte(nil), s...), d...)
+	body = binary.BigEndian.AppendUint16(body, sport)
+	return binary.BigEndian.AppendUint16(body, dport)
+}
+
+// dialProxy 连接服务并发送 PROXY 头, 头分两次写出以验证不完整的头
+func dialProxy(t *testing.T, host string, header []byte) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.Write(header[:len(header)/2])
+	time.Sleep(20 * time.Millisecond)
+	conn.Write(header[len(header)/2:])
+	return conn
+}
+
+func TestProxyProtocolTcp(t *testing.T) {
+	const TCP_HOST = "127.0.0.1:22211"
+
+	event := newProxyAddrEvent()
+	startService(t, &nw.Config{TcpHost: TCP_HOST, Timeout: 60, ProxyProtocol: []string{"127.0.0.1/32"}}, event)
+
+	cases := []struct {
+		name   string
+		header []byte
+		addr   string // 为空时保留套接字的对端地址
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.7 10.0.0.1 5555 22211\r\n"), "192.0.2.7:5555"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::9 2001:db8::1 6000 443\r\n"), "[2001:db8::9]:6000"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2 ipv4", proxyV2Header(1, 0x11, proxyV2Addr("198.51.100.3", "10.0.0.1", 7000, 443)), "198.51.100.3:7000"},
+		{"v2 ipv6 tlv", proxyV2Header(1, 0x21, append(proxyV2Addr("2001:db8::1", "2001:db8::2", 4444, 443), 0x04, 0, 2, 'a', 'b')), "[2001:db8::1]:4444"},
+		{"v2 local", proxyV2Header(0, 0x00, nil), ""},
+		{"v2 unspec", proxyV2Header(1, 0x00, nil), ""},
+	}
+
+	for _, c := range cases {
+		conn := dialProxy(t, TCP_HOST, c.header)
+
+		addrs := receive(t, event.addrs, c.name+" connect")
+		if len(c.addr) > 0 {
+			if addrs[0] != c.addr || addrs[1] != conn.LocalAddr().String() {
+				t.Fatalf("%s: remote %q proxy %q, want %q %q", c.name, addrs[0], addrs[1], c.addr, conn.LocalAddr())
+			}
+		} else if addrs[0] != conn.LocalAddr().String() || len(addrs[1]) > 0 {
+			t.Fatalf("%s: remote %q proxy %q, want socket address %q", c.name, addrs[0], addrs[1], conn.LocalAddr())
+		}
+
+		// 头之后的数据按帧解析
+		writeTcpFrame(conn, []byte("ping"))
+		if body := readTcpFrame(t, conn); string(body) != "ping" {
+			t.Fatalf("%s: echo %q", c.name, body)
+		}
+		conn.Close()
+	}
+
+	// 头和第一帧在同一次写入中
+	conn, err := net.Dial("tcp", TCP_HOST)
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write(append([]byte("PROXY TCP4 192.0.2.8 10.0.0.1 1234 22211\r\n"), 0, 0, 0, 4, 'p', 'o', 'n', 'g'))
+	if addrs := receive(t, event.addrs, "coalesced connect"); addrs[0] != "192.0.2.8:1234" {
+		t.Fatalf("coalesced remote %q", addrs[0])
+	}
+	if body := readTcpFrame(t, conn); string(body) != "pong" {
+		t.Fatalf("coalesced echo %q", body)
+	}
+}
+
+func TestProxyProtocolReject(t *testing.T) {
+	const TCP_HOST = "127.0.0.1:22212"
+
+	event := newProxyAddrEvent()
+	startService(t, &nw.Config{TcpHost: TCP_HOST, Timeout: 60, ProxyProtocol: []string{"127.0.0.1"}, DenyIPs: []string{"10.9.9.9"}}, event)
+
+	cases := []struct {
+		name   string
+		header []byte
+	}{
+		{"missing header", []byte{0, 0, 0, 4, 'p', 'i', 'n', 'g'}},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n")},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.7 10.0.0.1 70000 2\r\n")},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", nw.PROXY_V1_MAX_SIZE))},
+		{"v2 bad version", append(proxyV2Header(1, 0x11, proxyV2Addr("192.0.2.7", "10.0.0.1", 1, 2))[:12], 0x11, 0x11, 0, 0)},
+		{"v2 short address", proxyV2Header(1, 0x11, []byte{192, 0, 2, 7})},
+		{"denied client", []byte("PROXY TCP4 10.9.9.9 10.0.0.1 1 2\r\n")},
+	}
+
+	for _, c := range cases {
+		conn := dialProxy(t, TCP_HOST, c.header)
+		expectClosed(t, conn, c.name)
+	}
+
+	// 被拒绝的连接不触发 OnConnected
+	select {
+	case addrs := <-event.addrs:
+		t.Fatalf("rejected connection connected: %v", addrs)
+	default:
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	const TCP_HOST = "127.0.0.1:22213"
+
+	event := newProxyAddrEvent()
+	startService(t, &nw.Config{TcpHost: TCP_HOST, Timeout: 60, ProxyProtocol: []string{"10.0.0.0/8"}}, event)
+
+	// 不是来自可信来源的连接不解析 PROXY 头
+	conn, err := net.Dial("tcp", TCP_HOST)
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	defer conn.Close()
+
+	if addrs := receive(t, event.addrs, "connect"); addrs[0] != conn.LocalAddr().String() || len(addrs[1]) > 0 {
+		t.Fatalf("remote %q proxy %q, want socket address %q", addrs[0], addrs[1], conn.LocalAddr())
+	}
+
+	writeTcpFrame(conn, []byte("ping"))
+	if body := readTcpFrame(t, conn); string(body) != "ping" {
+		t.Fatalf("echo %q", body)
+	}
+}
+
+func TestProxyProtocolWs(t *testing.T) {
+	const WS_HOST = "127.0.0.1:22214"
+
+	event := newProxyAddrEvent()
+	startService(t, &nw.Config{WsHost: WS_HOST, Timeout: 60, ProxyProtocol: []string{"127.0.0.1"}}, event)
+
+	// 头在 http 升级请求之前
+	header := proxyV2Header(1, 0x21, proxyV2Addr("2001:db8::1", "2001:db8::2", 4444, 443))
+	conn := dialProxy(t, WS_HOST, header)
+
+	u, _ := url.Parse("ws://" + WS_HOST + "/ws")
+	if _, _, err := (ws.Dialer{}).Upgrade(conn, u); err != nil {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+
+	if addrs := receive(t, event.addrs, "ws connect"); addrs[0] != "[2001:db8::1]:4444" || addrs[1] != conn.LocalAddr().String() {
+		t.Fatalf("remote %q proxy %q", addrs[0], addrs[1])
+	}
+
+	conn.SetDeadline(time.Now().Add(WAIT_TIMEOUT))
+	if err := wsutil.WriteClientBinary(conn, []byte("x")); err != nil {
+		t.Fatalf("ws write failed: %v", err)
+	}
+	if msg, err := wsutil.ReadServerBinary(conn); err != nil || string(msg) != "x" {
+		t.Fatalf("ws echo %q: %v", msg, err)
+	}
+}
+
+func TestProxyProtocolTls(t *testing.T) {
+	const TCP_HOST = "127.0.0.1:22215"
+
+	certFile, keyFile, cert := writeCert(t, t.TempDir(), 1)
+	event := newProxyAddrEvent()
+	startService(t, &nw.Config{TcpHost: TCP_HOST, Timeout: 60, TlsCert: certFile, TlsKey: keyFile, ProxyProtocol: []string{"127.0.0.1"}}, event)
+
+	// 头在 tls 握手之前
+	conn := dialProxy(t, TCP_HOST, []byte("PROXY TCP6 2001:db8::9 2001:db8::1 6000 443\r\n"))
+	tc := tls.Client(conn, &tls.Config{RootCAs: certPool(cert), ServerName: "127.0.0.1"})
+	tc.SetDeadline(time.Now().Add(WAIT_TIMEOUT))
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("tls handshake failed: %v", err)
+	}
+
+	if addrs := receive(t, event.addrs, "tls connect"); addrs[0] != "[2001:db8::9]:6000" || addrs[1] != conn.LocalAddr().String() {
+		t.Fatalf("remote %q proxy %q", addrs[0], addrs[1])
+	}
+
+	writeTcpFrame(tc, []byte("secure"))
+	if body := readTcpFrame(t, tc); string(body) != "secure" {
+		t.Fatalf("tls echo %q", body)
+	}
+}
@@ -0,0 +1,289 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+// cutProxy tcp 转发, 可以切断所有连接和拒绝新连接, 模拟网络中断
+type cutProxy struct {
+	ln     net.Listener
+	mtx    sync.Mutex
+	conns  []net.Conn
+	refuse atomic.Bool
+}
+
+func newCutProxy(t *testing.T, target string) *cutProxy {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	p := &cutProxy{ln: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		p.cut()
+	})
+
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			if p.refuse.Load() {
+				client.Close()
+				continue
+			}
+
+			server, err := net.Dial("tcp", target)
+			if err != nil {
+				client.Close()
+				continue
+			}
+
+			p.mtx.Lock()
+			p.conns = append(p.conns, client, server)
+			p.mtx.Unlock()
+
+			go func() {
+				io.Copy(server, client)
+				server.Close()
+				client.Close()
+			}()
+			go func() {
+				io.Copy(client, server)
+				server.Close()
+				client.Close()
+			}()
+		}
+	}()
+
+	return p
+}
+
+func (this_ *cutProxy) addr() string {
+	return this_.ln.Addr().String()
+}
+
+// cut 切断已建立的连接
+func (this_ *cutProxy) cut() {
+	this_.mtx.Lock()
+	for _, c := range this_.conns {
+		c.Close()
+	}
+	this_.conns = nil
+	this_.mtx.Unlock()
+}
+
+// resumeEvent 连接建立时设置用户数据并加入分组, 记录会话恢复
+type resumeEvent struct {
+	*echoEvent
+	svc     *nw.Service
+	resumed chan string // 连接ID:用户数据
+}
+
+func (this_ *resumeEvent) OnInit(svc *nw.Service) error {
+	this_.svc = svc
+	return nil
+}
+
+func (this_ *resumeEvent) OnConnected(cctx *nw.ConnContext) error {
+	cctx.SetUserData("ud")
+	this_.svc.Join("room", cctx)
+	return this_.echoEvent.OnConnected(cctx)
+}
+
+func (this_ *resumeEvent) OnResumed(cctx *nw.ConnContext) {
+	this_.resumed <- fmt.Sprint(cctx.ID(), ":", cctx.UserData())
+}
+
+// resumeClient 统一 tcp 和 websocket 客户端
+type resumeClient interface {
+	write([]byte) error
+	read() ([]byte, error)
+	Close() error
+}
+
+type tcpResumeClient struct{ *nw.AsyncTCPClient }
+
+func (this_ tcpResumeClient) write(data []byte) error { return this_.Write(data) }
+func (this_ tcpResumeClient) read() ([]byte, error)   { return this_.Read() }
+
+type wsResumeClient struct{ *nw.WsClient }
+
+func (this_ wsResumeClient) write(data []byte) error {
+	_, err := this_.Write(data)
+	return err
+}
+func (this_ wsResumeClient) read() ([]byte, error) { return this_.Read() }
+
+// expectRead 在超时时间内读到 want
+func expectRead(t *testing.T, c resumeClient, want string) {
+	t.Helper()
+
+	ch := make(chan string, 1)
+	go func() {
+		data, err := c.read()
+		if err != nil {
+			ch <- "error: " + err.Error()
+			return
+		}
+		ch <- string(data)
+	}()
+
+	if got := receive(t, ch, "read "+want); got != want {
+		t.Fatalf("read %q, want %q", got, want)
+	}
+}
+
+// waitEvent 等待重连回调 want, 跳过其他回调
+func waitEvent(t *testing.T, events chan string, want string) {
+	t.Helper()
+
+	for {
+		if ev := receive(t, events, want); ev == want {
+			return
+		}
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	const TCP_HOST, WS_HOST = "127.0.0.1:22171", "127.0.0.1:22172"
+
+	event := &resumeEvent{echoEvent: newEchoEvent(), resumed: make(chan string, 8)}
+	svc := startService(t, &nw.Config{TcpHost: TCP_HOST, WsHost: WS_HOST, Resume: true, ResumeTimeout: 2, Timeout: 60, TcpEncrypt: true}, event)
+
+	for _, proto := range []string{"tcp", "ws"} {
+		target := TCP_HOST
+		if proto == "ws" {
+			target = WS_HOST
+		}
+
+		px := newCutProxy(t, target)
+		events := make(chan string, 64)
+		rc := &nw.ReconnectConfig{
+			MinDelay:     50 * time.Millisecond,
+			MaxDelay:     200 * time.Millisecond,
+			Resume:       true,
+			OnConnect:    func(resumed bool) { events <- fmt.Sprint("connect ", resumed) },
+			OnDisconnect: func(err error) { events <- "disconnect" },
+		}
+
+		var client resumeClient
+		if proto == "tcp" {
+			c, err := nw.NewAsyncTCPClientWithConfig(px.addr(), &nw.TCPClientConfig{Timeout: WAIT_TIMEOUT, Cipher: nw.CipherType_AesGcm, Reconnect: rc})
+			if err != nil {
+				t.Fatalf("%s: new client failed: %v", proto, err)
+			}
+			client = tcpResumeClient{c}
+		} else {
+			c, err := nw.NewWsClientWithConfig(px.addr(), &nw.WsClientConfig{Timeout: WAIT_TIMEOUT, Reconnect: rc})
+			if err != nil {
+				t.Fatalf("%s: new client failed: %v", proto, err)
+			}
+			client = wsResumeClient{c}
+		}
+
+		id := receive(t, event.connected, "connect").ID()
+		for i := 0; i < 50; i++ {
+			client.write([]byte(fmt.Sprint("m", i)))
+		}
+		for i := 0; i < 50; i++ {
+			expectRead(t, client, fmt.Sprint("m", i))
+		}
+
+		// 切断连接后会话保留, 断开期间双方写入的消息在恢复后送达
+		px.cut()
+		if err := svc.Write(id, []byte("during")); err != nil {
+			t.Fatalf("%s: write detached session: %v", proto, err)
+		}
+		if n := svc.SendGroup("room", []byte("group")); n != 1 {
+			t.Fatalf("%s: send group to %d conns", proto, n)
+		}
+		client.write([]byte("after"))
+
+		if got := receive(t, event.resumed, proto+" resume"); got != fmt.Sprint(id, ":ud") {
+			t.Fatalf("%s: resumed %s, want %d:ud", proto, got, id)
+		}
+		expectRead(t, client, "during")
+		expectRead(t, client, "group")
+		expectRead(t, client, "after")
+		waitEvent(t, events, "connect true")
+
+		select {
+		case got := <-event.disconnected:
+			t.Fatalf("%s: session %d ended while resuming", proto, got)
+		default:
+		}
+
+		// 超过保留时间后会话结束, 重连建立新会话
+		px.refuse.Store(true)
+		px.cut()
+		if got := receive(t, event.disconnected, "session expire"); got != id {
+			t.Fatalf("%s: expired %d, want %d", proto, got, id)
+		}
+		px.refuse.Store(false)
+
+		if nid := receive(t, event.connected, "new session").ID(); nid == id {
+			t.Fatalf("%s: new session reused id %d", proto, id)
+		}
+		waitEvent(t, events, "connect false")
+		client.write([]byte("fresh"))
+		expectRead(t, client, "fresh")
+
+		// 客户端主动关闭时会话立即结束
+		client.Close()
+		receive(t, event.disconnected, "close")
+	}
+}
+
+func TestReconnectGiveUp(t *testing.T) {
+	event := &resumeEvent{echoEvent: newEchoEvent(), resumed: make(chan string, 8)}
+	startService(t, &nw.Config{TcpHost: "127.0.0.1:22173", Resume: true, ResumeTimeout: 1, Timeout: 60}, event)
+
+	px := newCutProxy(t, "127.0.0.1:22173")
+	client, err := nw.NewAsyncTCPClientWithConfig(px.addr(), &nw.TCPClientConfig{
+		Timeout:   WAIT_TIMEOUT,
+		Reconnect: &nw.ReconnectConfig{Resume: true, MaxRetries: 2, MinDelay: 100 * time.Millisecond, QueueSize: 2},
+	})
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer client.Close()
+	receive(t, event.connected, "connect")
+
+	// 重连期间的写入排队, 超过上限时返回错误
+	px.refuse.Store(true)
+	px.cut()
+	waitFor(t, "reconnecting", client.Reconnecting)
+	for i := 0; i < 2; i++ {
+		if err := client.Write([]byte("queued")); err != nil {
+			t.Fatalf("queued write %d failed: %v", i, err)
+		}
+	}
+	if err := client.Write([]byte("overflow")); !errors.Is(err, nw.ErrReconnectQueueFull) {
+		t.Fatalf("overflow write: %v", err)
+	}
+
+	// 重连次数用尽后客户端关闭
+	if _, err := client.Read(); err == nil {
+		t.Fatalf("read after give up: %v", err)
+	}
+	if err := client.Write([]byte("x")); err == nil || !client.Closed() {
+		t.Fatalf("write after give up: %v", err)
+	}
+
+	receive(t, event.disconnected, "session expire")
+}
@@ -0,0 +1,246 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+	"github.com/gox/frm/nw/router"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// 测试使用的命令号
+const (
+	CMD_UPPER uint32 = iota + 1
+	CMD_DELAY
+	CMD_FAIL
+	CMD_REJECT
+	CMD_WRAPPED
+	CMD_BLOCK
+	CMD_PUSH
+	CMD_UNKNOWN
+)
+
+// routerEvent 将数据交给路由处理
+type routerEvent struct {
+	*echoEvent
+	r *router.Router
+}
+
+func (this_ *routerEvent) OnData(cctx *nw.ConnContext, data []byte) error {
+	return this_.r.OnData(cctx, data)
+}
+
+// newTestRouter 注册测试命令, CMD_BLOCK 阻塞到 release 关闭
+func newTestRouter(release chan struct{}) *router.Router {
+	r := router.New()
+
+	router.Register(r, CMD_UPPER, func(ctx *router.Context, req *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+		return wrapperspb.String(strings.ToUpper(req.Value)), nil
+	})
+
+	// 延迟消息体指定的毫秒数后原样应答
+	r.Handle(CMD_DELAY, func(ctx *router.Context, body []byte) ([]byte, error) {
+		ms, _ := strconv.Atoi(string(body))
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+		return body, nil
+	})
+
+	r.Handle(CMD_FAIL, func(ctx *router.Context, body []byte) ([]byte, error) {
+		return nil, errors.New("dial db 10.0.0.5:3306: connection refused")
+	})
+
+	r.Handle(CMD_REJECT, func(ctx *router.Context, body []byte) ([]byte, error) {
+		return nil, router.Errorf("name %q taken", body)
+	})
+
+	r.Handle(CMD_WRAPPED, func(ctx *router.Context, body []byte) ([]byte, error) {
+		return nil, fmt.Errorf("check quota: %w", &router.Error{Message: "quota exceeded"})
+	})
+
+	r.Handle(CMD_BLOCK, func(ctx *router.Context, body []byte) ([]byte, error) {
+		<-release
+		return body, nil
+	})
+
+	// 单向消息, 通过 Push 回复
+	r.Handle(CMD_PUSH, func(ctx *router.Context, body []byte) ([]byte, error) {
+		return nil, router.Push(ctx.Conn, CMD_PUSH, body)
+	})
+
+	return r
+}
+
+// startRouter 启动使用路由的服务并创建客户端, 返回的函数让阻塞的 CMD_BLOCK 继续
+func startRouter(t *testing.T, host string, timeout time.Duration) (*router.Client, func()) {
+	t.Helper()
+
+	ch := make(chan struct{})
+	release := sync.OnceFunc(func() { close(ch) })
+	t.Cleanup(release)
+
+	event := &routerEvent{echoEvent: newEchoEvent(), r: newTestRouter(ch)}
+	startService(t, &nw.Config{TcpHost: host, Timeout: 60, Dispatch: nw.DispatchMode_Unordered}, event)
+
+	c, err := nw.NewAsyncTCPClient(host, WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+
+	client := router.NewTCPClient(c, timeout)
+	t.Cleanup(func() { client.Close() })
+	return client, release
+}
+
+func TestRouterHeader(t *testing.T) {
+	h := router.Header{Cmd: 1001, Seq: 7, Flags: router.Flag_Response | router.Flag_Error}
+	data := h.Encode([]byte("boom"))
+
+	h2, body, err := router.Decode(data)
+	if err != nil {
+		t.Fatalf("router.Decode failed: %v", err)
+	}
+
+	if h2 != h || string(body) != "boom" {
+		t.Fatalf("decoded %+v %q", h2, body)
+	}
+
+	if !h2.IsResponse() || !h2.IsError() || h2.IsPush() {
+		t.Fatalf("flags %b", h2.Flags)
+	}
+
+	if _, _, err = router.Decode(data[:router.HEADER_SIZE-1]); err == nil {
+		t.Fatal("short frame should fail")
+	}
+}
+
+func TestRouterDispatch(t *testing.T) {
+	client, _ := startRouter(t, "127.0.0.1:22259", WAIT_TIMEOUT)
+	ctx := context.Background()
+
+	// protobuf 类型的处理函数
+	rsp, err := router.Invoke[wrapperspb.StringValue, wrapperspb.StringValue](ctx, client, CMD_UPPER, wrapperspb.String("hello"))
+	if err != nil || rsp.Value != "HELLO" {
+		t.Fatalf("invoke upper %v: %v", rsp, err)
+	}
+
+	// 应答出错时只有 *router.Error 的描述发给客户端
+	cases := []struct {
+		cmd  uint32
+		body string
+		want string
+	}{
+		{CMD_UNKNOWN, "", fmt.Sprint("unknown command ", CMD_UNKNOWN)},
+		{CMD_FAIL, "", router.ERR_INTERNAL},
+		{CMD_REJECT, "bob", `name "bob" taken`},
+		{CMD_WRAPPED, "", "quota exceeded"},
+		{CMD_UPPER, "\xff\xff", "invalid request"},
+	}
+	for _, c := range cases {
+		_, err := client.Call(ctx, c.cmd, []byte(c.body))
+		var re *router.RemoteError
+		if !errors.As(err, &re) || re.Cmd != c.cmd || re.Message != c.want {
+			t.Fatalf("cmd %d: %v, want remote error %q", c.cmd, err, c.want)
+		}
+	}
+
+	// 未注册命令的处理函数
+	r := router.New()
+	r.NotFound(func(ctx *router.Context, body []byte) ([]byte, error) {
+		return []byte(fmt.Sprint("fallback ", ctx.Header.Cmd)), nil
+	})
+	event := &routerEvent{echoEvent: newEchoEvent(), r: r}
+	startService(t, &nw.Config{TcpHost: "127.0.0.1:22260", Timeout: 60}, event)
+
+	c, err := nw.NewAsyncTCPClient("127.0.0.1:22260", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	fallback := router.NewTCPClient(c, WAIT_TIMEOUT)
+	defer fallback.Close()
+
+	if body, err := fallback.Call(ctx, 42, nil); err != nil || string(body) != "fallback 42" {
+		t.Fatalf("not found handler %q: %v", body, err)
+	}
+
+	// 单向消息不应答
+	pushed := make(chan string, 1)
+	client.OnPush(func(h router.Header, body []byte) {
+		if h.IsPush() && h.Cmd == CMD_PUSH {
+			pushed <- string(body)
+		}
+	})
+	if err := client.Notify(CMD_PUSH, []byte("note")); err != nil {
+		t.Fatalf("notify failed: %v", err)
+	}
+	if got := receive(t, pushed, "push"); got != "note" {
+		t.Fatalf("pushed %q", got)
+	}
+}
+
+func TestRouterSeq(t *testing.T) {
+	client, _ := startRouter(t, "127.0.0.1:22261", WAIT_TIMEOUT)
+
+	// 并发请求的应答乱序到达, 按序列号交给对应的调用
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(ms int) {
+			defer wg.Done()
+
+			body, err := client.Call(context.Background(), CMD_DELAY, []byte(strconv.Itoa(ms)))
+			if err == nil && string(body) != strconv.Itoa(ms) {
+				err = fmt.Errorf("request %d got response %q", ms, body)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}((10 - i) * 10)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestRouterCallTimeout(t *testing.T) {
+	client, release := startRouter(t, "127.0.0.1:22262", 200*time.Millisecond)
+
+	// 没有截止时间时使用默认超时
+	start := time.Now()
+	if _, err := client.Call(context.Background(), CMD_BLOCK, []byte("a")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("call without deadline: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > WAIT_TIMEOUT {
+		t.Fatalf("timed out after %v", elapsed)
+	}
+
+	// 调用方取消
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := client.Call(ctx, CMD_BLOCK, []byte("b")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled call: %v", err)
+	}
+
+	// 超时和取消的请求的迟到应答被丢弃, 不会交给之后的请求
+	release()
+	time.Sleep(100 * time.Millisecond)
+	if body, err := client.Call(context.Background(), CMD_DELAY, []byte("1")); err != nil || string(body) != "1" {
+		t.Fatalf("call after late responses %q: %v", body, err)
+	}
+
+	// 关闭后的调用立即失败
+	client.Close()
+	if _, err := client.Call(context.Background(), CMD_DELAY, []byte("1")); err == nil {
+		t.Fatalf("call after close succeeded")
+	}
+}
@@ -0,0 +1,93 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+// WAIT_TIMEOUT 等待异步事件的超时
+const WAIT_TIMEOUT = 3 * time.Second
+
+// echoEvent 回显收到的消息, 记录连接的建立和断开
+type echoEvent struct {
+	connected    chan *nw.ConnContext
+	disconnected chan uint64
+}
+
+func newEchoEvent() *echoEvent {
+	return &echoEvent{
+		connected:    make(chan *nw.ConnContext, 64),
+		disconnected: make(chan uint64, 64),
+	}
+}
+
+func (this_ *echoEvent) OnInit(*nw.Service) error { return nil }
+
+func (this_ *echoEvent) OnConnected(cctx *nw.ConnContext) error {
+	this_.connected <- cctx
+	return nil
+}
+
+func (this_ *echoEvent) OnDisconnected(cctx *nw.ConnContext) {
+	this_.disconnected <- cctx.ID()
+}
+
+func (this_ *echoEvent) OnStopped(*nw.Service) {}
+
+func (this_ *echoEvent) OnData(cctx *nw.ConnContext, data []byte) error {
+	return cctx.Write(data)
+}
+
+func (this_ *echoEvent) OnIdle(*nw.ConnContext, nw.IdleState) bool { return false }
+
+// startService 启动服务, 测试结束时停止
+func startService(t *testing.T, c *nw.Config, event nw.IServiceEvent) *nw.Service {
+	t.Helper()
+
+	svc := nw.NewService(c, event)
+	done := make(chan struct{})
+	go func() {
+		svc.Run()
+		close(done)
+	}()
+
+	// 服务没有就绪通知, 探测连接又会触发连接事件, 等待引擎启动
+	time.Sleep(300 * time.Millisecond)
+
+	t.Cleanup(func() {
+		svc.Stop()
+		<-done
+	})
+
+	return svc
+}
+
+// receive 从通道接收一个值, 超时时测试失败
+func receive[T any](t *testing.T, ch <-chan T, what string) T {
+	t.Helper()
+
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(WAIT_TIMEOUT):
+		t.Fatalf("wait %s timeout", what)
+	}
+
+	var zero T
+	return zero
+}
+
+// waitFor 等待条件成立, 超时时测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(WAIT_TIMEOUT)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("wait %s timeout", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,322 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+// welcomeEvent 连接建立后发送 welcome, 收到的消息回显
+type welcomeEvent struct {
+	*echoEvent
+}
+
+func (this_ *welcomeEvent) OnConnected(cctx *nw.ConnContext) error {
+	this_.echoEvent.OnConnected(cctx)
+	return cctx.Write([]byte("welcome"))
+}
+
+// startFrameProxy 转发一个 tcp 连接, 客户端发往服务端的帧(默认编解码器)经过 mutate 处理. 心跳帧原样转发
+//   - mutate: i 为除心跳帧外的帧序号, 第 0 帧为 HELLO. 返回实际转发的帧
+func startFrameProxy(t *testing.T, listen, target string, mutate func(i int, frame []byte) [][]byte) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		client, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+
+		server, err := net.Dial("tcp", target)
+		if err != nil {
+			return
+		}
+		defer server.Close()
+
+		// 服务端关闭连接时同时关闭客户端连接
+		go func() {
+			io.Copy(client, server)
+			client.Close()
+		}()
+
+		for i := 0; ; {
+			var header [4]byte
+			if _, err := io.ReadFull(client, header[:]); err != nil {
+				return
+			}
+
+			size := binary.BigEndian.Uint32(header[:])
+			frame := make([]byte, 4+size&^nw.TCP_HEARTBEAT_FLAG)
+			copy(frame, header[:])
+			if _, err := io.ReadFull(client, frame[4:]); err != nil {
+				return
+			}
+
+			if size&nw.TCP_HEARTBEAT_FLAG != 0 {
+				server.Write(frame)
+				continue
+			}
+
+			for _, f := range mutate(i, frame) {
+				server.Write(f)
+			}
+			i++
+		}
+	}()
+}
+
+func TestCipherSession(t *testing.T) {
+	event := &welcomeEvent{newEchoEvent()}
+	startService(t, &nw.Config{
+		TcpHost:              "127.0.0.1:22161",
+		TcpEncrypt:           true,
+		TcpEncryptKey:        "psk",
+		TcpCompress:          nw.CompressType_Zstd,
+		TcpCompressThreshold: 10,
+		Timeout:              60,
+	}, event)
+
+	big := bytes.Repeat([]byte("abc"), 10000)
+	for _, kind := range []nw.CipherType{nw.CipherType_AesGcm, nw.CipherType_ChaCha20Poly1305} {
+		client, err := nw.NewAsyncTCPClientWithConfig("127.0.0.1:22161", &nw.TCPClientConfig{
+			Timeout:    WAIT_TIMEOUT,
+			Cipher:     kind,
+			EncryptKey: "psk",
+			Compress:   nw.CompressType_Snappy,
+		})
+		if err != nil {
+			t.Fatalf("%v: new tcp client failed: %v", kind, err)
+		}
+
+		// 会话建立后才触发 OnConnected, 其中写入的消息经过加密
+		receive(t, event.connected, "session established")
+		if rsp, err := client.Read(); err != nil || string(rsp) != "welcome" {
+			t.Fatalf("%v: read %q: %v", kind, rsp, err)
+		}
+
+		// 多个协程并发写入, 序号和密文顺序一致
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				client.Write(big)
+			}()
+		}
+		for i := 0; i < 20; i++ {
+			if rsp, err := client.Read(); err != nil || !bytes.Equal(rsp, big) {
+				t.Fatalf("%v: read %d: %d bytes: %v", kind, i, len(rsp), err)
+			}
+		}
+		wg.Wait()
+
+		client.Close()
+		receive(t, event.disconnected, "disconnect")
+	}
+}
+
+func TestCipherSessionReject(t *testing.T) {
+	event := &welcomeEvent{newEchoEvent()}
+	startService(t, &nw.Config{TcpHost: "127.0.0.1:22162", TcpEncrypt: true, TcpEncryptKey: "psk", Timeout: 60}, event)
+
+	// 预共享密钥不一致时握手完成, 第一个数据帧无法解密
+	client, err := nw.NewAsyncTCPClientWithConfig("127.0.0.1:22162", &nw.TCPClientConfig{Timeout: WAIT_TIMEOUT, Cipher: nw.CipherType_AesGcm, EncryptKey: "other"})
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer client.Close()
+
+	receive(t, event.connected, "session established")
+	client.Write([]byte("hi"))
+	receive(t, event.disconnected, "bad psk disconnect")
+
+	// 不加密的客户端发送的不是 HELLO 帧
+	plain, err := nw.NewAsyncTCPClient("127.0.0.1:22162", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer plain.Close()
+
+	plain.Write([]byte("plain"))
+	if rsp, err := plain.Read(); err == nil {
+		t.Fatalf("plain client read %q", rsp)
+	}
+
+	select {
+	case <-event.connected:
+		t.Fatalf("plain client connected")
+	default:
+	}
+}
+
+// recordEvent 记录服务端处理的消息
+type recordEvent struct {
+	*echoEvent
+	received chan string
+}
+
+func (this_ *recordEvent) OnData(cctx *nw.ConnContext, data []byte) error {
+	this_.received <- string(data)
+	return nil
+}
+
+func TestCipherSessionReplay(t *testing.T) {
+	// 第 1 帧是 HELLO 之后的第一个数据帧
+	cases := []struct {
+		name   string
+		host   string
+		proxy  string
+		mutate func(i int, frame []byte) [][]byte
+		want   []string // 服务端最多处理的消息
+	}{
+		{"replay", "127.0.0.1:22163", "127.0.0.1:22166", func(i int, frame []byte) [][]byte {
+			if i == 1 {
+				return [][]byte{frame, frame}
+			}
+			return [][]byte{frame}
+		}, []string{"first"}},
+		{"tamper", "127.0.0.1:22164", "127.0.0.1:22167", func(i int, frame []byte) [][]byte {
+			if i == 1 {
+				frame[len(frame)-1] ^= 1
+			}
+			return [][]byte{frame}
+		}, nil},
+		{"drop", "127.0.0.1:22165", "127.0.0.1:22168", func(i int, frame []byte) [][]byte {
+			if i == 1 {
+				return nil
+			}
+			return [][]byte{frame}
+		}, nil},
+	}
+
+	for _, c := range cases {
+		event := &recordEvent{echoEvent: newEchoEvent(), received: make(chan string, 4)}
+		host, proxy := c.host, c.proxy
+		startService(t, &nw.Config{TcpHost: host, TcpEncrypt: true, Timeout: 60}, event)
+		startFrameProxy(t, proxy, host, c.mutate)
+
+		client, err := nw.NewAsyncTCPClientWithConfig(proxy, &nw.TCPClientConfig{Timeout: WAIT_TIMEOUT, Cipher: nw.CipherType_AesGcm})
+		if err != nil {
+			t.Fatalf("%s: new tcp client failed: %v", c.name, err)
+		}
+		defer client.Close()
+
+		receive(t, event.connected, "session established")
+		client.Write([]byte("first"))
+		client.Write([]byte("second"))
+
+		// 被重放、篡改或丢弃的帧之后, 服务端无法解密, 关闭连接
+		receive(t, event.disconnected, c.name+" disconnect")
+		if _, err := client.Read(); err == nil {
+			t.Fatalf("%s: client read after disconnect", c.name)
+		}
+
+		// 连接关闭时尚未处理的消息被丢弃. 重放的帧不会被当作新消息处理, 之后的消息也不再处理
+		time.Sleep(100 * time.Millisecond)
+		var got []string
+		for len(event.received) > 0 {
+			got = append(got, <-event.received)
+		}
+
+		if len(got) > len(c.want) || !slices.Equal(got, c.want[:len(got)]) {
+			t.Fatalf("%s: handled %q, want at most %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCipherSessionHeartbeat(t *testing.T) {
+	event := newEchoEvent()
+	startService(t, &nw.Config{
+		TcpHost:           "127.0.0.1:22266",
+		TcpEncrypt:        true,
+		TcpEncryptKey:     "psk",
+		Timeout:           2,
+		Heartbeat:         true,
+		HeartbeatInterval: 1,
+	}, event)
+
+	client, err := nw.NewAsyncTCPClientWithConfig("127.0.0.1:22266", &nw.TCPClientConfig{
+		Timeout:    1500 * time.Millisecond,
+		Heartbeat:  true,
+		Cipher:     nw.CipherType_ChaCha20Poly1305,
+		EncryptKey: "psk",
+	})
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer client.Close()
+
+	// 加密的心跳帧与数据帧共用序号, 两个方向交错发送后仍能解密
+	cctx := receive(t, event.connected, "session established")
+	time.Sleep(2500 * time.Millisecond)
+	if cctx.RTT() <= 0 || client.RTT() <= 0 {
+		t.Fatalf("server rtt %v, client rtt %v", cctx.RTT(), client.RTT())
+	}
+
+	client.Write([]byte("after heartbeat"))
+	if rsp, err := client.Read(); err != nil || string(rsp) != "after heartbeat" {
+		t.Fatalf("read %q: %v", rsp, err)
+	}
+}
+
+func TestCipherSessionForgedHeartbeat(t *testing.T) {
+	plain := make([]byte, 4+nw.HEARTBEAT_SIZE)
+	binary.BigEndian.PutUint32(plain, nw.TCP_HEARTBEAT_FLAG|nw.HEARTBEAT_SIZE)
+	plain[4] = nw.HEARTBEAT_PING
+
+	sealed := make([]byte, 4+nw.HEARTBEAT_SEALED_SIZE)
+	binary.BigEndian.PutUint32(sealed, nw.TCP_HEARTBEAT_FLAG|nw.HEARTBEAT_SEALED_SIZE)
+	sealed[4] = nw.HEARTBEAT_PING
+
+	cases := []struct {
+		name   string
+		host   string
+		proxy  string
+		forged []byte
+	}{
+		{"plain", "127.0.0.1:22267", "127.0.0.1:22268", plain},
+		{"sealed", "127.0.0.1:22269", "127.0.0.1:22270", sealed},
+	}
+
+	for _, c := range cases {
+		event := &recordEvent{echoEvent: newEchoEvent(), received: make(chan string, 4)}
+		startService(t, &nw.Config{TcpHost: c.host, TcpEncrypt: true, TcpEncryptKey: "psk", Timeout: 60, Heartbeat: true}, event)
+
+		// 在第一个数据帧之前插入伪造的心跳帧, 无法通过认证
+		forged := c.forged
+		startFrameProxy(t, c.proxy, c.host, func(i int, frame []byte) [][]byte {
+			if i == 1 {
+				return [][]byte{forged, frame}
+			}
+			return [][]byte{frame}
+		})
+
+		client, err := nw.NewAsyncTCPClientWithConfig(c.proxy, &nw.TCPClientConfig{Timeout: WAIT_TIMEOUT, Heartbeat: true, Cipher: nw.CipherType_AesGcm, EncryptKey: "psk"})
+		if err != nil {
+			t.Fatalf("%s: new tcp client failed: %v", c.name, err)
+		}
+		defer client.Close()
+
+		receive(t, event.connected, "session established")
+		client.Write([]byte("first"))
+
+		receive(t, event.disconnected, c.name+" disconnect")
+		if len(event.received) != 0 {
+			t.Fatalf("%s: handled %q after forged heartbeat", c.name, <-event.received)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+// slowEvent 每条消息处理 100ms 后回显
+type slowEvent struct {
+	*echoEvent
+}
+
+func (this_ *slowEvent) OnData(cctx *nw.ConnContext, data []byte) error {
+	time.Sleep(100 * time.Millisecond)
+	return cctx.Write(data)
+}
+
+// blockEvent 消息处理阻塞到 release 关闭
+type blockEvent struct {
+	*echoEvent
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (this_ *blockEvent) OnData(cctx *nw.ConnContext, data []byte) error {
+	this_.entered <- struct{}{}
+	<-this_.release
+	return nil
+}
+
+// initEvent 通知 OnInit 的调用, 此时服务已进入运行状态, 引擎尚未启动
+type initEvent struct {
+	*echoEvent
+	inited chan struct{}
+}
+
+func (this_ *initEvent) OnInit(*nw.Service) error {
+	close(this_.inited)
+	return nil
+}
+
+func TestShutdownDrain(t *testing.T) {
+	event := &slowEvent{newEchoEvent()}
+	svc := nw.NewService(&nw.Config{TcpHost: "127.0.0.1:22031", WsHost: "127.0.0.1:22032", Timeout: 60}, event)
+	done := make(chan struct{})
+	go func() {
+		svc.Run()
+		close(done)
+	}()
+	time.Sleep(300 * time.Millisecond)
+
+	client, err := nw.NewAsyncTCPClient("127.0.0.1:22031", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer client.Close()
+
+	ws, err := nw.NewWsClient("127.0.0.1:22032", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("new ws client failed: %v", err)
+	}
+	defer ws.Close()
+
+	for i := 0; i < 5; i++ {
+		client.Write([]byte(fmt.Sprint(i)))
+	}
+	receive(t, event.connected, "tcp connect")
+	receive(t, event.connected, "ws connect")
+
+	ctx, cancel := context.WithTimeout(context.Background(), WAIT_TIMEOUT)
+	defer cancel()
+
+	res, err := svc.Shutdown(ctx, []byte("bye"))
+	if err != nil || res.Drained != 2 || res.Killed != 0 {
+		t.Fatalf("shutdown %+v: %v", res, err)
+	}
+	receive(t, done, "service stop")
+
+	// 关闭前处理完所有消息, 回显按顺序到达, 通知穿插在其中
+	var echoes []string
+	bye := false
+	for i := 0; i < 6; i++ {
+		rsp, err := client.Read()
+		if err != nil {
+			t.Fatalf("read %d failed: %v", i, err)
+		}
+
+		if string(rsp) == "bye" {
+			bye = true
+			continue
+		}
+		echoes = append(echoes, string(rsp))
+	}
+
+	if !bye || strings.Join(echoes, ",") != "0,1,2,3,4" {
+		t.Fatalf("go away %v echoes %v", bye, echoes)
+	}
+
+	if _, err := client.Read(); err == nil {
+		t.Fatalf("read after shutdown succeeded")
+	}
+
+	if _, err := ws.Read(); err == nil || !strings.Contains(err.Error(), "1001") {
+		t.Fatalf("ws close: %v", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	event := &blockEvent{newEchoEvent(), make(chan struct{}, 1), make(chan struct{})}
+	svc := nw.NewService(&nw.Config{TcpHost: "127.0.0.1:22033", Timeout: 60}, event)
+	done := make(chan struct{})
+	go func() {
+		svc.Run()
+		close(done)
+	}()
+	time.Sleep(300 * time.Millisecond)
+
+	client, err := nw.NewAsyncTCPClient("127.0.0.1:22033", WAIT_TIMEOUT)
+	if err != nil {
+		t.Fatalf("new tcp client failed: %v", err)
+	}
+	defer client.Close()
+
+	client.Write([]byte("block"))
+	receive(t, event.entered, "message handle")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	// 阻塞的消息处理在截止时间后才结束, 服务停止需要等待工作协程退出
+	go func() {
+		<-ctx.Done()
+		close(event.release)
+	}()
+
+	res, err := svc.Shutdown(ctx, nil)
+	if !errors.Is(err, context.DeadlineExceeded) || res.Drained != 0 || res.Killed != 1 {
+		t.Fatalf("shutdown %+v: %v", res, err)
+	}
+	receive(t, done, "service stop")
+
+	// 已停止的服务再次关闭不做任何事
+	if res, err := svc.Shutdown(context.Background(), nil); err != nil || res != (nw.ShutdownResult{}) {
+		t.Fatalf("second shutdown %+v: %v", res, err)
+	}
+}
+
+func TestStopDuringBoot(t *testing.T) {
+	// Run 之后立即 Stop, 引擎可能尚未启动, Run 不能阻塞
+	for i := 0; i < 10; i++ {
+		event := &initEvent{newEchoEvent(), make(chan struct{})}
+		svc := nw.NewService(&nw.Config{TcpHost: "127.0.0.1:22034", WsHost: "127.0.0.1:22035", Timeout: 60}, event)
+		done := make(chan struct{})
+		go func() {
+			svc.Run()
+			close(done)
+		}()
+
+		receive(t, event.inited, "service init")
+		svc.Stop()
+		receive(t, done, "service stop")
+	}
+}
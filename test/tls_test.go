@@ -0,0 +1,204 @@
+package test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+// writeCert 生成自签名证书写入 dir, 返回证书文件, 私钥文件和客户端使用的证书
+func writeCert(t *testing.T, dir string, serial int64) (string, string, tls.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key failed: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate failed: %v", err)
+	}
+
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key failed: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("write cert failed: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("write key failed: %v", err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("load key pair failed: %v", err)
+	}
+	cert.Leaf, _ = x509.ParseCertificate(der)
+
+	return certFile, keyFile, cert
+}
+
+// certPool 信任证书自身
+func certPool(cert tls.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	return pool
+}
+
+func TestTlsEcho(t *testing.T) {
+	certFile, keyFile, cert := writeCert(t, t.TempDir(), 1)
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{
+		TcpHost: "127.0.0.1:22021",
+		WsHost:  "127.0.0.1:22022",
+		Timeout: 60,
+		TlsCert: certFile,
+		TlsKey:  keyFile,
+		TlsCA:   certFile,
+	}, event)
+
+	config := &tls.Config{RootCAs: certPool(cert), Certificates: []tls.Certificate{cert}}
+	client, err := nw.NewAsyncTLSClient("127.0.0.1:22021", WAIT_TIMEOUT, config)
+	if err != nil {
+		t.Fatalf("new tls client failed: %v", err)
+	}
+	defer client.Close()
+
+	// 大于一个 tls 记录的消息
+	for i := 0; i < 20; i++ {
+		if err := client.Write(bytes.Repeat([]byte(fmt.Sprint(i)), 1+i*1000)); err != nil {
+			t.Fatalf("write %d failed: %v", i, err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		msg := bytes.Repeat([]byte(fmt.Sprint(i)), 1+i*1000)
+		rsp, err := client.Read()
+		if err != nil || !bytes.Equal(rsp, msg) {
+			t.Fatalf("read %d: len %d, want %d, err %v", i, len(rsp), len(msg), err)
+		}
+	}
+
+	ws, err := nw.NewWssClient("127.0.0.1:22022", WAIT_TIMEOUT, config)
+	if err != nil {
+		t.Fatalf("new wss client failed: %v", err)
+	}
+	defer ws.Close()
+
+	for i := 0; i < 10; i++ {
+		msg := bytes.Repeat([]byte(fmt.Sprint(i)), 1+i*100)
+		if _, err := ws.Write(msg); err != nil {
+			t.Fatalf("wss write %d failed: %v", i, err)
+		}
+		rsp, err := ws.Read()
+		if err != nil || !bytes.Equal(rsp, msg) {
+			t.Fatalf("wss read %d: len %d, want %d, err %v", i, len(rsp), len(msg), err)
+		}
+	}
+
+	if svc.CurrConn() != 2 {
+		t.Fatalf("conns %d, want 2", svc.CurrConn())
+	}
+}
+
+func TestTlsClientCert(t *testing.T) {
+	certFile, keyFile, cert := writeCert(t, t.TempDir(), 1)
+	startService(t, &nw.Config{
+		TcpHost: "127.0.0.1:22023",
+		Timeout: 60,
+		TlsCert: certFile,
+		TlsKey:  keyFile,
+		TlsCA:   certFile,
+	}, newEchoEvent())
+
+	// 启用双向认证后, 没有客户端证书的连接在握手时被拒绝
+	conn, err := tls.Dial("tcp", "127.0.0.1:22023", &tls.Config{RootCAs: certPool(cert)})
+	if err == nil {
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(WAIT_TIMEOUT))
+		// tls 1.3 的客户端在服务端校验证书前完成握手, 拒绝在首次读取时返回
+		conn.Write([]byte{0, 0, 0, 1, 'x'})
+		_, err = conn.Read(make([]byte, 16))
+	}
+
+	if err == nil {
+		t.Fatalf("connection without client certificate accepted")
+	}
+}
+
+func TestTlsReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeCert(t, dir, 1)
+	svc := startService(t, &nw.Config{
+		TcpHost: "127.0.0.1:22024",
+		Timeout: 60,
+		TlsCert: certFile,
+		TlsKey:  keyFile,
+	}, newEchoEvent())
+
+	// peerSerial 新连接握手时服务端证书的序列号
+	peerSerial := func(pool *x509.CertPool) int64 {
+		conn, err := tls.Dial("tcp", "127.0.0.1:22024", &tls.Config{RootCAs: pool})
+		if err != nil {
+			t.Fatalf("dial tls failed: %v", err)
+		}
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if serial := peerSerial(certPool(cert)); serial != 1 {
+		t.Fatalf("serial %d, want 1", serial)
+	}
+
+	// 覆盖证书文件后重新加载, 新连接使用新证书
+	_, _, cert = writeCert(t, dir, 2)
+	if err := svc.ReloadCertificate(); err != nil {
+		t.Fatalf("reload certificate failed: %v", err)
+	}
+
+	if serial := peerSerial(certPool(cert)); serial != 2 {
+		t.Fatalf("serial %d, want 2", serial)
+	}
+
+	// 加载失败时保留原证书
+	os.WriteFile(keyFile, []byte("broken"), 0600)
+	if err := svc.ReloadCertificate(); err == nil {
+		t.Fatalf("reload broken certificate succeeded")
+	}
+
+	if serial := peerSerial(certPool(cert)); serial != 2 {
+		t.Fatalf("serial %d after failed reload, want 2", serial)
+	}
+}
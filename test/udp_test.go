@@ -0,0 +1,115 @@
+package test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gox/frm/nw"
+)
+
+// udpCall 发送一个数据报并等待回复
+func udpCall(t *testing.T, conn net.Conn, msg string) string {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("udp write failed: %v", err)
+	}
+
+	buf := make([]byte, nw.UDP_MESSAGE_MAX_SIZE)
+	conn.SetReadDeadline(time.Now().Add(WAIT_TIMEOUT))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("udp read failed: %v", err)
+	}
+
+	return string(buf[:n])
+}
+
+func TestUdpSession(t *testing.T) {
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{UdpHost: "127.0.0.1:22001", Timeout: 60}, event)
+
+	var (
+		conns [2]net.Conn
+		cctxs [2]*nw.ConnContext
+	)
+	for i := range conns {
+		conn, err := net.Dial("udp", "127.0.0.1:22001")
+		if err != nil {
+			t.Fatalf("dial udp failed: %v", err)
+		}
+		defer conn.Close()
+
+		if rsp := udpCall(t, conn, "hello"); rsp != "hello" {
+			t.Fatalf("echo %q", rsp)
+		}
+
+		conns[i] = conn
+		cctxs[i] = receive(t, event.connected, "udp session")
+		if cctxs[i].RemoteAddr() != conn.LocalAddr().String() {
+			t.Fatalf("remote addr %s, want %s", cctxs[i].RemoteAddr(), conn.LocalAddr())
+		}
+
+		if cctxs[i].Fd() < nw.UDP_VIRTUAL_FD_BASE || cctxs[i].Protocol() != nw.Protocol_UDP {
+			t.Fatalf("fd %d protocol %v", cctxs[i].Fd(), cctxs[i].Protocol())
+		}
+	}
+
+	// 同一地址的后续数据报属于同一会话
+	if rsp := udpCall(t, conns[0], "again"); rsp != "again" {
+		t.Fatalf("echo %q", rsp)
+	}
+
+	if svc.CurrConn() != 2 || cctxs[0].ID() == cctxs[1].ID() || cctxs[0].Fd() == cctxs[1].Fd() {
+		t.Fatalf("conns %d ids %d/%d fds %d/%d", svc.CurrConn(), cctxs[0].ID(), cctxs[1].ID(), cctxs[0].Fd(), cctxs[1].Fd())
+	}
+
+	if err := cctxs[0].Write(make([]byte, nw.UDP_MESSAGE_MAX_SIZE+1)); !errors.Is(err, nw.ErrUdpMessageTooLarge) {
+		t.Fatalf("oversize write: %v", err)
+	}
+
+	// 在应用协程中关闭, OnDisconnected 在下一个 tick 触发
+	id := cctxs[0].ID()
+	cctxs[0].Close()
+	if got := receive(t, event.disconnected, "udp disconnect"); got != id {
+		t.Fatalf("disconnected %d, want %d", got, id)
+	}
+
+	var stale *nw.StaleConnError
+	if err := svc.Write(id, []byte("x")); !errors.As(err, &stale) {
+		t.Fatalf("write closed session: %v", err)
+	}
+
+	// 关闭后同一地址的数据报创建新会话
+	if rsp := udpCall(t, conns[0], "new"); rsp != "new" {
+		t.Fatalf("echo %q", rsp)
+	}
+
+	if cctx := receive(t, event.connected, "new udp session"); cctx.ID() <= cctxs[1].ID() {
+		t.Fatalf("new session id %d", cctx.ID())
+	}
+}
+
+func TestUdpIdle(t *testing.T) {
+	event := newEchoEvent()
+	svc := startService(t, &nw.Config{UdpHost: "127.0.0.1:22002", Timeout: 1}, event)
+
+	conn, err := net.Dial("udp", "127.0.0.1:22002")
+	if err != nil {
+		t.Fatalf("dial udp failed: %v", err)
+	}
+	defer conn.Close()
+
+	udpCall(t, conn, "hello")
+	id := receive(t, event.connected, "udp session").ID()
+
+	if got := receive(t, event.disconnected, "udp idle timeout"); got != id {
+		t.Fatalf("disconnected %d, want %d", got, id)
+	}
+
+	if svc.CurrConn() != 0 {
+		t.Fatalf("conns %d after idle timeout", svc.CurrConn())
+	}
+}
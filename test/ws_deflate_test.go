@@ -0,0 +1,158 @@
+package test
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gox/frm/nw"
+)
+
+// DEFLATE_TAIL 压缩数据末尾被省略的空块
+var DEFLATE_TAIL = []byte{0, 0, 0xff, 0xff}
+
+// jsonPayload 可压缩的消息
+var jsonPayload = []byte(strings.Repeat(`{"name":"hello","value":12345},`, 400))
+
+// dialDeflateWs 协商 permessage-deflate 建立连接, 返回服务端应答的扩展参数
+func dialDeflateWs(t *testing.T, host string) (net.Conn, string) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	dialer := ws.Dialer{Extensions: []httphead.Option{wsflate.Parameters{}.Option()}}
+	u, _ := url.Parse("ws://" + host + "/ws")
+	_, hs, err := dialer.Upgrade(conn, u)
+	if err != nil {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+
+	var extensions string
+	for _, opt := range hs.Extensions {
+		extensions += string(opt.Name) + opt.Parameters.String()
+	}
+
+	conn.SetDeadline(time.Now().Add(WAIT_TIMEOUT))
+	return conn, extensions
+}
+
+func TestWsDeflateClient(t *testing.T) {
+	startService(t, &nw.Config{WsHost: "127.0.0.1:22121", Timeout: 60, WsCompress: true}, newEchoEvent())
+
+	client, err := nw.NewWsClientWithConfig("127.0.0.1:22121", &nw.WsClientConfig{Timeout: WAIT_TIMEOUT, Compress: true})
+	if err != nil {
+		t.Fatalf("new ws client failed: %v", err)
+	}
+	defer client.Close()
+
+	for _, msg := range [][]byte{jsonPayload, []byte("small"), jsonPayload} {
+		if _, err := client.Write(msg); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if rsp, err := client.Read(); err != nil || !bytes.Equal(rsp, msg) {
+			t.Fatalf("read %d bytes, want %d: %v", len(rsp), len(msg), err)
+		}
+	}
+}
+
+func TestWsDeflateContextTakeover(t *testing.T) {
+	startService(t, &nw.Config{
+		WsHost:                  "127.0.0.1:22122",
+		Timeout:                 60,
+		WsCompress:              true,
+		WsServerContextTakeover: true,
+		WsClientContextTakeover: true,
+	}, newEchoEvent())
+
+	conn, extensions := dialDeflateWs(t, "127.0.0.1:22122")
+	if !strings.Contains(extensions, "permessage-deflate") || strings.Contains(extensions, "no_context_takeover") {
+		t.Fatalf("extensions %q", extensions)
+	}
+
+	// 两个方向都保留上下文: 客户端连续使用同一个压缩器, 解压服务端的消息时带上之前的窗口
+	var (
+		buf    bytes.Buffer
+		window []byte
+	)
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	for i := 0; i < 3; i++ {
+		buf.Reset()
+		fw.Write(jsonPayload)
+		fw.Flush()
+
+		frame := ws.NewBinaryFrame(bytes.TrimSuffix(buf.Bytes(), DEFLATE_TAIL))
+		frame.Header.Rsv = ws.Rsv(true, false, false)
+		ws.WriteFrame(conn, ws.MaskFrameInPlace(frame))
+
+		rsp, err := ws.ReadFrame(conn)
+		if err != nil || !rsp.Header.Rsv1() {
+			t.Fatalf("read compressed frame %+v: %v", rsp.Header, err)
+		}
+
+		// 保留上下文时后续消息引用之前的内容, 压缩后更小
+		if i > 0 && len(rsp.Payload) >= len(jsonPayload)/20 {
+			t.Fatalf("message %d compressed to %d bytes", i, len(rsp.Payload))
+		}
+
+		r := flate.NewReaderDict(io.MultiReader(bytes.NewReader(rsp.Payload), bytes.NewReader(DEFLATE_TAIL)), window)
+		data, err := io.ReadAll(io.LimitReader(r, int64(len(jsonPayload))))
+		if err != nil || !bytes.Equal(data, jsonPayload) {
+			t.Fatalf("inflate %d bytes: %v", len(data), err)
+		}
+
+		window = append(window, data...)
+		if len(window) > 32768 {
+			window = window[len(window)-32768:]
+		}
+	}
+
+	// 小于阈值的消息不压缩
+	ws.WriteFrame(conn, ws.MaskFrameInPlace(ws.NewBinaryFrame([]byte("small"))))
+	if rsp, err := ws.ReadFrame(conn); err != nil || rsp.Header.Rsv1() || string(rsp.Payload) != "small" {
+		t.Fatalf("read %+v %q: %v", rsp.Header, rsp.Payload, err)
+	}
+}
+
+func TestWsDeflateNegotiation(t *testing.T) {
+	startService(t, &nw.Config{WsHost: "127.0.0.1:22123", Timeout: 60, WsCompress: true}, newEchoEvent())
+	startService(t, &nw.Config{WsHost: "127.0.0.1:22124", Timeout: 60}, newEchoEvent())
+
+	// 默认不保留上下文
+	conn, extensions := dialDeflateWs(t, "127.0.0.1:22123")
+	if !strings.Contains(extensions, "server_no_context_takeover") || !strings.Contains(extensions, "client_no_context_takeover") {
+		t.Fatalf("extensions %q", extensions)
+	}
+
+	// 不保留上下文时每条消息可以独立解压
+	for i := 0; i < 2; i++ {
+		// 掩码直接修改帧的内容, 使用副本
+		ws.WriteFrame(conn, ws.MaskFrameInPlace(ws.NewBinaryFrame(bytes.Clone(jsonPayload))))
+		rsp, err := ws.ReadFrame(conn)
+		if err != nil || !rsp.Header.Rsv1() {
+			t.Fatalf("read compressed frame %+v: %v", rsp.Header, err)
+		}
+
+		r := flate.NewReader(io.MultiReader(bytes.NewReader(rsp.Payload), bytes.NewReader(DEFLATE_TAIL)))
+		data, err := io.ReadAll(io.LimitReader(r, int64(len(jsonPayload))))
+		if err != nil || !bytes.Equal(data, jsonPayload) {
+			t.Fatalf("inflate %d bytes: %v", len(data), err)
+		}
+	}
+
+	// 未开启压缩的服务不应答扩展
+	if _, extensions := dialDeflateWs(t, "127.0.0.1:22124"); extensions != "" {
+		t.Fatalf("extensions %q without compression", extensions)
+	}
+}
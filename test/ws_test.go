@@ -0,0 +1,185 @@
+package test
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/gorilla/websocket"
+	"github.com/gox/frm/nw"
+)
+
+// messageEvent 按消息类型回显, 收到 bye 时以 4000 状态码关闭连接
+type messageEvent struct {
+	*echoEvent
+}
+
+func (this_ *messageEvent) OnMessage(cctx *nw.ConnContext, kind nw.MessageType, data []byte) error {
+	if string(data) == "bye" {
+		cctx.CloseWithStatus(4000, "bye bye")
+		return nil
+	}
+
+	if kind == nw.MessageType_Text {
+		return cctx.WriteText(data)
+	}
+
+	return cctx.Write(data)
+}
+
+// dialRawWs 建立 websocket 连接, 返回底层的 tcp 连接, 由测试直接读写帧
+func dialRawWs(t *testing.T, host string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatalf("dial tcp failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	u, _ := url.Parse("ws://" + host + "/ws")
+	if _, _, err := (ws.Dialer{}).Upgrade(conn, u); err != nil {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(WAIT_TIMEOUT))
+	return conn
+}
+
+// clientFrames 编码客户端帧(带掩码)
+func clientFrames(frames ...ws.Frame) []byte {
+	var buf bytes.Buffer
+	for _, f := range frames {
+		ws.WriteFrame(&buf, ws.MaskFrameInPlace(f))
+	}
+
+	return buf.Bytes()
+}
+
+// readCloseCode 读取服务端发送的关闭帧的状态码
+func readCloseCode(t *testing.T, conn net.Conn) ws.StatusCode {
+	t.Helper()
+
+	for {
+		f, err := ws.ReadFrame(conn)
+		if err != nil {
+			t.Fatalf("read close frame failed: %v", err)
+		}
+
+		if f.Header.OpCode == ws.OpClose {
+			code, _ := ws.ParseCloseFrameData(f.Payload)
+			return code
+		}
+	}
+}
+
+func TestWsMessageType(t *testing.T) {
+	event := &messageEvent{newEchoEvent()}
+	startService(t, &nw.Config{WsHost: "127.0.0.1:22111", Timeout: 60}, event)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:22111/ws", nil)
+	if err != nil {
+		t.Fatalf("dial ws failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("héllo"))
+	if kind, data, err := conn.ReadMessage(); err != nil || kind != websocket.TextMessage || string(data) != "héllo" {
+		t.Fatalf("read %d %q: %v", kind, data, err)
+	}
+
+	conn.WriteMessage(websocket.BinaryMessage, []byte{0xff, 0x00})
+	if kind, data, err := conn.ReadMessage(); err != nil || kind != websocket.BinaryMessage || !bytes.Equal(data, []byte{0xff, 0x00}) {
+		t.Fatalf("read %d %q: %v", kind, data, err)
+	}
+
+	// 服务端发起关闭, 携带状态码和原因
+	conn.WriteMessage(websocket.TextMessage, []byte("bye"))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, 4000) || !bytes.Contains([]byte(err.Error()), []byte("bye bye")) {
+		t.Fatalf("close: %v", err)
+	}
+	receive(t, event.disconnected, "server close")
+}
+
+func TestWsFrameParser(t *testing.T) {
+	event := &messageEvent{newEchoEvent()}
+	startService(t, &nw.Config{WsHost: "127.0.0.1:22112", Timeout: 60}, event)
+
+	conn := dialRawWs(t, "127.0.0.1:22112")
+
+	// 一次写入多个帧: 分片消息中间穿插 ping, 之后紧跟一条完整消息
+	conn.Write(clientFrames(
+		ws.NewFrame(ws.OpBinary, false, []byte("part1-")),
+		ws.NewPingFrame([]byte("p")),
+		ws.NewFrame(ws.OpContinuation, false, []byte("part2-")),
+		ws.NewFrame(ws.OpContinuation, true, []byte("part3")),
+		ws.NewTextFrame([]byte("second")),
+	))
+
+	// 控制帧立即应答, 先于分片消息的回显
+	want := []struct {
+		op   ws.OpCode
+		data string
+	}{
+		{ws.OpPong, "p"},
+		{ws.OpBinary, "part1-part2-part3"},
+		{ws.OpText, "second"},
+	}
+	for _, w := range want {
+		f, err := ws.ReadFrame(conn)
+		if err != nil || f.Header.OpCode != w.op || string(f.Payload) != w.data {
+			t.Fatalf("read %v %q: %v, want %v %q", f.Header.OpCode, f.Payload, err, w.op, w.data)
+		}
+	}
+
+	// 逐字节写入, 帧在多次读事件之间拼接
+	for _, b := range clientFrames(ws.NewBinaryFrame(bytes.Repeat([]byte("x"), 300))) {
+		conn.Write([]byte{b})
+	}
+	if data, err := wsutil.ReadServerBinary(conn); err != nil || len(data) != 300 {
+		t.Fatalf("read %d bytes: %v", len(data), err)
+	}
+
+	// 客户端发起关闭, 服务端回应相同的状态码
+	conn.Write(clientFrames(ws.NewCloseFrame(ws.NewCloseFrameBody(3001, "x"))))
+	if code := readCloseCode(t, conn); code != 3001 {
+		t.Fatalf("close code %d, want 3001", code)
+	}
+	receive(t, event.disconnected, "client close")
+}
+
+func TestWsProtocolError(t *testing.T) {
+	event := &messageEvent{newEchoEvent()}
+	startService(t, &nw.Config{WsHost: "127.0.0.1:22113", Timeout: 60}, event)
+
+	cases := []struct {
+		name  string
+		frame []byte
+		code  ws.StatusCode
+	}{
+		// 1005 不能出现在关闭帧中
+		{"reserved close code", clientFrames(ws.NewCloseFrame(ws.NewCloseFrameBody(1005, ""))), ws.StatusProtocolError},
+		// 客户端帧必须带掩码
+		{"unmasked frame", ws.MustCompileFrame(ws.NewBinaryFrame([]byte("unmasked"))), ws.StatusProtocolError},
+		// 文本消息必须是合法的 UTF-8
+		{"invalid utf8", clientFrames(ws.NewTextFrame([]byte{0xff, 0xfe})), ws.StatusInvalidFramePayloadData},
+		// 没有开始的分片消息
+		{"orphan continuation", clientFrames(ws.NewFrame(ws.OpContinuation, true, []byte("x"))), ws.StatusProtocolError},
+		// 控制帧不能分片
+		{"fragmented ping", clientFrames(ws.NewFrame(ws.OpPing, false, []byte("x"))), ws.StatusProtocolError},
+	}
+
+	for _, c := range cases {
+		conn := dialRawWs(t, "127.0.0.1:22113")
+		conn.Write(c.frame)
+		if code := readCloseCode(t, conn); code != c.code {
+			t.Fatalf("%s: close code %d, want %d", c.name, code, c.code)
+		}
+		receive(t, event.disconnected, c.name)
+	}
+}
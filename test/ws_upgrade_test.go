@@ -0,0 +1,101 @@
+package test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/gox/frm/nw"
+)
+
+// upgradeEvent 检查升级请求: /deny 要求认证, 其他路径要求 sid cookie, 选择最后一个子协议
+type upgradeEvent struct {
+	*echoEvent
+}
+
+func (this_ *upgradeEvent) OnUpgrade(cctx *nw.ConnContext, req *nw.UpgradeRequest) error {
+	if req.Path == "/deny" {
+		return &nw.UpgradeError{Status: http.StatusUnauthorized, Reason: "need auth", Header: http.Header{"Www-Authenticate": {"Bearer"}}}
+	}
+
+	cookie, err := req.Cookie("sid")
+	if err != nil {
+		return err
+	}
+
+	cctx.SetUserData(cookie.Value + ":" + req.Query.Get("room") + ":" + req.Host + ":" + req.Origin())
+	if len(req.Protocols) > 0 {
+		req.Protocol = req.Protocols[len(req.Protocols)-1]
+	}
+
+	return nil
+}
+
+// OnData 回复升级时设置的用户数据
+func (this_ *upgradeEvent) OnData(cctx *nw.ConnContext, data []byte) error {
+	return cctx.Write([]byte(cctx.UserData().(string)))
+}
+
+func TestWsUpgradeHook(t *testing.T) {
+	event := &upgradeEvent{newEchoEvent()}
+	startService(t, &nw.Config{WsHost: "127.0.0.1:22131", Timeout: 60, WsAllowOrigins: []string{"https://*.example.com"}}, event)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"json", "chat"}}
+	header := http.Header{"Cookie": {"sid=abc"}, "Origin": {"https://app.example.com"}}
+
+	conn, _, err := dialer.Dial("ws://127.0.0.1:22131/ws?room=7", header)
+	if err != nil {
+		t.Fatalf("dial ws failed: %v", err)
+	}
+	defer conn.Close()
+
+	if conn.Subprotocol() != "chat" {
+		t.Fatalf("subprotocol %q, want chat", conn.Subprotocol())
+	}
+
+	conn.WriteMessage(websocket.BinaryMessage, []byte("x"))
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "abc:7:127.0.0.1:22131:https://app.example.com" {
+		t.Fatalf("user data %q: %v", data, err)
+	}
+
+	rejects := []struct {
+		name   string
+		uri    string
+		header http.Header
+		status int
+	}{
+		{"custom status", "/deny", header, http.StatusUnauthorized},
+		{"origin not allowed", "/ws", http.Header{"Cookie": {"sid=abc"}, "Origin": {"https://evil.com"}}, http.StatusForbidden},
+		{"origin suffix", "/ws", http.Header{"Cookie": {"sid=abc"}, "Origin": {"https://example.com.evil.com"}}, http.StatusForbidden},
+		{"hook error", "/ws", nil, http.StatusForbidden},
+	}
+	for _, r := range rejects {
+		_, rsp, err := dialer.Dial("ws://127.0.0.1:22131"+r.uri, r.header)
+		if err == nil || rsp == nil || rsp.StatusCode != r.status {
+			t.Fatalf("%s: response %v: %v", r.name, rsp, err)
+		}
+		if r.status == http.StatusUnauthorized && rsp.Header.Get("Www-Authenticate") != "Bearer" {
+			t.Fatalf("%s: header %v", r.name, rsp.Header)
+		}
+	}
+
+	// 没有 Origin 头的请求总是允许
+	conn, _, err = dialer.Dial("ws://127.0.0.1:22131/ws", http.Header{"Cookie": {"sid=def"}})
+	if err != nil {
+		t.Fatalf("dial ws without origin failed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestWsUpgradeRejectTLS(t *testing.T) {
+	certFile, keyFile, cert := writeCert(t, t.TempDir(), 1)
+	startService(t, &nw.Config{WsHost: "127.0.0.1:22132", Timeout: 60, TlsCert: certFile, TlsKey: keyFile}, &upgradeEvent{newEchoEvent()})
+
+	// 拒绝的响应经过 tls 写出
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: certPool(cert)}}
+	_, rsp, err := dialer.Dial("wss://127.0.0.1:22132/deny", nil)
+	if err == nil || rsp == nil || rsp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("response %v: %v", rsp, err)
+	}
+}
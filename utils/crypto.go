@@ -7,13 +7,18 @@ import (
 	"io"
 )
 
-func AesGcmEncrypt(plaintext, key []byte) ([]byte, error) {
+// NewAesGcm 创建 AES-GCM 加密器, key 长度为 16, 24 或 32 字节
+func NewAesGcm(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	return cipher.NewGCM(block)
+}
+
+func AesGcmEncrypt(plaintext, key []byte) ([]byte, error) {
+	gcm, err := NewAesGcm(key)
 	if err != nil {
 		return nil, err
 	}
@@ -28,12 +33,7 @@ func AesGcmEncrypt(plaintext, key []byte) ([]byte, error) {
 }
 
 func AesGcmDecrypt(ciphertext, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := NewAesGcm(key)
 	if err != nil {
 		return nil, err
 	}
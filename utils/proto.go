@@ -11,3 +11,12 @@ func PbEncode[T any, U __Message_[T]](msg *T) []byte {
 	data, _ := proto.Marshal(U(msg))
 	return data
 }
+
+func PbDecode[T any, U __Message_[T]](data []byte) (*T, error) {
+	msg := new(T)
+	if err := proto.Unmarshal(data, U(msg)); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
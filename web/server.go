@@ -2,6 +2,8 @@ package web
 
 import (
 	"net"
+	"net/http"
+	"strings"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -49,6 +51,15 @@ func (this_ *Server) Router() *gin.Engine {
 	return this_.router
 }
 
+// Mount 将 http.Handler 挂载到 prefix 及其子路径, 处理器收到的路径去掉了 prefix.
+// 用于挂载 nw.Service 的 MetricsHandler 等接口
+func (this_ *Server) Mount(prefix string, h http.Handler) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	handler := gin.WrapH(http.StripPrefix(prefix, h))
+	this_.router.Any(prefix, handler)
+	this_.router.Any(prefix+"/*path", handler)
+}
+
 func (this_ *Server) Run() error {
 	var err error
 